@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 访问日志默认缓冲行数
+const defaultLogBuffer = 1024
+
+const logTimeFormat = "2006/01/02 15:04:05"
+
+// accessEntry 一条访问日志。Line 为普通文本日志行；Final 为请求结束时的汇总记录，
+// 带有完整的结构化字段，供 pretty 等格式和 journald 等支持字段的输出使用
+type accessEntry struct {
+	Line       string
+	Final      bool
+	Time       time.Time
+	ID         int64
+	RemoteAddr string
+	Method     string
+	URL        string
+	Host       string
+	Rule       string
+	Upstream   string
+	UserAgent  string
+	Referer    string
+	Status     int
+	Bytes      int64
+	Duration   time.Duration
+	// GraphQL 接口的操作类型和名称
+	GraphQLType string
+	GraphQLOp   string
+}
+
+// accessSink 访问日志输出目标
+type accessSink interface {
+	writeAccess(e *accessEntry)
+}
+
+// entryFormatter 将访问日志格式化为一行文本，返回 false 表示该格式不输出这条日志
+type entryFormatter func(e *accessEntry) (string, bool)
+
+// textFormat 原有的文本格式，与 log 包输出一致，不输出请求汇总行
+func textFormat(e *accessEntry) (string, bool) {
+	if e.Final {
+		return "", false
+	}
+	return time.Now().Format(logTimeFormat) + " " + e.Line, true
+}
+
+// prettyFormat 只输出请求汇总行，以及不属于具体请求的提示信息
+func prettyFormat(color bool) entryFormatter {
+	return func(e *accessEntry) (string, bool) {
+		if e.Final {
+			return prettyLine(e, color), true
+		}
+		if e.ID == 0 {
+			return time.Now().Format("15:04:05") + " " + e.Line, true
+		}
+		return "", false
+	}
+}
+
+// templateFormat 按 log 的 template 配置输出请求汇总行
+func templateFormat(t *logTemplate) entryFormatter {
+	return func(e *accessEntry) (string, bool) {
+		if e.Final {
+			return t.render(e), true
+		}
+		if e.ID == 0 {
+			return time.Now().Format(logTimeFormat) + " " + e.Line, true
+		}
+		return "", false
+	}
+}
+
+// structuredFields 请求汇总行的结构化字段，供 json 和 logfmt 格式使用，顺序固定
+func structuredFields(e *accessEntry) [][2]any {
+	fields := [][2]any{
+		{"time", e.Time.Format(time.RFC3339Nano)},
+		{"id", e.ID},
+		{"remote_addr", e.RemoteAddr},
+		{"method", e.Method},
+		{"url", e.URL},
+		{"host", e.Host},
+		{"rule", e.Rule},
+		{"upstream", e.Upstream},
+		{"status", e.Status},
+		{"bytes", e.Bytes},
+		{"duration_ms", float64(e.Duration.Microseconds()) / 1000},
+		{"user_agent", e.UserAgent},
+		{"referer", e.Referer},
+	}
+	if e.GraphQLType != "" || e.GraphQLOp != "" {
+		fields = append(fields, [2]any{"graphql_type", e.GraphQLType}, [2]any{"graphql_operation", e.GraphQLOp})
+	}
+	return fields
+}
+
+// jsonFormat 每个请求输出一行 JSON，不属于具体请求的提示信息输出为 {"time","msg"}
+func jsonFormat(e *accessEntry) (string, bool) {
+	var fields [][2]any
+	switch {
+	case e.Final:
+		fields = structuredFields(e)
+	case e.ID == 0:
+		fields = [][2]any{{"time", time.Now().Format(time.RFC3339Nano)}, {"msg", e.Line}}
+	default:
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(f[0])
+		v, _ := json.Marshal(f[1])
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.String(), true
+}
+
+// logfmtFormat 每个请求输出一行 key=value，值包含空格或引号时加引号
+func logfmtFormat(e *accessEntry) (string, bool) {
+	var fields [][2]any
+	switch {
+	case e.Final:
+		fields = structuredFields(e)
+	case e.ID == 0:
+		fields = [][2]any{{"time", time.Now().Format(time.RFC3339Nano)}, {"msg", e.Line}}
+	default:
+		return "", false
+	}
+	parts := make([]string, 0, len(fields))
+	for _, f := range fields {
+		v := fmt.Sprint(f[1])
+		if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+			v = strconv.Quote(v)
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", f[0], v))
+	}
+	return strings.Join(parts, " "), true
+}
+
+// accessFormatter 根据配置选择访问日志格式，console 表示输出到终端
+func accessFormatter(console bool) entryFormatter {
+	switch {
+	case config().Log.template != nil:
+		return templateFormat(config().Log.template)
+	case strings.EqualFold(config().Log.Format, "json"):
+		return jsonFormat
+	case strings.EqualFold(config().Log.Format, "logfmt"):
+		return logfmtFormat
+	case console && strings.EqualFold(config().Log.Format, "pretty"):
+		return prettyFormat(isTerminal(os.Stderr))
+	}
+	return textFormat
+}
+
+// writerSink 将格式化后的访问日志写入普通 io.Writer
+type writerSink struct {
+	io.Writer
+	format entryFormatter
+}
+
+func (s writerSink) writeAccess(e *accessEntry) {
+	format := s.format
+	if format == nil {
+		format = textFormat
+	}
+	if line, ok := format(e); ok {
+		fmt.Fprintln(s, line)
+	}
+}
+
+var accessWriter *asyncWriter
+
+type logItem struct {
+	e   *accessEntry
+	ack chan struct{}
+}
+
+// asyncWriter 带缓冲的异步写入器，缓冲区满时丢弃并计数
+type asyncWriter struct {
+	sinks    []accessSink
+	ch       chan logItem
+	dropped  atomic.Int64
+	reported int64
+}
+
+func newAsyncWriter(sinks []accessSink, size int) *asyncWriter {
+	if size <= 0 {
+		size = defaultLogBuffer
+	}
+	w := &asyncWriter{sinks: sinks, ch: make(chan logItem, size)}
+	go w.run()
+	return w
+}
+
+func (w *asyncWriter) write(e *accessEntry) {
+	select {
+	case w.ch <- logItem{e: e}:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+func (w *asyncWriter) run() {
+	for item := range w.ch {
+		if item.ack != nil {
+			close(item.ack)
+			continue
+		}
+		for _, s := range w.sinks {
+			s.writeAccess(item.e)
+		}
+		if d := w.dropped.Load(); d > w.reported {
+			for _, s := range w.sinks {
+				s.writeAccess(&accessEntry{Line: fmt.Sprintf("[WARN] 访问日志缓冲区已满，丢弃 %d 条日志", d-w.reported)})
+			}
+			w.reported = d
+		}
+	}
+}
+
+// Flush 等待已缓冲的日志写出，最多等待 timeout
+func (w *asyncWriter) Flush(timeout time.Duration) {
+	ack := make(chan struct{})
+	select {
+	case w.ch <- logItem{ack: ack}:
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-ack:
+	case <-time.After(timeout):
+	}
+}
+
+// logAccess 写一条访问日志，不阻塞请求处理
+func logAccess(e *accessEntry) {
+	if accessWriter == nil {
+		writerSink{Writer: os.Stderr}.writeAccess(e)
+		return
+	}
+	accessWriter.write(e)
+}
+
+func initAccessLog() {
+	console := io.Writer(os.Stderr)
+	var accessOut []accessSink
+	var errOut []io.Writer
+
+	// 使用 journald 时不再输出到标准输出，避免日志重复
+	if config().Log.Journald {
+		j, err := newJournalWriter("r-proxy")
+		if err != nil {
+			log.Printf("journald 初始化失败: %v", err)
+		} else {
+			console = nil
+			accessOut = append(accessOut, j)
+			errOut = append(errOut, j)
+		}
+	}
+	if c := config().Log.File; c != nil {
+		f, err := newRotatingFile(c)
+		if err != nil {
+			log.Printf("日志文件初始化失败: %v", err)
+		} else {
+			if !c.Stdout {
+				console = nil
+			}
+			accessOut = append(accessOut, writerSink{Writer: f, format: accessFormatter(false)})
+			errOut = append(errOut, f)
+			log.Printf("日志写入文件 %s", c.Path)
+		}
+	}
+	if console != nil {
+		accessOut = append(accessOut, writerSink{Writer: console, format: accessFormatter(true)})
+		errOut = append(errOut, console)
+	}
+	if c := config().Log.Syslog; c != nil {
+		access, err := newSyslogWriter(c, 6)
+		if err != nil {
+			log.Printf("syslog 初始化失败: %v", err)
+		} else {
+			accessOut = append(accessOut, writerSink{Writer: access, format: accessFormatter(false)})
+			// 错误日志同样发送到 syslog，级别按日志前缀判断
+			if errw, err := newSyslogWriter(c, 0); err == nil {
+				errOut = append(errOut, errw)
+			}
+			log.Printf("日志同时输出到 syslog %s", c.Address)
+		}
+	}
+	if eventSink != nil {
+		errOut = append(errOut, eventLogWriter{})
+	}
+	log.SetOutput(io.MultiWriter(errOut...))
+	accessWriter = newAsyncWriter(accessOut, config().Log.BufferSize)
+}
+
+func flushAccessLog() {
+	if accessWriter != nil {
+		accessWriter.Flush(time.Second)
+	}
+}
+
+func droppedLogs() int64 {
+	if accessWriter == nil {
+		return 0
+	}
+	return accessWriter.dropped.Load()
+}
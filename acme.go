@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACMEConfig 通过 ACME(如 Let's Encrypt)自动申请和续期证书，使用 http-01 验证，需要能从公网访问 80 端口
+type ACMEConfig struct {
+	Hosts     []string `xml:"host"`
+	Email     string   `xml:"email,attr,omitempty"`
+	CacheDir  string   `xml:"cacheDir,attr,omitempty"`  // 保存账号密钥和证书，默认 ./acme-cache
+	Directory string   `xml:"directory,attr,omitempty"` // ACME 服务地址，默认 Let's Encrypt 正式环境
+}
+
+const letsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+// 证书剩余有效期少于该值时续期
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// 轮询订单和验证状态的间隔
+var acmePollInterval = 2 * time.Second
+
+type acmeManager struct {
+	cfg    *ACMEConfig
+	client *http.Client
+
+	mu     sync.Mutex
+	cert   *tls.Certificate
+	tokens map[string]string // http-01 token -> key authorization
+
+	key   *ecdsa.PrivateKey // 账号密钥
+	kid   string
+	nonce string
+	dir   struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+}
+
+func newACMEManager(cfg *ACMEConfig) *acmeManager {
+	if cfg.CacheDir == "" {
+		cfg.CacheDir = "./acme-cache"
+	}
+	if cfg.Directory == "" {
+		cfg.Directory = letsEncryptDirectory
+	}
+	return &acmeManager{cfg: cfg, client: &http.Client{Timeout: 30 * time.Second}, tokens: map[string]string{}}
+}
+
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cert == nil {
+		return nil, errors.New("ACME 证书尚未签发")
+	}
+	return m.cert, nil
+}
+
+// challengeHandler 响应 /.well-known/acme-challenge/ 验证请求，其他请求交给 next
+func (m *acmeManager) challengeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.mu.Lock()
+		auth := m.tokens[token]
+		m.mu.Unlock()
+		if auth == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, auth)
+	})
+}
+
+// run 加载缓存的证书，快过期或不存在时申请，之后每 12 小时检查一次
+func (m *acmeManager) run() {
+	if cert, err := m.loadCached(); err == nil {
+		m.setCert(cert)
+	}
+	for {
+		if m.needsRenew() {
+			if err := m.obtain(); err != nil {
+				log.Printf("[WARN] ACME 申请证书失败: %v", err)
+				time.Sleep(time.Hour)
+				continue
+			}
+			log.Printf("ACME 证书已签发: %s", strings.Join(m.cfg.Hosts, ","))
+			systemEvent(eventInfo, "ACME 证书已签发: %s", strings.Join(m.cfg.Hosts, ","))
+		}
+		time.Sleep(12 * time.Hour)
+	}
+}
+
+func (m *acmeManager) setCert(cert *tls.Certificate) {
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+}
+
+func (m *acmeManager) needsRenew() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cert == nil || time.Until(m.cert.Leaf.NotAfter) < acmeRenewBefore
+}
+
+func (m *acmeManager) loadCached() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(m.cfg.CacheDir, "cert.pem"), filepath.Join(m.cfg.CacheDir, "key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	// 配置的域名变化后重新申请
+	for _, h := range m.cfg.Hosts {
+		if leaf.VerifyHostname(h) != nil {
+			return nil, fmt.Errorf("缓存的证书不包含 %s", h)
+		}
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// obtain 按 RFC 8555 完成一次 账号 -> 订单 -> http-01 验证 -> 提交 CSR -> 下载证书 的流程
+func (m *acmeManager) obtain() error {
+	if err := os.MkdirAll(m.cfg.CacheDir, 0700); err != nil {
+		return err
+	}
+	if err := m.account(); err != nil {
+		return fmt.Errorf("注册账号: %v", err)
+	}
+	var ids []map[string]string
+	for _, h := range m.cfg.Hosts {
+		ids = append(ids, map[string]string{"type": "dns", "value": h})
+	}
+	var order struct {
+		Status         string   `json:"status"`
+		Authorizations []string `json:"authorizations"`
+		Finalize       string   `json:"finalize"`
+		Certificate    string   `json:"certificate"`
+	}
+	resp, err := m.post(m.dir.NewOrder, map[string]any{"identifiers": ids}, &order)
+	if err != nil {
+		return fmt.Errorf("创建订单: %v", err)
+	}
+	orderURL := resp.Header.Get("Location")
+	for _, authz := range order.Authorizations {
+		if err := m.authorize(authz); err != nil {
+			return err
+		}
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.cfg.Hosts[0]},
+		DNSNames: m.cfg.Hosts,
+	}, certKey)
+	if err != nil {
+		return err
+	}
+	if _, err := m.post(order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return fmt.Errorf("提交 CSR: %v", err)
+	}
+	for i := 0; order.Status != "valid"; i++ {
+		if order.Status == "invalid" || i >= 30 {
+			return fmt.Errorf("订单状态 %s", order.Status)
+		}
+		time.Sleep(acmePollInterval)
+		if _, err := m.post(orderURL, nil, &order); err != nil {
+			return err
+		}
+	}
+	var chain []byte
+	if _, err := m.post(order.Certificate, nil, &chain); err != nil {
+		return fmt.Errorf("下载证书: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(m.cfg.CacheDir, "key.pem"), keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(m.cfg.CacheDir, "cert.pem"), chain, 0600); err != nil {
+		return err
+	}
+	cert, err := m.loadCached()
+	if err != nil {
+		return err
+	}
+	m.setCert(cert)
+	return nil
+}
+
+// account 读取或生成账号密钥并注册，已注册的密钥会返回原有账号
+func (m *acmeManager) account() error {
+	if m.kid != "" {
+		return nil
+	}
+	resp, err := m.client.Get(m.cfg.Directory)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&m.dir)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	keyFile := filepath.Join(m.cfg.CacheDir, "account.key")
+	if data, err := os.ReadFile(keyFile); err == nil {
+		if block, _ := pem.Decode(data); block != nil {
+			m.key, _ = x509.ParseECPrivateKey(block.Bytes)
+		}
+	}
+	if m.key == nil {
+		if m.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return err
+		}
+		der, err := x509.MarshalECPrivateKey(m.key)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return err
+		}
+	}
+
+	req := map[string]any{"termsOfServiceAgreed": true}
+	if m.cfg.Email != "" {
+		req["contact"] = []string{"mailto:" + m.cfg.Email}
+	}
+	resp, err = m.post(m.dir.NewAccount, req, nil)
+	if err != nil {
+		return err
+	}
+	m.kid = resp.Header.Get("Location")
+	return nil
+}
+
+// authorize 完成单个域名的 http-01 验证
+func (m *acmeManager) authorize(authzURL string) error {
+	var authz struct {
+		Status     string `json:"status"`
+		Identifier struct {
+			Value string `json:"value"`
+		} `json:"identifier"`
+		Challenges []struct {
+			Type  string `json:"type"`
+			URL   string `json:"url"`
+			Token string `json:"token"`
+		} `json:"challenges"`
+	}
+	if _, err := m.post(authzURL, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	var chalURL, token string
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			chalURL, token = c.URL, c.Token
+		}
+	}
+	if chalURL == "" {
+		return fmt.Errorf("%s 没有 http-01 验证方式", authz.Identifier.Value)
+	}
+	m.mu.Lock()
+	m.tokens[token] = token + "." + jwkThumbprint(&m.key.PublicKey)
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.tokens, token)
+		m.mu.Unlock()
+	}()
+
+	if _, err := m.post(chalURL, struct{}{}, nil); err != nil {
+		return fmt.Errorf("验证 %s: %v", authz.Identifier.Value, err)
+	}
+	for i := 0; i < 30; i++ {
+		time.Sleep(acmePollInterval)
+		if _, err := m.post(authzURL, nil, &authz); err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "invalid":
+			return fmt.Errorf("%s 验证失败", authz.Identifier.Value)
+		}
+	}
+	return fmt.Errorf("%s 验证超时", authz.Identifier.Value)
+}
+
+// post 发送 JWS 签名的请求，payload 为 nil 时是 POST-as-GET。响应体总会读完并关闭，
+// out 为 *[]byte 时保存原始内容，为其他非 nil 值时解析 JSON；返回的 resp 只用于读取响应头
+func (m *acmeManager) post(url string, payload any, out any) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		body, err := m.signJWS(url, payload)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := m.client.Post(url, "application/jose+json", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		m.nonce = resp.Header.Get("Replay-Nonce")
+		if resp.StatusCode >= 400 {
+			var problem struct {
+				Type   string `json:"type"`
+				Detail string `json:"detail"`
+			}
+			json.NewDecoder(resp.Body).Decode(&problem)
+			resp.Body.Close()
+			// nonce 过期时换新的 nonce 重试一次
+			if strings.HasSuffix(problem.Type, ":badNonce") && attempt == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("%d %s", resp.StatusCode, problem.Detail)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch out := out.(type) {
+		case nil:
+		case *[]byte:
+			*out = data
+		default:
+			if err := json.Unmarshal(data, out); err != nil {
+				return nil, err
+			}
+		}
+		return resp, nil
+	}
+}
+
+func (m *acmeManager) signJWS(url string, payload any) ([]byte, error) {
+	if m.nonce == "" {
+		resp, err := m.client.Head(m.dir.NewNonce)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		m.nonce = resp.Header.Get("Replay-Nonce")
+	}
+	protected := map[string]any{"alg": "ES256", "nonce": m.nonce, "url": url}
+	m.nonce = ""
+	if m.kid != "" {
+		protected["kid"] = m.kid
+	} else {
+		protected["jwk"] = jwk(&m.key.PublicKey)
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if payload != nil {
+		if data, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	signed := b64(header) + "." + b64(data)
+	hash := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, m.key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	// ES256 签名为定长的 r||s
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return json.Marshal(map[string]string{"protected": b64(header), "payload": b64(data), "signature": b64(sig)})
+}
+
+func jwk(pub *ecdsa.PublicKey) map[string]string {
+	return map[string]string{"crv": "P-256", "kty": "EC", "x": b64(pad32(pub.X)), "y": b64(pad32(pub.Y))}
+}
+
+// jwkThumbprint RFC 7638，字段按字典序排列
+func jwkThumbprint(pub *ecdsa.PublicKey) string {
+	k := jwk(pub)
+	s := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, k["crv"], k["kty"], k["x"], k["y"])
+	sum := sha256.Sum256([]byte(s))
+	return b64(sum[:])
+}
+
+func pad32(n *big.Int) []byte {
+	b := make([]byte, 32)
+	n.FillBytes(b)
+	return b
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
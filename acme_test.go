@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bodyTracker 记录未关闭的响应体
+type bodyTracker struct {
+	open atomic.Int64
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	t      *bodyTracker
+	closed bool
+}
+
+func (b *trackedBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.t.open.Add(-1)
+	}
+	return b.ReadCloser.Close()
+}
+
+func (t *bodyTracker) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err == nil {
+		t.open.Add(1)
+		resp.Body = &trackedBody{ReadCloser: resp.Body, t: t}
+	}
+	return resp, err
+}
+
+// stubACME 最小的 RFC 8555 服务端，http-01 验证直接调用 m.challengeHandler
+func stubACME(t *testing.T, m **acmeManager) *httptest.Server {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var srv *httptest.Server
+	var validated, badNonceSent bool
+	var chain []byte
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "n"+time.Now().String())
+		if r.URL.Path == "/dir" {
+			json.NewEncoder(w).Encode(map[string]string{"newNonce": srv.URL + "/nonce", "newAccount": srv.URL + "/account", "newOrder": srv.URL + "/order"})
+			return
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+			t.Errorf("%s: %v", r.URL.Path, err)
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		w.Header().Set("Content-Type", "application/json")
+		order := map[string]any{"status": "pending", "authorizations": []string{srv.URL + "/authz"}, "finalize": srv.URL + "/finalize"}
+		switch r.URL.Path {
+		case "/account":
+			if !badNonceSent {
+				badNonceSent = true
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"type":"urn:ietf:params:acme:error:badNonce"}`)
+				return
+			}
+			w.Header().Set("Location", srv.URL+"/acct/1")
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"status":"valid"}`)
+		case "/order":
+			w.Header().Set("Location", srv.URL+"/order/1")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(order)
+		case "/authz":
+			status := "pending"
+			if validated {
+				status = "valid"
+			}
+			json.NewEncoder(w).Encode(map[string]any{"status": status, "identifier": map[string]string{"value": "a.example"},
+				"challenges": []map[string]string{{"type": "http-01", "url": srv.URL + "/chal", "token": "tok"}}})
+		case "/chal":
+			rec := httptest.NewRecorder()
+			(*m).challengeHandler(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/tok", nil))
+			if want := "tok." + jwkThumbprint(&(*m).key.PublicKey); rec.Body.String() != want {
+				t.Errorf("key authorization = %q, want %q", rec.Body.String(), want)
+			}
+			validated = true
+			io.WriteString(w, `{"status":"processing"}`)
+		case "/finalize":
+			var req struct {
+				CSR string `json:"csr"`
+			}
+			json.Unmarshal(payload, &req)
+			der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				t.Errorf("CSR: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: csr.DNSNames, NotBefore: time.Now(), NotAfter: time.Now().Add(90 * 24 * time.Hour)}
+			cert, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, csr.PublicKey, caKey)
+			chain = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+			order["status"], order["certificate"] = "valid", srv.URL+"/cert"
+			json.NewEncoder(w).Encode(order)
+		case "/cert":
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+			w.Write(chain)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return srv
+}
+
+func TestACMEObtain(t *testing.T) {
+	defer func(d time.Duration) { acmePollInterval = d }(acmePollInterval)
+	acmePollInterval = time.Millisecond
+
+	var m *acmeManager
+	srv := stubACME(t, &m)
+	defer srv.Close()
+	m = newACMEManager(&ACMEConfig{Hosts: []string{"a.example"}, CacheDir: t.TempDir(), Directory: srv.URL + "/dir"})
+	tracker := &bodyTracker{}
+	m.client = &http.Client{Transport: tracker}
+
+	if err := m.obtain(); err != nil {
+		t.Fatal(err)
+	}
+	if m.kid != srv.URL+"/acct/1" {
+		t.Errorf("kid = %q", m.kid)
+	}
+	cert, err := m.getCertificate(nil)
+	if err != nil || !strings.Contains(strings.Join(cert.Leaf.DNSNames, ","), "a.example") {
+		t.Errorf("certificate = %v, %v", cert, err)
+	}
+	if len(m.tokens) != 0 {
+		t.Errorf("tokens not cleared: %v", m.tokens)
+	}
+	if n := tracker.open.Load(); n != 0 {
+		t.Errorf("%d response bodies left open", n)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// AdminConfig 管理接口配置，管理接口使用单独的端口
+type AdminConfig struct {
+	Listen string `xml:"listen,attr"`          // 如 127.0.0.1:3001
+	Token  string `xml:"token,attr,omitempty"` // 请求需带 Authorization: Bearer <token>
+}
+
+var adminMux = http.NewServeMux()
+
+// adminAuth 校验管理接口的 Bearer token，未配置 token 时只允许本机访问
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := config().Admin.Token
+		if token == "" {
+			if !isLoopback(r.RemoteAddr) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		} else if !isDashboardAsset(r) {
+			// 管理页面本身不含数据，由页面中输入的 token 访问接口
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="r-proxy admin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isLoopback(remoteAddr string) bool {
+	host := remoteAddr
+	if i := strings.LastIndex(remoteAddr, ":"); i >= 0 {
+		host = remoteAddr[:i]
+	}
+	host = strings.Trim(host, "[]")
+	return host == "127.0.0.1" || host == "::1" || strings.HasPrefix(host, "127.")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func startAdmin() {
+	if config().Admin == nil || config().Admin.Listen == "" {
+		return
+	}
+	ln, err := listen("admin", config().Admin.Listen)
+	if err != nil {
+		log.Printf("管理接口启动失败: %v", err)
+		return
+	}
+	log.Printf("管理接口启动在 http://%s", config().Admin.Listen)
+	server := &http.Server{Handler: adminAuth(adminMux)}
+	trackServer(server)
+	go server.Serve(ln)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// configEdits 管理接口对配置的修改串行执行
+var configEdits sync.Mutex
+
+// editConfig 复制当前配置并修改，初始化成功后整体替换；persist 为 true 时写回配置文件。
+// 配置文件之后被手动修改时会重新加载，未写回的修改会丢失
+func editConfig(persist bool, edit func(c *ProxyConfig) error) (*ProxyConfig, error) {
+	configEdits.Lock()
+	defer configEdits.Unlock()
+
+	// 通过 XML 序列化深拷贝，只复制导出字段，内部状态由 init 重新生成
+	data, err := xml.Marshal(config())
+	if err != nil {
+		return nil, err
+	}
+	c := &ProxyConfig{}
+	if err := xml.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if err := edit(c); err != nil {
+		return nil, err
+	}
+	if err := installConfig(c, persist); err != nil {
+		return nil, err
+	}
+	log.Printf("管理接口修改了配置，共 %d 条代理规则", len(c.ProxyRules))
+	systemEvent(eventInfo, "管理接口修改了配置，共 %d 条代理规则", len(c.ProxyRules))
+	replicateConfig(c, persist)
+	return c, nil
+}
+
+// installConfig 初始化并替换当前配置，调用方需持有 configEdits
+func installConfig(c *ProxyConfig, persist bool) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+	if persist {
+		if err := writeConfigFile(configFile, c); err != nil {
+			return fmt.Errorf("写入配置文件失败: %v", err)
+		}
+	}
+	old := config()
+	currentConfig.Store(c)
+	old.closeIdleConnections()
+	return nil
+}
+
+// decodeAdminBody 请求体使用与 JSON 配置文件相同的字段名，如 {"domain": "a.com", "proxyUrl": "http://..."}
+func decodeAdminBody(r *http.Request, v any) error {
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	n, err := parseJSONConfig(data)
+	if err != nil {
+		return err
+	}
+	var d configDecoder
+	if err := d.decode(n, reflect.ValueOf(v).Elem(), ""); err != nil {
+		return err
+	}
+	if len(d.unknown) > 0 {
+		return fmt.Errorf("%s", d.unknown[0])
+	}
+	return nil
+}
+
+func persistRequested(r *http.Request) bool {
+	p, _ := strconv.ParseBool(r.URL.Query().Get("persist"))
+	return p
+}
+
+// adminRules 管理接口: GET 列出规则(按生效顺序)，POST 添加，PUT 替换，DELETE 删除；?persist=true 写回配置文件。
+// PUT/DELETE 通过 ?domain=(或 ?regex=)&pathPrefix= 指定规则，也可以用 GET 返回的 ?index=，
+// 但添加规则后会按 priority 重新排序，index 可能变化
+func adminRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, encodeRuleList(config().ProxyRules))
+		return
+	}
+	var rule ProxyRule
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if err := decodeAdminBody(r, &rule); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if rule.Domain == "" && rule.Regex == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "domain 和 regex 不能都为空"})
+			return
+		}
+	}
+	c, err := editConfig(persistRequested(r), func(c *ProxyConfig) error {
+		switch r.Method {
+		case http.MethodPost:
+			c.ProxyRules = append(c.ProxyRules, rule)
+		case http.MethodPut, http.MethodDelete:
+			index, err := findRule(c.ProxyRules, r.URL.Query())
+			if err != nil {
+				return err
+			}
+			if r.Method == http.MethodPut {
+				c.ProxyRules[index] = rule
+			} else {
+				c.ProxyRules = append(c.ProxyRules[:index], c.ProxyRules[index+1:]...)
+			}
+		default:
+			return errMethod
+		}
+		return nil
+	})
+	if err != nil {
+		writeEditError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, encodeRuleList(c.ProxyRules))
+}
+
+// findRule 按 domain/regex 和 pathPrefix 或 index 查找要修改的规则
+func findRule(rules []ProxyRule, q url.Values) (int, error) {
+	if q.Has("index") {
+		index, err := strconv.Atoi(q.Get("index"))
+		if err != nil {
+			return 0, fmt.Errorf("index 格式错误: %s", q.Get("index"))
+		}
+		if index < 0 || index >= len(rules) {
+			return 0, errNotFound
+		}
+		return index, nil
+	}
+	if !q.Has("domain") && !q.Has("regex") {
+		return 0, errors.New("需要 domain、regex 或 index 参数")
+	}
+	found := -1
+	for i, r := range rules {
+		if r.Domain == q.Get("domain") && r.Regex == q.Get("regex") && r.PathPrefix == q.Get("pathPrefix") {
+			if found >= 0 {
+				return 0, errors.New("匹配到多条规则，请使用 index 指定")
+			}
+			found = i
+		}
+	}
+	if found < 0 {
+		return 0, errNotFound
+	}
+	return found, nil
+}
+
+// adminDirectDomains 管理接口: GET 列出，POST {"domain": "..."} 添加，DELETE ?domain= 删除
+func adminDirectDomains(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, nonNil(config().DirectDomains))
+		return
+	}
+	var body struct {
+		Domain string `xml:"domain"`
+	}
+	if r.Method == http.MethodPost {
+		if err := decodeAdminBody(r, &body); err != nil || body.Domain == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "需要 domain"})
+			return
+		}
+	}
+	domain := r.URL.Query().Get("domain")
+	c, err := editConfig(persistRequested(r), func(c *ProxyConfig) error {
+		switch r.Method {
+		case http.MethodPost:
+			for _, d := range c.DirectDomains {
+				if d == body.Domain {
+					return nil
+				}
+			}
+			c.DirectDomains = append(c.DirectDomains, body.Domain)
+		case http.MethodDelete:
+			for i, d := range c.DirectDomains {
+				if d == domain {
+					c.DirectDomains = append(c.DirectDomains[:i], c.DirectDomains[i+1:]...)
+					return nil
+				}
+			}
+			return errNotFound
+		default:
+			return errMethod
+		}
+		return nil
+	})
+	if err != nil {
+		writeEditError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nonNil(c.DirectDomains))
+}
+
+// adminCustomHeaders 管理接口: GET 列出，POST {"domain","pathPrefix","headersPath","setHeader":[{"name","value"}]} 添加，DELETE ?domain=&pathPrefix= 删除
+func adminCustomHeaders(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, encodeList(config().CustomHeaders))
+		return
+	}
+	var header CustomHeader
+	if r.Method == http.MethodPost {
+		if err := decodeAdminBody(r, &header); err != nil || header.Domain == "" || header.empty() {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "需要 domain 和 headersPath 或 setHeader/addHeader/removeHeader"})
+			return
+		}
+	}
+	q := r.URL.Query()
+	c, err := editConfig(persistRequested(r), func(c *ProxyConfig) error {
+		switch r.Method {
+		case http.MethodPost:
+			c.CustomHeaders = append(c.CustomHeaders, header)
+		case http.MethodDelete:
+			for i, h := range c.CustomHeaders {
+				if h.Domain == q.Get("domain") && h.PathPrefix == q.Get("pathPrefix") {
+					c.CustomHeaders = append(c.CustomHeaders[:i], c.CustomHeaders[i+1:]...)
+					return nil
+				}
+			}
+			return errNotFound
+		default:
+			return errMethod
+		}
+		return nil
+	})
+	if err != nil {
+		writeEditError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, encodeList(c.CustomHeaders))
+}
+
+var (
+	errMethod   = errors.New("不支持的请求方法")
+	errNotFound = errors.New("没有找到")
+)
+
+func writeEditError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch err {
+	case errMethod:
+		status = http.StatusMethodNotAllowed
+	case errNotFound:
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// encodeRuleList 规则使用配置文件中的字段名输出，index 用于 PUT/DELETE
+func encodeRuleList(rules []ProxyRule) []any {
+	list := []any{}
+	for i := range rules {
+		m, _ := encodeConfig(reflect.ValueOf(&rules[i])).(*cfgMap)
+		if m == nil {
+			m = &cfgMap{}
+		}
+		m.keys = append([]string{"index"}, m.keys...)
+		m.vals = append([]any{i}, m.vals...)
+		list = append(list, m)
+	}
+	return list
+}
+
+// encodeList 列表使用配置文件中的字段名输出，空列表输出 []
+func encodeList(v any) any {
+	if list := encodeConfig(reflect.ValueOf(v)); list != nil {
+		return list
+	}
+	return []any{}
+}
+
+// adminCache 管理接口: DELETE 清空响应缓存
+func adminCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeEditError(w, errMethod)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purgeCache()})
+}
+
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+func init() {
+	adminMux.HandleFunc("/api/rules", adminRules)
+	adminMux.HandleFunc("/api/direct-domains", adminDirectDomains)
+	adminMux.HandleFunc("/api/custom-headers", adminCustomHeaders)
+	adminMux.HandleFunc("/api/cache", adminCache)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func setTestRules(t *testing.T, rules string) {
+	t.Helper()
+	c := &ProxyConfig{}
+	if err := xml.Unmarshal([]byte("<config>"+rules+"</config>"), c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+	currentConfig.Store(c)
+}
+
+func TestAdminRulesAddressing(t *testing.T) {
+	const rules = `<proxy domain="a.com" proxyUrl="http://127.0.0.1:1" />` +
+		`<proxy domain="b.com" proxyUrl="http://127.0.0.1:2" />` +
+		`<proxy domain="b.com" pathPrefix="/api/" proxyUrl="http://127.0.0.1:3" />`
+	tests := []struct {
+		method, query string
+		status        int
+		left          []string // 请求后剩余规则的 domain+pathPrefix
+	}{
+		{http.MethodDelete, "", http.StatusBadRequest, []string{"a.com", "b.com", "b.com/api/"}},
+		{http.MethodDelete, "?index=x", http.StatusBadRequest, []string{"a.com", "b.com", "b.com/api/"}},
+		{http.MethodDelete, "?index=3", http.StatusNotFound, []string{"a.com", "b.com", "b.com/api/"}},
+		{http.MethodDelete, "?domain=c.com", http.StatusNotFound, []string{"a.com", "b.com", "b.com/api/"}},
+		{http.MethodDelete, "?domain=b.com&pathPrefix=/api/", http.StatusOK, []string{"a.com", "b.com"}},
+		{http.MethodDelete, "?domain=b.com", http.StatusOK, []string{"a.com", "b.com/api/"}},
+		{http.MethodDelete, "?index=0", http.StatusOK, []string{"b.com", "b.com/api/"}},
+		{http.MethodPut, "", http.StatusBadRequest, []string{"a.com", "b.com", "b.com/api/"}},
+	}
+	for _, tt := range tests {
+		setTestRules(t, rules)
+		body := `{"domain": "a.com", "proxyUrl": "http://127.0.0.1:4"}`
+		r := httptest.NewRequest(tt.method, "/api/rules"+tt.query, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		adminRules(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d: %s", tt.method, tt.query, w.Code, tt.status, w.Body.String())
+		}
+		var left []string
+		for _, rule := range config().ProxyRules {
+			left = append(left, rule.Domain+rule.PathPrefix)
+		}
+		if strings.Join(left, ",") != strings.Join(tt.left, ",") {
+			t.Errorf("%s %s: rules %v, want %v", tt.method, tt.query, left, tt.left)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// APIKey 发给其他人的访问密钥，只能访问 domains 中的目标(为空时不限制)，并按 rateLimit 限速。
+// 请求通过 Authorization: Bearer <key>、X-Api-Key 头或代理认证的密码(curl -x http://any:<key>@host:3000)携带密钥
+type APIKey struct {
+	Name      string  `xml:"name,attr"`
+	Key       string  `xml:"key,attr"`
+	Domains   string  `xml:"domains,attr,omitempty"` // 逗号分隔，只支持精确域名和通配符，如 api.github.com,*.npmjs.org
+	RateLimit float64 `xml:"rateLimit,attr,omitempty"`
+	RateBurst int     `xml:"rateBurst,attr,omitempty"`
+
+	domains []string
+}
+
+func (c *ProxyConfig) initAPIKeys() error {
+	seen := map[string]bool{}
+	for i := range c.APIKeys {
+		k := &c.APIKeys[i]
+		if k.Name == "" || k.Key == "" {
+			return errors.New("apiKeys 的 key 需要 name 和 key")
+		}
+		if seen[k.Key] {
+			return fmt.Errorf("apiKeys 中 %s 的 key 与其他密钥重复", k.Name)
+		}
+		seen[k.Key] = true
+		k.domains = nil
+		for _, d := range strings.Split(k.Domains, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				if strings.HasPrefix(d, "~") {
+					return fmt.Errorf("apiKeys 中 %s 的 domains 不支持 ~ 包含匹配: %s", k.Name, d)
+				}
+				k.domains = append(k.domains, d)
+			}
+		}
+	}
+	return nil
+}
+
+// findAPIKey 查找请求携带的密钥，返回密钥和携带密钥的请求头
+func findAPIKey(r *http.Request) (*APIKey, string) {
+	keys := config().APIKeys
+	if len(keys) == 0 {
+		return nil, ""
+	}
+	candidates := map[string]string{"X-Api-Key": r.Header.Get("X-Api-Key")}
+	for _, h := range []string{"Authorization", "Proxy-Authorization"} {
+		v := r.Header.Get(h)
+		if token, ok := cutPrefixFold(v, "Bearer "); ok {
+			candidates[h] = strings.TrimSpace(token)
+		} else if _, password, ok := parseBasicAuth(v); ok {
+			candidates[h] = password
+		}
+	}
+	for h, token := range candidates {
+		if token == "" {
+			continue
+		}
+		for i := range keys {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(keys[i].Key)) == 1 {
+				return &keys[i], h
+			}
+		}
+	}
+	return nil, ""
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return "", false
+	}
+	return s[len(prefix):], true
+}
+
+type apiKeyCtx struct{}
+
+func withAPIKey(r *http.Request, k *APIKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyCtx{}, k))
+}
+
+// checkAPIKey 使用密钥的请求只能访问密钥允许的目标，并按密钥限速
+func checkAPIKey(w http.ResponseWriter, id int64, r *http.Request, target *url.URL) bool {
+	k, _ := r.Context().Value(apiKeyCtx{}).(*APIKey)
+	if k == nil {
+		return false
+	}
+	if len(k.domains) > 0 {
+		allowed := false
+		for _, d := range k.domains {
+			if ruleMatch(d, target.Host) >= matchWildcard {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			warnf("id:%d 密钥 %s 无权访问 %s", id, k.Name, target.Host)
+			http.Error(w, "该密钥无权访问目标地址", http.StatusForbidden)
+			return true
+		}
+	}
+	if k.RateLimit > 0 {
+		if ok, wait := takeToken("rate:key:"+k.Name, k.RateLimit, k.RateBurst); !ok {
+			warnf("id:%d 密钥 %s 请求过于频繁", id, k.Name)
+			rejectRateLimited(w, wait, "请求过于频繁，请稍后重试")
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 超过该大小的请求体不计算哈希，使用 UNSIGNED-PAYLOAD(仅 S3 支持)
+const awsSignBodyLimit = 10 << 20
+
+// AWSSign 使用 AWS SigV4 为转发给上游的请求签名
+type AWSSign struct {
+	Region       string `xml:"region,attr"`
+	Service      string `xml:"service,attr"` // s3、es 等
+	AccessKey    string `xml:"accessKey,attr,omitempty"`
+	SecretKey    string `xml:"secretKey,attr,omitempty"`
+	SessionToken string `xml:"sessionToken,attr,omitempty"`
+
+	mu    sync.Mutex
+	creds awsCredentials
+}
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (a *AWSSign) init() error {
+	if a.Region == "" || a.Service == "" {
+		return fmt.Errorf("awsSign 需要配置 region 和 service")
+	}
+	return nil
+}
+
+// credentials 依次使用配置、环境变量、ECS 容器凭证和 EC2 实例角色
+func (a *AWSSign) credentials() (awsCredentials, error) {
+	if a.AccessKey != "" {
+		return awsCredentials{AccessKeyID: a.AccessKey, SecretAccessKey: a.SecretKey, Token: a.SessionToken}, nil
+	}
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// 提前 5 分钟刷新临时凭证
+	if a.creds.AccessKeyID != "" && time.Until(a.creds.Expiration) > 5*time.Minute {
+		return a.creds, nil
+	}
+	creds, err := fetchRoleCredentials()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	a.creds = creds
+	return creds, nil
+}
+
+var awsMetadataClient = &http.Client{Timeout: 5 * time.Second}
+
+func fetchRoleCredentials() (awsCredentials, error) {
+	var endpoint, auth string
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		endpoint = "http://169.254.170.2" + rel
+	} else if full := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); full != "" {
+		endpoint = full
+		auth = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	}
+	if endpoint != "" {
+		return getCredentials(endpoint, map[string]string{"Authorization": auth})
+	}
+
+	// EC2 IMDSv2: 先获取会话令牌，再读取角色名和凭证
+	const imds = "http://169.254.169.254/latest"
+	req, _ := http.NewRequest(http.MethodPut, imds+"/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, err := awsMetadataClient.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("获取实例元数据令牌失败: %v", err)
+	}
+	token, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	headers := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+	role, err := metadataGet(imds+"/meta-data/iam/security-credentials/", headers)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	return getCredentials(imds+"/meta-data/iam/security-credentials/"+role, headers)
+}
+
+func metadataGet(u string, headers map[string]string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range headers {
+		if v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	resp, err := awsMetadataClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("读取凭证失败: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("读取凭证失败: %s", resp.Status)
+	}
+	return string(b), err
+}
+
+func getCredentials(u string, headers map[string]string) (awsCredentials, error) {
+	body, err := metadataGet(u, headers)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var c awsCredentials
+	if err := json.Unmarshal([]byte(body), &c); err != nil {
+		return awsCredentials{}, fmt.Errorf("解析凭证失败: %v", err)
+	}
+	return c, nil
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// awsEscape 按 RFC 3986 编码，除 A-Z a-z 0-9 - _ . ~ 外都转义
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(u *url.URL) string {
+	q := u.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string{}, q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// payloadHash 计算请求体哈希，读取后放回请求体
+func payloadHash(r *http.Request, service string) string {
+	if r.Body == nil || r.Body == http.NoBody {
+		return sha256Hex(nil)
+	}
+	if r.ContentLength < 0 || r.ContentLength > awsSignBodyLimit {
+		if service == "s3" {
+			return "UNSIGNED-PAYLOAD"
+		}
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	if err != nil {
+		return "UNSIGNED-PAYLOAD"
+	}
+	return sha256Hex(body)
+}
+
+// sign 计算 SigV4 签名并设置 Authorization 等请求头
+func (a *AWSSign) sign(r *http.Request, now time.Time) error {
+	creds, err := a.credentials()
+	if err != nil {
+		return err
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	hash := payloadHash(r, a.Service)
+
+	r.Header.Del("Authorization")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", hash)
+	if creds.Token != "" {
+		r.Header.Set("X-Amz-Security-Token", creds.Token)
+	} else {
+		r.Header.Del("X-Amz-Security-Token")
+	}
+
+	signed := map[string]string{"host": r.Host}
+	for k, v := range r.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" || lk == "content-md5" {
+			signed[lk] = strings.Join(strings.Fields(strings.Join(v, ",")), " ")
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, k := range names {
+		headers.WriteString(k + ":" + signed[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// S3 的路径只编码一次，其他服务需要对已编码的路径再编码一次
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if a.Service != "s3" {
+		path = awsEscape(path, true)
+	}
+	canonical := strings.Join([]string{r.Method, path, canonicalQuery(r.URL), headers.String(), signedHeaders, hash}, "\n")
+
+	scope := date + "/" + a.Region + "/" + a.Service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, a.Region)
+	key = hmacSHA256(key, a.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+// applyAWSSign 在 Director 中调用，签名失败时记录日志并按原样转发
+func applyAWSSign(id int64, rule *ProxyRule, r *http.Request) {
+	if rule == nil || rule.AWSSign == nil {
+		return
+	}
+	if err := rule.AWSSign.sign(r, time.Now()); err != nil {
+		warnf("id:%d AWS 签名失败: %v", id, err)
+	}
+}
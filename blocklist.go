@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// BlocklistConfig 广告/跟踪域名拦截列表
+type BlocklistConfig struct {
+	Refresh string            `xml:"refresh,attr,omitempty"` // 远程列表刷新间隔，如 24h，默认 24h
+	Status  int               `xml:"status,attr,omitempty"`  // 命中时返回的状态码，默认 204
+	Message string            `xml:"message,attr,omitempty"` // 状态码不是 204 时返回的内容
+	Lists   []BlocklistSource `xml:"list"`
+	Domains []string          `xml:"domain"` // 直接写在配置中的域名，子域名也会命中
+}
+
+// BlocklistSource 单个列表来源，path 和 url 二选一
+type BlocklistSource struct {
+	Path   string `xml:"path,attr,omitempty"`
+	URL    string `xml:"url,attr,omitempty"`
+	Format string `xml:"format,attr,omitempty"` // hosts(默认) 或 adblock
+}
+
+func (s BlocklistSource) name() string {
+	if s.URL != "" {
+		return s.URL
+	}
+	return s.Path
+}
+
+// ThreatFeedConfig 恶意域名/URL 威胁情报订阅(URLhaus/abuse.ch 等)，命中时记录 WARN 日志
+type ThreatFeedConfig struct {
+	Refresh string            `xml:"refresh,attr,omitempty"` // 刷新间隔，默认 1h
+	Status  int               `xml:"status,attr,omitempty"`  // 命中时返回的状态码，默认 403
+	Message string            `xml:"message,attr,omitempty"`
+	Feeds   []BlocklistSource `xml:"feed"`
+	Allow   []string          `xml:"allow"` // 误报时放行的域名
+}
+
+// domainSet 域名集合，子域名也会命中
+type domainSet struct {
+	block map[string]struct{}
+	allow map[string]struct{} // adblock 格式中 @@|| 开头的例外规则及配置的放行域名
+	urls  map[string]struct{} // urls 格式中的完整URL
+}
+
+func newDomainSet() *domainSet {
+	return &domainSet{block: map[string]struct{}{}, allow: map[string]struct{}{}, urls: map[string]struct{}{}}
+}
+
+func (s *domainSet) size() int {
+	return len(s.block) + len(s.urls)
+}
+
+// match 依次检查 host 及其上级域名
+func matchDomain(m map[string]struct{}, host string) bool {
+	for host != "" {
+		if _, ok := m[host]; ok {
+			return true
+		}
+		_, rest, found := strings.Cut(host, ".")
+		if !found {
+			break
+		}
+		host = rest
+	}
+	return false
+}
+
+// containsURL 检查域名或完整URL(不含查询参数)是否命中
+func (s *domainSet) containsURL(u *url.URL) bool {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if matchDomain(s.allow, host) {
+		return false
+	}
+	if matchDomain(s.block, host) {
+		return true
+	}
+	if len(s.urls) == 0 {
+		return false
+	}
+	_, ok := s.urls[normalizeFeedURL(u.Scheme+"://"+u.Host+u.Path)]
+	return ok
+}
+
+func normalizeFeedURL(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return raw
+	}
+	return strings.ToLower(u.Host) + u.Path
+}
+
+// parseHostsLine 解析 "0.0.0.0 ads.example.com" 或只有域名的行
+func parseHostsLine(line string) []string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	if net.ParseIP(fields[0]) != nil {
+		fields = fields[1:]
+	}
+	var hosts []string
+	for _, f := range fields {
+		f = strings.ToLower(f)
+		if f == "localhost" || f == "localhost.localdomain" || f == "broadcasthost" || f == "local" || net.ParseIP(f) != nil {
+			continue
+		}
+		hosts = append(hosts, f)
+	}
+	return hosts
+}
+
+// parseAdblockLine 只支持域名级规则: ||example.com^ 和例外规则 @@||example.com^
+func parseAdblockLine(line string) (host string, allow bool) {
+	if strings.HasPrefix(line, "@@") {
+		allow = true
+		line = line[2:]
+	}
+	if !strings.HasPrefix(line, "||") {
+		return "", false
+	}
+	line = line[2:]
+	end := strings.IndexAny(line, "^/$*")
+	if end >= 0 {
+		// 带路径或通配符的规则无法在域名级别处理
+		if line[end] != '^' || (end+1 < len(line) && line[end+1] != '$') {
+			return "", false
+		}
+		line = line[:end]
+	}
+	return strings.ToLower(line), allow
+}
+
+func (s *domainSet) load(r io.Reader, format string) error {
+	format = strings.ToLower(format)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		if format == "urls" {
+			// 每行一个URL，如 URLhaus 的 text_online 列表
+			s.urls[normalizeFeedURL(line)] = struct{}{}
+			continue
+		}
+		if format == "adblock" {
+			if host, allow := parseAdblockLine(line); host != "" {
+				if allow {
+					s.allow[host] = struct{}{}
+				} else {
+					s.block[host] = struct{}{}
+				}
+			}
+			continue
+		}
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		for _, h := range parseHostsLine(line) {
+			s.block[h] = struct{}{}
+		}
+	}
+	return sc.Err()
+}
+
+func openBlocklist(src BlocklistSource) (io.ReadCloser, error) {
+	if src.URL == "" {
+		return os.Open(src.Path)
+	}
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Get(src.URL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("下载失败: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *domainSet) merge(o *domainSet) {
+	for h := range o.block {
+		s.block[h] = struct{}{}
+	}
+	for h := range o.allow {
+		s.allow[h] = struct{}{}
+	}
+	for u := range o.urls {
+		s.urls[u] = struct{}{}
+	}
+}
+
+// loadSource 加载单个来源，解析出错时同时返回已解析的部分
+func loadSource(src BlocklistSource) (*domainSet, error) {
+	r, err := openBlocklist(src)
+	if err != nil {
+		log.Printf("加载拦截列表 %s 失败: %v", src.name(), err)
+		return nil, err
+	}
+	defer r.Close()
+	set := newDomainSet()
+	if err := set.load(r, src.Format); err != nil {
+		log.Printf("解析拦截列表 %s 失败: %v", src.name(), err)
+		return set, err
+	}
+	log.Printf("加载拦截列表 %s，共 %d 个域名", src.name(), set.size())
+	return set, nil
+}
+
+// loadDomainSet 加载配置的域名和所有来源，单个来源失败时沿用该来源上次成功加载的内容
+func (b *domainBlocker) loadDomainSet(sources []BlocklistSource, block, allow []string) *domainSet {
+	set := newDomainSet()
+	for _, d := range block {
+		set.block[strings.ToLower(strings.TrimSpace(d))] = struct{}{}
+	}
+	for _, a := range allow {
+		set.allow[strings.ToLower(strings.TrimSpace(a))] = struct{}{}
+	}
+	if b.last == nil {
+		b.last = make([]*domainSet, len(sources))
+	}
+	for i, src := range sources {
+		s, err := loadSource(src)
+		switch {
+		case err == nil:
+			b.last[i] = s
+		case b.last[i] != nil:
+			log.Printf("拦截列表 %s 沿用上次加载的 %d 个域名", src.name(), b.last[i].size())
+			s = b.last[i]
+		}
+		if s != nil {
+			set.merge(s)
+		}
+	}
+	return set
+}
+
+// domainBlocker 定期刷新的拦截列表
+type domainBlocker struct {
+	kind    string // 用于日志和响应头: blocklist / threat
+	status  int
+	message string
+	warn    bool // 命中时输出 WARN 日志
+	set     atomic.Pointer[domainSet]
+	last    []*domainSet // 各来源上次成功加载的内容，只在加载的 goroutine 中使用
+}
+
+var adBlocker, threatBlocker *domainBlocker
+
+func startBlocker(b *domainBlocker, sources []BlocklistSource, block, allow []string, refresh string, defRefresh time.Duration) *domainBlocker {
+	b.set.Store(b.loadDomainSet(sources, block, allow))
+	if len(sources) == 0 {
+		return b
+	}
+
+	interval := defRefresh
+	if refresh != "" {
+		if d, err := time.ParseDuration(refresh); err == nil && d > 0 {
+			interval = d
+		} else {
+			log.Printf("%s refresh 格式错误: %s，使用默认值 %s", b.kind, refresh, defRefresh)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			b.set.Store(b.loadDomainSet(sources, block, allow))
+		}
+	}()
+	return b
+}
+
+// initBlocklist 加载广告拦截列表和威胁情报订阅，并按间隔刷新
+func initBlocklist() {
+	if c := config().Blocklist; c != nil && (len(c.Lists) > 0 || len(c.Domains) > 0) {
+		status := c.Status
+		if status == 0 {
+			status = http.StatusNoContent
+		}
+		b := &domainBlocker{kind: "blocklist", status: status, message: c.Message}
+		adBlocker = startBlocker(b, c.Lists, c.Domains, nil, c.Refresh, 24*time.Hour)
+	}
+	if c := config().ThreatFeeds; c != nil && len(c.Feeds) > 0 {
+		status := c.Status
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		b := &domainBlocker{kind: "threat", status: status, message: c.Message, warn: true}
+		threatBlocker = startBlocker(b, c.Feeds, nil, c.Allow, c.Refresh, time.Hour)
+	}
+}
+
+func (b *domainBlocker) check(w http.ResponseWriter, id int64, target *url.URL) bool {
+	if b == nil || !b.set.Load().containsURL(target) {
+		return false
+	}
+	if b.warn {
+		warnf("id:%d 目标命中威胁情报列表，已拦截 %s", id, target.String())
+	}
+	logAccess(&accessEntry{ID: id, Host: target.Host, Status: b.status, Line: fmt.Sprintf("id:%d blocked(%s) %s", id, b.kind, target.Host)})
+	w.Header().Set("X-Proxy-Blocked", b.kind)
+	if b.status == http.StatusNoContent {
+		w.WriteHeader(b.status)
+	} else {
+		http.Error(w, messageOr(b.message, "目标地址已被代理策略拦截"), b.status)
+	}
+	return true
+}
+
+// checkBlocklist 目标命中拦截列表时直接返回，不转发请求
+func checkBlocklist(w http.ResponseWriter, id int64, target *url.URL) bool {
+	return threatBlocker.check(w, id, target) || adBlocker.check(w, id, target)
+}
+
+// messageOr 配置了拒绝提示时使用配置的内容
+func messageOr(message, def string) string {
+	if message != "" {
+		return message
+	}
+	return def
+}
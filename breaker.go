@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerConfig 上游代理连续失败 failures 次后熔断 cooldown 时间，期间按 onOpen 直接返回 503(fail)或直连(direct)；
+// 冷却结束后放行请求试探，再次失败立即重新熔断
+type CircuitBreakerConfig struct {
+	Failures int    `xml:"failures,attr,omitempty"` // 默认 5
+	Cooldown string `xml:"cooldown,attr,omitempty"` // 默认 30s
+	OnOpen   string `xml:"onOpen,attr,omitempty"`   // fail(默认) 或 direct
+
+	cooldown time.Duration
+}
+
+func (c *CircuitBreakerConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	if c.Failures <= 0 {
+		c.Failures = 5
+	}
+	c.cooldown = 30 * time.Second
+	if c.Cooldown != "" {
+		d, err := time.ParseDuration(c.Cooldown)
+		if err != nil {
+			return fmt.Errorf("circuitBreaker cooldown 格式错误: %v", err)
+		}
+		c.cooldown = d
+	}
+	switch c.OnOpen {
+	case "", "fail", "direct":
+	default:
+		return fmt.Errorf("circuitBreaker onOpen 只能是 fail 或 direct: %s", c.OnOpen)
+	}
+	return nil
+}
+
+type circuit struct {
+	sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// circuits 按 proxyUrl 记录连续失败次数，重新加载配置后保留
+var circuits sync.Map
+
+func circuitFor(proxyURL string) *circuit {
+	v, _ := circuits.LoadOrStore(proxyURL, &circuit{})
+	return v.(*circuit)
+}
+
+// allow 熔断期间返回 false，未配置熔断时总是 true
+func (c *CircuitBreakerConfig) allow(proxyURL string) bool {
+	if c == nil {
+		return true
+	}
+	cb := circuitFor(proxyURL)
+	cb.Lock()
+	defer cb.Unlock()
+	return !time.Now().Before(cb.openUntil)
+}
+
+// record 记录一次经过该代理的请求结果
+func (c *CircuitBreakerConfig) record(proxyURL string, failed bool) {
+	if c == nil {
+		return
+	}
+	cb := circuitFor(proxyURL)
+	cb.Lock()
+	defer cb.Unlock()
+	if !failed {
+		if cb.failures >= c.Failures {
+			warnf("上游代理 %s 已恢复，解除熔断", proxyURL)
+		}
+		cb.failures, cb.openUntil = 0, time.Time{}
+		return
+	}
+	cb.failures++
+	if cb.failures >= c.Failures && !time.Now().Before(cb.openUntil) {
+		cb.openUntil = time.Now().Add(c.cooldown)
+		warnf("上游代理 %s 连续失败 %d 次，熔断 %s", proxyURL, cb.failures, c.cooldown)
+	}
+}
+
+// checkCircuit 规则的所有上游代理都已熔断时，按 onOpen 返回 503 (rejected) 或改为直连 (direct)
+func checkCircuit(w http.ResponseWriter, id int64, rule *ProxyRule) (rejected, direct bool) {
+	c := config().CircuitBreaker
+	if c == nil || rule == nil || !rule.usesProxy() {
+		return false, false
+	}
+	for _, proxyURL := range rule.proxyURLs() {
+		if c.allow(proxyURL) {
+			return false, false
+		}
+	}
+	if c.OnOpen == "direct" {
+		warnf("id:%d 规则 %s 的上游代理已熔断，改为直连", id, ruleName(rule))
+		return false, true
+	}
+	warnf("id:%d 规则 %s 的上游代理已熔断", id, ruleName(rule))
+	w.Header().Set("Retry-After", fmt.Sprint(int(c.cooldown.Seconds())))
+	http.Error(w, "上游代理暂时不可用", http.StatusServiceUnavailable)
+	return true, false
+}
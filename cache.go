@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig 响应缓存的存储设置，规则上设置 cacheTtl 后才缓存该规则的响应
+type CacheConfig struct {
+	MaxSize      string `xml:"maxSize,attr,omitempty"`      // 缓存总大小，默认 256MB
+	MaxEntrySize string `xml:"maxEntrySize,attr,omitempty"` // 单个响应的最大大小，默认 10MB
+	Dir          string `xml:"dir,attr,omitempty"`          // 保存到该目录，重启后仍然有效；为空时只保存在内存中
+
+	maxSize, maxEntrySize int64
+}
+
+func (c *CacheConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	var err error
+	if c.maxSize, err = parseLimit("cache maxSize", c.MaxSize); err != nil {
+		return err
+	}
+	c.maxEntrySize, err = parseLimit("cache maxEntrySize", c.MaxEntrySize)
+	return err
+}
+
+func (c *CacheConfig) limits() (maxSize, maxEntrySize int64, dir string) {
+	maxSize, maxEntrySize = 256<<20, 10<<20
+	if c == nil {
+		return
+	}
+	if c.maxSize > 0 {
+		maxSize = c.maxSize
+	}
+	if c.maxEntrySize > 0 {
+		maxEntrySize = c.maxEntrySize
+	}
+	return maxSize, maxEntrySize, c.Dir
+}
+
+// 可以缓存的状态码
+var cacheableStatus = map[int]bool{200: true, 203: true, 301: true, 404: true, 410: true}
+
+// cacheEntry 缓存的上游响应；保存到目录时 Body 在文件中，内存中只有元数据
+type cacheEntry struct {
+	Key     string            `json:"key"`
+	URL     string            `json:"url,omitempty"`
+	Status  int               `json:"status"`
+	Header  http.Header       `json:"header"`
+	Vary    map[string]string `json:"vary,omitempty"` // Vary 中列出的请求头在缓存时的值
+	Stored  time.Time         `json:"stored"`
+	Expires time.Time         `json:"expires"`
+	Size    int64             `json:"size"`
+
+	body []byte
+	elem *list.Element
+}
+
+// responseCache 按目标地址和 Vary 列出的请求头缓存响应，超过总大小时淘汰最久未使用的
+type responseCache struct {
+	mu      sync.Mutex
+	dir     string
+	entries map[string]*cacheEntry
+	vary    map[string]*varyIndex // 地址 -> 最近一次响应的 Vary 请求头，用于计算查找时的 key
+	lru     *list.List
+	size    int64
+}
+
+type varyIndex struct {
+	names []string
+	n     int // 该地址缓存的版本数，为 0 时删除
+}
+
+// variantKey 同一地址按 Vary 中列出的请求头的值分开缓存
+func variantKey(url string, vary map[string]string) string {
+	if len(vary) == 0 {
+		return url
+	}
+	var b strings.Builder
+	b.WriteString(url)
+	for _, name := range slices.Sorted(maps.Keys(vary)) {
+		b.WriteString("\n" + name + ": " + vary[name])
+	}
+	return b.String()
+}
+
+// lookupKey 按该地址上次响应的 Vary 计算请求对应的 key
+func (c *responseCache) lookupKey(url string, r *http.Request) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := c.vary[url]
+	if v == nil {
+		return url
+	}
+	vary := map[string]string{}
+	for _, name := range v.names {
+		vary[name] = r.Header.Get(name)
+	}
+	return variantKey(url, vary)
+}
+
+// index 调用方持有锁
+func (c *responseCache) index(e *cacheEntry, delta int) {
+	url := e.URL
+	if url == "" {
+		url = e.Key
+	}
+	v := c.vary[url]
+	if v == nil {
+		v = &varyIndex{}
+		c.vary[url] = v
+	}
+	if delta > 0 {
+		v.names = slices.Sorted(maps.Keys(e.Vary))
+	}
+	if v.n += delta; v.n <= 0 {
+		delete(c.vary, url)
+	}
+}
+
+var caches = struct {
+	sync.Mutex
+	c *responseCache
+}{}
+
+// sharedCache 配置重新加载时保留已有的缓存，只有 dir 修改时才重新创建
+func sharedCache(dir string) *responseCache {
+	caches.Lock()
+	defer caches.Unlock()
+	if caches.c == nil || caches.c.dir != dir {
+		caches.c = newResponseCache(dir)
+	}
+	return caches.c
+}
+
+func newResponseCache(dir string) *responseCache {
+	c := &responseCache{dir: dir, entries: map[string]*cacheEntry{}, vary: map[string]*varyIndex{}, lru: list.New()}
+	if dir == "" {
+		return c
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		warnf("创建缓存目录失败: %v", err)
+		c.dir = ""
+		return c
+	}
+	// 载入目录中已有缓存的元数据
+	files, _ := filepath.Glob(filepath.Join(dir, "*.cache"))
+	for _, f := range files {
+		e, err := readCacheMeta(f)
+		if err != nil {
+			os.Remove(f)
+			continue
+		}
+		e.elem = c.lru.PushFront(e)
+		c.entries[e.Key] = e
+		c.index(e, 1)
+		c.size += e.Size
+	}
+	return c
+}
+
+func (c *responseCache) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".cache")
+}
+
+// 缓存文件的第一行是 JSON 元数据，之后是响应体
+func readCacheMeta(path string) (*cacheEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	e := &cacheEntry{}
+	if err := json.Unmarshal(line, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// get 返回与请求匹配的缓存及其响应体
+func (c *responseCache) get(key string, r *http.Request) (*cacheEntry, []byte) {
+	c.mu.Lock()
+	e := c.entries[key]
+	if e == nil || !e.matches(r) {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	c.lru.MoveToFront(e.elem)
+	body := e.body
+	c.mu.Unlock()
+	if c.dir == "" {
+		return e, body
+	}
+	b, err := os.ReadFile(c.file(key))
+	if err != nil {
+		c.remove(key)
+		return nil, nil
+	}
+	_, body, _ = bytes.Cut(b, []byte("\n"))
+	return e, body
+}
+
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for k, v := range e.Vary {
+		if r.Header.Get(k) != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *responseCache) put(e *cacheEntry, body []byte, maxSize int64) {
+	e.Size = int64(len(body))
+	if c.dir != "" {
+		meta, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		path := c.file(e.Key)
+		tmp := path + ".tmp"
+		data := append(append(meta, '\n'), body...)
+		if err := os.WriteFile(tmp, data, 0o644); err != nil {
+			warnf("写入缓存文件失败: %v", err)
+			return
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return
+		}
+	} else {
+		e.body = body
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.entries[e.Key]; old != nil {
+		c.lru.Remove(old.elem)
+		c.index(old, -1)
+		c.size -= old.Size
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.Key] = e
+	c.index(e, 1)
+	c.size += e.Size
+	for c.size > maxSize && c.lru.Len() > 1 {
+		c.evict(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+func (c *responseCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.entries[key]; e != nil {
+		c.evict(e)
+	}
+}
+
+// evict 调用方持有锁
+func (c *responseCache) evict(e *cacheEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.Key)
+	c.index(e, -1)
+	c.size -= e.Size
+	if c.dir != "" {
+		os.Remove(c.file(e.Key))
+	}
+}
+
+// withCache 规则设置了 cacheTtl 时在 Transport 外层缓存 GET 响应，缓存的是上游的原始响应，改写等步骤每次重新执行
+func withCache(base http.RoundTripper, id int64, rule *ProxyRule, reqLog *requestLog) http.RoundTripper {
+	if rule == nil || rule.cacheTTL <= 0 {
+		return base
+	}
+	maxSize, maxEntrySize, dir := config().Cache.limits()
+	return &cacheTransport{base: base, cache: sharedCache(dir), ttl: rule.cacheTTL, maxSize: maxSize, maxEntrySize: maxEntrySize, id: id, log: reqLog}
+}
+
+type cacheTransport struct {
+	base                  http.RoundTripper
+	cache                 *responseCache
+	ttl                   time.Duration
+	maxSize, maxEntrySize int64
+	id                    int64
+	log                   *requestLog
+}
+
+func (t *cacheTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" || isUpgrade(r) {
+		return t.base.RoundTrip(r)
+	}
+	reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+	if _, ok := reqCC["no-store"]; ok {
+		return t.base.RoundTrip(r)
+	}
+	url := r.URL.String()
+	key := t.cache.lookupKey(url, r)
+	_, noCache := reqCC["no-cache"]
+	noCache = noCache || r.Header.Get("Pragma") == "no-cache"
+	cached, body := t.cache.get(key, r)
+	if cached != nil && !noCache && time.Now().Before(cached.Expires) {
+		t.log.printf("id:%d cache hit %s", t.id, key)
+		return cached.response(r, body, "HIT"), nil
+	}
+
+	// 过期的缓存带上 ETag/Last-Modified 向上游确认，未修改时上游返回 304，不需要重新传输响应体
+	out := r
+	if cached != nil && cached.revalidatable() && !isConditional(r) {
+		out = r.Clone(r.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if lm := cached.Header.Get("Last-Modified"); lm != "" {
+			out.Header.Set("If-Modified-Since", lm)
+		}
+	}
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	if out != r && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		t.log.printf("id:%d cache revalidated %s", t.id, key)
+		return t.refresh(cached, body, r, resp), nil
+	}
+	e := t.newEntry(url, r, resp)
+	if e == nil {
+		return resp, nil
+	}
+	resp.Header.Set("X-Cache", "MISS")
+	resp.Body = &cacheBody{ReadCloser: resp.Body, t: t, e: e}
+	return resp, nil
+}
+
+// refresh 304 响应中的头更新到缓存，重新计算有效期后用缓存的响应体返回
+func (t *cacheTransport) refresh(e *cacheEntry, body []byte, r *http.Request, resp *http.Response) *http.Response {
+	h := e.Header.Clone()
+	for k, v := range resp.Header {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Type":
+		default:
+			h[k] = v
+		}
+	}
+	updated := &http.Response{StatusCode: e.Status, Header: h}
+	url := e.URL
+	if url == "" {
+		url = e.Key
+	}
+	if ne := t.newEntry(url, r, updated); ne != nil {
+		if ne.Key != e.Key {
+			t.cache.remove(e.Key)
+		}
+		t.cache.put(ne, body, t.maxSize)
+		e = ne
+	} else {
+		t.cache.remove(e.Key)
+	}
+	return e.response(r, body, "REVALIDATED")
+}
+
+// revalidatable 缓存带有 ETag 或 Last-Modified，过期后可以向上游确认
+func (e *cacheEntry) revalidatable() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// isConditional 客户端自己发送的条件请求，304 响应直接返回给客户端
+func isConditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// newEntry 按 Cache-Control、Expires 和规则的 cacheTtl 计算有效期，不能缓存时返回 nil；
+// no-cache 或已经过期但带有 ETag/Last-Modified 的响应也会缓存，每次使用前向上游确认
+func (t *cacheTransport) newEntry(url string, r *http.Request, resp *http.Response) *cacheEntry {
+	if !cacheableStatus[resp.StatusCode] || resp.Header.Get("Set-Cookie") != "" || resp.ContentLength > t.maxEntrySize {
+		return nil
+	}
+	cc := parseCacheControl(resp.Header.Get("Cache-Control"))
+	for _, k := range []string{"no-store", "private"} {
+		if _, ok := cc[k]; ok {
+			return nil
+		}
+	}
+	_, public := cc["public"]
+	_, shared := cc["s-maxage"]
+	// 缓存由所有客户端共享，带认证或 Cookie 的请求可能得到个性化的内容，只有明确允许共享时才缓存
+	if (r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "") && !public && !shared {
+		return nil
+	}
+	now := time.Now()
+	ttl := t.ttl
+	if s, ok := cc["s-maxage"]; ok {
+		ttl = parseSeconds(s)
+	} else if s, ok := cc["max-age"]; ok {
+		ttl = parseSeconds(s)
+	} else if exp, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		ttl = exp.Sub(now)
+	}
+	if _, ok := cc["no-cache"]; ok {
+		ttl = 0
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	if ttl == 0 && resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "" {
+		return nil
+	}
+	vary := map[string]string{}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+			if h == "*" {
+				return nil
+			}
+			if h != "" {
+				vary[h] = r.Header.Get(h)
+			}
+		}
+	}
+	return &cacheEntry{Key: variantKey(url, vary), URL: url, Status: resp.StatusCode, Header: resp.Header.Clone(), Vary: vary, Stored: now, Expires: now.Add(ttl)}
+}
+
+// response 用缓存构造响应，Age 是缓存的时间，X-Cache 为 HIT 或 REVALIDATED
+func (e *cacheEntry) response(r *http.Request, body []byte, state string) *http.Response {
+	h := e.Header.Clone()
+	h.Set("Age", strconv.Itoa(int(time.Since(e.Stored).Seconds())))
+	h.Set("X-Cache", state)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+// cacheBody 在转发响应体的同时保存一份，完整读完后写入缓存；超过大小或中途断开时放弃
+type cacheBody struct {
+	io.ReadCloser
+	t    *cacheTransport
+	e    *cacheEntry
+	buf  bytes.Buffer
+	skip bool
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.skip {
+		if int64(b.buf.Len()+n) > b.t.maxEntrySize {
+			b.skip = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.skip {
+		b.skip = true
+		b.t.cache.put(b.e, b.buf.Bytes(), b.t.maxSize)
+	} else if err != nil && err != io.EOF {
+		b.skip = true
+	}
+	return n, err
+}
+
+func parseCacheControl(v string) map[string]string {
+	cc := map[string]string{}
+	for _, part := range strings.Split(v, ",") {
+		k, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+			cc[k] = strings.Trim(strings.TrimSpace(val), `"`)
+		}
+	}
+	return cc
+}
+
+func parseSeconds(s string) time.Duration {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// purgeCache 清空缓存，管理接口使用
+func purgeCache() int {
+	caches.Lock()
+	c := caches.c
+	caches.Unlock()
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	for _, e := range c.entries {
+		c.evict(e)
+	}
+	log.Printf("已清空 %d 个缓存", n)
+	return n
+}
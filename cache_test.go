@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingUpstream 记录请求次数，按请求头返回内容
+type countingUpstream struct {
+	calls  int
+	header http.Header
+}
+
+func (u *countingUpstream) RoundTrip(r *http.Request) (*http.Response, error) {
+	u.calls++
+	body := "user=" + r.Header.Get("Cookie") + " enc=" + r.Header.Get("Accept-Encoding")
+	return &http.Response{StatusCode: http.StatusOK, Header: u.header.Clone(), Body: io.NopCloser(strings.NewReader(body)), ContentLength: int64(len(body)), Request: r}, nil
+}
+
+func newTestCache(up *countingUpstream) *cacheTransport {
+	return &cacheTransport{base: up, cache: newResponseCache(""), ttl: time.Minute, maxSize: 1 << 20, maxEntrySize: 1 << 20, log: &requestLog{mode: logModeOff}}
+}
+
+func fetch(t *testing.T, ct *cacheTransport, header map[string]string) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	resp, err := ct.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return string(b)
+}
+
+func TestCacheSkipsCookieRequests(t *testing.T) {
+	up := &countingUpstream{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	ct := newTestCache(up)
+	alice := fetch(t, ct, map[string]string{"Cookie": "session=alice"})
+	if got := fetch(t, ct, map[string]string{"Cookie": "session=bob"}); got == alice {
+		t.Fatalf("bob got alice's page %q", got)
+	}
+	if up.calls != 2 {
+		t.Fatalf("upstream calls = %d, want 2", up.calls)
+	}
+
+	up = &countingUpstream{header: http.Header{"Cache-Control": {"public, max-age=60"}}}
+	ct = newTestCache(up)
+	fetch(t, ct, map[string]string{"Cookie": "session=alice"})
+	fetch(t, ct, map[string]string{"Cookie": "session=bob"})
+	if up.calls != 1 {
+		t.Fatalf("public response: upstream calls = %d, want 1", up.calls)
+	}
+}
+
+func TestCacheVaryKey(t *testing.T) {
+	up := &countingUpstream{header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}}}
+	ct := newTestCache(up)
+	gzip := fetch(t, ct, map[string]string{"Accept-Encoding": "gzip"})
+	plain := fetch(t, ct, map[string]string{"Accept-Encoding": "identity"})
+	if got := fetch(t, ct, map[string]string{"Accept-Encoding": "gzip"}); got != gzip {
+		t.Fatalf("gzip variant = %q, want %q", got, gzip)
+	}
+	if got := fetch(t, ct, map[string]string{"Accept-Encoding": "identity"}); got != plain {
+		t.Fatalf("identity variant = %q, want %q", got, plain)
+	}
+	if up.calls != 2 {
+		t.Fatalf("upstream calls = %d, want 2", up.calls)
+	}
+	if n := len(ct.cache.entries); n != 2 {
+		t.Fatalf("cached variants = %d, want 2", n)
+	}
+	purgeCacheEntries(ct.cache)
+	if n := len(ct.cache.vary); n != 0 {
+		t.Fatalf("vary index not cleaned up: %d", n)
+	}
+}
+
+func purgeCacheEntries(c *responseCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		c.evict(e)
+	}
+}
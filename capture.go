@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// CaptureConfig 抓包模式的存储限制: 最多保留 maxEntries 个请求(默认 500)，每个请求体/响应体最多保存 maxBodySize(默认 1MB)。
+// 规则上 capture="true" 或通过管理接口开启后记录发往上游的完整请求和上游返回的响应，可以导出为 HAR 文件
+type CaptureConfig struct {
+	MaxEntries  int    `xml:"maxEntries,attr,omitempty"`
+	MaxBodySize string `xml:"maxBodySize,attr,omitempty"`
+
+	maxBody int64
+}
+
+func (c *CaptureConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("capture maxEntries 不能为负数")
+	}
+	var err error
+	c.maxBody, err = parseLimit("capture maxBodySize", c.MaxBodySize)
+	return err
+}
+
+func captureLimits() (entries int, body int64) {
+	entries, body = 500, 1<<20
+	if c := config().Capture; c != nil {
+		if c.MaxEntries > 0 {
+			entries = c.MaxEntries
+		}
+		if c.maxBody > 0 {
+			body = c.maxBody
+		}
+	}
+	return entries, body
+}
+
+// captureAll 通过管理接口开启后记录所有请求，重启后恢复关闭
+var captureAll atomic.Bool
+
+// withCapture 规则或管理接口开启抓包时包装 Transport，记录实际发往上游的请求
+func withCapture(base http.RoundTripper, rule *ProxyRule) http.RoundTripper {
+	if !captureAll.Load() && (rule == nil || !rule.Capture) {
+		return base
+	}
+	return &captureTransport{base: base}
+}
+
+type captureTransport struct {
+	base http.RoundTripper
+}
+
+func (t *captureTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	_, max := captureLimits()
+	start := time.Now()
+	e := &harEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         r.URL.String(),
+			HTTPVersion: r.Proto,
+			Headers:     harHeaders(r.Header),
+			QueryString: []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    r.ContentLength,
+		},
+		Cache: struct{}{},
+	}
+	if r.Host != "" && r.Header.Get("Host") == "" {
+		e.Request.Headers = append([]harNameValue{{"Host", r.Host}}, e.Request.Headers...)
+	}
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{k, v})
+		}
+	}
+	var reqBody *cappedBuffer
+	if r.Body != nil && r.Body != http.NoBody {
+		reqBody = &cappedBuffer{max: max}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, reqBody), r.Body}
+	}
+	// 请求体由 Transport 在后台发送，记录时再读取
+	postData := func() {
+		if reqBody != nil {
+			text, enc, comment := reqBody.content("")
+			e.Request.BodySize = reqBody.size()
+			e.Request.PostData = &harPostData{MimeType: r.Header.Get("Content-Type"), Text: text, Encoding: enc, Comment: comment}
+		}
+	}
+	resp, err := t.base.RoundTrip(r)
+	wait := time.Since(start)
+	if err != nil {
+		e.Response = harResponse{Headers: []harNameValue{}, Cookies: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+		e.Comment = "转发失败: " + err.Error()
+		e.Timings = harTimings{Wait: ms(wait)}
+		e.Time = ms(wait)
+		postData()
+		recordCapture(e)
+		return resp, err
+	}
+	e.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Headers:     harHeaders(resp.Header),
+		Cookies:     []harNameValue{},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+	}
+	// 切换协议后 Body 是双向连接，不能包装
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil || resp.Body == http.NoBody {
+		e.Timings = harTimings{Wait: ms(wait)}
+		e.Time = ms(wait)
+		postData()
+		recordCapture(e)
+		return resp, nil
+	}
+	buf := &cappedBuffer{max: max}
+	var once sync.Once
+	finish := func() {
+		once.Do(func() {
+			total := time.Since(start)
+			e.Response.BodySize = buf.size()
+			e.Response.Content.Size = buf.size()
+			e.Response.Content.Text, e.Response.Content.Encoding, e.Response.Content.Comment = buf.content(resp.Header.Get("Content-Encoding"))
+			e.Timings = harTimings{Wait: ms(wait), Receive: ms(total - wait)}
+			e.Time = ms(total)
+			postData()
+			recordCapture(e)
+		})
+	}
+	resp.Body = &captureBody{ReadCloser: resp.Body, buf: buf, finish: finish}
+	return resp, nil
+}
+
+// captureBody 响应体读完或关闭时记录
+type captureBody struct {
+	io.ReadCloser
+	buf    *cappedBuffer
+	finish func()
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+// cappedBuffer 最多保存 max 字节，total 记录实际大小
+type cappedBuffer struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	max   int64
+	total int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.total += int64(len(p))
+	if room := b.max - int64(b.buf.Len()); room > 0 {
+		b.buf.Write(p[:min(int64(len(p)), room)])
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
+
+// content 完整保存的 gzip/deflate 内容先解压；UTF-8 文本原样保存，其他内容使用 base64
+func (b *cappedBuffer) content(encoding string) (text, enc, comment string) {
+	b.mu.Lock()
+	data := bytes.Clone(b.buf.Bytes())
+	truncated := b.total > int64(len(data))
+	b.mu.Unlock()
+	if !truncated {
+		var zr io.Reader
+		switch strings.ToLower(strings.TrimSpace(encoding)) {
+		case "gzip":
+			zr, _ = gzip.NewReader(bytes.NewReader(data))
+		case "deflate":
+			zr, _ = zlib.NewReader(bytes.NewReader(data))
+		}
+		if zr != nil {
+			if plain, err := io.ReadAll(zr); err == nil {
+				data = plain
+			}
+		}
+	}
+	if truncated {
+		comment = fmt.Sprintf("内容过大，只保存了前 %d 字节", len(data))
+	}
+	if utf8.Valid(data) {
+		return string(data), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64", comment
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	list := []harNameValue{}
+	for k, vs := range h {
+		for _, v := range vs {
+			list = append(list, harNameValue{k, v})
+		}
+	}
+	return list
+}
+
+// HAR 1.2 格式，只包含代理能够得到的字段
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+// captured 抓到的请求，按完成顺序保存，超过上限后覆盖最早的
+var captured = struct {
+	sync.Mutex
+	entries []*harEntry
+	next    int
+}{}
+
+func recordCapture(e *harEntry) {
+	limit, _ := captureLimits()
+	captured.Lock()
+	defer captured.Unlock()
+	if len(captured.entries) > limit {
+		captured.entries, captured.next = nil, 0
+	}
+	if len(captured.entries) < limit {
+		captured.entries = append(captured.entries, e)
+		return
+	}
+	captured.entries[captured.next] = e
+	captured.next = (captured.next + 1) % limit
+}
+
+// capturedEntries 按开始时间先后返回
+func capturedEntries() []*harEntry {
+	captured.Lock()
+	defer captured.Unlock()
+	n := len(captured.entries)
+	list := make([]*harEntry, 0, n)
+	for i := 0; i < n; i++ {
+		list = append(list, captured.entries[(captured.next+i)%n])
+	}
+	return list
+}
+
+// adminCapture 管理接口: GET 抓包状态，POST ?enabled=true|false 开启或关闭所有请求的抓包，DELETE 清空记录
+func adminCapture(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "需要 enabled"})
+			return
+		}
+		captureAll.Store(enabled)
+	case http.MethodDelete:
+		captured.Lock()
+		captured.entries, captured.next = nil, 0
+		captured.Unlock()
+	default:
+		writeEditError(w, errMethod)
+		return
+	}
+	captured.Lock()
+	n := len(captured.entries)
+	captured.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"enabled": captureAll.Load(), "entries": n})
+}
+
+// adminCaptureHAR 管理接口: GET 导出抓到的请求为 HAR 文件，可以导入浏览器开发者工具或 HAR 查看器
+func adminCaptureHAR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeEditError(w, errMethod)
+		return
+	}
+	har := map[string]any{"log": map[string]any{
+		"version": "1.2",
+		"creator": map[string]string{"name": "r-proxy", "version": "1.0"},
+		"entries": capturedEntries(),
+	}}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="r-proxy.har"`)
+	json.NewEncoder(w).Encode(har)
+}
+
+func init() {
+	adminMux.HandleFunc("/api/capture", adminCapture)
+	adminMux.HandleFunc("/api/capture/har", adminCaptureHAR)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"compress/gzip"
+	"embed"
+	"encoding/binary"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// 双字节码表，由 charset/gen_tables.py 生成
+//
+//go:embed charset/*.bin.gz
+var charsetFS embed.FS
+
+const (
+	dbcsTrailMin = 0x40
+	dbcsTrailMax = 0xFE
+	dbcsWidth    = dbcsTrailMax - dbcsTrailMin + 1
+)
+
+type dbcsTable struct {
+	once  sync.Once
+	file  string
+	table []uint16
+}
+
+var (
+	gbkTable  = &dbcsTable{file: "charset/gbk.bin.gz"}
+	big5Table = &dbcsTable{file: "charset/big5.bin.gz"}
+)
+
+// charsetTables 支持转码的字符集，GB2312 是 GBK 的子集
+var charsetTables = map[string]*dbcsTable{
+	"gbk":        gbkTable,
+	"gb2312":     gbkTable,
+	"gb_2312-80": gbkTable,
+	"cp936":      gbkTable,
+	"x-gbk":      gbkTable,
+	"big5":       big5Table,
+	"big5-hkscs": big5Table,
+	"x-x-big5":   big5Table,
+}
+
+func (t *dbcsTable) load() []uint16 {
+	t.once.Do(func() {
+		f, err := charsetFS.Open(t.file)
+		if err != nil {
+			log.Printf("加载码表 %s 失败: %v", t.file, err)
+			return
+		}
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			log.Printf("加载码表 %s 失败: %v", t.file, err)
+			return
+		}
+		b, err := io.ReadAll(zr)
+		if err != nil {
+			log.Printf("加载码表 %s 失败: %v", t.file, err)
+			return
+		}
+		t.table = make([]uint16, len(b)/2)
+		for i := range t.table {
+			t.table[i] = binary.LittleEndian.Uint16(b[i*2:])
+		}
+	})
+	return t.table
+}
+
+// decode 将双字节编码转换为 UTF-8，无法识别的字节替换为 U+FFFD
+func (t *dbcsTable) decode(src []byte) []byte {
+	table := t.load()
+	out := make([]byte, 0, len(src)*3/2)
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if c < 0x80 {
+			out = append(out, c)
+			continue
+		}
+		if c == 0x80 && t == gbkTable {
+			out = utf8.AppendRune(out, '€')
+			continue
+		}
+		if c >= 0x81 && c <= 0xFE && i+1 < len(src) {
+			trail := src[i+1]
+			if trail >= dbcsTrailMin && trail <= dbcsTrailMax {
+				if r := table[int(c-0x81)*dbcsWidth+int(trail-dbcsTrailMin)]; r != 0 {
+					out = utf8.AppendRune(out, rune(r))
+					i++
+					continue
+				}
+			}
+		}
+		out = utf8.AppendRune(out, utf8.RuneError)
+	}
+	return out
+}
+
+var (
+	metaCharsetRe = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-z0-9_\-]+)`)
+	xmlEncodingRe = regexp.MustCompile(`(?i)^\s*<\?xml[^>]+encoding\s*=\s*["']([a-z0-9_\-]+)["']`)
+)
+
+// detectCharset 优先使用 Content-Type 中的 charset，其次是 HTML meta 标签或 XML 声明
+func detectCharset(contentType string, body []byte) string {
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		return strings.ToLower(params["charset"])
+	}
+	head := body
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if m := xmlEncodingRe.FindSubmatch(head); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+	if m := metaCharsetRe.FindSubmatch(head); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+	return ""
+}
+
+// applyTranscode 将 GBK/GB2312/Big5 的文本响应转为 UTF-8，并修正 Content-Type 和 meta 标签
+func applyTranscode(id int64, rule *ProxyRule, resp *http.Response) error {
+	if rule == nil || !rule.Transcode || !isIdentityEncoding(resp) {
+		return nil
+	}
+	ct := resp.Header.Get("Content-Type")
+	if !matchTypes(parseTypeList(""), ct) {
+		return nil
+	}
+	body, ok, err := readBodyLimited(resp, defaultRewriteMaxSize)
+	if err != nil || !ok {
+		return err
+	}
+	cs := detectCharset(ct, body)
+	table, found := charsetTables[cs]
+	if !found {
+		setBody(resp, body)
+		return nil
+	}
+	out := table.decode(body)
+	// 替换文档中声明的编码，避免浏览器按原编码再次解码
+	head := out
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if loc := metaCharsetRe.FindSubmatchIndex(head); loc != nil {
+		out = append(out[:loc[2]:loc[2]], append([]byte("utf-8"), out[loc[3]:]...)...)
+	} else if loc := xmlEncodingRe.FindSubmatchIndex(head); loc != nil {
+		out = append(out[:loc[2]:loc[2]], append([]byte("utf-8"), out[loc[3]:]...)...)
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mediaType, params = "text/html", map[string]string{}
+	}
+	params["charset"] = "utf-8"
+	resp.Header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	setBody(resp, out)
+	log.Printf("id:%d 响应已从 %s 转码为 UTF-8", id, cs)
+	return nil
+}
@@ -0,0 +1,21 @@
+#!/usr/bin/env python3
+# 生成 GBK / Big5 双字节码表，输出到当前目录的 gbk.bin.gz 和 big5.bin.gz
+# 表结构: 首字节 0x81-0xFE、尾字节 0x40-0xFE 共 126*191 项，每项为 UTF-16 码元(小端)，0 表示无效
+import gzip
+import struct
+
+def table(codec):
+    out = bytearray()
+    for lead in range(0x81, 0xFF):
+        for trail in range(0x40, 0xFF):
+            try:
+                ch = bytes([lead, trail]).decode(codec)
+                cp = ord(ch) if len(ch) == 1 and ord(ch) <= 0xFFFF else 0
+            except UnicodeDecodeError:
+                cp = 0
+            out += struct.pack('<H', cp)
+    return bytes(out)
+
+for name, codec in (('gbk', 'gbk'), ('big5', 'big5')):
+    with gzip.GzipFile(name + '.bin.gz', 'wb', mtime=0) as f:
+        f.write(table(codec))
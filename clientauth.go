@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ClientAuthConfig 要求客户端提供用户名和密码才能使用代理。mode="proxy" 使用 Proxy-Authorization(浏览器和 curl -x 的代理认证)，
+// mode="basic" 使用 Authorization，默认 auto: CONNECT 和绝对地址的请求按代理认证，/https://... 形式的请求按 Basic 认证
+type ClientAuthConfig struct {
+	Mode  string       `xml:"mode,attr,omitempty"`  // auto(默认)、proxy 或 basic
+	Realm string       `xml:"realm,attr,omitempty"` // 默认 r-proxy
+	Users []ClientUser `xml:"user"`
+}
+
+// ClientUser 一个账号，password 可以写成 sha256:<十六进制摘要>，不在配置中保存明文
+type ClientUser struct {
+	Name     string `xml:"name,attr"`
+	Password string `xml:"password,attr"`
+}
+
+func (c *ClientAuthConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	switch c.Mode {
+	case "", "auto", "proxy", "basic":
+	default:
+		return fmt.Errorf("clientAuth mode 只能是 auto、proxy 或 basic: %q", c.Mode)
+	}
+	if len(c.Users) == 0 {
+		return errors.New("clientAuth 至少需要一个 user")
+	}
+	for _, u := range c.Users {
+		if u.Name == "" || u.Password == "" {
+			return errors.New("clientAuth 的 user 需要 name 和 password")
+		}
+	}
+	return nil
+}
+
+// check 校验用户名和密码
+func (c *ClientAuthConfig) check(name, password string) bool {
+	for _, u := range c.Users {
+		if u.Name != name {
+			continue
+		}
+		if digest, ok := strings.CutPrefix(u.Password, "sha256:"); ok {
+			sum := sha256.Sum256([]byte(password))
+			return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(digest))) == 1
+		}
+		return subtle.ConstantTimeCompare([]byte(password), []byte(u.Password)) == 1
+	}
+	return false
+}
+
+type clientUserKey struct{}
+
+// clientUser 通过认证的用户名，未开启认证时为空
+func clientUser(r *http.Request) string {
+	u, _ := r.Context().Value(clientUserKey{}).(string)
+	return u
+}
+
+// clientAuth 在处理请求之前校验客户端账号或 API 密钥；健康检查和分享链接不需要认证
+func clientAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := config()
+		c := cfg.ClientAuth
+		if c == nil && len(cfg.APIKeys) == 0 || r.URL.Path == healthzPath || r.URL.Path == readyzPath || strings.HasPrefix(r.URL.Path, sharePrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// 代理自己的认证信息不转发给目标站点
+		if k, header := findAPIKey(r); k != nil {
+			r.Header.Del(header)
+			next.ServeHTTP(w, withAPIKey(r, k))
+			return
+		}
+		mode, realm := "auto", "r-proxy"
+		if c != nil {
+			mode = c.Mode
+			if c.Realm != "" {
+				realm = c.Realm
+			}
+		}
+		proxyAuth := mode == "proxy" || mode != "basic" && (r.Method == http.MethodConnect || r.URL.IsAbs())
+		header, challenge, status := "Authorization", "WWW-Authenticate", http.StatusUnauthorized
+		if proxyAuth {
+			header, challenge, status = "Proxy-Authorization", "Proxy-Authenticate", http.StatusProxyAuthRequired
+		}
+		name, password, ok := parseBasicAuth(r.Header.Get(header))
+		if c == nil || !ok || !c.check(name, password) {
+			if ok {
+				warnf("客户端 %s 的用户 %q 认证失败", clientIP(r), name)
+			}
+			w.Header().Set(challenge, fmt.Sprintf("Basic realm=%q", realm))
+			http.Error(w, "需要登录后使用代理", status)
+			return
+		}
+		r.Header.Del(header)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientUserKey{}, name)))
+	})
+}
+
+func parseBasicAuth(v string) (name, password string, ok bool) {
+	const prefix = "Basic "
+	if len(v) < len(prefix) || !strings.EqualFold(v[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+)
+
+func (c *ProxyConfig) initClientNetworks() error {
+	var err error
+	if c.allowClients, err = parseNetworks("allowClients", c.AllowClients); err != nil {
+		return err
+	}
+	c.denyClients, err = parseNetworks("denyClients", c.DenyClients)
+	return err
+}
+
+// clientAllowed 客户端地址不在 denyClients 中，并且 allowClients 为空或包含该地址
+func clientAllowed(r *http.Request) bool {
+	c := config()
+	if len(c.allowClients) == 0 && len(c.denyClients) == 0 {
+		return true
+	}
+	ip, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return false
+	}
+	if inNetworks(ip, c.denyClients) {
+		return false
+	}
+	return len(c.allowClients) == 0 || inNetworks(ip, c.allowClients)
+}
+
+// clientFilter 在处理任何请求之前按客户端地址拒绝，避免能访问端口的人借用本机和上游代理
+func clientFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !clientAllowed(r) {
+			warnf("拒绝客户端 %s 的请求 %s %s", clientIP(r), r.Method, r.URL)
+			http.Error(w, "客户端地址不允许使用代理", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterConfig 集群模式: 各实例通过管理接口互相探测，ID 最小的存活节点作为主节点分发配置，
+// 短链接和规则等管理接口的修改会推送到所有节点。所有节点使用相同的配置文件和管理 token
+type ClusterConfig struct {
+	Interval string   `xml:"interval,attr,omitempty"` // 探测间隔，默认 5s
+	Peers    []string `xml:"peer"`                    // 各节点管理接口地址，如 http://10.0.0.2:3001，可以包含自身
+}
+
+// clusterNodeID 节点 ID，默认为主机名，可通过环境变量 R_PROXY_NODE 指定
+var clusterNodeID = func() string {
+	if id := os.Getenv("R_PROXY_NODE"); id != "" {
+		return id
+	}
+	h, _ := os.Hostname()
+	return h
+}()
+
+// nodeState 节点之间交换的状态
+type nodeState struct {
+	ID           string `json:"id"`
+	Leader       string `json:"leader"`
+	ConfigHash   string `json:"configHash"`
+	LinksVersion int64  `json:"linksVersion"`
+}
+
+type peerState struct {
+	addr     string
+	state    nodeState
+	alive    bool
+	lastSeen time.Time
+}
+
+var cluster = struct {
+	sync.Mutex
+	peers  map[string]*peerState
+	leader string
+}{peers: map[string]*peerState{}}
+
+var clusterClient = &http.Client{Timeout: 5 * time.Second}
+
+func clusterEnabled() bool {
+	return config().Cluster != nil && len(config().Cluster.Peers) > 0 && config().Admin != nil
+}
+
+func configHash() string {
+	b, err := os.ReadFile(configFile)
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:8])
+}
+
+func localState() nodeState {
+	cluster.Lock()
+	leader := cluster.leader
+	cluster.Unlock()
+	return nodeState{ID: clusterNodeID, Leader: leader, ConfigHash: configHash(), LinksVersion: shortLinkVersion()}
+}
+
+// peerRequest 使用管理 token 调用其他节点的管理接口
+func peerRequest(method, addr, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(addr, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if config().Admin.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config().Admin.Token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := clusterClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return b, err
+}
+
+func startCluster() {
+	if !clusterEnabled() {
+		return
+	}
+	interval := 5 * time.Second
+	if d, err := time.ParseDuration(config().Cluster.Interval); err == nil && d > 0 {
+		interval = d
+	}
+	log.Printf("集群模式，节点 %s，共 %d 个节点地址", clusterNodeID, len(config().Cluster.Peers))
+	go func() {
+		for {
+			clusterTick()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// clusterTick 探测所有节点，选出主节点，并从主节点同步配置、从最新的节点同步短链接
+func clusterTick() {
+	var wg sync.WaitGroup
+	for _, addr := range config().Cluster.Peers {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			b, err := peerRequest(http.MethodGet, addr, "/api/cluster/state", nil)
+			var st nodeState
+			if err == nil {
+				err = json.Unmarshal(b, &st)
+			}
+			cluster.Lock()
+			p := cluster.peers[addr]
+			if p == nil {
+				p = &peerState{addr: addr}
+				cluster.peers[addr] = p
+			}
+			if p.alive && err != nil {
+				warnf("集群节点 %s 不可达: %v", addr, err)
+			}
+			p.alive = err == nil
+			if err == nil {
+				p.state, p.lastSeen = st, time.Now()
+			}
+			cluster.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	cluster.Lock()
+	leader, leaderAddr := clusterNodeID, ""
+	var newest *peerState
+	for _, p := range cluster.peers {
+		if !p.alive || p.state.ID == clusterNodeID {
+			continue
+		}
+		if p.state.ID < leader {
+			leader, leaderAddr = p.state.ID, p.addr
+		}
+		if p.state.LinksVersion > shortLinkVersion() && (newest == nil || p.state.LinksVersion > newest.state.LinksVersion) {
+			newest = p
+		}
+	}
+	var leaderState nodeState
+	if p := cluster.peers[leaderAddr]; p != nil {
+		leaderState = p.state
+	}
+	if cluster.leader != leader {
+		log.Printf("集群主节点: %s", leader)
+		cluster.leader = leader
+	}
+	cluster.Unlock()
+
+	if leaderAddr != "" && leaderState.ConfigHash != "" && leaderState.ConfigHash != configHash() {
+		syncConfigFrom(leaderAddr)
+	}
+	if newest != nil {
+		syncShortLinksFrom(newest.addr)
+	}
+}
+
+// syncConfigFrom 下载主节点的配置文件，写入后由配置监听触发重新加载
+func syncConfigFrom(addr string) {
+	b, err := peerRequest(http.MethodGet, addr, "/api/cluster/config", nil)
+	if err != nil {
+		warnf("从主节点同步配置失败: %v", err)
+		return
+	}
+	tmp := configFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		warnf("写入同步的配置失败: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, configFile); err != nil {
+		warnf("写入同步的配置失败: %v", err)
+		return
+	}
+	systemEvent(eventInfo, "已从集群主节点同步配置")
+}
+
+func syncShortLinksFrom(addr string) {
+	b, err := peerRequest(http.MethodGet, addr, "/api/cluster/shortlinks", nil)
+	if err != nil {
+		warnf("同步短链接失败: %v", err)
+		return
+	}
+	var snap shortLinkSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		warnf("同步短链接失败: %v", err)
+		return
+	}
+	replaceShortLinks(snap)
+}
+
+// replicateShortLinks 管理接口修改短链接后推送给其他节点
+func replicateShortLinks() {
+	if !clusterEnabled() {
+		return
+	}
+	b, _ := json.Marshal(currentShortLinks())
+	for _, addr := range config().Cluster.Peers {
+		go func(addr string) {
+			if _, err := peerRequest(http.MethodPut, addr, "/api/cluster/shortlinks", b); err != nil {
+				warnf("推送短链接到 %s 失败: %v", addr, err)
+			}
+		}(addr)
+	}
+}
+
+// replicateConfig 管理接口修改配置后推送给其他节点，persist 时各节点同时写回配置文件，
+// 保证配置文件与主节点一致，不会在下次探测时被主节点的配置覆盖
+func replicateConfig(c *ProxyConfig, persist bool) {
+	if !clusterEnabled() {
+		return
+	}
+	b, err := xml.Marshal(c)
+	if err != nil {
+		warnf("推送配置失败: %v", err)
+		return
+	}
+	path := "/api/cluster/config?persist=" + strconv.FormatBool(persist)
+	cluster.Lock()
+	self := map[string]bool{}
+	for addr, p := range cluster.peers {
+		self[addr] = p.state.ID == clusterNodeID
+	}
+	cluster.Unlock()
+	for _, addr := range c.Cluster.Peers {
+		if self[addr] {
+			continue
+		}
+		go func(addr string) {
+			if _, err := peerRequest(http.MethodPut, addr, path, b); err != nil {
+				warnf("推送配置到 %s 失败: %v", addr, err)
+			}
+		}(addr)
+	}
+}
+
+func adminClusterState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, localState())
+}
+
+func adminClusterConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		adminClusterPushConfig(w, r)
+		return
+	}
+	b, err := os.ReadFile(configFile)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(b)
+}
+
+// adminClusterPushConfig 接收其他节点推送的配置，只在本节点生效，不再继续推送
+func adminClusterPushConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, 16<<20))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	c := &ProxyConfig{}
+	if err := xml.Unmarshal(data, c); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	configEdits.Lock()
+	err = installConfig(c, persistRequested(r))
+	configEdits.Unlock()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("已应用集群节点推送的配置，共 %d 条代理规则", len(c.ProxyRules))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminClusterShortLinks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, currentShortLinks())
+	case http.MethodPut:
+		var snap shortLinkSnapshot
+		if err := json.NewDecoder(r.Body).Decode(&snap); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		replaceShortLinks(snap)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// adminClusterStats 汇总所有节点的统计数据
+func adminClusterStats(w http.ResponseWriter, r *http.Request) {
+	nodes := map[string]any{clusterNodeID: statsSnapshot()}
+	total := nodes[clusterNodeID].(map[string]any)["requests"].(int64)
+	if clusterEnabled() {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, addr := range config().Cluster.Peers {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				b, err := peerRequest(http.MethodGet, addr, "/api/cluster/node-stats", nil)
+				var st struct {
+					ID    string         `json:"id"`
+					Stats map[string]any `json:"stats"`
+				}
+				if err == nil {
+					err = json.Unmarshal(b, &st)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					nodes[addr] = map[string]string{"error": err.Error()}
+					return
+				}
+				if st.ID == clusterNodeID {
+					return
+				}
+				nodes[st.ID] = st.Stats
+				if n, ok := st.Stats["requests"].(float64); ok {
+					total += int64(n)
+				}
+			}(addr)
+		}
+		wg.Wait()
+	}
+	cluster.Lock()
+	leader := cluster.leader
+	cluster.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"leader": leader, "nodes": nodes, "requests": total})
+}
+
+func adminNodeStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"id": clusterNodeID, "stats": statsSnapshot()})
+}
+
+func init() {
+	adminMux.HandleFunc("/api/cluster/state", adminClusterState)
+	adminMux.HandleFunc("/api/cluster/config", adminClusterConfig)
+	adminMux.HandleFunc("/api/cluster/shortlinks", adminClusterShortLinks)
+	adminMux.HandleFunc("/api/cluster/stats", adminClusterStats)
+	adminMux.HandleFunc("/api/cluster/node-stats", adminNodeStats)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// 小于该大小的响应压缩后收益很小，不压缩
+const minCompressSize = 1024
+
+// 标准库支持解压和压缩的编码
+var supportedEncodings = map[string]bool{"gzip": true, "deflate": true}
+
+// checkCompress 检查规则的 compress 配置；br 和 zstd 需要第三方库，暂不支持
+func checkCompress(enc string) error {
+	if enc == "" || supportedEncodings[enc] {
+		return nil
+	}
+	return fmt.Errorf("compress 暂不支持 %s，可选 gzip 或 deflate", enc)
+}
+
+// bodyAcceptEncoding 改写响应体的规则让上游只返回可以解压的编码
+func bodyAcceptEncoding(r *http.Request) {
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+}
+
+// decodeBody 解压 gzip/deflate 响应体，后续的改写步骤都处理明文；其他编码保持不变，改写步骤会跳过
+func decodeBody(resp *http.Response) error {
+	enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if !supportedEncodings[enc] || resp.Body == http.NoBody {
+		return nil
+	}
+	body := resp.Body
+	var zr io.ReadCloser
+	var err error
+	if enc == "gzip" {
+		zr, err = gzip.NewReader(body)
+	} else {
+		zr, err = zlib.NewReader(body)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{zr, closerFunc(func() error {
+		zr.Close()
+		return body.Close()
+	})}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// applyCompress 客户端接受规则的 compress 编码时压缩改写后的文本响应
+func applyCompress(in *http.Request, rule *ProxyRule, resp *http.Response) error {
+	if rule == nil || rule.Compress == "" || resp.Body == http.NoBody || !isIdentityEncoding(resp) {
+		return nil
+	}
+	if !acceptsEncoding(in, rule.Compress) || !matchTypes(parseTypeList(""), resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < minCompressSize {
+		return nil
+	}
+	body := resp.Body
+	out := compressStream(rule.Compress, body)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{out, closerFunc(func() error {
+		out.Close()
+		return body.Close()
+	})}
+	resp.Header.Set("Content-Encoding", rule.Compress)
+	resp.Header.Add("Vary", "Accept-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// acceptsEncoding 客户端的 Accept-Encoding 是否包含 enc，q=0 表示不接受
+func acceptsEncoding(r *http.Request, enc string) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, item := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), enc) {
+				continue
+			}
+			q := strings.ReplaceAll(params, " ", "")
+			return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+		}
+	}
+	return false
+}
+
+// compressStream 在后台压缩 r 的内容，读取方关闭后停止
+func compressStream(enc string, r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var zw io.WriteCloser
+		if enc == "deflate" {
+			zw = zlib.NewWriter(pw)
+		} else {
+			zw = gzip.NewWriter(pw)
+		}
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConcurrencyConfig 同时转发给上游的请求数上限，规则上的 maxConcurrent 单独限制该规则；
+// 达到上限后最多 queue 个请求排队等待 queueTimeout(默认 30s)，队列已满或等待超时返回 503
+type ConcurrencyConfig struct {
+	Max          int    `xml:"max,attr,omitempty"`
+	Queue        int    `xml:"queue,attr,omitempty"`
+	QueueTimeout string `xml:"queueTimeout,attr,omitempty"`
+
+	queueTimeout time.Duration
+}
+
+func (c *ConcurrencyConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	if c.Max < 0 || c.Queue < 0 {
+		return fmt.Errorf("concurrency max 和 queue 不能为负数")
+	}
+	c.queueTimeout = 30 * time.Second
+	if c.QueueTimeout != "" {
+		d, err := time.ParseDuration(c.QueueTimeout)
+		if err != nil {
+			return fmt.Errorf("concurrency queueTimeout 格式错误: %v", err)
+		}
+		c.queueTimeout = d
+	}
+	return nil
+}
+
+// concurrencyLimiter 容量为上限的信号量，waiting 为正在排队的请求数
+type concurrencyLimiter struct {
+	slots   chan struct{}
+	queue   int
+	mu      sync.Mutex
+	waiting int
+}
+
+// acquire 有空位时立即返回，否则在队列未满时等待空位
+func (l *concurrencyLimiter) acquire(ctx context.Context, timeout time.Duration) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	l.mu.Lock()
+	if l.waiting >= l.queue {
+		l.mu.Unlock()
+		return false
+	}
+	l.waiting++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+var (
+	limitersMu sync.Mutex
+	// limiters 按名称保存，重新加载配置后保留；上限或队列长度改变时换成新的，旧的请求结束后释放到旧的信号量
+	limiters = map[string]*concurrencyLimiter{}
+)
+
+func limiterFor(name string, max, queue int) *concurrencyLimiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l := limiters[name]
+	if l == nil || cap(l.slots) != max || l.queue != queue {
+		l = &concurrencyLimiter{slots: make(chan struct{}, max), queue: queue}
+		limiters[name] = l
+	}
+	return l
+}
+
+// acquireUpstream 按全局和规则的并发上限占用名额，超过时返回 503；成功时返回的函数用于释放名额
+func acquireUpstream(w http.ResponseWriter, id int64, r *http.Request, rule *ProxyRule) (func(), bool) {
+	c := config().Concurrency
+	timeout := 30 * time.Second
+	if c != nil {
+		timeout = c.queueTimeout
+	}
+	var held []*concurrencyLimiter
+	release := func() {
+		for _, l := range held {
+			l.release()
+		}
+	}
+	if c != nil && c.Max > 0 {
+		l := limiterFor("", c.Max, c.Queue)
+		if !l.acquire(r.Context(), timeout) {
+			warnf("id:%d 并发请求数达到上限 %d", id, c.Max)
+			rejectBusy(w)
+			return nil, false
+		}
+		held = append(held, l)
+	}
+	if rule != nil && rule.MaxConcurrent > 0 {
+		l := limiterFor("rule|"+ruleName(rule), rule.MaxConcurrent, rule.MaxQueue)
+		if !l.acquire(r.Context(), timeout) {
+			release()
+			warnf("id:%d 规则 %s 并发请求数达到上限 %d", id, ruleName(rule), rule.MaxConcurrent)
+			rejectBusy(w)
+			return nil, false
+		}
+		held = append(held, l)
+	}
+	return release, true
+}
+
+func rejectBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "代理繁忙，请稍后重试", http.StatusServiceUnavailable)
+}
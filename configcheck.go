@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// lineIndex 将字节偏移转换为行号
+type lineIndex []int
+
+func newLineIndex(data []byte) lineIndex {
+	idx := lineIndex{0}
+	for i, c := range data {
+		if c == '\n' {
+			idx = append(idx, i+1)
+		}
+	}
+	return idx
+}
+
+func (l lineIndex) line(offset int64) int {
+	return sort.Search(len(l), func(i int) bool { return int64(l[i]) > offset })
+}
+
+// parseJSONConfig 解析 JSON 配置为通用节点，保留每个值所在的行号
+func parseJSONConfig(data []byte) (*cfgNode, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	lines := newLineIndex(data)
+	n, err := jsonNode(dec, lines)
+	if err != nil {
+		return nil, fmt.Errorf("第 %d 行: %v", lines.line(dec.InputOffset()), err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("第 %d 行: JSON 之后有多余的内容", lines.line(dec.InputOffset()))
+	}
+	return n, nil
+}
+
+func jsonNode(dec *json.Decoder, lines lineIndex) (*cfgNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	line := lines.line(dec.InputOffset() - 1)
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			n := &cfgNode{kind: nodeMap, line: line}
+			for dec.More() {
+				k, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				v, err := jsonNode(dec, lines)
+				if err != nil {
+					return nil, err
+				}
+				n.keys = append(n.keys, k.(string))
+				n.vals = append(n.vals, v)
+			}
+			_, err := dec.Token()
+			return n, err
+		case '[':
+			n := &cfgNode{kind: nodeList, line: line}
+			for dec.More() {
+				v, err := jsonNode(dec, lines)
+				if err != nil {
+					return nil, err
+				}
+				n.items = append(n.items, v)
+			}
+			_, err := dec.Token()
+			return n, err
+		}
+		return nil, fmt.Errorf("意外的 %v", t)
+	case nil:
+		return &cfgNode{kind: nodeScalar, line: line}, nil
+	default:
+		return &cfgNode{kind: nodeScalar, line: line, value: fmt.Sprint(t)}, nil
+	}
+}
+
+// parseXMLNode 将 XML 转换为通用节点，用于检查未知字段: 属性和子元素作为键，
+// 同名子元素合并为列表，只有文本的元素作为标量
+func parseXMLNode(data []byte) (*cfgNode, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			line, _ := dec.InputPos()
+			return xmlElement(dec, start, line)
+		}
+	}
+}
+
+func xmlElement(dec *xml.Decoder, start xml.StartElement, line int) (*cfgNode, error) {
+	n := &cfgNode{kind: nodeMap, line: line}
+	for _, a := range start.Attr {
+		n.keys = append(n.keys, a.Name.Local)
+		n.vals = append(n.vals, &cfgNode{kind: nodeScalar, line: line, value: a.Value})
+	}
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			l, _ := dec.InputPos()
+			child, err := xmlElement(dec, t, l)
+			if err != nil {
+				return nil, err
+			}
+			if prev := n.get(t.Name.Local); prev != nil {
+				if prev.kind != nodeList || prev.line != -1 {
+					list := &cfgNode{kind: nodeList, line: -1, items: []*cfgNode{prev}}
+					for i, k := range n.keys {
+						if k == t.Name.Local {
+							n.vals[i] = list
+						}
+					}
+					prev = list
+				}
+				prev.items = append(prev.items, child)
+				continue
+			}
+			n.keys = append(n.keys, t.Name.Local)
+			n.vals = append(n.vals, child)
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			for _, v := range n.vals {
+				if v.kind == nodeList && v.line == -1 {
+					v.line = v.items[0].line
+				}
+			}
+			s := strings.TrimSpace(text.String())
+			if len(n.keys) == 0 {
+				return &cfgNode{kind: nodeScalar, line: line, value: s}, nil
+			}
+			if s != "" {
+				n.keys = append(n.keys, "#text")
+				n.vals = append(n.vals, &cfgNode{kind: nodeScalar, line: line, value: text.String()})
+			}
+			return n, nil
+		}
+	}
+}
+
+// parseConfigNode 按扩展名解析配置文件为通用节点
+func parseConfigNode(filename string, data []byte) (*cfgNode, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return parseYAML(data)
+	case ".json":
+		return parseJSONConfig(data)
+	}
+	return parseXMLNode(data)
+}
+
+// checkConfig 检查未知字段、空的 proxyUrl 和重复的域名，返回带行号的问题列表
+func checkConfig(n *cfgNode) []string {
+	var d configDecoder
+	var c ProxyConfig
+	var problems []string
+	if err := d.decode(n, reflect.ValueOf(&c).Elem(), ""); err != nil {
+		problems = append(problems, err.Error())
+	}
+	problems = append(problems, d.unknown...)
+
+	seen := map[string]int{}
+	dup := func(domain string, line int, what string) {
+		if domain == "" {
+			return
+		}
+		if first, ok := seen[domain]; ok {
+			problems = append(problems, fmt.Sprintf("第 %d 行: %s %s 重复，第 %d 行已配置", line, what, domain, first))
+			return
+		}
+		seen[domain] = line
+	}
+	for _, rule := range listItems(n.get("proxy")) {
+		if rule.kind != nodeMap {
+			continue
+		}
+		domain := rule.get("domain")
+		if domain == nil || domain.value == "" {
+			if re := rule.get("regex"); re == nil || re.value == "" {
+				problems = append(problems, fmt.Sprintf("第 %d 行: 代理规则缺少 domain 或 regex", rule.line))
+			}
+			continue
+		}
+		if p := rule.get("proxyUrl"); (p == nil || strings.TrimSpace(p.value) == "") && rule.get("pool") == nil {
+			problems = append(problems, fmt.Sprintf("第 %d 行: 规则 %s 的 proxyUrl 为空，将直连", rule.line, domain.value))
+		}
+		// 同一域名按不同路径前缀分流不算重复
+		key := domain.value
+		if p := rule.get("pathPrefix"); p != nil {
+			key += p.value
+		}
+		dup(key, domain.line, "代理规则域名")
+	}
+	direct := n.get("directDomains")
+	if direct != nil && direct.kind == nodeMap && direct.get("domain") != nil {
+		direct = direct.get("domain")
+	}
+	for _, d := range listItems(direct) {
+		dup(d.value, d.line, "直连域名")
+	}
+	return problems
+}
+
+func listItems(n *cfgNode) []*cfgNode {
+	switch {
+	case n == nil:
+		return nil
+	case n.kind == nodeList:
+		return n.items
+	}
+	return []*cfgNode{n}
+}
+
+// runCheckCommand 命令行检查配置文件: r-proxy check [-config proxy_config.xml]
+func runCheckCommand(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	cfg := fs.String("config", configFile, "配置文件")
+	fs.Parse(args)
+	data, err := os.ReadFile(*cfg)
+	if err == nil {
+		var n *cfgNode
+		if n, err = parseConfigNode(*cfg, data); err == nil {
+			problems := checkConfig(n)
+			for _, p := range problems {
+				fmt.Println(p)
+			}
+			if len(problems) > 0 {
+				err = errors.New("请检查以上问题")
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *cfg, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: 配置正常\n", *cfg)
+}
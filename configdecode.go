@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// cfgNode YAML/JSON 配置解析后的通用节点，记录行号用于报错
+type cfgNode struct {
+	kind  int
+	line  int
+	value string     // 标量
+	keys  []string   // 映射，保持原有顺序
+	vals  []*cfgNode // 映射的值，与 keys 一一对应
+	items []*cfgNode // 列表
+}
+
+const (
+	nodeScalar = iota
+	nodeMap
+	nodeList
+)
+
+func (n *cfgNode) get(key string) *cfgNode {
+	for i, k := range n.keys {
+		if k == key {
+			return n.vals[i]
+		}
+	}
+	return nil
+}
+
+// cfgField 结构体字段在 YAML/JSON 中的名称，沿用 xml 标签: 属性和子元素都是同名的键，
+// a>b 形式的路径使用第一段作为键，chardata 使用字段名首字母小写
+type cfgField struct {
+	index    int
+	name     string
+	inner    string // a>b 中的 b，值也可以写成 {b: [...]}
+	chardata bool   // XML 元素的文本内容，转换后的键为 #text
+}
+
+func cfgFields(t reflect.Type) []cfgField {
+	var fields []cfgField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Name == "XMLName" {
+			continue
+		}
+		tag, opts, _ := strings.Cut(f.Tag.Get("xml"), ",")
+		if tag == "-" {
+			continue
+		}
+		field := cfgField{index: i, name: tag, chardata: strings.Contains(opts, "chardata")}
+		if field.chardata || tag == "" {
+			field.name = strings.ToLower(f.Name[:1]) + f.Name[1:]
+		}
+		if outer, inner, ok := strings.Cut(tag, ">"); ok {
+			field.name, field.inner = outer, inner
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// configDecoder 按 xml 标签把通用节点填充到配置结构体中，并记录未知字段
+type configDecoder struct {
+	unknown []string
+}
+
+func (d *configDecoder) decode(n *cfgNode, v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if n.kind == nodeScalar && n.value == "" {
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(n, v.Elem(), path)
+	case reflect.Struct:
+		if n.kind == nodeScalar && n.value == "" {
+			return nil
+		}
+		fields := cfgFields(v.Type())
+		if n.kind == nodeScalar {
+			// 只有文本内容的元素，如 <robots>User-agent: *</robots>
+			for _, f := range fields {
+				if f.chardata {
+					v.Field(f.index).SetString(n.value)
+					return nil
+				}
+			}
+		}
+		if n.kind != nodeMap {
+			return fmt.Errorf("第 %d 行: %s 应为对象", n.line, path)
+		}
+		for i, key := range n.keys {
+			var field *cfgField
+			for j := range fields {
+				if fields[j].name == key || key == "#text" && fields[j].chardata {
+					field = &fields[j]
+					break
+				}
+			}
+			if field == nil {
+				d.unknown = append(d.unknown, fmt.Sprintf("第 %d 行: 未知字段 %s", n.vals[i].line, joinPath(path, key)))
+				continue
+			}
+			val := n.vals[i]
+			if field.inner != "" && val.kind == nodeMap && len(val.keys) == 1 && val.keys[0] == field.inner {
+				val = val.vals[0]
+			}
+			if err := d.decode(val, v.Field(field.index), joinPath(path, key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		items := n.items
+		switch n.kind {
+		case nodeMap:
+			// 只有一个元素时可以不写成列表
+			items = []*cfgNode{n}
+		case nodeScalar:
+			if n.value == "" {
+				return nil
+			}
+			items = []*cfgNode{n}
+		}
+		s := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := d.decode(item, s.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+
+	if n.kind != nodeScalar {
+		return fmt.Errorf("第 %d 行: %s 应为单个值", n.line, path)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(n.value)
+	case reflect.Bool:
+		switch strings.ToLower(n.value) {
+		case "true", "yes", "on", "1":
+			v.SetBool(true)
+		case "false", "no", "off", "0", "":
+			v.SetBool(false)
+		default:
+			return fmt.Errorf("第 %d 行: %s 应为 true 或 false", n.line, path)
+		}
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		if n.value == "" {
+			return nil
+		}
+		i, err := strconv.ParseInt(n.value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("第 %d 行: %s 应为整数", n.line, path)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint64, reflect.Uint32:
+		if n.value == "" {
+			return nil
+		}
+		i, err := strconv.ParseUint(n.value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("第 %d 行: %s 应为非负整数", n.line, path)
+		}
+		v.SetUint(i)
+	case reflect.Float64, reflect.Float32:
+		if n.value == "" {
+			return nil
+		}
+		f, err := strconv.ParseFloat(n.value, 64)
+		if err != nil {
+			return fmt.Errorf("第 %d 行: %s 应为数字", n.line, path)
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("第 %d 行: %s 的类型不支持", n.line, path)
+	}
+	return nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
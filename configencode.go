@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// cfgMap 保持字段顺序的映射，键与 YAML/JSON 配置文件中的名称一致
+type cfgMap struct {
+	keys []string
+	vals []any
+}
+
+func (m *cfgMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		val, err := json.Marshal(m.vals[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(val)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// encodeConfig 与 configDecoder 相反，按 xml 标签把配置结构体转换为 cfgMap/[]any/标量，零值省略
+func encodeConfig(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		return encodeConfig(v.Elem())
+	case reflect.Struct:
+		m := &cfgMap{}
+		for _, f := range cfgFields(v.Type()) {
+			if val := encodeConfig(v.Field(f.index)); val != nil {
+				m.keys = append(m.keys, f.name)
+				m.vals = append(m.vals, val)
+			}
+		}
+		if len(m.keys) == 0 {
+			return nil
+		}
+		return m
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil
+		}
+		items := make([]any, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			item := encodeConfig(v.Index(i))
+			if item == nil {
+				item = &cfgMap{}
+			}
+			items = append(items, item)
+		}
+		return items
+	}
+	if v.IsZero() {
+		return nil
+	}
+	return v.Interface()
+}
+
+// marshalYAML 输出 yaml.go 能解析的块格式 YAML
+func marshalYAML(v any) []byte {
+	var b bytes.Buffer
+	writeYAML(&b, v, 0)
+	return b.Bytes()
+}
+
+func writeYAML(b *bytes.Buffer, v any, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch v := v.(type) {
+	case *cfgMap:
+		for i, k := range v.keys {
+			b.WriteString(pad + yamlString(k) + ":")
+			writeYAMLValue(b, v.vals[i], indent+1)
+		}
+	case []any:
+		for _, item := range v {
+			b.WriteString(pad + "-")
+			if m, ok := item.(*cfgMap); ok && len(m.keys) > 0 {
+				// 列表项的第一个键与 - 写在同一行
+				var inner bytes.Buffer
+				writeYAML(&inner, m, indent+1)
+				b.WriteString(" " + strings.TrimPrefix(inner.String(), pad+"  "))
+				continue
+			}
+			writeYAMLValue(b, item, indent+1)
+		}
+	}
+}
+
+func writeYAMLValue(b *bytes.Buffer, v any, indent int) {
+	switch v := v.(type) {
+	case *cfgMap:
+		if len(v.keys) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+		b.WriteString("\n")
+		writeYAML(b, v, indent)
+	case []any:
+		b.WriteString("\n")
+		writeYAML(b, v, indent)
+	case string:
+		b.WriteString(" " + yamlString(v) + "\n")
+	default:
+		fmt.Fprintf(b, " %v\n", v)
+	}
+}
+
+// yamlString 可能被当作其他类型或包含特殊字符的字符串加双引号
+func yamlString(s string) string {
+	if s == "" || s != strings.TrimSpace(s) || strings.ContainsAny(s, ":#{}[],&*?|<>=!%@`\"'\\\n\t") ||
+		strings.HasPrefix(s, "-") {
+		return strconv.Quote(s)
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~":
+		return strconv.Quote(s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// marshalConfigFile 按配置文件扩展名输出配置，XML 中原有的注释不会保留
+func marshalConfigFile(filename string, c *ProxyConfig) ([]byte, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return marshalYAML(encodeConfig(reflect.ValueOf(c))), nil
+	case ".json":
+		data, err := json.MarshalIndent(encodeConfig(reflect.ValueOf(c)), "", "  ")
+		return append(data, '\n'), err
+	}
+	data, err := xml.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+// writeConfigFile 先写临时文件再重命名，避免文件监视读到写了一半的配置
+func writeConfigFile(filename string, c *ProxyConfig) error {
+	data, err := marshalConfigFile(filename, c)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
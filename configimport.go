@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// importResult 从 PAC、NO_PROXY 或 hosts 文件转换出的配置
+type importResult struct {
+	rules        []ProxyRule
+	direct       []string // directDomains
+	networks     []string // directNetworks
+	blocked      []string // blocklists 中的 domain
+	defaultProxy *ProxyRule
+	skipped      []string // 无法转换的内容，输出到 stderr 由用户手动处理
+}
+
+func (r *importResult) skip(format string, v ...any) {
+	r.skipped = append(r.skipped, fmt.Sprintf(format, v...))
+}
+
+func appendUnique(list []string, v string) []string {
+	if slices.Contains(list, v) {
+		return list
+	}
+	return append(list, v)
+}
+
+// runImportCommand r-proxy import [-write] pac|noproxy|hosts 来源，把已有的代理设置转换为 proxy 规则和直连域名，
+// 默认输出可以粘贴到配置文件中的片段，-write 时合并到配置文件
+func runImportCommand(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	cfg := fs.String("config", configFile, "配置文件，-write 时写入")
+	write := fs.Bool("write", false, "合并到配置文件，XML 中原有的注释不会保留")
+	fs.Parse(args)
+	kind, source := fs.Arg(0), fs.Arg(1)
+	if kind == "noproxy" && source == "" {
+		source = envOr("NO_PROXY", os.Getenv("no_proxy"))
+	}
+	if fs.NArg() > 2 || source == "" || kind != "pac" && kind != "noproxy" && kind != "hosts" {
+		fmt.Fprintln(os.Stderr, "用法: r-proxy import [-write] [-config proxy_config.xml] pac <文件或URL> | noproxy [NO_PROXY 的值] | hosts <文件或URL>")
+		os.Exit(2)
+	}
+
+	var res *importResult
+	var err error
+	switch kind {
+	case "pac":
+		var src string
+		if src, err = readPACSource(source); err == nil {
+			res, err = importPAC(src)
+		}
+	case "noproxy":
+		res = importNoProxy(source)
+	case "hosts":
+		var rc io.ReadCloser
+		if rc, err = openBlocklist(importSource(source)); err == nil {
+			res, err = importHosts(rc)
+			rc.Close()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", source, err)
+		os.Exit(1)
+	}
+	for _, s := range res.skipped {
+		fmt.Fprintf(os.Stderr, "跳过: %s\n", s)
+	}
+	if !*write {
+		os.Stdout.Write(res.fragment())
+		return
+	}
+	if err := res.merge(*cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *cfg, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: 已添加 %d 条代理规则、%d 个直连域名、%d 个直连网段、%d 个拦截域名\n",
+		*cfg, len(res.rules), len(res.direct), len(res.networks), len(res.blocked))
+}
+
+func importSource(source string) BlocklistSource {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return BlocklistSource{URL: source}
+	}
+	return BlocklistSource{Path: source}
+}
+
+// fragment 输出配置文件片段，元素名与配置文件相同
+func (r *importResult) fragment() []byte {
+	var b strings.Builder
+	enc := xml.NewEncoder(&b)
+	enc.Indent("  ", "  ")
+	elem := func(name string, v any) {
+		enc.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: name}})
+	}
+	if r.defaultProxy != nil {
+		elem("defaultProxy", r.defaultProxy)
+	}
+	for _, rule := range r.rules {
+		elem("proxy", rule)
+	}
+	if len(r.direct) > 0 {
+		elem("directDomains", struct {
+			Domains []string `xml:"domain"`
+		}{r.direct})
+	}
+	if len(r.networks) > 0 {
+		elem("directNetworks", struct {
+			Networks []string `xml:"network"`
+		}{r.networks})
+	}
+	if len(r.blocked) > 0 {
+		elem("blocklists", struct {
+			Domains []string `xml:"domain"`
+		}{r.blocked})
+	}
+	enc.Flush()
+	if b.Len() == 0 {
+		return nil
+	}
+	return []byte(b.String() + "\n")
+}
+
+// merge 追加到配置文件中，已有的域名和网段不重复添加；配置文件中已有默认代理时不覆盖
+func (r *importResult) merge(filename string) error {
+	c, err := parseConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	if r.defaultProxy != nil {
+		if c.DefaultProxy.usesProxy() {
+			fmt.Fprintf(os.Stderr, "跳过: 配置文件中已有默认代理 %s，没有改为 %s\n", c.DefaultProxy.upstreamName(), r.defaultProxy.ProxyURL)
+		} else {
+			c.DefaultProxy.ProxyURL, c.DefaultProxy.Fallbacks = r.defaultProxy.ProxyURL, r.defaultProxy.Fallbacks
+		}
+	}
+	c.ProxyRules = append(c.ProxyRules, r.rules...)
+	for _, d := range r.direct {
+		c.DirectDomains = appendUnique(c.DirectDomains, d)
+	}
+	for _, n := range r.networks {
+		c.DirectNetworks = appendUnique(c.DirectNetworks, n)
+	}
+	if len(r.blocked) > 0 {
+		if c.Blocklist == nil {
+			c.Blocklist = &BlocklistConfig{}
+		}
+		for _, d := range r.blocked {
+			c.Blocklist.Domains = appendUnique(c.Blocklist.Domains, d)
+		}
+	}
+	if err := c.init(); err != nil {
+		return err
+	}
+	return writeConfigFile(filename, c)
+}
+
+// importNoProxy 转换 NO_PROXY 环境变量: 逗号或空格分隔，example.com 转换为 example.com 和 *.example.com，网段放入 directNetworks
+func importNoProxy(value string) *importResult {
+	res := &importResult{}
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "*" {
+			res.skip("NO_PROXY 中的 * 表示所有目标都直连，不需要配置代理规则")
+			continue
+		}
+		if p, err := netip.ParsePrefix(item); err == nil {
+			res.networks = appendUnique(res.networks, p.Masked().String())
+			continue
+		}
+		host := item
+		if h, port, ok := strings.Cut(item, ":"); ok && !strings.Contains(port, ":") && !strings.HasPrefix(item, "[") {
+			res.skip("%s: 不能按端口直连，已改为整个主机直连", item)
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		// NO_PROXY 中的域名同时匹配子域名，.example.com 只匹配子域名
+		suffix, dot := strings.CutPrefix(host, ".")
+		if suffix == "" {
+			continue
+		}
+		if !dot {
+			res.direct = appendUnique(res.direct, suffix)
+		}
+		if net.ParseIP(suffix) == nil {
+			res.direct = appendUnique(res.direct, "*."+suffix)
+		}
+	}
+	return res
+}
+
+// importHosts 转换 hosts 文件: 指向 0.0.0.0、127.0.0.1 等地址的域名为拦截列表，指向其他地址的域名改为直连
+func importHosts(r io.Reader) (*importResult, error) {
+	res := &importResult{}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// 只有域名的行与拦截列表的格式相同
+		blocked := true
+		if ip, err := netip.ParseAddr(fields[0]); err == nil {
+			blocked = ip.IsUnspecified() || ip.IsLoopback()
+		}
+		for _, h := range parseHostsLine(line) {
+			if blocked {
+				res.blocked = appendUnique(res.blocked, h)
+			} else {
+				res.direct = appendUnique(res.direct, h)
+			}
+		}
+	}
+	return res, sc.Err()
+}
+
+// ---------- PAC ----------
+
+// pacMatcher PAC 条件转换出的匹配方式，只有一个字段有值
+type pacMatcher struct {
+	domain  string // 与 proxy 规则的 domain 相同
+	regex   string
+	network string
+}
+
+// pacImporter 按 FindProxyForURL 中的 if 语句逐条转换，条件只能是 shExpMatch、dnsDomainIs、localHostOrDomainIs、
+// isPlainHostName、isInNet 和 host == "..." 用 || 组合，返回值必须是字符串常量或初始值为字符串的变量
+type pacImporter struct {
+	res       *importResult
+	url, host string // FindProxyForURL 的参数名
+	consts    map[string]string
+}
+
+func importPAC(src string) (*importResult, error) {
+	prog, err := jsParse(src)
+	if err != nil {
+		return nil, err
+	}
+	imp := &pacImporter{res: &importResult{}, consts: map[string]string{}}
+	var fn *jsFuncLit
+	for _, s := range prog {
+		switch s := s.(type) {
+		case *jsFuncDecl:
+			if s.fn.name == "FindProxyForURL" {
+				fn = s.fn
+			}
+		case *jsVarDecl:
+			imp.collectConsts(s)
+		}
+	}
+	if fn == nil {
+		return nil, fmt.Errorf("脚本中没有定义 FindProxyForURL 函数")
+	}
+	if len(fn.params) > 0 {
+		imp.url = fn.params[0]
+	}
+	if len(fn.params) > 1 {
+		imp.host = fn.params[1]
+	}
+	for _, s := range fn.body {
+		if v, ok := s.(*jsVarDecl); ok {
+			imp.collectConsts(v)
+		}
+	}
+	imp.statements(fn.body)
+	return imp.res, nil
+}
+
+// collectConsts 记录初始值为字符串的变量，如 var proxy = "PROXY 10.0.0.1:8080"
+func (imp *pacImporter) collectConsts(d *jsVarDecl) {
+	for i, name := range d.names {
+		if lit, ok := d.inits[i].(*jsLit); ok {
+			if s, ok := lit.v.(string); ok {
+				imp.consts[name] = s
+			}
+		}
+	}
+}
+
+// statements 返回 false 表示遇到了无条件的 return，后面的语句不会执行
+func (imp *pacImporter) statements(list []jsStmt) bool {
+	for _, s := range list {
+		switch s := s.(type) {
+		case *jsVarDecl, *jsExprStmt, *jsFuncDecl:
+			// host = host.toLowerCase() 之类的语句不影响转换
+		case *jsBlock:
+			if !imp.statements(s.list) {
+				return false
+			}
+		case *jsReturn:
+			value, ok := imp.stringValue(s.x)
+			if !ok {
+				imp.res.skip("最后的 return 返回值不是字符串常量")
+				return false
+			}
+			imp.defaultRule(value)
+			return false
+		case *jsIf:
+			imp.ifStatement(s)
+			if s.els != nil && !imp.statements([]jsStmt{s.els}) {
+				return false
+			}
+		default:
+			imp.res.skip("不支持转换 for、while、switch 等语句，请手动检查")
+		}
+	}
+	return true
+}
+
+func (imp *pacImporter) ifStatement(s *jsIf) {
+	value, ok := imp.returnValue(s.then)
+	if !ok {
+		imp.res.skip("if 语句的内容不是单个返回字符串的 return")
+		return
+	}
+	matchers, ok := imp.condition(s.cond)
+	if !ok {
+		imp.res.skip("无法转换返回 %q 的条件", value)
+		return
+	}
+	urls, err := parsePACResult(value)
+	if err != nil {
+		imp.res.skip("返回值 %q: %v", value, err)
+		return
+	}
+	for _, m := range matchers {
+		imp.add(m, urls)
+	}
+}
+
+// returnValue then 分支为 return "..." 或只包含它的语句块
+func (imp *pacImporter) returnValue(s jsStmt) (string, bool) {
+	if b, ok := s.(*jsBlock); ok && len(b.list) == 1 {
+		s = b.list[0]
+	}
+	if r, ok := s.(*jsReturn); ok {
+		return imp.stringValue(r.x)
+	}
+	return "", false
+}
+
+func (imp *pacImporter) stringValue(x jsExpr) (string, bool) {
+	switch x := x.(type) {
+	case *jsLit:
+		s, ok := x.v.(string)
+		return s, ok
+	case *jsIdent:
+		s, ok := imp.consts[x.name]
+		return s, ok
+	}
+	return "", false
+}
+
+func (imp *pacImporter) isHost(x jsExpr) bool {
+	id, ok := x.(*jsIdent)
+	return ok && id.name == imp.host
+}
+
+func (imp *pacImporter) isURL(x jsExpr) bool {
+	id, ok := x.(*jsIdent)
+	return ok && id.name == imp.url
+}
+
+// condition 把条件转换为匹配方式，任意一个匹配即成立
+func (imp *pacImporter) condition(x jsExpr) ([]pacMatcher, bool) {
+	switch x := x.(type) {
+	case *jsLogical:
+		if x.op != "||" {
+			return nil, false
+		}
+		l, ok1 := imp.condition(x.l)
+		r, ok2 := imp.condition(x.r)
+		return append(l, r...), ok1 && ok2
+	case *jsBinary:
+		if x.op != "==" && x.op != "===" {
+			return nil, false
+		}
+		l, r := x.l, x.r
+		if imp.isHost(r) {
+			l, r = r, l
+		}
+		if s, ok := imp.stringValue(r); ok && imp.isHost(l) {
+			return []pacMatcher{{domain: strings.ToLower(s)}}, true
+		}
+	case *jsCall:
+		return imp.call(x)
+	}
+	return nil, false
+}
+
+func (imp *pacImporter) call(x *jsCall) ([]pacMatcher, bool) {
+	fn, ok := x.fn.(*jsIdent)
+	if !ok {
+		return nil, false
+	}
+	arg := func(i int) (string, bool) {
+		if i >= len(x.args) {
+			return "", false
+		}
+		return imp.stringValue(x.args[i])
+	}
+	switch fn.name {
+	case "isPlainHostName":
+		if len(x.args) == 1 && imp.isHost(x.args[0]) {
+			return []pacMatcher{{regex: `^[^.]+$`}}, true
+		}
+	case "dnsDomainIs", "localHostOrDomainIs":
+		if s, ok := arg(1); ok && imp.isHost(x.args[0]) {
+			s = strings.ToLower(s)
+			if fn.name == "localHostOrDomainIs" {
+				return []pacMatcher{{domain: s}}, true
+			}
+			// dnsDomainIs 按后缀匹配，没有点开头时域名本身也匹配
+			if suffix, ok := strings.CutPrefix(s, "."); ok {
+				return []pacMatcher{{domain: "*." + suffix}}, true
+			}
+			return []pacMatcher{{domain: s}, {domain: "*." + s}}, true
+		}
+	case "shExpMatch":
+		s, ok := arg(1)
+		if !ok {
+			return nil, false
+		}
+		s = strings.ToLower(s)
+		if imp.isHost(x.args[0]) {
+			return []pacMatcher{globMatcher(s)}, true
+		}
+		if imp.isURL(x.args[0]) {
+			return []pacMatcher{{regex: shExpRegexp(s).String()}}, true
+		}
+	case "isInNet":
+		addr, ok1 := arg(1)
+		mask, ok2 := arg(2)
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		target := x.args[0]
+		if c, ok := target.(*jsCall); ok && len(c.args) == 1 {
+			if f, ok := c.fn.(*jsIdent); ok && f.name == "dnsResolve" {
+				target = c.args[0]
+			}
+		}
+		if !imp.isHost(target) {
+			return nil, false
+		}
+		if network, ok := maskNetwork(addr, mask); ok {
+			return []pacMatcher{{network: network}}, true
+		}
+	}
+	return nil, false
+}
+
+// globMatcher 没有通配符或只有开头的 *. 时使用 domain，其他情况转换为正则
+func globMatcher(glob string) pacMatcher {
+	rest := strings.TrimPrefix(glob, "*.")
+	if !strings.ContainsAny(rest, "*?") {
+		return pacMatcher{domain: glob}
+	}
+	return pacMatcher{regex: shExpRegexp(glob).String()}
+}
+
+// maskNetwork 把 isInNet 的地址和子网掩码转换为 CIDR
+func maskNetwork(addr, mask string) (string, bool) {
+	ip, err1 := netip.ParseAddr(addr)
+	m, err2 := netip.ParseAddr(mask)
+	if err1 != nil || err2 != nil || !ip.Is4() || !m.Is4() {
+		return "", false
+	}
+	v := pacAddrValue(m)
+	bits := 0
+	for v&(1<<31) != 0 {
+		bits++
+		v <<= 1
+	}
+	if v != 0 {
+		return "", false
+	}
+	return netip.PrefixFrom(ip, bits).Masked().String(), true
+}
+
+// add 添加一条转换结果；directDomains 先于所有规则检查，直连的域名可能改变前面代理规则的结果时使用空 proxyUrl 的规则
+func (imp *pacImporter) add(m pacMatcher, urls []string) {
+	res := imp.res
+	if m.network != "" {
+		if len(urls) > 0 {
+			res.skip("不支持按网段 %s 选择代理 %s", m.network, urls[0])
+			return
+		}
+		res.networks = appendUnique(res.networks, m.network)
+		return
+	}
+	if len(urls) == 0 && m.domain != "" {
+		shadows := false
+		for _, p := range res.rules {
+			if !p.usesProxy() || p.Domain == "" {
+				continue
+			}
+			if ruleMatch(p.Domain, m.domain) != matchNone {
+				res.skip("%s: 前面返回 %s 的条件 %s 已经包含该域名，PAC 中不会直连", m.domain, p.ProxyURL, p.Domain)
+				return
+			}
+			if ruleMatch(m.domain, p.Domain) != matchNone {
+				shadows = true
+			}
+		}
+		if !shadows {
+			res.direct = appendUnique(res.direct, m.domain)
+			return
+		}
+	}
+	rule := ProxyRule{Domain: m.domain}
+	if m.regex != "" {
+		if _, err := regexp.Compile(m.regex); err != nil {
+			res.skip("正则 %s: %v", m.regex, err)
+			return
+		}
+		rule.Regex = m.regex
+	}
+	setPACUpstreams(&rule, urls)
+	res.rules = append(res.rules, rule)
+}
+
+func (imp *pacImporter) defaultRule(value string) {
+	urls, err := parsePACResult(value)
+	if err != nil {
+		imp.res.skip("最后的返回值 %q: %v", value, err)
+		return
+	}
+	if len(urls) == 0 {
+		return
+	}
+	imp.res.defaultProxy = &ProxyRule{}
+	setPACUpstreams(imp.res.defaultProxy, urls)
+}
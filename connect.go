@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// forwardProxyHandler 支持把本服务器设置为浏览器或工具的 HTTP 代理: CONNECT 建立隧道，绝对地址的请求(GET http://host/a)直接转发；
+// 两种请求使用与路径形式相同的规则、直连列表和访问控制
+func forwardProxyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodConnect:
+			connectHandler(w, r)
+		case r.URL.IsAbs():
+			proxyHandler(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func connectHandler(w http.ResponseWriter, r *http.Request) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, "CONNECT 的目标需要是 host:port", http.StatusBadRequest)
+		return
+	}
+	// 规则按主机名匹配，443 端口与 https:// 的请求一致
+	targetURL := &url.URL{Scheme: "https", Host: r.Host}
+	if port == "443" {
+		targetURL.Host = host
+	}
+
+	id := atomic.AddInt64(&uuid, 1)
+	inflightRequests.Add(1)
+	defer inflightRequests.Add(-1)
+	if checkClientRate(w, id, r) || checkClientCert(w, id, r, targetURL) || checkAPIKey(w, id, r, targetURL) || checkAllowlist(w, id, r, targetURL) || checkBlocklist(w, id, targetURL) || checkReputation(w, id, targetURL) {
+		return
+	}
+	proxyRule := findProxyRule(targetURL)
+	reqLog := newRequestLog(id, r, targetURL, proxyRule)
+	rejected, direct := checkCircuit(w, id, proxyRule)
+	if rejected {
+		reqLog.done(http.StatusServiceUnavailable, 0, phaseTimes{})
+		return
+	}
+	release, ok := acquireUpstream(w, id, r, proxyRule)
+	if !ok {
+		reqLog.done(http.StatusServiceUnavailable, 0, phaseTimes{})
+		return
+	}
+	defer release()
+	var transport http.RoundTripper = config().directTransport
+	if proxyRule != nil && proxyRule.usesProxy() && !direct {
+		if transport, err = proxyRule.roundTripper(); err != nil {
+			http.Error(w, "代理URL配置错误", http.StatusInternalServerError)
+			reqLog.done(http.StatusInternalServerError, 0, phaseTimes{})
+			return
+		}
+		reqLog.printf("id:%d use+proxy %s connect %s", id, proxyRule.upstreamName(), r.Host)
+	} else {
+		reqLog.printf("id:%d no-proxy connect %s", id, r.Host)
+		var denied int
+		if r, denied = pinTarget(w, id, r, targetURL); denied != 0 {
+			reqLog.done(denied, 0, phaseTimes{})
+			return
+		}
+	}
+
+	start := time.Now()
+	var upstream net.Conn
+	for _, t := range newTunnelTransport(transport).transports {
+		if upstream, err = dialTunnel(r.Context(), t, r, r.Host); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		reqLog.printf("id:%d connect error: %v", id, err)
+		http.Error(w, "无法连接目标地址", http.StatusBadGateway)
+		reqLog.done(http.StatusBadGateway, 0, phaseTimes{Total: time.Since(start)})
+		return
+	}
+	defer upstream.Close()
+	// HTTP/2 的 CONNECT 不能接管连接，客户端通常使用 HTTP/1.1 连接代理
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "不支持在该连接上建立隧道", http.StatusHTTPVersionNotSupported)
+		reqLog.done(http.StatusHTTPVersionNotSupported, 0, phaseTimes{})
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	// 任一方向结束时关闭两边的连接
+	in := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(upstream, brw)
+		upstream.Close()
+		in <- n
+	}()
+	out, _ := io.Copy(conn, upstream)
+	conn.Close()
+	bytesIn := <-in
+
+	total := time.Since(start)
+	recordMetrics(targetURL.Host, ruleName(proxyRule), http.StatusOK, bytesIn, out, 0)
+	reqLog.done(http.StatusOK, out, phaseTimes{Total: total})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewriteSetCookies 改写目标站点设置的 Cookie，使浏览器在代理地址下保存并发回:
+// 去掉 Domain(浏览器不接受不属于代理主机的 Domain)，Path 加上 /https://host 前缀，不同目标站点的 Cookie 互不影响；
+// 规则开启 insecureCookies 且客户端使用 HTTP 访问代理时去掉 Secure 和 SameSite=None
+func rewriteSetCookies(in *http.Request, target *url.URL, rule *ProxyRule, resp *http.Response) {
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	insecure := rule != nil && rule.InsecureCookies && in.TLS == nil
+	prefix := "/" + target.Scheme + "://" + target.Host
+	resp.Header.Del("Set-Cookie")
+	for _, c := range cookies {
+		resp.Header.Add("Set-Cookie", rewriteSetCookie(c, prefix, insecure))
+	}
+}
+
+// rewriteSetCookie 按属性逐个处理，保留无法识别的属性；没有 Path 时浏览器按请求路径的目录计算，已经带有前缀
+func rewriteSetCookie(c, prefix string, insecure bool) string {
+	parts := strings.Split(c, ";")
+	out := []string{parts[0]}
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "domain":
+			continue
+		case "path":
+			v = strings.TrimSpace(v)
+			if !strings.HasPrefix(v, "/") {
+				v = "/"
+			}
+			p = " Path=" + prefix + v
+		case "secure":
+			if insecure {
+				continue
+			}
+		case "samesite":
+			if insecure && strings.EqualFold(strings.TrimSpace(v), "none") {
+				continue
+			}
+		}
+		out = append(out, p)
+	}
+	return strings.Join(out, ";")
+}
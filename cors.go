@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig 规则级别的跨域配置，代理会用它替换上游返回的 Access-Control-* 响应头
+type CORSConfig struct {
+	Origins     string `xml:"origins,attr,omitempty"` // 逗号分隔，* 表示任意来源，也支持 *.example.com；为空时同 *
+	Methods     string `xml:"methods,attr,omitempty"` // 默认 GET,POST,PUT,PATCH,DELETE,OPTIONS
+	Headers     string `xml:"headers,attr,omitempty"` // 为空时回显预检请求的 Access-Control-Request-Headers
+	Expose      string `xml:"expose,attr,omitempty"`
+	Credentials bool   `xml:"credentials,attr,omitempty"` // 需要 origins 列出具体来源
+	MaxAge      int    `xml:"maxAge,attr,omitempty"`      // 预检结果缓存秒数
+	Preflight   bool   `xml:"preflight,attr,omitempty"`   // 在代理本地直接响应预检请求，不转发给上游
+
+	origins []string
+}
+
+func (c *CORSConfig) init() error {
+	c.origins = nil
+	for _, o := range strings.Split(c.Origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			c.origins = append(c.origins, o)
+		}
+	}
+	if len(c.origins) == 0 {
+		c.origins = []string{"*"}
+	}
+	// 携带凭证时回显任意来源等于允许任何网站读取用户的登录态
+	if c.Credentials && slices.Contains(c.origins, "*") {
+		return errors.New(`cors 的 credentials="true" 需要在 origins 中列出具体来源，不能为空或 *`)
+	}
+	return nil
+}
+
+const defaultCORSMethods = "GET,POST,PUT,PATCH,DELETE,OPTIONS"
+
+// allowOrigin 返回应写入 Access-Control-Allow-Origin 的值，不允许时返回空
+func (c *CORSConfig) allowOrigin(origin string) string {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	for _, o := range c.origins {
+		switch {
+		case o == "*":
+			return "*"
+		case strings.HasPrefix(o, "*."):
+			if h := u.Hostname(); strings.HasSuffix(h, o[1:]) || h == o[2:] {
+				return origin
+			}
+		case strings.EqualFold(strings.TrimSuffix(o, "/"), origin):
+			return origin
+		}
+	}
+	return ""
+}
+
+// setHeaders 写入跨域响应头，preflight 表示是否为预检请求
+func (c *CORSConfig) setHeaders(h http.Header, r *http.Request, preflight bool) {
+	for k := range h {
+		if strings.HasPrefix(k, "Access-Control-") {
+			h.Del(k)
+		}
+	}
+	h.Add("Vary", "Origin")
+	allow := c.allowOrigin(r.Header.Get("Origin"))
+	if allow == "" {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", allow)
+	if c.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if c.Expose != "" {
+			h.Set("Access-Control-Expose-Headers", c.Expose)
+		}
+		return
+	}
+	methods := c.Methods
+	if methods == "" {
+		methods = defaultCORSMethods
+	}
+	h.Set("Access-Control-Allow-Methods", methods)
+	if c.Headers != "" {
+		h.Set("Access-Control-Allow-Headers", c.Headers)
+	} else if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+		h.Set("Access-Control-Allow-Headers", req)
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// applyCORS 在 ModifyResponse 中用规则的跨域配置替换上游的跨域响应头
+func applyCORS(rule *ProxyRule, in *http.Request, resp *http.Response) {
+	if rule == nil || rule.CORS == nil || in.Header.Get("Origin") == "" {
+		return
+	}
+	rule.CORS.setHeaders(resp.Header, in, isPreflight(in))
+}
+
+// corsErrorHeaders 代理自己返回错误时也写入跨域头，浏览器中的脚本才能看到 502 等状态码，而不是跨域错误
+func corsErrorHeaders(w http.ResponseWriter, rule *ProxyRule, r *http.Request) {
+	if rule == nil || rule.CORS == nil || r.Header.Get("Origin") == "" {
+		return
+	}
+	rule.CORS.setHeaders(w.Header(), r, false)
+}
+
+// answerPreflight 规则开启 preflight 时直接返回 204 响应预检请求
+func answerPreflight(w http.ResponseWriter, rule *ProxyRule, r *http.Request) bool {
+	if rule == nil || rule.CORS == nil || !rule.CORS.Preflight || !isPreflight(r) {
+		return false
+	}
+	rule.CORS.setHeaders(w.Header(), r, true)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dashboardPath 管理端口上的网页，显示规则、最近的请求和各域名的计数
+const dashboardPath = "/dashboard/"
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// recentRequests 最近完成的请求，供管理页面显示
+const recentLimit = 200
+
+var recentRequests = struct {
+	sync.Mutex
+	entries []accessEntry
+	next    int
+}{}
+
+func recordRecent(e *accessEntry) {
+	recentRequests.Lock()
+	defer recentRequests.Unlock()
+	if len(recentRequests.entries) < recentLimit {
+		recentRequests.entries = append(recentRequests.entries, *e)
+		return
+	}
+	recentRequests.entries[recentRequests.next] = *e
+	recentRequests.next = (recentRequests.next + 1) % recentLimit
+}
+
+// adminRecent 管理接口: GET 最近完成的请求，最新的在前
+func adminRecent(w http.ResponseWriter, r *http.Request) {
+	recentRequests.Lock()
+	n := len(recentRequests.entries)
+	list := make([]map[string]any, 0, n)
+	for i := 0; i < n; i++ {
+		e := recentRequests.entries[(recentRequests.next+n-1-i)%n]
+		list = append(list, map[string]any{
+			"id": e.ID, "time": e.Time.Format(time.RFC3339), "method": e.Method, "url": e.URL,
+			"rule": e.Rule, "upstream": e.Upstream, "status": e.Status, "bytes": e.Bytes,
+			"duration_ms": e.Duration.Milliseconds(),
+		})
+	}
+	recentRequests.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// adminDomains 管理接口: GET 各目标域名的请求数、错误数和流量，来自 Prometheus 指标
+func adminDomains(w http.ResponseWriter, r *http.Request) {
+	type domainStats struct {
+		Domain   string  `json:"domain"`
+		Requests int64   `json:"requests"`
+		Errors   int64   `json:"errors"`
+		BytesIn  int64   `json:"bytes_in"`
+		BytesOut int64   `json:"bytes_out"`
+		AvgMs    float64 `json:"avg_latency_ms"`
+	}
+	byDomain := map[string]*domainStats{}
+	var latency = map[string]float64{}
+	metrics.Lock()
+	for k, v := range metrics.m {
+		d := byDomain[k.domain]
+		if d == nil {
+			d = &domainStats{Domain: k.domain}
+			byDomain[k.domain] = d
+		}
+		for class, n := range v.requests {
+			d.Requests += n
+			if class == 0 || class >= 4 {
+				d.Errors += n
+			}
+		}
+		d.BytesIn += v.bytesIn
+		d.BytesOut += v.bytesOut
+		latency[k.domain] += v.latSumSec
+	}
+	metrics.Unlock()
+	list := make([]*domainStats, 0, len(byDomain))
+	for _, d := range byDomain {
+		if d.Requests > 0 {
+			d.AvgMs = latency[d.Domain] * 1000 / float64(d.Requests)
+		}
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Requests > list[j].Requests })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// adminToggleRule 管理接口: POST ?index=&disabled=true|false 启用或停用规则，?persist=true 写回配置文件
+func adminToggleRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeEditError(w, errMethod)
+		return
+	}
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	disabled, err2 := strconv.ParseBool(r.URL.Query().Get("disabled"))
+	if err != nil || err2 != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "需要 index 和 disabled"})
+		return
+	}
+	c, err := editConfig(persistRequested(r), func(c *ProxyConfig) error {
+		if index < 0 || index >= len(c.ProxyRules) {
+			return errNotFound
+		}
+		c.ProxyRules[index].Disabled = disabled
+		return nil
+	})
+	if err != nil {
+		writeEditError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, encodeRuleList(c.ProxyRules))
+}
+
+func isDashboardAsset(r *http.Request) bool {
+	return r.Method == http.MethodGet && (r.URL.Path == "/" || strings.HasPrefix(r.URL.Path, dashboardPath))
+}
+
+func init() {
+	sub, _ := fs.Sub(dashboardFiles, "dashboard")
+	adminMux.Handle(dashboardPath, http.StripPrefix(dashboardPath, http.FileServer(http.FS(sub))))
+	adminMux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, dashboardPath, http.StatusFound)
+	})
+	adminMux.HandleFunc("/api/recent", adminRecent)
+	adminMux.HandleFunc("/api/domains", adminDomains)
+	adminMux.HandleFunc("/api/rules/toggle", adminToggleRule)
+}
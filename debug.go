@@ -0,0 +1,118 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DebugConfig 调试接口: pprof、expvar、goroutine 和客户端连接列表。使用单独的端口，只能监听本机地址，并且只允许本机访问
+type DebugConfig struct {
+	Listen string `xml:"listen,attr"` // 如 127.0.0.1:6060
+}
+
+func (c *DebugConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return fmt.Errorf("debug listen 格式错误: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("debug listen 只能是本机地址，如 127.0.0.1:6060: %s", c.Listen)
+	}
+	return nil
+}
+
+func init() {
+	expvar.Publish("r_proxy", expvar.Func(func() any {
+		return map[string]any{
+			"goroutines":        runtime.NumGoroutine(),
+			"active_conns":      activeConns.Load(),
+			"inflight_requests": inflightRequests.Load(),
+			"log_dropped":       droppedLogs(),
+		}
+	}))
+}
+
+// startDebug 启动调试端口；只在启动时读取配置，修改 listen 需要重启
+func startDebug() {
+	c := config().Debug
+	if c == nil || c.Listen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", goroutinesHandler)
+	mux.HandleFunc("/debug/connections", connectionsHandler)
+
+	ln, err := listen("debug", c.Listen)
+	if err != nil {
+		log.Printf("调试接口启动失败: %v", err)
+		return
+	}
+	log.Printf("调试接口启动在 http://%s/debug/pprof/", c.Listen)
+	server := &http.Server{Handler: loopbackOnly(mux)}
+	trackServer(server)
+	go server.Serve(ln)
+}
+
+// loopbackOnly 监听地址已经限制为本机，这里再按来源地址检查一次，防止经过端口转发访问
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopback(r.RemoteAddr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// goroutinesHandler 输出所有 goroutine 的完整调用栈
+func goroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "goroutines: %d\n\n", runtime.NumGoroutine())
+	runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// connectionsHandler 列出当前打开的客户端连接，按打开时间排序；CONNECT 隧道和 WebSocket 接管连接后不再列出
+func connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	type row struct {
+		remote, local string
+		info          connInfo
+	}
+	var rows []row
+	clientConns.Range(func(k, v any) bool {
+		c := k.(net.Conn)
+		rows = append(rows, row{c.RemoteAddr().String(), c.LocalAddr().String(), v.(connInfo)})
+		return true
+	})
+	sort.Slice(rows, func(i, j int) bool { return rows[i].info.opened.Before(rows[j].info.opened) })
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	now := time.Now()
+	var b strings.Builder
+	fmt.Fprintf(&b, "connections: %d  inflight requests: %d  goroutines: %d  heap: %d MB\n\n",
+		len(rows), inflightRequests.Load(), runtime.NumGoroutine(), mem.HeapAlloc>>20)
+	for _, r := range rows {
+		fmt.Fprintf(&b, "%-22s -> %-22s %-7s age=%s in_state=%s\n", r.remote, r.local, r.info.state,
+			now.Sub(r.info.opened).Round(time.Second), now.Sub(r.info.changed).Round(time.Second))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNSConfig 直连目标使用的域名解析: 固定的 hosts 映射、自定义 DNS 服务器和解析结果缓存，
+// 公司 DNS 不可用或被污染时直连仍然可以工作
+type DNSConfig struct {
+	// 逗号分隔，如 223.5.5.5,8.8.8.8:53；tls://1.1.1.1 使用 DNS-over-TLS(默认端口 853)，
+	// https://dns.google/dns-query 使用 DNS-over-HTTPS。为空时使用系统 DNS
+	Servers  string    `xml:"servers,attr,omitempty"`
+	CacheTTL string    `xml:"cacheTtl,attr,omitempty"` // 解析结果缓存时间，默认 1m，0 表示不缓存
+	Timeout  string    `xml:"timeout,attr,omitempty"`  // 单次查询超时，默认 5s
+	Hosts    []DNSHost `xml:"host"`
+
+	servers  []dnsServer
+	cacheTTL time.Duration
+	timeout  time.Duration
+	hosts    map[string][]netip.Addr
+	resolver *net.Resolver
+	next     atomic.Uint32
+}
+
+// DNSHost 与 hosts 文件相同的固定解析，ip 可以逗号分隔多个
+type DNSHost struct {
+	Name string `xml:"name,attr"`
+	IP   string `xml:"ip,attr"`
+}
+
+func (c *DNSConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	c.servers = nil
+	for _, s := range strings.Split(c.Servers, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		server, err := c.parseServer(s)
+		if err != nil {
+			return err
+		}
+		c.servers = append(c.servers, server)
+	}
+	c.cacheTTL = time.Minute
+	if c.CacheTTL != "" {
+		d, err := time.ParseDuration(c.CacheTTL)
+		if c.CacheTTL == "0" {
+			d, err = 0, nil
+		}
+		if err != nil {
+			return fmt.Errorf("dns cacheTtl 格式错误: %v", err)
+		}
+		c.cacheTTL = d
+	}
+	c.timeout = 5 * time.Second
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return fmt.Errorf("dns timeout 格式错误: %v", err)
+		}
+		c.timeout = d
+	}
+	c.hosts = map[string][]netip.Addr{}
+	for _, h := range c.Hosts {
+		name := strings.ToLower(strings.TrimSuffix(h.Name, "."))
+		for _, s := range strings.Split(h.IP, ",") {
+			ip, err := netip.ParseAddr(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("dns host %s 的 ip 格式错误: %v", h.Name, err)
+			}
+			c.hosts[name] = append(c.hosts[name], ip)
+		}
+	}
+	c.resolver = net.DefaultResolver
+	if len(c.servers) > 0 {
+		c.resolver = &net.Resolver{PreferGo: true, Dial: c.dialServer}
+	}
+	return nil
+}
+
+// dialServer 替换系统配置的 DNS 服务器，每次查询轮流使用配置的服务器
+func (c *DNSConfig) dialServer(ctx context.Context, network, _ string) (net.Conn, error) {
+	server := c.servers[int(c.next.Add(1)-1)%len(c.servers)]
+	d := net.Dialer{Timeout: c.timeout}
+	switch server.kind {
+	case "tls":
+		return dialDoT(ctx, c, server)
+	case "https":
+		return newDoHConn(ctx, server), nil
+	}
+	return d.DialContext(ctx, network, server.addr)
+}
+
+type dnsEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// dnsCache 解析结果缓存，配置重新加载后继续使用
+var dnsCache sync.Map
+
+// lookupHost 解析直连目标的域名: 先查 hosts，再查缓存，最后使用配置的 DNS 服务器；没有 dns 配置时使用系统解析
+func lookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	c := config().DNS
+	if c == nil {
+		return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if addrs, ok := c.hosts[name]; ok {
+		return addrs, nil
+	}
+	if v, ok := dnsCache.Load(name); ok {
+		if e := v.(dnsEntry); time.Now().Before(e.expires) {
+			return e.addrs, nil
+		}
+		dnsCache.Delete(name)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	addrs, err := c.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if c.cacheTTL > 0 && len(addrs) > 0 {
+		dnsCache.Store(name, dnsEntry{addrs: addrs, expires: time.Now().Add(c.cacheTTL)})
+	}
+	return addrs, nil
+}
+
+// dialResolved 用 lookupHost 的解析结果依次连接，没有 dns 配置时与 net.Dialer 相同
+func dialResolved(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || config().DNS == nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("解析 %s 没有结果", host)
+	}
+	var lastErr error
+	for _, ip := range addrs {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dnsServer 单个 DNS 服务器，kind 为 udp(同时支持 TCP)、tls(DNS-over-TLS)或 https(DNS-over-HTTPS)
+type dnsServer struct {
+	kind   string
+	addr   string // host:port
+	host   string // TLS 握手使用的服务器名
+	url    string
+	client *http.Client
+}
+
+func (c *DNSConfig) parseServer(s string) (dnsServer, error) {
+	switch {
+	case strings.HasPrefix(s, "https://"):
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return dnsServer{}, fmt.Errorf("dns 服务器 %s 格式错误", s)
+		}
+		t := &http.Transport{DialContext: c.bootstrapDial, ForceAttemptHTTP2: true, TLSHandshakeTimeout: c.timeoutOrDefault()}
+		return dnsServer{kind: "https", url: s, client: &http.Client{Transport: t}}, nil
+	case strings.HasPrefix(s, "tls://"):
+		addr := strings.TrimPrefix(s, "tls://")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "853")
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		return dnsServer{kind: "tls", addr: addr, host: host}, nil
+	}
+	addr := strings.TrimPrefix(s, "udp://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	return dnsServer{kind: "udp", addr: addr}, nil
+}
+
+func (c *DNSConfig) timeoutOrDefault() time.Duration {
+	if c.timeout > 0 {
+		return c.timeout
+	}
+	return 5 * time.Second
+}
+
+// bootstrapDial 连接 DoT/DoH 服务器，服务器的域名只查 dns 的 host 配置和系统 DNS，不能再经过自己
+func (c *DNSConfig) bootstrapDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: c.timeoutOrDefault()}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ips := c.hosts[strings.ToLower(host)]; len(ips) > 0 {
+			addr = net.JoinHostPort(ips[0].String(), port)
+		}
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// dialDoT 与服务器建立 TLS 连接，解析器在流式连接上按 DNS over TCP 的格式收发消息
+func dialDoT(ctx context.Context, c *DNSConfig, s dnsServer) (net.Conn, error) {
+	conn, err := c.bootstrapDial(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(conn, &tls.Config{ServerName: s.host})
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("与 DNS 服务器 %s 的 TLS 握手失败: %v", s.addr, err)
+	}
+	return tc, nil
+}
+
+// dohConn 把解析器写入的 DNS 消息(带 2 字节长度前缀)以 application/dns-message POST 给 DoH 服务器，
+// 响应加上长度前缀后供解析器读取
+type dohConn struct {
+	ctx      context.Context
+	server   dnsServer
+	wbuf     bytes.Buffer
+	rbuf     bytes.Buffer
+	err      error
+	deadline time.Time
+}
+
+func newDoHConn(ctx context.Context, s dnsServer) *dohConn {
+	return &dohConn{ctx: ctx, server: s}
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	c.wbuf.Write(p)
+	for c.wbuf.Len() >= 2 {
+		n := int(binary.BigEndian.Uint16(c.wbuf.Bytes()))
+		if c.wbuf.Len() < 2+n {
+			break
+		}
+		msg := make([]byte, n)
+		c.wbuf.Next(2)
+		c.wbuf.Read(msg)
+		resp, err := c.query(msg)
+		if err != nil {
+			c.err = err
+			return 0, err
+		}
+		binary.Write(&c.rbuf, binary.BigEndian, uint16(len(resp)))
+		c.rbuf.Write(resp)
+	}
+	return len(p), nil
+}
+
+func (c *dohConn) query(msg []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.server.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH 服务器 %s 返回 %s", c.server.url, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 12 {
+		return nil, errors.New("DoH 响应不是有效的 DNS 消息")
+	}
+	return b, nil
+}
+
+func (c *dohConn) Read(p []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		return 0, io.EOF
+	}
+	return c.rbuf.Read(p)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+)
+
+// 系统事件级别
+const (
+	eventInfo = iota
+	eventWarning
+	eventError
+)
+
+// eventReporter 操作系统事件日志(目前只有 Windows 事件日志)
+type eventReporter interface {
+	report(kind int, msg string) error
+	close()
+}
+
+var eventSink eventReporter
+
+// systemEvent 记录启动、停止、配置重载等事件。WARN 和失败的日志已由 eventLogWriter 转发，
+// 输出这类日志的地方不需要再调用 systemEvent，否则事件日志中会出现两次
+func systemEvent(kind int, format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	if eventSink != nil {
+		if err := eventSink.report(kind, msg); err != nil {
+			fmt.Fprintf(os.Stderr, "写入事件日志失败: %v\n", err)
+		}
+	}
+}
+
+// eventLogWriter 将错误日志中的 WARN/错误 行转发到事件日志
+type eventLogWriter struct{}
+
+func (eventLogWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimRight(stripLogTime(p), "\n"))
+	switch severityOf(p) {
+	case 3:
+		systemEvent(eventError, "%s", msg)
+	case 4:
+		systemEvent(eventWarning, "%s", msg)
+	}
+	return len(p), nil
+}
+
+func initEventLog() {
+	if config().Log.EventLog == "" {
+		return
+	}
+	r, err := openEventLog(config().Log.EventLog)
+	if err != nil {
+		log.Printf("打开事件日志失败: %v", err)
+		return
+	}
+	eventSink = r
+}
+
+// closeEventLog 记录停止事件并关闭事件日志。停止事件只在 handleStopSignals 收到信号时记录；
+// 程序没有实现服务控制管理器(SCM)的停止/关机回调，作为服务运行时由包装程序停止的进程不会记录停止事件
+func closeEventLog() {
+	if eventSink == nil {
+		return
+	}
+	systemEvent(eventInfo, "代理服务器停止")
+	eventSink.close()
+}
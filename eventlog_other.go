@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func openEventLog(source string) (eventReporter, error) {
+	return nil, errors.New("事件日志仅支持 Windows")
+}
@@ -0,0 +1,64 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32                  = syscall.NewLazyDLL("advapi32.dll")
+	procRegisterEventSourceW  = advapi32.NewProc("RegisterEventSourceW")
+	procDeregisterEventSource = advapi32.NewProc("DeregisterEventSource")
+	procReportEventW          = advapi32.NewProc("ReportEventW")
+)
+
+// Windows 事件类型
+const (
+	eventlogErrorType       = 0x0001
+	eventlogWarningType     = 0x0002
+	eventlogInformationType = 0x0004
+)
+
+type windowsEventLog struct {
+	handle uintptr
+}
+
+func openEventLog(source string) (eventReporter, error) {
+	name, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(name)))
+	if h == 0 {
+		return nil, err
+	}
+	return &windowsEventLog{handle: h}, nil
+}
+
+func (l *windowsEventLog) report(kind int, msg string) error {
+	etype := uint16(eventlogInformationType)
+	eventID := uint32(1)
+	switch kind {
+	case eventWarning:
+		etype, eventID = eventlogWarningType, 2
+	case eventError:
+		etype, eventID = eventlogErrorType, 3
+	}
+	s, err := syscall.UTF16PtrFromString(msg)
+	if err != nil {
+		return err
+	}
+	strs := []*uint16{s}
+	r, _, err := procReportEventW.Call(l.handle, uintptr(etype), 0, uintptr(eventID), 0,
+		1, 0, uintptr(unsafe.Pointer(&strs[0])), 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (l *windowsEventLog) close() {
+	procDeregisterEventSource.Call(l.handle)
+}
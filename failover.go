@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ProxyUpstream 规则的备用上游代理或代理池中的代理
+type ProxyUpstream struct {
+	ProxyURL string `xml:"proxyUrl,attr"`
+	Username string `xml:"username,attr,omitempty"`
+	Password string `xml:"password,attr,omitempty"`
+}
+
+// proxyDown 记录暂时不可用的上游代理和恢复时间，按 proxyUrl 区分，重新加载配置后保留
+var proxyDown sync.Map
+
+func markProxyDown(proxyURL string, cooldown time.Duration) {
+	if _, loaded := proxyDown.Swap(proxyURL, time.Now().Add(cooldown)); !loaded {
+		warnf("上游代理 %s 不可用，%s 内改用备用代理", proxyURL, cooldown)
+	}
+}
+
+func proxyIsDown(proxyURL string) bool {
+	v, ok := proxyDown.Load(proxyURL)
+	if !ok {
+		return false
+	}
+	if time.Now().Before(v.(time.Time)) {
+		return true
+	}
+	proxyDown.CompareAndDelete(proxyURL, v)
+	return false
+}
+
+type failoverUpstream struct {
+	proxyURL  string
+	transport *http.Transport
+	pooled    bool // 属于规则引用的代理池，按池的 strategy 排序
+}
+
+// failoverTransport 依次尝试规则的主代理和备用代理，跳过冷却期内失败过的、健康检查失败的和已熔断的代理；全部失败过时仍按顺序尝试。
+// 每次结果记录到熔断器
+type failoverTransport struct {
+	upstreams []failoverUpstream
+	cooldown  time.Duration
+	breaker   *CircuitBreakerConfig
+	health    *HealthCheckConfig
+	pool      string
+	strategy  string
+}
+
+// initFailover 为配置了 pool、fallback 或熔断的规则创建 failoverTransport，主代理使用 r.transport
+func (c *ProxyConfig) initFailover(r *ProxyRule) error {
+	r.failover = nil
+	if r.Pool != "" && r.ProxyURL != "" {
+		return fmt.Errorf("规则 %s: pool 和 proxyUrl 只能配置一个", ruleName(r))
+	}
+	if len(r.Fallbacks) > 0 && !r.usesProxy() {
+		return fmt.Errorf("规则 %s: 配置 fallback 时需要 proxyUrl 或 pool", ruleName(r))
+	}
+	if !r.usesProxy() || r.Pool == "" && len(r.Fallbacks) == 0 && c.CircuitBreaker == nil {
+		return nil
+	}
+	cooldown := 30 * time.Second
+	if r.FailoverCooldown != "" {
+		d, err := time.ParseDuration(r.FailoverCooldown)
+		if err != nil {
+			return fmt.Errorf("规则 %s: failoverCooldown 格式错误: %v", ruleName(r), err)
+		}
+		cooldown = d
+	}
+	f := &failoverTransport{cooldown: cooldown, breaker: c.CircuitBreaker, health: c.HealthCheck}
+	if r.Pool != "" {
+		pool := c.pool(r.Pool)
+		if pool == nil {
+			return fmt.Errorf("规则 %s: 没有名为 %s 的 proxyPool", ruleName(r), r.Pool)
+		}
+		f.pool, f.strategy = pool.Name, pool.Strategy
+		for _, u := range pool.Proxies {
+			t, err := c.upstreamTransport(r, u)
+			if err != nil {
+				return fmt.Errorf("规则 %s: proxyPool %s 的 %s 配置错误: %v", ruleName(r), pool.Name, u.ProxyURL, err)
+			}
+			f.upstreams = append(f.upstreams, failoverUpstream{proxyURL: u.ProxyURL, transport: t, pooled: true})
+		}
+	} else {
+		f.upstreams = append(f.upstreams, failoverUpstream{proxyURL: r.ProxyURL, transport: r.transport})
+	}
+	for _, u := range r.Fallbacks {
+		t, err := c.upstreamTransport(r, u)
+		if err != nil {
+			return fmt.Errorf("规则 %s: fallback %s 配置错误: %v", ruleName(r), u.ProxyURL, err)
+		}
+		f.upstreams = append(f.upstreams, failoverUpstream{proxyURL: u.ProxyURL, transport: t})
+	}
+	r.failover = f
+	return nil
+}
+
+// upstreamTransport 使用规则的 TLS 设置和 u 的代理地址、认证信息创建 Transport
+func (c *ProxyConfig) upstreamTransport(r *ProxyRule, u ProxyUpstream) (*http.Transport, error) {
+	ur := *r
+	ur.ProxyURL, ur.Username, ur.Password = u.ProxyURL, u.Username, u.Password
+	t, err := proxyTransport(&ur, c.rootCAs)
+	if err != nil {
+		return nil, err
+	}
+	c.Timeouts.apply(t)
+	return t, nil
+}
+
+// candidates 按优先顺序排列本次请求可以使用的代理
+func (f *failoverTransport) candidates() []failoverUpstream {
+	candidates := f.filter(func(u failoverUpstream) bool {
+		return !proxyIsDown(u.proxyURL) && f.health.healthy(u.proxyURL) && f.breaker.allow(u.proxyURL)
+	})
+	if len(candidates) == 0 {
+		candidates = f.filter(func(u failoverUpstream) bool { return f.breaker.allow(u.proxyURL) })
+	}
+	if len(candidates) == 0 {
+		candidates = f.upstreams
+	}
+	return f.order(candidates)
+}
+
+func (f *failoverTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	candidates := f.candidates()
+	// 有请求体的请求失败后请求体已被关闭，不能再发给下一个代理
+	replayable := r.Body == nil || r.Body == http.NoBody
+	var resp *http.Response
+	var err error
+	for i, u := range candidates {
+		resp, err = f.roundTrip(u, r)
+		failed := proxyFailed(resp, err)
+		f.breaker.record(u.proxyURL, failed)
+		if !failed {
+			return resp, err
+		}
+		if len(f.upstreams) > 1 {
+			markProxyDown(u.proxyURL, f.cooldown)
+		}
+		if i == len(candidates)-1 || !replayable || r.Context().Err() != nil {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+	return resp, err
+}
+
+func (f *failoverTransport) filter(keep func(failoverUpstream) bool) []failoverUpstream {
+	var list []failoverUpstream
+	for _, u := range f.upstreams {
+		if keep(u) {
+			list = append(list, u)
+		}
+	}
+	return list
+}
+
+// proxyFailed 无法连接上游代理，或者代理返回 502/504 表示它无法访问目标站点
+func proxyFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return isConnectError(err)
+	}
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout
+}
+
+// usesProxy 规则通过上游代理或代理池访问目标站点
+func (r *ProxyRule) usesProxy() bool {
+	return r.ProxyURL != "" || r.Pool != ""
+}
+
+// upstreamName 日志中显示的上游，代理池显示为 pool:名称
+func (r *ProxyRule) upstreamName() string {
+	if r.Pool != "" {
+		return "pool:" + r.Pool
+	}
+	return r.ProxyURL
+}
+
+// upstreams 规则的主代理(或代理池)和备用代理及其 Transport
+func (r *ProxyRule) upstreams() []failoverUpstream {
+	if r.failover != nil {
+		return r.failover.upstreams
+	}
+	if r.ProxyURL == "" || r.transport == nil {
+		return nil
+	}
+	return []failoverUpstream{{proxyURL: r.ProxyURL, transport: r.transport}}
+}
+
+// proxyURLs 规则可能使用的所有上游代理地址
+func (r *ProxyRule) proxyURLs() []string {
+	var urls []string
+	for _, u := range r.upstreams() {
+		urls = append(urls, u.proxyURL)
+	}
+	return urls
+}
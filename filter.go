@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ContentFilter 按响应的 Content-Type 过滤响应，可限定最小体积
+type ContentFilter struct {
+	Type    string `xml:"type,attr"`              // 如 video/* 或 application/octet-stream
+	Action  string `xml:"action,attr,omitempty"`  // block(默认，返回403) 或 strip(去掉响应体)
+	MinSize string `xml:"minSize,attr,omitempty"` // 响应体超过该大小才过滤，如 100MB
+
+	minSize int64
+}
+
+func (f *ContentFilter) init() error {
+	f.minSize = 0
+	if f.MinSize != "" {
+		n, err := parseSize(f.MinSize)
+		if err != nil {
+			return err
+		}
+		f.minSize = n
+	}
+	return nil
+}
+
+// parseSize 解析 100KB、5MB、1GB 或纯数字(字节)形式的大小
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		n      int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}}
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.n
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("大小格式错误: %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+func (f *ContentFilter) matchType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	pattern := strings.ToLower(f.Type)
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+	return mediaType == pattern
+}
+
+// applyContentFilters 在 ModifyResponse 中调用，返回 true 表示响应已被过滤
+func applyContentFilters(id int64, rule *ProxyRule, resp *http.Response) bool {
+	if rule == nil {
+		return false
+	}
+	ct := resp.Header.Get("Content-Type")
+	for i := range rule.ContentFilters {
+		f := &rule.ContentFilters[i]
+		if !f.matchType(ct) {
+			continue
+		}
+		if f.minSize > 0 && resp.ContentLength >= 0 && resp.ContentLength < f.minSize {
+			continue
+		}
+		if f.minSize > 0 && resp.ContentLength < 0 {
+			// 长度未知时无法提前判断，只能在超过大小后中断连接，响应头此时已发出，只能预先声明阈值
+			resp.Body = &sizeCutter{ReadCloser: resp.Body, remain: f.minSize, id: id}
+			resp.Header.Set("X-Proxy-Filtered", "abort-after="+strconv.FormatInt(f.minSize, 10))
+			return false
+		}
+		log.Printf("id:%d 过滤响应(%s) Content-Type=%s Content-Length=%d", id, f.action(), ct, resp.ContentLength)
+		resp.Body.Close()
+		if f.action() == "strip" {
+			resp.Body = http.NoBody
+			resp.ContentLength = 0
+			resp.Header.Set("Content-Length", "0")
+			resp.Header.Set("X-Proxy-Filtered", "stripped")
+			return true
+		}
+		msg := fmt.Sprintf("响应类型 %s 已被代理策略拦截\n", ct)
+		resp.StatusCode = http.StatusForbidden
+		resp.Status = http.StatusText(http.StatusForbidden)
+		resp.Header = http.Header{}
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		resp.Header.Set("X-Proxy-Filtered", "blocked")
+		resp.Body = io.NopCloser(strings.NewReader(msg))
+		resp.ContentLength = int64(len(msg))
+		return true
+	}
+	return false
+}
+
+func (f *ContentFilter) action() string {
+	if strings.EqualFold(f.Action, "strip") {
+		return "strip"
+	}
+	return "block"
+}
+
+// errResponseFiltered 响应体超过阈值，返回错误而不是 io.EOF，ReverseProxy 会中断连接，
+// 客户端不会把截断的响应当作完整的 200
+var errResponseFiltered = errors.New("response filtered")
+
+// sizeCutter 响应体超过阈值后停止转发
+type sizeCutter struct {
+	io.ReadCloser
+	remain int64
+	id     int64
+}
+
+func (c *sizeCutter) Read(p []byte) (int, error) {
+	if c.remain <= 0 {
+		log.Printf("id:%d 响应体超过过滤阈值，已中断", c.id)
+		return 0, errResponseFiltered
+	}
+	if int64(len(p)) > c.remain {
+		p = p[:c.remain]
+	}
+	n, err := c.ReadCloser.Read(p)
+	c.remain -= int64(n)
+	return n, err
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"time"
+)
+
+// flushInterval 未配置时为 0，由 ReverseProxy 决定: text/event-stream 和未知长度的响应立即发送
+func flushInterval(rule *ProxyRule) time.Duration {
+	if rule == nil {
+		return 0
+	}
+	return rule.flushInterval
+}
+
+// isEventStream Server-Sent Events 响应
+func isEventStream(resp *http.Response) bool {
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return ct == "text/event-stream"
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ForwardedConfig 发给目标站点的转发头。未配置时只由 ReverseProxy 追加 X-Forwarded-For。
+// 客户端不在 trust 中时丢弃它带来的转发头，避免伪造；strip 不发送任何转发头
+type ForwardedConfig struct {
+	XForwarded bool   `xml:"xForwarded,attr,omitempty"` // X-Forwarded-For/Proto/Host
+	Forwarded  bool   `xml:"forwarded,attr,omitempty"`  // RFC 7239 Forwarded
+	Trust      string `xml:"trust,attr,omitempty"`      // 逗号分隔的 IP 或网段，如 10.0.0.0/8,127.0.0.1；* 表示全部信任
+	Strip      bool   `xml:"strip,attr,omitempty"`
+
+	trustAll bool
+	trust    []netip.Prefix
+}
+
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"}
+
+func (c *ForwardedConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	c.trustAll, c.trust = false, nil
+	for _, s := range strings.Split(c.Trust, ",") {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "":
+		case s == "*":
+			c.trustAll = true
+		case strings.Contains(s, "/"):
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return fmt.Errorf("forwardHeaders trust 格式错误: %v", err)
+			}
+			c.trust = append(c.trust, p.Masked())
+		default:
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return fmt.Errorf("forwardHeaders trust 格式错误: %v", err)
+			}
+			c.trust = append(c.trust, netip.PrefixFrom(ip, ip.BitLen()))
+		}
+	}
+	return nil
+}
+
+func (c *ForwardedConfig) trusted(r *http.Request) bool {
+	if c.trustAll {
+		return true
+	}
+	ip, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return false
+	}
+	for _, p := range c.trust {
+		if p.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyForwarded 在 Director 中设置 out 的转发头；X-Forwarded-For 由 ReverseProxy 在已有值后追加客户端 IP，值为 nil 时不添加
+func applyForwarded(in, out *http.Request) {
+	c := config().ForwardHeaders
+	if c == nil {
+		return
+	}
+	if c.Strip || !c.trusted(in) {
+		for _, h := range forwardedHeaders {
+			out.Header.Del(h)
+		}
+	}
+	if c.Strip {
+		out.Header["X-Forwarded-For"] = nil
+		return
+	}
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	if c.XForwarded {
+		if out.Header.Get("X-Forwarded-Proto") == "" {
+			out.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if out.Header.Get("X-Forwarded-Host") == "" {
+			out.Header.Set("X-Forwarded-Host", in.Host)
+		}
+	} else {
+		out.Header["X-Forwarded-For"] = nil
+	}
+	if c.Forwarded {
+		elem := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(clientIP(in)), forwardedValue(in.Host), proto)
+		if prior := out.Header.Get("Forwarded"); prior != "" {
+			elem = prior + ", " + elem
+		}
+		out.Header.Set("Forwarded", elem)
+	}
+}
+
+// forwardedNode IPv6 地址需要加方括号和引号，如 for="[2001:db8::1]"
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue 含有 token 以外字符的值加引号
+func forwardedValue(s string) string {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+		}
+	}
+	return s
+}
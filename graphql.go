@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// GraphQL 请求体最多读取的字节数
+const graphqlBodyLimit = 64 << 10
+
+// GraphQLEndpoint 需要解析操作名的 GraphQL 接口
+type GraphQLEndpoint struct {
+	Domain string `xml:"domain,attr"`
+	Path   string `xml:"path,attr,omitempty"` // 默认 /graphql
+}
+
+func isGraphQLEndpoint(target *url.URL) bool {
+	for _, e := range config().GraphQL {
+		p := e.Path
+		if p == "" {
+			p = "/graphql"
+		}
+		if strings.EqualFold(target.Hostname(), e.Domain) && strings.TrimSuffix(target.Path, "/") == strings.TrimSuffix(p, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	graphqlCommentRe = regexp.MustCompile(`#[^\n]*`)
+	graphqlStringRe  = regexp.MustCompile(`"""(?s:.*?)"""|"(?:[^"\\]|\\.)*"`)
+	graphqlOpRe      = regexp.MustCompile(`\b(query|mutation|subscription)\s*([_A-Za-z][_0-9A-Za-z]*)?`)
+)
+
+// parseGraphQLOperation 从查询文本中取出操作类型和名称，operationName 不为空时查找对应的操作
+func parseGraphQLOperation(query, operationName string) (opType, opName string) {
+	q := graphqlStringRe.ReplaceAllString(query, `""`)
+	q = graphqlCommentRe.ReplaceAllString(q, "")
+	for _, m := range graphqlOpRe.FindAllStringSubmatch(q, -1) {
+		if operationName == "" || m[2] == operationName {
+			return m[1], m[2]
+		}
+	}
+	// 简写形式 { ... } 是匿名查询
+	if strings.HasPrefix(strings.TrimSpace(q), "{") {
+		return "query", operationName
+	}
+	return "", operationName
+}
+
+type graphqlRequest struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+}
+
+// graphqlInfo 识别请求中的 GraphQL 操作，批量请求返回以逗号连接的多个操作名
+func graphqlInfo(r *http.Request) (opType, opName string) {
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		return parseGraphQLOperation(q.Get("query"), q.Get("operationName"))
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", ""
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, graphqlBodyLimit))
+	// 把读取的部分放回请求体，继续正常转发
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil {
+		return "", ""
+	}
+	body = bytes.TrimSpace(body)
+	var reqs []graphqlRequest
+	if len(body) > 0 && body[0] == '[' {
+		json.Unmarshal(body, &reqs)
+	} else {
+		var one graphqlRequest
+		if json.Unmarshal(body, &one) == nil {
+			reqs = append(reqs, one)
+		}
+	}
+	var types, names []string
+	for _, req := range reqs {
+		t, n := parseGraphQLOperation(req.Query, req.OperationName)
+		if t != "" {
+			types = append(types, t)
+		}
+		if n == "" {
+			n = "anonymous"
+		}
+		names = append(names, n)
+	}
+	return strings.Join(types, ","), strings.Join(names, ",")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// isGRPC gRPC 请求，Content-Type 为 application/grpc 或 application/grpc+proto 等
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcTarget gRPC 客户端不能在路径前加目标地址，改用 :authority 指定目标服务，如 grpc.WithAuthority("api.internal:50051")；
+// authority 是本服务器自己时返回空。默认使用 TLS，规则设置 h2c 时改为明文
+func grpcTarget(r *http.Request) string {
+	if !isGRPC(r) || hasScheme(strings.TrimPrefix(r.URL.Path, "/")) || isLocalAuthority(r.Host) {
+		return ""
+	}
+	return "https://" + r.Host + r.URL.Path
+}
+
+// isLocalAuthority 主机名指向本服务器: 端口与监听端口相同，并且是 localhost、监听地址或本机网卡地址
+func isLocalAuthority(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, ""
+	}
+	if port != "" && port != strconv.Itoa(serverPort) {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") || strings.EqualFold(host, serverHost) || host == listenHost {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverProtocols 主端口同时接受 HTTP/1.1、TLS 上的 HTTP/2 和明文 HTTP/2(h2c)，gRPC 客户端可以直接连接
+func serverProtocols() *http.Protocols {
+	p := &http.Protocols{}
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+// newH2CTransport 用明文 HTTP/2 连接 http:// 上游，用于 h2c 的 gRPC 服务
+func newH2CTransport() *http.Transport {
+	t := newDirectTransport(nil)
+	t.Protocols = &http.Protocols{}
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t
+}
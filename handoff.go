@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listenFDsEnv 重启时父进程通过该环境变量告诉新进程传入的文件，如 main=3,admin=4,ready=5；
+// ready 是管道，新进程开始服务后写入一个字节通知父进程
+const listenFDsEnv = "R_PROXY_LISTEN_FDS"
+
+// 新进程就绪的最长等待时间，以及旧进程处理完进行中请求的最长时间
+const (
+	handoffReadyTimeout = 30 * time.Second
+	handoffDrainTimeout = 30 * time.Second
+)
+
+// inheritedFiles 父进程传来的文件，按名称取出后删除
+var inheritedFiles = struct {
+	sync.Mutex
+	m      map[string]*os.File
+	parsed bool
+}{m: map[string]*os.File{}}
+
+func inheritedFile(name string) *os.File {
+	inheritedFiles.Lock()
+	defer inheritedFiles.Unlock()
+	if !inheritedFiles.parsed {
+		inheritedFiles.parsed = true
+		for _, kv := range strings.Split(os.Getenv(listenFDsEnv), ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			fd, err := strconv.Atoi(v)
+			if ok && err == nil {
+				inheritedFiles.m[k] = os.NewFile(uintptr(fd), k)
+			}
+		}
+		os.Unsetenv(listenFDsEnv)
+	}
+	f := inheritedFiles.m[name]
+	delete(inheritedFiles.m, name)
+	return f
+}
+
+// servers 本进程的监听 socket 和服务器，重启时传给新进程并停止
+var servers = struct {
+	sync.Mutex
+	listeners map[string]net.Listener
+	list      []*http.Server
+}{listeners: map[string]net.Listener{}}
+
+// listen 地址相同时使用父进程传来的监听 socket，否则新建；name 区分主端口、管理端口和重定向端口
+func listen(name, addr string) (net.Listener, error) {
+	var ln net.Listener
+	if f := inheritedFile(name); f != nil {
+		l, err := net.FileListener(f)
+		f.Close()
+		switch {
+		case err != nil:
+			log.Printf("[WARN] 使用父进程传来的 %s 监听 socket 失败: %v", name, err)
+		case !sameAddr(l.Addr(), addr):
+			// 监听地址已修改，旧 socket 随父进程退出关闭
+			l.Close()
+		default:
+			ln = l
+		}
+	}
+	if ln == nil {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		ln = l
+	}
+	servers.Lock()
+	servers.listeners[name] = ln
+	servers.Unlock()
+	return ln, nil
+}
+
+func sameAddr(a net.Addr, addr string) bool {
+	ta, ok := a.(*net.TCPAddr)
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if !ok || err != nil || ta.Port != want.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return ta.IP.IsUnspecified()
+	}
+	return ta.IP.Equal(want.IP)
+}
+
+// trackServer 记录服务器，重启时停止接受新连接并处理完进行中的请求
+func trackServer(s *http.Server) {
+	servers.Lock()
+	defer servers.Unlock()
+	servers.list = append(servers.list, s)
+}
+
+// notifyReady 主端口开始服务前调用，通知父进程可以退出；新进程启动失败时管道只会读到 EOF
+func notifyReady() {
+	if f := inheritedFile("ready"); f != nil {
+		f.Write([]byte{1})
+		f.Close()
+	}
+}
+
+// passListeners 把监听 socket 和就绪管道加入 cmd 的 ExtraFiles；返回的函数在 cmd 启动后调用，等待新进程就绪。
+// Windows 等不支持传递 socket 的系统返回错误，此时按原来的方式重启
+func passListeners(cmd *exec.Cmd) (func() error, error) {
+	servers.Lock()
+	defer servers.Unlock()
+	if len(servers.listeners) == 0 {
+		return nil, errors.New("没有监听 socket")
+	}
+	var files []*os.File
+	var fds []string
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for name, ln := range servers.listeners {
+		tl, ok := ln.(*net.TCPListener)
+		if !ok {
+			closeAll()
+			return nil, fmt.Errorf("%s 不是 TCP 监听", name)
+		}
+		f, err := tl.File()
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+		fds = append(fds, fmt.Sprintf("%s=%d", name, 2+len(files)))
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	files = append(files, w)
+	fds = append(fds, fmt.Sprintf("ready=%d", 2+len(files)))
+
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), listenFDsEnv+"="+strings.Join(fds, ","))
+	return func() error {
+		// 父进程的副本在新进程启动后关闭，新进程关闭或退出时管道读到 EOF
+		closeAll()
+		defer r.Close()
+		done := make(chan bool, 1)
+		go func() {
+			n, _ := r.Read(make([]byte, 1))
+			done <- n == 1
+		}()
+		select {
+		case ok := <-done:
+			if !ok {
+				cmd.Wait()
+				return errors.New("新进程启动失败")
+			}
+			return nil
+		case <-time.After(handoffReadyTimeout):
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("新进程 %s 内没有就绪", handoffReadyTimeout)
+		}
+	}, nil
+}
+
+// shutdownServers 停止接受新连接，等待进行中的请求完成
+func shutdownServers() {
+	ctx, cancel := context.WithTimeout(context.Background(), handoffDrainTimeout)
+	defer cancel()
+	servers.Lock()
+	list := servers.list
+	servers.Unlock()
+	var wg sync.WaitGroup
+	for _, s := range list {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			s.Shutdown(ctx)
+		}(s)
+	}
+	wg.Wait()
+}
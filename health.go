@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// 健康检查接口，主端口和管理端口都提供
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// lastReload 最近一次重新加载配置的结果，失败时继续使用旧配置
+var lastReload struct {
+	sync.Mutex
+	time time.Time
+	err  string
+}
+
+func recordReload(err error) {
+	lastReload.Lock()
+	defer lastReload.Unlock()
+	lastReload.time = time.Now()
+	lastReload.err = ""
+	if err != nil {
+		lastReload.err = err.Error()
+	}
+}
+
+// upstreamProbe 上游代理的 TCP 探测结果，缓存一段时间避免频繁的健康检查打到代理上
+type upstreamProbe struct {
+	ok      bool
+	err     string
+	checked time.Time
+}
+
+const upstreamProbeTTL = 10 * time.Second
+
+var upstreamProbes = struct {
+	sync.Mutex
+	m map[string]upstreamProbe
+}{m: map[string]upstreamProbe{}}
+
+func probeUpstream(proxyURL string) upstreamProbe {
+	upstreamProbes.Lock()
+	p, ok := upstreamProbes.m[proxyURL]
+	upstreamProbes.Unlock()
+	if ok && time.Since(p.checked) < upstreamProbeTTL {
+		return p
+	}
+	p = upstreamProbe{checked: time.Now()}
+	u, err := url.Parse(proxyURL)
+	if err == nil {
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}[u.Scheme]
+		}
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), 2*time.Second); err == nil {
+			conn.Close()
+		}
+	}
+	p.ok = err == nil
+	if err != nil {
+		p.err = err.Error()
+	}
+	upstreamProbes.Lock()
+	upstreamProbes.m[proxyURL] = p
+	upstreamProbes.Unlock()
+	return p
+}
+
+// healthzHandler 进程存活即返回 200
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// readyzHandler 报告配置加载状态和各上游代理是否可连接；配置未加载，或者配置了上游代理但全部无法连接时返回 503
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	loaded := currentConfig.Load() != nil
+	c := config()
+	seen := map[string]bool{}
+	upstreams := map[string]any{}
+	reachable := 0
+	for _, rule := range append([]ProxyRule{c.DefaultProxy}, c.ProxyRules...) {
+		for _, proxyURL := range rule.proxyURLs() {
+			if seen[proxyURL] {
+				continue
+			}
+			seen[proxyURL] = true
+			// 配置了 healthCheck 时使用后台检查的结果，否则只检查能否连接到代理
+			p, checked := healthStatus(proxyURL)
+			if c.HealthCheck == nil || !checked {
+				p = probeUpstream(proxyURL)
+			}
+			if p.ok {
+				reachable++
+			}
+			// 上游代理地址可能带认证信息，只显示主机
+			name := proxyURL
+			if u, err := url.Parse(proxyURL); err == nil {
+				name = u.Scheme + "://" + u.Host
+			}
+			upstreams[name] = map[string]any{"reachable": p.ok, "error": p.err, "checked": p.checked.Format(time.RFC3339)}
+		}
+	}
+
+	lastReload.Lock()
+	reload := map[string]any{}
+	if !lastReload.time.IsZero() {
+		reload = map[string]any{"time": lastReload.time.Format(time.RFC3339), "error": lastReload.err}
+	}
+	lastReload.Unlock()
+
+	ready := loaded && (len(upstreams) == 0 || reachable > 0)
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]any{
+		"ready":       ready,
+		"config":      map[string]any{"loaded": loaded, "file": configFile, "rules": len(c.ProxyRules), "lastReload": reload},
+		"upstreams":   upstreams,
+		"reachable":   reachable,
+		"unreachable": len(upstreams) - reachable,
+	})
+}
+
+func init() {
+	adminMux.HandleFunc(healthzPath, healthzHandler)
+	adminMux.HandleFunc(readyzPath, readyzHandler)
+}
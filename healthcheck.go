@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig 定时通过每个上游代理访问 url 检查代理是否可用，路由时跳过检查失败的代理。
+// method="head" 发送 HEAD 请求，收到 502/504 以外的响应即可用；method="connect" 只检查代理能否建立到 url 主机的隧道
+type HealthCheckConfig struct {
+	URL      string `xml:"url,attr"`
+	Method   string `xml:"method,attr,omitempty"`   // head(默认) 或 connect
+	Interval string `xml:"interval,attr,omitempty"` // 默认 30s
+	Timeout  string `xml:"timeout,attr,omitempty"`  // 默认 5s
+
+	target   *url.URL
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func (c *HealthCheckConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("healthCheck url 格式错误: %s", c.URL)
+	}
+	c.target = u
+	switch c.Method {
+	case "", "head", "connect":
+	default:
+		return fmt.Errorf("healthCheck method 只能是 head 或 connect: %s", c.Method)
+	}
+	c.interval, c.timeout = 30*time.Second, 5*time.Second
+	for _, d := range []struct {
+		name string
+		s    string
+		v    *time.Duration
+	}{{"interval", c.Interval, &c.interval}, {"timeout", c.Timeout, &c.timeout}} {
+		if d.s == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.s)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("healthCheck %s 格式错误: %s", d.name, d.s)
+		}
+		*d.v = v
+	}
+	return nil
+}
+
+// proxyHealth 最近一次健康检查的结果，按 proxyUrl 区分
+var proxyHealth = struct {
+	sync.Mutex
+	m map[string]upstreamProbe
+}{m: map[string]upstreamProbe{}}
+
+// healthy 没有配置健康检查或还没有检查过时视为可用
+func (c *HealthCheckConfig) healthy(proxyURL string) bool {
+	if c == nil {
+		return true
+	}
+	p, ok := healthStatus(proxyURL)
+	return !ok || p.ok
+}
+
+func healthStatus(proxyURL string) (upstreamProbe, bool) {
+	proxyHealth.Lock()
+	defer proxyHealth.Unlock()
+	p, ok := proxyHealth.m[proxyURL]
+	return p, ok
+}
+
+// startHealthChecks 后台按间隔检查当前配置中的所有上游代理，重新加载配置后使用新的设置
+func startHealthChecks() {
+	go func() {
+		for {
+			c := config()
+			if c.HealthCheck == nil {
+				time.Sleep(10 * time.Second)
+				continue
+			}
+			c.HealthCheck.checkAll(c)
+			time.Sleep(c.HealthCheck.interval)
+		}
+	}()
+}
+
+func (c *HealthCheckConfig) checkAll(cfg *ProxyConfig) {
+	seen := map[string]bool{}
+	var wg sync.WaitGroup
+	for _, rule := range append([]ProxyRule{cfg.DefaultProxy}, cfg.ProxyRules...) {
+		for _, u := range rule.upstreams() {
+			if seen[u.proxyURL] {
+				continue
+			}
+			seen[u.proxyURL] = true
+			wg.Add(1)
+			go func(u failoverUpstream) {
+				defer wg.Done()
+				c.check(u)
+			}(u)
+		}
+	}
+	wg.Wait()
+}
+
+func (c *HealthCheckConfig) check(u failoverUpstream) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	err := c.probe(ctx, u.transport)
+	p := upstreamProbe{ok: err == nil, checked: time.Now()}
+	if err != nil {
+		p.err = err.Error()
+	}
+	proxyHealth.Lock()
+	prev, seen := proxyHealth.m[u.proxyURL]
+	proxyHealth.m[u.proxyURL] = p
+	proxyHealth.Unlock()
+	switch {
+	case !p.ok && (!seen || prev.ok):
+		warnf("上游代理 %s 健康检查失败: %v", u.proxyURL, err)
+	case p.ok && seen && !prev.ok:
+		warnf("上游代理 %s 健康检查恢复", u.proxyURL)
+	}
+}
+
+// errTunnelOK connect 检查在代理返回 200 后中止请求
+var errTunnelOK = errors.New("tunnel established")
+
+func (c *HealthCheckConfig) probe(ctx context.Context, t *http.Transport) error {
+	target := c.target
+	if c.Method == "connect" {
+		port := target.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443"}[target.Scheme]
+		}
+		addr := net.JoinHostPort(target.Hostname(), port)
+		if t.Proxy == nil {
+			// SOCKS5 代理在拨号时完成到目标的连接
+			conn, err := t.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+		t = t.Clone()
+		t.OnProxyConnectResponse = func(ctx context.Context, proxyURL *url.URL, req *http.Request, resp *http.Response) error {
+			if resp.StatusCode == http.StatusOK {
+				return errTunnelOK
+			}
+			return nil
+		}
+		defer t.CloseIdleConnections()
+		target = &url.URL{Scheme: "https", Host: addr, Path: "/"}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.RoundTrip(req)
+	if errors.Is(err, errTunnelOK) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if proxyFailed(resp, nil) {
+		return fmt.Errorf("代理返回 %s", resp.Status)
+	}
+	return nil
+}
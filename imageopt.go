@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// 图片优化最多处理的原图大小和像素数，按文件头中的尺寸判断，
+// 很小的文件也可能声明巨大的尺寸，解码时耗尽内存
+const (
+	maxImageSize   = 20 << 20
+	maxImagePixels = 24 << 20
+)
+
+// ImageOptimize 图片压缩配置：超过最大尺寸时等比缩小，并重新压缩 JPEG/PNG。
+// 标准库没有 WebP 编码器，因此不做 WebP 转换
+type ImageOptimize struct {
+	MaxWidth  int `xml:"maxWidth,attr,omitempty"`
+	MaxHeight int `xml:"maxHeight,attr,omitempty"`
+	Quality   int `xml:"quality,attr,omitempty"` // JPEG 质量 1-100，默认 75
+}
+
+func (o *ImageOptimize) quality() int {
+	if o.Quality <= 0 || o.Quality > 100 {
+		return 75
+	}
+	return o.Quality
+}
+
+// targetSize 计算等比缩放后的尺寸
+func (o *ImageOptimize) targetSize(w, h int) (int, int) {
+	scale := 1.0
+	if o.MaxWidth > 0 && w > o.MaxWidth {
+		scale = float64(o.MaxWidth) / float64(w)
+	}
+	if o.MaxHeight > 0 && h > o.MaxHeight {
+		if s := float64(o.MaxHeight) / float64(h); s < scale {
+			scale = s
+		}
+	}
+	if scale >= 1 {
+		return w, h
+	}
+	return max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+}
+
+// pixelFunc 返回读取像素的函数(16 位预乘 RGBA)，JPEG 解码得到的 YCbCr 和 PNG 常见的 RGBA/NRGBA 直接读取像素数据；
+// 其他类型通过 At 读取，每个像素都要分配一个 color.Color，大图会慢很多
+func pixelFunc(src image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch m := src.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			yi, ci := m.YOffset(x, y), m.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(m.Y[yi], m.Cb[ci], m.Cr[ci])
+			return uint32(r) * 0x101, uint32(g) * 0x101, uint32(b) * 0x101, 0xffff
+		}
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := m.Pix[m.PixOffset(x, y):]
+			return uint32(p[0]) * 0x101, uint32(p[1]) * 0x101, uint32(p[2]) * 0x101, uint32(p[3]) * 0x101
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := m.Pix[m.PixOffset(x, y):]
+			return color.NRGBA{R: p[0], G: p[1], B: p[2], A: p[3]}.RGBA()
+		}
+	}
+	return func(x, y int) (uint32, uint32, uint32, uint32) { return src.At(x, y).RGBA() }
+}
+
+// resizeImage 使用区域平均法缩小图片，缩小时比最近邻插值更清晰
+func resizeImage(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	at := pixelFunc(src)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := b.Dx(), b.Dy()
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*sh/h
+		y1 := max(y0+1, b.Min.Y+(y+1)*sh/h)
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*sw/w
+			x1 := max(x0+1, b.Min.X+(x+1)*sw/w)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := at(sx, sy)
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(bl / n >> 8), A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// applyImageOptimize 缩小并重新压缩 JPEG/PNG 图片，结果不比原图小时保留原图
+func applyImageOptimize(id int64, rule *ProxyRule, resp *http.Response) error {
+	if rule == nil || rule.Image == nil || !isIdentityEncoding(resp) {
+		return nil
+	}
+	ct := strings.ToLower(resp.Header.Get("Content-Type"))
+	isJPEG := strings.HasPrefix(ct, "image/jpeg") || strings.HasPrefix(ct, "image/jpg")
+	isPNG := strings.HasPrefix(ct, "image/png")
+	if !isJPEG && !isPNG {
+		return nil
+	}
+	body, ok, err := readBodyLimited(resp, maxImageSize)
+	if err != nil || !ok {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil || int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		setBody(resp, body)
+		return nil
+	}
+	// 重新编码会丢掉 EXIF，带旋转方向的照片(手机拍摄的常见)会显示成横躺的，这类图片保持原样
+	if isJPEG && jpegOrientation(body) > 1 {
+		setBody(resp, body)
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		setBody(resp, body)
+		return nil
+	}
+	b := img.Bounds()
+	if w, h := rule.Image.targetSize(b.Dx(), b.Dy()); w != b.Dx() || h != b.Dy() {
+		img = resizeImage(img, w, h)
+	}
+	var buf bytes.Buffer
+	if isJPEG {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: rule.Image.quality()})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	if err != nil || buf.Len() >= len(body) {
+		setBody(resp, body)
+		return nil
+	}
+	log.Printf("id:%d 图片压缩 %dx%d %d -> %d 字节", id, b.Dx(), b.Dy(), len(body), buf.Len())
+	setBody(resp, buf.Bytes())
+	return nil
+}
+
+// jpegOrientation 读取 JPEG 中 EXIF 的 Orientation 标签，没有时返回 0
+func jpegOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return 0
+	}
+	for i := 2; i+4 <= len(b) && b[i] == 0xff; {
+		marker, size := b[i+1], int(binary.BigEndian.Uint16(b[i+2:]))
+		// 图像数据之前没有 EXIF 就不会再有
+		if marker == 0xda || size < 2 || i+2+size > len(b) {
+			return 0
+		}
+		seg := b[i+4 : i+2+size]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return exifOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 0
+}
+
+// exifOrientation 在 TIFF 格式的 IFD0 中查找 0x0112 标签
+func exifOrientation(t []byte) int {
+	if len(t) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(t[4:]))
+	if ifd < 8 || ifd+2 > len(t) {
+		return 0
+	}
+	n := int(order.Uint16(t[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(t) {
+			return 0
+		}
+		if order.Uint16(t[e:]) == 0x0112 {
+			return int(order.Uint16(t[e+8:]))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// clientRewriteScript 注入到 HTML 中的脚本，在浏览器端把 fetch/XHR/动态创建元素等使用的
+// 站点根路径和绝对地址改写为经过代理的地址，弥补服务端改写覆盖不到的单页应用
+const clientRewriteScript = `<script data-r-proxy>(function(){
+var m=location.pathname.match(/^\/(https?):\/+([^\/]+)/);if(!m)return;
+var P=location.origin,T=m[1]+'://'+m[2];
+function rw(u){if(typeof u!=='string'&&!(u instanceof URL))return u;u=String(u);
+if(/^(data|blob|javascript|about|mailto):/i.test(u)||u.charAt(0)==='#')return u;
+if(u.indexOf(P+'/http')===0)return u;
+if(u.indexOf('//')===0)u=m[1]+':'+u;
+else if(u.charAt(0)==='/')return P+'/'+T+u;
+else if(u.indexOf(P+'/')===0)return P+'/'+T+u.substring(P.length);
+if(/^https?:\/\//i.test(u))return P+'/'+u;return u}
+var f=window.fetch;if(f)window.fetch=function(i,o){if(i instanceof Request)i=new Request(rw(i.url),i);else i=rw(i);return f.call(this,i,o)};
+var x=XMLHttpRequest.prototype.open;XMLHttpRequest.prototype.open=function(){var a=[].slice.call(arguments);a[1]=rw(a[1]);return x.apply(this,a)};
+var w=window.open;window.open=function(u){var a=[].slice.call(arguments);a[0]=rw(u);return w.apply(this,a)};
+if(window.WebSocket){var W=WebSocket;window.WebSocket=function(u,p){u=String(u).replace(/^ws/i,'http');u=rw(u).replace(/^http/i,'ws');return p===undefined?new W(u):new W(u,p)};window.WebSocket.prototype=W.prototype}
+if(window.EventSource){var E=EventSource;window.EventSource=function(u,o){return new E(rw(u),o)};window.EventSource.prototype=E.prototype}
+var s=Element.prototype.setAttribute;Element.prototype.setAttribute=function(n,v){var l=String(n).toLowerCase();if(l==='src'||l==='href'||l==='action'||l==='poster')v=rw(v);return s.call(this,n,v)};
+[[HTMLImageElement,'src'],[HTMLScriptElement,'src'],[HTMLLinkElement,'href'],[HTMLAnchorElement,'href'],[HTMLIFrameElement,'src'],[HTMLFormElement,'action'],[HTMLSourceElement,'src'],[HTMLMediaElement,'src']].forEach(function(e){
+var d=Object.getOwnPropertyDescriptor(e[0].prototype,e[1]);if(!d||!d.set)return;
+Object.defineProperty(e[0].prototype,e[1],{get:d.get,set:function(v){d.set.call(this,rw(v))},configurable:true})});
+var h=history.pushState,r=history.replaceState;
+history.pushState=function(a,b,u){return h.call(this,a,b,u==null?u:rw(u))};history.replaceState=function(a,b,u){return r.call(this,a,b,u==null?u:rw(u))};
+})();</script>`
+
+var headOpenRe = regexp.MustCompile(`(?i)<head[^>]*>`)
+
+// injectIntoHead 在 <head> 之后插入内容，没有 head 时插在 <html> 之后或文档开头
+func injectIntoHead(body []byte, snippet string) []byte {
+	loc := headOpenRe.FindIndex(body)
+	if loc == nil {
+		loc = regexp.MustCompile(`(?i)<html[^>]*>`).FindIndex(body)
+	}
+	pos := 0
+	if loc != nil {
+		pos = loc[1]
+	}
+	out := make([]byte, 0, len(body)+len(snippet))
+	out = append(out, body[:pos]...)
+	out = append(out, snippet...)
+	return append(out, body[pos:]...)
+}
+
+func isHTML(resp *http.Response) bool {
+	return strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "text/html")
+}
+
+// applyScriptInject 向 HTML 响应注入客户端URL改写脚本
+func applyScriptInject(rule *ProxyRule, resp *http.Response) error {
+	if rule == nil || !rule.InjectScript || !isIdentityEncoding(resp) || !isHTML(resp) {
+		return nil
+	}
+	body, ok, err := readBodyLimited(resp, defaultRewriteMaxSize)
+	if err != nil || !ok {
+		return err
+	}
+	if !bytes.Contains(body, []byte("data-r-proxy")) {
+		body = injectIntoHead(body, clientRewriteScript)
+	}
+	// 页面的 CSP 会阻止内联脚本执行
+	resp.Header.Del("Content-Security-Policy")
+	setBody(resp, body)
+	return nil
+}
+
+// proxyOrigin 客户端访问代理使用的地址，如 http://localhost:3000
+func proxyOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// proxiedURL 将目标地址转换为经过代理的地址
+func proxiedURL(origin string, u *url.URL) string {
+	return origin + "/" + u.String()
+}
+
+var baseTagRe = regexp.MustCompile(`(?i)<base\b[^>]*?\bhref\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)[^>]*>`)
+
+// applyBaseHref 注入或修改 <base> 标签，使相对链接相对于目标页面所在目录解析，
+// 而不是代理根路径(如 /https:/example.com 下的 a.html 会被解析成 /https:/a.html)
+func applyBaseHref(origin string, target *url.URL, rule *ProxyRule, resp *http.Response) error {
+	if rule == nil || !rule.BaseHref || !isIdentityEncoding(resp) || !isHTML(resp) {
+		return nil
+	}
+	body, ok, err := readBodyLimited(resp, defaultRewriteMaxSize)
+	if err != nil || !ok {
+		return err
+	}
+	dir := *target
+	dir.RawQuery, dir.Fragment = "", ""
+	if i := strings.LastIndex(dir.Path, "/"); i >= 0 {
+		dir.Path = dir.Path[:i+1]
+	} else {
+		dir.Path = "/"
+	}
+	dir.RawPath = ""
+
+	if loc := baseTagRe.FindSubmatchIndex(body); loc != nil {
+		// 页面已有 base 时按目标地址解析后再转换为代理地址
+		raw := html.UnescapeString(strings.Trim(string(body[loc[2]:loc[3]]), `"'`))
+		if ref, err := target.Parse(raw); err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+			href := `"` + html.EscapeString(proxiedURL(origin, ref)) + `"`
+			body = append(body[:loc[2]:loc[2]], append([]byte(href), body[loc[3]:]...)...)
+		}
+	} else {
+		body = injectIntoHead(body, `<base href="`+html.EscapeString(proxiedURL(origin, &dir))+`">`)
+	}
+	setBody(resp, body)
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalWriter 通过 journald 原生协议写日志，带 REQUEST_ID/TARGET_HOST/STATUS 等字段，
+// 可以用 journalctl REQUEST_ID=123 过滤
+type journalWriter struct {
+	conn       *net.UnixConn
+	addr       *net.UnixAddr
+	identifier string
+}
+
+func newJournalWriter(identifier string) (*journalWriter, error) {
+	if _, err := os.Stat(journalSocket); err != nil {
+		return nil, fmt.Errorf("journald socket 不存在: %v", err)
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalWriter{
+		conn:       conn,
+		addr:       &net.UnixAddr{Name: journalSocket, Net: "unixgram"},
+		identifier: identifier,
+	}, nil
+}
+
+// appendField 按 journald 协议追加字段，值包含换行时使用长度前缀格式
+func appendField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteString(key)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (j *journalWriter) send(priority int, msg string, fields map[string]string) error {
+	var buf bytes.Buffer
+	appendField(&buf, "MESSAGE", msg)
+	appendField(&buf, "PRIORITY", strconv.Itoa(priority))
+	appendField(&buf, "SYSLOG_IDENTIFIER", j.identifier)
+	for k, v := range fields {
+		appendField(&buf, k, v)
+	}
+	_, err := j.conn.WriteToUnix(buf.Bytes(), j.addr)
+	return err
+}
+
+func (j *journalWriter) writeAccess(e *accessEntry) {
+	if e.Final {
+		return
+	}
+	fields := map[string]string{}
+	if e.ID != 0 {
+		fields["REQUEST_ID"] = strconv.FormatInt(e.ID, 10)
+	}
+	if e.Host != "" {
+		fields["TARGET_HOST"] = e.Host
+	}
+	if e.Status != 0 {
+		fields["STATUS"] = strconv.Itoa(e.Status)
+	}
+	priority := 6
+	if e.Status >= 500 {
+		priority = 4
+	}
+	j.send(priority, e.Line, fields)
+}
+
+// Write 用于错误日志，级别按日志前缀判断
+func (j *journalWriter) Write(p []byte) (int, error) {
+	msg := bytes.TrimRight(stripLogTime(p), "\n")
+	if err := j.send(severityOf(msg), string(msg), nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
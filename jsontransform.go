@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// JSONTransform JSON 响应字段处理，path 为 JSONPath 子集:
+// $.a.b、$['a']、$.list[0]、$.list[*].x、$..password
+type JSONTransform struct {
+	Path   string `xml:"path,attr"`
+	Action string `xml:"action,attr"`         // remove / rename / mask
+	To     string `xml:"to,attr,omitempty"`   // rename 的新字段名
+	Keep   int    `xml:"keep,attr,omitempty"` // mask 时保留末尾的字符数
+
+	segs []pathSeg
+}
+
+type pathSeg struct {
+	name      string // 字段名，"*" 表示所有字段
+	index     int    // 数组下标，name 和 index 只有一个有效
+	isIndex   bool
+	recursive bool // ..name
+}
+
+func (t *JSONTransform) init() error {
+	segs, err := parseJSONPath(t.Path)
+	if err != nil {
+		return err
+	}
+	if len(segs) == 0 {
+		return fmt.Errorf("JSONPath %q 不能只有 $", t.Path)
+	}
+	switch t.Action {
+	case "remove", "mask":
+	case "rename":
+		if t.To == "" {
+			return fmt.Errorf("JSONPath %q 的 rename 缺少 to 属性", t.Path)
+		}
+	default:
+		return fmt.Errorf("JSONPath %q 未知的 action: %s", t.Path, t.Action)
+	}
+	t.segs = segs
+	return nil
+}
+
+func parseJSONPath(p string) ([]pathSeg, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("JSONPath %q 必须以 $ 开头", p)
+	}
+	var segs []pathSeg
+	s := p[1:]
+	for s != "" {
+		recursive := false
+		switch {
+		case strings.HasPrefix(s, ".."):
+			recursive = true
+			s = s[2:]
+		case s[0] == '.':
+			s = s[1:]
+		}
+		if s == "" {
+			return nil, fmt.Errorf("JSONPath %q 格式错误", p)
+		}
+		if s[0] == '[' {
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q 缺少 ]", p)
+			}
+			inner := strings.TrimSpace(s[1:end])
+			s = s[end+1:]
+			switch {
+			case inner == "*":
+				segs = append(segs, pathSeg{name: "*", recursive: recursive})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"'):
+				segs = append(segs, pathSeg{name: inner[1 : len(inner)-1], recursive: recursive})
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("JSONPath %q 下标错误: %s", p, inner)
+				}
+				segs = append(segs, pathSeg{index: n, isIndex: true, recursive: recursive})
+			}
+			continue
+		}
+		end := strings.IndexAny(s, ".[")
+		if end < 0 {
+			end = len(s)
+		}
+		segs = append(segs, pathSeg{name: s[:end], recursive: recursive})
+		s = s[end:]
+	}
+	return segs, nil
+}
+
+// apply 在 node 上执行变换，返回是否有修改
+func (t *JSONTransform) apply(node any) bool {
+	return t.walk(node, t.segs)
+}
+
+func (t *JSONTransform) walk(node any, segs []pathSeg) bool {
+	seg := segs[0]
+	last := len(segs) == 1
+	changed := false
+
+	if seg.recursive {
+		// 递归匹配: 先在当前层匹配，再向下层继续查找同样的路径
+		switch n := node.(type) {
+		case map[string]any:
+			for _, v := range n {
+				changed = t.walk(v, segs) || changed
+			}
+		case []any:
+			for _, v := range n {
+				changed = t.walk(v, segs) || changed
+			}
+		}
+		seg.recursive = false
+		return t.walk(node, append([]pathSeg{seg}, segs[1:]...)) || changed
+	}
+
+	switch n := node.(type) {
+	case map[string]any:
+		if seg.isIndex {
+			return false
+		}
+		var keys []string
+		if seg.name == "*" {
+			for k := range n {
+				keys = append(keys, k)
+			}
+		} else if _, ok := n[seg.name]; ok {
+			keys = []string{seg.name}
+		}
+		for _, k := range keys {
+			if last {
+				t.applyField(n, k)
+				changed = true
+			} else {
+				changed = t.walk(n[k], segs[1:]) || changed
+			}
+		}
+	case []any:
+		var idx []int
+		switch {
+		case seg.name == "*":
+			for i := range n {
+				idx = append(idx, i)
+			}
+		case seg.isIndex && seg.index >= 0 && seg.index < len(n):
+			idx = []int{seg.index}
+		case seg.isIndex && seg.index < 0 && -seg.index <= len(n):
+			idx = []int{len(n) + seg.index}
+		}
+		for _, i := range idx {
+			if last {
+				// 数组元素不能删除或改名，只支持 mask
+				if t.Action == "mask" {
+					n[i] = t.mask(n[i])
+					changed = true
+				}
+			} else {
+				changed = t.walk(n[i], segs[1:]) || changed
+			}
+		}
+	}
+	return changed
+}
+
+func (t *JSONTransform) applyField(m map[string]any, k string) {
+	switch t.Action {
+	case "remove":
+		delete(m, k)
+	case "rename":
+		v := m[k]
+		delete(m, k)
+		m[t.To] = v
+	case "mask":
+		m[k] = t.mask(m[k])
+	}
+}
+
+// mask 字符串保留末尾 keep 个字符，其他类型替换为 "***"
+func (t *JSONTransform) mask(v any) any {
+	if v == nil {
+		return nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "***"
+	}
+	r := []rune(s)
+	if t.Keep <= 0 || t.Keep >= len(r) {
+		return strings.Repeat("*", min(len(r), 8))
+	}
+	return strings.Repeat("*", len(r)-t.Keep) + string(r[len(r)-t.Keep:])
+}
+
+func isJSONType(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	mt, _, _ := strings.Cut(ct, ";")
+	mt = strings.TrimSpace(mt)
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// applyJSONTransforms 对 application/json 响应执行字段删除、改名和脱敏
+func applyJSONTransforms(id int64, rule *ProxyRule, resp *http.Response) error {
+	if rule == nil || len(rule.JSONTransforms) == 0 || !isIdentityEncoding(resp) || !isJSONType(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	body, ok, err := readBodyLimited(resp, defaultRewriteMaxSize)
+	if err != nil || !ok {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		// 不是合法 JSON 时原样返回
+		log.Printf("id:%d JSON 响应解析失败，跳过字段处理: %v", id, err)
+		setBody(resp, body)
+		return nil
+	}
+	changed := false
+	for i := range rule.JSONTransforms {
+		changed = rule.JSONTransforms[i].apply(doc) || changed
+	}
+	if !changed {
+		setBody(resp, body)
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	setBody(resp, bytes.TrimRight(buf.Bytes(), "\n"))
+	return nil
+}
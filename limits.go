@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// BodyLimits 请求体和响应体的大小限制，如 10MB，规则上的同名属性优先
+type BodyLimits struct {
+	MaxRequestBody  string `xml:"maxRequestBody,attr,omitempty"`
+	MaxResponseBody string `xml:"maxResponseBody,attr,omitempty"`
+
+	maxRequest, maxResponse int64
+}
+
+func (l *BodyLimits) init() error {
+	if l == nil {
+		return nil
+	}
+	var err error
+	if l.maxRequest, err = parseLimit("maxRequestBody", l.MaxRequestBody); err != nil {
+		return err
+	}
+	l.maxResponse, err = parseLimit("maxResponseBody", l.MaxResponseBody)
+	return err
+}
+
+func parseLimit(name, s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := parseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s 格式错误: %v", name, err)
+	}
+	return n, nil
+}
+
+// bodyLimits 规则设置的限制优先，否则使用全局 bodyLimits，0 表示不限制
+func bodyLimits(rule *ProxyRule) (request, response int64) {
+	if l := config().BodyLimits; l != nil {
+		request, response = l.maxRequest, l.maxResponse
+	}
+	if rule != nil && rule.bodyLimits != nil {
+		if rule.bodyLimits.maxRequest > 0 {
+			request = rule.bodyLimits.maxRequest
+		}
+		if rule.bodyLimits.maxResponse > 0 {
+			response = rule.bodyLimits.maxResponse
+		}
+	}
+	return request, response
+}
+
+// limitRequestBody 请求体超过限制时返回 413，Content-Length 未知时在转发过程中截断
+func limitRequestBody(w http.ResponseWriter, id int64, rule *ProxyRule, r *http.Request) bool {
+	max, _ := bodyLimits(rule)
+	if max <= 0 {
+		return false
+	}
+	if r.ContentLength > max {
+		warnf("id:%d 请求体 %d 字节超过限制 %d", id, r.ContentLength, max)
+		http.Error(w, "请求体过大", http.StatusRequestEntityTooLarge)
+		return true
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	return false
+}
+
+var errResponseTooLarge = errors.New("响应体超过大小限制")
+
+// limitedBody 读取超过限制后返回错误，转发中断
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// 多读一个字节用于判断是否超过限制
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		return n, errResponseTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// limitResponseBody 响应头中的长度超过限制时返回错误(502)，否则在传输过程中限制
+func limitResponseBody(rule *ProxyRule, resp *http.Response) error {
+	_, max := bodyLimits(rule)
+	if max <= 0 {
+		return nil
+	}
+	if resp.ContentLength > max {
+		return fmt.Errorf("%w: %d > %d", errResponseTooLarge, resp.ContentLength, max)
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: max}
+	return nil
+}
+
+// proxyErrorStatus 转发失败时返回给客户端的状态码
+func proxyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 等待标签结束时最多缓冲的字节数，超过时原样输出，避免异常页面占用过多内存
+const linkRewriteMaxPending = 64 << 10
+
+// 改写这些属性中的地址
+var linkAttrs = map[string]bool{"href": true, "src": true, "action": true, "srcset": true}
+
+// applyLinkRewrite 流式改写 HTML 中 href/src/action/srcset 的绝对地址和根路径地址为 /https://host/... 的形式，
+// 链接、表单和脚本在浏览器中仍然经过代理；gzip 压缩的响应先解压，改写后重新压缩
+func applyLinkRewrite(target *url.URL, rule *ProxyRule, resp *http.Response) error {
+	if rule == nil || !rule.RewriteLinks || !isHTML(resp) || resp.Body == http.NoBody {
+		return nil
+	}
+	body := resp.Body
+	gzipped := strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "gzip")
+	if !gzipped && !isIdentityEncoding(resp) {
+		return nil
+	}
+	var src io.Reader = body
+	if gzipped {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		src = zr
+	}
+	var out io.Reader = &linkRewriter{src: src, target: target}
+	if gzipped {
+		out = compressStream("gzip", out)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{out, closerFunc(func() error {
+		if c, ok := out.(io.Closer); ok {
+			c.Close()
+		}
+		return body.Close()
+	})}
+	// 改写后长度未知，按分块传输
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Content-MD5")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// linkAcceptEncoding 改写链接的规则只接受 gzip 或未压缩的响应
+func linkAcceptEncoding(rule *ProxyRule, r *http.Request) {
+	if rule == nil || !rule.RewriteLinks {
+		return
+	}
+	if strings.Contains(strings.ToLower(r.Header.Get("Accept-Encoding")), "gzip") {
+		r.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		r.Header.Del("Accept-Encoding")
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// linkRewriter 逐块扫描 HTML，只在标签内改写属性；注释和 script/style 的内容原样输出，
+// 块边界上不完整的标签留到读到后续内容时处理
+type linkRewriter struct {
+	src     io.Reader
+	target  *url.URL
+	pending []byte
+	out     bytes.Buffer
+	rawEnd  string // 位于 script/style 内容中时为对应的结束标签，如 </script
+	eof     bool
+	err     error
+}
+
+func (l *linkRewriter) Read(p []byte) (int, error) {
+	for l.out.Len() == 0 {
+		if l.eof {
+			if len(l.pending) > 0 {
+				l.process(true)
+				continue
+			}
+			return 0, l.err
+		}
+		buf := make([]byte, 32<<10)
+		n, err := l.src.Read(buf)
+		l.pending = append(l.pending, buf[:n]...)
+		if err != nil {
+			l.eof, l.err = true, err
+		}
+		l.process(l.eof)
+	}
+	return l.out.Read(p)
+}
+
+// process 处理 pending 中可以确定的部分，final 表示后面没有更多内容
+func (l *linkRewriter) process(final bool) {
+	b := l.pending
+	for len(b) > 0 {
+		if l.rawEnd != "" {
+			i := indexFold(b, l.rawEnd)
+			if i < 0 {
+				// 保留可能是结束标签开头的部分
+				keep := len(l.rawEnd) - 1
+				if final || len(b) <= keep {
+					if final {
+						l.out.Write(b)
+						b = nil
+					}
+					break
+				}
+				l.out.Write(b[:len(b)-keep])
+				b = b[len(b)-keep:]
+				break
+			}
+			l.out.Write(b[:i])
+			b = b[i:]
+			l.rawEnd = ""
+		}
+		i := bytes.IndexByte(b, '<')
+		if i < 0 {
+			l.out.Write(b)
+			b = nil
+			break
+		}
+		l.out.Write(b[:i])
+		b = b[i:]
+
+		var end int
+		if bytes.HasPrefix(b, []byte("<!--")) {
+			if j := bytes.Index(b[4:], []byte("-->")); j >= 0 {
+				end = 4 + j + 3
+			}
+		} else {
+			end = tagEnd(b)
+		}
+		if end == 0 {
+			if final || len(b) > linkRewriteMaxPending {
+				l.out.Write(b)
+				b = nil
+			}
+			break
+		}
+		l.out.Write(l.rewriteTag(b[:end]))
+		b = b[end:]
+	}
+	l.pending = append(l.pending[:0], b...)
+}
+
+// tagEnd 返回标签结尾 > 之后的位置，引号中的 > 不算结尾；不完整时返回 0
+func tagEnd(b []byte) int {
+	var quote byte
+	for i := 1; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func indexFold(b []byte, s string) int {
+	return bytes.Index(bytes.ToLower(b), []byte(s))
+}
+
+// rewriteTag 改写单个开始标签中的地址属性，进入 script/style 时记录结束标签
+func (l *linkRewriter) rewriteTag(tag []byte) []byte {
+	i := 1
+	for i < len(tag) && isTagNameChar(tag[i]) {
+		i++
+	}
+	name := strings.ToLower(string(tag[1:i]))
+	if name == "" {
+		return tag
+	}
+	if name == "script" || name == "style" {
+		l.rawEnd = "</" + name
+	}
+
+	var out []byte
+	last := 0
+	for i < len(tag) {
+		for i < len(tag) && (isSpace(tag[i]) || tag[i] == '/') {
+			i++
+		}
+		start := i
+		for i < len(tag) && !isSpace(tag[i]) && tag[i] != '=' && tag[i] != '>' && tag[i] != '/' {
+			i++
+		}
+		attr := strings.ToLower(string(tag[start:i]))
+		if attr == "" {
+			break
+		}
+		j := i
+		for j < len(tag) && isSpace(tag[j]) {
+			j++
+		}
+		if j >= len(tag) || tag[j] != '=' {
+			continue
+		}
+		j++
+		for j < len(tag) && isSpace(tag[j]) {
+			j++
+		}
+		vs, ve := j, j
+		if j < len(tag) && (tag[j] == '"' || tag[j] == '\'') {
+			q := tag[j]
+			vs = j + 1
+			ve = vs
+			for ve < len(tag) && tag[ve] != q {
+				ve++
+			}
+			i = ve + 1
+		} else {
+			for ve < len(tag) && !isSpace(tag[ve]) && tag[ve] != '>' {
+				ve++
+			}
+			i = ve
+		}
+		if !linkAttrs[attr] {
+			continue
+		}
+		value := string(tag[vs:ve])
+		var rewritten string
+		if attr == "srcset" {
+			rewritten = l.rewriteSrcset(value)
+		} else {
+			rewritten = l.rewriteURL(value)
+		}
+		if rewritten != value {
+			out = append(out, tag[last:vs]...)
+			out = append(out, rewritten...)
+			last = ve
+		}
+	}
+	if out == nil {
+		return tag
+	}
+	return append(out, tag[last:]...)
+}
+
+// rewriteURL 绝对地址、//host 和 /path 形式的地址转换为代理路径，相对路径在代理路径下本来就能正确解析
+func (l *linkRewriter) rewriteURL(v string) string {
+	s := strings.TrimSpace(v)
+	lower := strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://"):
+		return "/" + s
+	case strings.HasPrefix(s, "//"):
+		return "/" + l.target.Scheme + ":" + s
+	case strings.HasPrefix(s, "/"):
+		// 已经是代理路径
+		if hasScheme(strings.TrimPrefix(s, "/")) {
+			return v
+		}
+		return "/" + l.target.Scheme + "://" + l.target.Host + s
+	}
+	return v
+}
+
+// rewriteSrcset 改写 srcset 中每一项的地址，如 "/a.png 1x, /b.png 2x"
+func (l *linkRewriter) rewriteSrcset(v string) string {
+	items := strings.Split(v, ",")
+	for i, item := range items {
+		trimmed := strings.TrimLeft(item, " \t\r\n")
+		u, desc, _ := strings.Cut(trimmed, " ")
+		items[i] = item[:len(item)-len(trimmed)] + l.rewriteURL(u)
+		if desc != "" {
+			items[i] += " " + desc
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+func isTagNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ListenerConfig 本地服务器的 HTTPS 设置，cert/key 为 PEM 文件，或者用 acme 自动申请，修改后需要重启
+type ListenerConfig struct {
+	Cert string `xml:"cert,attr,omitempty"`
+	Key  string `xml:"key,attr,omitempty"`
+	// 额外监听该地址(如 :80)，把 HTTP 请求重定向到 HTTPS；使用 acme 时默认 :80，同时响应 http-01 验证
+	RedirectHTTP string      `xml:"redirectHttp,attr,omitempty"`
+	ACME         *ACMEConfig `xml:"acme"`
+	// 要求客户端证书，只接受该 CA(PEM)签发的证书
+	ClientCA string `xml:"clientCa,attr,omitempty"`
+	// 不为空时只允许列出的证书 CN 访问，可以限制每个客户端能访问的目标域名
+	Clients []ClientRule `xml:"client"`
+}
+
+// ClientRule 按客户端证书 CN 限制访问，domains 为逗号分隔的精确域名或通配符(*.example.com)，为空表示不限制
+type ClientRule struct {
+	CN      string `xml:"cn,attr"`
+	Domains string `xml:"domains,attr,omitempty"`
+}
+
+func (l *ListenerConfig) tlsEnabled() bool {
+	return l != nil && (l.Cert != "" && l.Key != "" || l.ACME != nil && len(l.ACME.Hosts) > 0)
+}
+
+func listenerTLS() bool {
+	return config().Listener.tlsEnabled()
+}
+
+// init 客户端证书只能在 HTTPS 监听上校验，明文监听时配置 clientCa/client 会让人误以为已经启用
+func (l *ListenerConfig) init() error {
+	if l == nil {
+		return nil
+	}
+	if (l.ClientCA != "" || len(l.Clients) > 0) && !l.tlsEnabled() {
+		return errors.New("listener 的 clientCa 和 client 需要同时配置 cert/key 或 acme")
+	}
+	for _, c := range l.Clients {
+		for _, d := range strings.Split(c.Domains, ",") {
+			if d = strings.TrimSpace(d); strings.HasPrefix(d, "~") {
+				return fmt.Errorf("listener 中 client %s 的 domains 不支持 ~ 包含匹配: %s", c.CN, d)
+			}
+		}
+	}
+	return nil
+}
+
+// serverBase 生成链接和日志中显示的本地服务器地址
+func serverBase() string {
+	scheme := "http"
+	if listenerTLS() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(serverHost, strconv.Itoa(serverPort)))
+}
+
+// serve 按 listener 配置以 HTTP 或 HTTPS 启动服务器
+func serve(server *http.Server) error {
+	ln, err := listen("main", server.Addr)
+	if err != nil {
+		return err
+	}
+	trackServer(server)
+	if !listenerTLS() {
+		notifyReady()
+		return server.Serve(ln)
+	}
+	l := config().Listener
+	var redirect http.Handler = http.HandlerFunc(redirectToHTTPS)
+	redirectAddr := l.RedirectHTTP
+	if l.Cert != "" && l.Key != "" {
+		cert, err := tls.LoadX509KeyPair(l.Cert, l.Key)
+		if err != nil {
+			return fmt.Errorf("加载证书失败: %v", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	} else {
+		m := newACMEManager(l.ACME)
+		server.TLSConfig = &tls.Config{GetCertificate: m.getCertificate}
+		redirect = m.challengeHandler(redirect)
+		if redirectAddr == "" {
+			redirectAddr = ":80"
+		}
+		go m.run()
+	}
+	if l.ClientCA != "" {
+		pool := x509.NewCertPool()
+		if err := appendCAFile(pool, l.ClientCA); err != nil {
+			return fmt.Errorf("clientCa: %v", err)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if redirectAddr != "" {
+		serveRedirect(redirectAddr, redirect)
+	}
+	notifyReady()
+	return server.ServeTLS(ln, "", "")
+}
+
+// serveRedirect 启动明文 HTTP 服务，用于重定向和 ACME 验证
+func serveRedirect(addr string, handler http.Handler) {
+	ln, err := listen("redirect", addr)
+	if err != nil {
+		log.Printf("[WARN] HTTP 重定向服务启动失败: %v", err)
+		return
+	}
+	log.Printf("HTTP 重定向服务启动在 %s", addr)
+	server := &http.Server{Handler: handler}
+	trackServer(server)
+	go server.Serve(ln)
+}
+
+// redirectToHTTPS 把明文请求重定向到同一主机的 HTTPS 端口
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if serverPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(serverPort))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// checkClientCert 按客户端证书 CN 和 client 规则检查是否允许访问目标地址
+func checkClientCert(w http.ResponseWriter, id int64, r *http.Request, target *url.URL) bool {
+	l := config().Listener
+	if l == nil || len(l.Clients) == 0 {
+		return false
+	}
+	// 没有 TLS 连接时按没有证书处理，拒绝访问
+	cn := ""
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cn = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	for _, c := range l.Clients {
+		if c.CN != cn {
+			continue
+		}
+		if c.Domains == "" {
+			return false
+		}
+		for _, d := range strings.Split(c.Domains, ",") {
+			if ruleMatch(strings.TrimSpace(d), target.Host) >= matchWildcard {
+				return false
+			}
+		}
+		break
+	}
+	warnf("id:%d 拒绝客户端证书 %q 访问 %s", id, cn, target.Host)
+	http.Error(w, "客户端证书无权访问该地址", http.StatusForbidden)
+	return true
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFileConfig 日志写入文件，按大小或时间轮转，修改后需要重启
+type LogFileConfig struct {
+	Path       string `xml:"path,attr"`
+	MaxSize    int    `xml:"maxSize,attr,omitempty"`    // 单个文件最大 MB，超过后轮转，0 表示不按大小轮转
+	Rotate     string `xml:"rotate,attr,omitempty"`     // daily 或 hourly，按时间轮转
+	MaxBackups int    `xml:"maxBackups,attr,omitempty"` // 最多保留的旧文件数，0 表示不限制
+	MaxAge     string `xml:"maxAge,attr,omitempty"`     // 旧文件保留时间，如 168h，为空不限制
+	Stdout     bool   `xml:"stdout,attr,omitempty"`     // 同时输出到标准输出，默认只写文件
+}
+
+// 轮转后的旧文件名为 <path>.<时间>
+const logBackupFormat = "20060102-150405.000"
+
+// rotatingFile 按大小和时间轮转的日志文件，每次 Write 对应一行日志
+type rotatingFile struct {
+	mu     sync.Mutex
+	cfg    *LogFileConfig
+	maxAge time.Duration
+	file   *os.File
+	size   int64
+	period time.Time
+}
+
+func newRotatingFile(c *LogFileConfig) (*rotatingFile, error) {
+	if c.Path == "" {
+		return nil, fmt.Errorf("log file 没有设置 path")
+	}
+	if c.Rotate != "" && c.Rotate != "daily" && c.Rotate != "hourly" {
+		return nil, fmt.Errorf("log file rotate 只支持 daily 或 hourly")
+	}
+	f := &rotatingFile{cfg: c}
+	if c.MaxAge != "" {
+		d, err := time.ParseDuration(c.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("log file maxAge 格式错误: %v", err)
+		}
+		f.maxAge = d
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	f.period = f.periodOf(info.ModTime())
+	if info.Size() == 0 {
+		f.period = f.periodOf(time.Now())
+	}
+	return nil
+}
+
+// periodOf 时间所在的轮转周期起点
+func (f *rotatingFile) periodOf(t time.Time) time.Time {
+	switch f.cfg.Rotate {
+	case "daily":
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	case "hourly":
+		return t.Truncate(time.Hour)
+	}
+	return time.Time{}
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.file == nil ||
+		f.cfg.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > int64(f.cfg.MaxSize)<<20 ||
+		f.cfg.Rotate != "" && !f.periodOf(now).Equal(f.period) {
+		if err := f.rotate(now); err != nil {
+			fmt.Fprintf(os.Stderr, "日志文件轮转失败: %v\n", err)
+		}
+	}
+	if f.file == nil {
+		return os.Stderr.Write(p)
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate(now time.Time) error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+		backup := f.cfg.Path + "." + now.Format(logBackupFormat)
+		if err := os.Rename(f.cfg.Path, backup); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	go f.cleanup(now)
+	return nil
+}
+
+// cleanup 删除超过 maxBackups 个数或 maxAge 时间的旧文件
+func (f *rotatingFile) cleanup(now time.Time) {
+	matches, _ := filepath.Glob(f.cfg.Path + ".*")
+	var backups []string
+	for _, m := range matches {
+		if _, err := time.Parse(logBackupFormat, strings.TrimPrefix(m, f.cfg.Path+".")); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// 文件名中的时间可以直接按字符串排序，新的在前
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, b := range backups {
+		expired := false
+		if f.maxAge > 0 {
+			t, _ := time.ParseInLocation(logBackupFormat, strings.TrimPrefix(b, f.cfg.Path+"."), now.Location())
+			expired = now.Sub(t) > f.maxAge
+		}
+		if expired || f.cfg.MaxBackups > 0 && i >= f.cfg.MaxBackups {
+			os.Remove(b)
+		}
+	}
+}
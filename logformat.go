@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logVariables 访问日志模板中可用的变量
+var logVariables = map[string]func(e *accessEntry) string{
+	"time_local":   func(e *accessEntry) string { return e.Time.Format("02/Jan/2006:15:04:05 -0700") },
+	"time_iso8601": func(e *accessEntry) string { return e.Time.Format(time.RFC3339) },
+	"request_id":   func(e *accessEntry) string { return strconv.FormatInt(e.ID, 10) },
+	"remote_addr": func(e *accessEntry) string {
+		if host, _, err := net.SplitHostPort(e.RemoteAddr); err == nil {
+			return host
+		}
+		return e.RemoteAddr
+	},
+	"request_method":    func(e *accessEntry) string { return e.Method },
+	"target_url":        func(e *accessEntry) string { return e.URL },
+	"target_host":       func(e *accessEntry) string { return e.Host },
+	"status":            func(e *accessEntry) string { return strconv.Itoa(e.Status) },
+	"bytes_sent":        func(e *accessEntry) string { return strconv.FormatInt(e.Bytes, 10) },
+	"duration_ms":       func(e *accessEntry) string { return strconv.FormatInt(e.Duration.Milliseconds(), 10) },
+	"request_time":      func(e *accessEntry) string { return fmt.Sprintf("%.3f", e.Duration.Seconds()) },
+	"proxy_name":        func(e *accessEntry) string { return e.Rule },
+	"upstream":          func(e *accessEntry) string { return dash(e.Upstream) },
+	"http_user_agent":   func(e *accessEntry) string { return dash(e.UserAgent) },
+	"http_referer":      func(e *accessEntry) string { return dash(e.Referer) },
+	"graphql_type":      func(e *accessEntry) string { return dash(e.GraphQLType) },
+	"graphql_operation": func(e *accessEntry) string { return dash(e.GraphQLOp) },
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+var logVarPattern = regexp.MustCompile(`\$(\{[a-z_0-9]+\}|[a-z_0-9]+)`)
+
+// logTemplate 预先解析的访问日志模板，literal 与 vars 交替出现
+type logTemplate struct {
+	literals []string
+	vars     []func(e *accessEntry) string
+}
+
+// parseLogTemplate 解析形如 "$remote_addr $status ${duration_ms}ms" 的模板
+func parseLogTemplate(s string) (*logTemplate, error) {
+	t := &logTemplate{}
+	last := 0
+	for _, m := range logVarPattern.FindAllStringSubmatchIndex(s, -1) {
+		name := strings.Trim(s[m[2]:m[3]], "{}")
+		fn, ok := logVariables[name]
+		if !ok {
+			return nil, fmt.Errorf("日志模板中未知的变量: $%s", name)
+		}
+		t.literals = append(t.literals, s[last:m[0]])
+		t.vars = append(t.vars, fn)
+		last = m[1]
+	}
+	t.literals = append(t.literals, s[last:])
+	return t, nil
+}
+
+func (t *logTemplate) render(e *accessEntry) string {
+	var b strings.Builder
+	for i, fn := range t.vars {
+		b.WriteString(t.literals[i])
+		b.WriteString(fn(e))
+	}
+	b.WriteString(t.literals[len(t.literals)-1])
+	return b.String()
+}
+
+// responseRecorder 记录实际写给客户端的状态码和字节数
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap 使 http.ResponseController 能够找到底层的 Flush/Hijack 实现
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogConfig 日志配置
+type LogConfig struct {
+	Level         string         `xml:"level,attr,omitempty"`         // debug 或 info(默认)
+	Format        string         `xml:"format,attr,omitempty"`        // text(默认)、pretty(彩色对齐，适合本地调试)、json 或 logfmt(每个请求一行结构化日志)
+	Template      string         `xml:"template,attr,omitempty"`      // 自定义访问日志格式，类似 nginx log_format
+	SlowThreshold string         `xml:"slowThreshold,attr,omitempty"` // 慢请求阈值，如 2s，超过后输出WARN日志
+	Sample        int            `xml:"sample,attr,omitempty"`        // 直连请求的日志采样率，每N个成功请求记录1个
+	BufferSize    int            `xml:"bufferSize,attr,omitempty"`    // 异步访问日志缓冲行数，满了之后丢弃并计数
+	EventLog      string         `xml:"eventLog,attr,omitempty"`      // Windows 事件日志来源名称，为空不写事件日志
+	Journald      bool           `xml:"journald,attr,omitempty"`      // 通过 journald 原生协议写日志，代替标准输出
+	Syslog        *SyslogConfig  `xml:"syslog"`
+	File          *LogFileConfig `xml:"file"`
+
+	slowThreshold time.Duration
+	template      *logTemplate
+}
+
+func (c *LogConfig) init() error {
+	c.slowThreshold = 0
+	if c.SlowThreshold != "" {
+		d, err := time.ParseDuration(c.SlowThreshold)
+		if err != nil {
+			return fmt.Errorf("slowThreshold 格式错误: %v", err)
+		}
+		c.slowThreshold = d
+	}
+	c.template = nil
+	if c.Template != "" {
+		t, err := parseLogTemplate(c.Template)
+		if err != nil {
+			return err
+		}
+		c.template = t
+	}
+	return nil
+}
+
+func debugEnabled() bool {
+	return strings.EqualFold(config().Log.Level, "debug")
+}
+
+func debugf(format string, v ...any) {
+	if debugEnabled() {
+		log.Printf("[DEBUG] "+format, v...)
+	}
+}
+
+func warnf(format string, v ...any) {
+	log.Printf("[WARN] "+format, v...)
+}
+
+// ruleName 返回请求匹配到的规则名称，用于日志
+func ruleName(rule *ProxyRule) string {
+	if rule == nil {
+		return "direct"
+	}
+	if rule.Domain == "" {
+		if rule.Regex != "" {
+			return rule.Regex
+		}
+		return "default"
+	}
+	return rule.Domain
+}
+
+// logSlowRequest 请求耗时超过阈值时输出带耗时明细的WARN日志
+func logSlowRequest(id int64, target string, rule *ProxyRule, status int, p phaseTimes) {
+	if config().Log.slowThreshold <= 0 || p.Total < config().Log.slowThreshold {
+		return
+	}
+	upstream := "none"
+	if rule != nil && rule.usesProxy() {
+		upstream = rule.upstreamName()
+	}
+	warnf("id:%d slow request %s status=%d rule=%s upstream=%s %s",
+		id, target, status, ruleName(rule), upstream, p)
+}
+
+// sampleCounters 每个规则的成功请求计数，用于日志采样
+var sampleCounters sync.Map
+
+func logSampleRate(rule *ProxyRule) int {
+	if rule == nil {
+		return config().Log.Sample
+	}
+	return rule.LogSample
+}
+
+// requestLog 缓存单个请求的日志行，请求结束时按采样结果决定是否输出。
+// 未开启采样时直接输出，保持原有的实时日志行为
+type requestLog struct {
+	base    accessEntry
+	rule    *ProxyRule
+	rate    int
+	mode    string
+	entries []*accessEntry
+	span    *span
+}
+
+// 规则日志模式
+const (
+	logModeOff     = "off"     // 不记录访问日志
+	logModeMeta    = "meta"    // 只记录请求元信息(默认)
+	logModeVerbose = "verbose" // 额外记录请求和响应头
+)
+
+func logMode(rule *ProxyRule) string {
+	if rule == nil || rule.Log == "" {
+		return logModeMeta
+	}
+	return strings.ToLower(rule.Log)
+}
+
+// redactedHeaders verbose 模式下不输出原值的请求头
+var redactedHeaders = map[string]bool{
+	"Authorization":        true,
+	"Proxy-Authorization":  true,
+	"Cookie":               true,
+	"Set-Cookie":           true,
+	"X-Amz-Security-Token": true,
+}
+
+func newRequestLog(id int64, r *http.Request, target *url.URL, rule *ProxyRule) *requestLog {
+	l := &requestLog{
+		base: accessEntry{
+			ID:         id,
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			URL:        target.String(),
+			Host:       target.Host,
+			Rule:       ruleName(rule),
+			UserAgent:  r.UserAgent(),
+			Referer:    r.Referer(),
+		},
+		rule: rule,
+		rate: logSampleRate(rule),
+		mode: logMode(rule),
+		span: startSpan(r, target, rule),
+	}
+	if rule != nil {
+		l.base.Upstream = rule.upstreamName()
+	}
+	return l
+}
+
+func (l *requestLog) setGraphQL(opType, opName string) {
+	l.base.GraphQLType = opType
+	l.base.GraphQLOp = opName
+}
+
+func (l *requestLog) setStatus(status int) {
+	l.base.Status = status
+}
+
+func (l *requestLog) emit(e *accessEntry) {
+	if l.mode == logModeOff {
+		return
+	}
+	if l.rate <= 1 {
+		logAccess(e)
+		return
+	}
+	l.entries = append(l.entries, e)
+}
+
+func (l *requestLog) printf(format string, v ...any) {
+	e := l.base
+	e.Line = fmt.Sprintf(format, v...)
+	l.emit(&e)
+}
+
+// headers verbose 模式下逐行记录请求头(>)或响应头(<)
+func (l *requestLog) headers(dir string, h http.Header) {
+	if l.mode != logModeVerbose {
+		return
+	}
+	for k, vs := range h {
+		for _, v := range vs {
+			if redactedHeaders[k] {
+				v = fmt.Sprintf("[%d bytes]", len(v))
+			}
+			l.printf("id:%d %s %s: %s", l.base.ID, dir, k, v)
+		}
+	}
+}
+
+// done 记录请求结束时的汇总日志，并按采样结果输出
+func (l *requestLog) done(status int, bytes int64, p phaseTimes) {
+	e := l.base
+	e.Final = true
+	e.Time = time.Now()
+	e.Status = status
+	e.Bytes = bytes
+	e.Duration = p.Total
+	recordRecent(&e)
+	l.emit(&e)
+	l.flush(status)
+	l.span.finish(status, bytes)
+}
+
+// flush 错误请求(状态码>=400)总是输出，成功请求每 rate 个输出一个
+func (l *requestLog) flush(status int) {
+	if l.rate <= 1 {
+		return
+	}
+	if status < 400 {
+		c, _ := sampleCounters.LoadOrStore(ruleName(l.rule), new(atomic.Int64))
+		if (c.(*atomic.Int64).Add(1)-1)%int64(l.rate) != 0 {
+			return
+		}
+	}
+	for _, e := range l.entries {
+		e.Status = status
+		logAccess(e)
+	}
+}
@@ -2,34 +2,110 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"encoding/xml"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // ProxyConfig 代理配置结构体
 type ProxyConfig struct {
-	XMLName       xml.Name       `xml:"config"`
-	DefaultProxy  ProxyRule      `xml:"defaultProxy"`
-	ProxyRules    []ProxyRule    `xml:"proxy"`
-	DirectDomains []string       `xml:"directDomains>domain"`
-	CustomHeaders []CustomHeader `xml:"customHeaders>header"`
+	XMLName       xml.Name    `xml:"config"`
+	DefaultProxy  ProxyRule   `xml:"defaultProxy"`
+	ProxyRules    []ProxyRule `xml:"proxy"`
+	DirectDomains []string    `xml:"directDomains>domain"`
+	// 目标 IP 属于这些网段时直连，如 10.0.0.0/8
+	DirectNetworks []string `xml:"directNetworks>network"`
+	// 只允许这些网段的客户端使用代理，denyClients 中的网段总是拒绝，如 192.168.1.0/24
+	AllowClients  []string          `xml:"allowClients>network"`
+	DenyClients   []string          `xml:"denyClients>network"`
+	ClientAuth    *ClientAuthConfig `xml:"clientAuth"`
+	APIKeys       []APIKey          `xml:"apiKeys>key"`
+	CustomHeaders []CustomHeader    `xml:"customHeaders>header"`
+	// 修改响应头，与 customHeaders 对应
+	ResponseHeaders []ResponseHeader      `xml:"responseHeaders>header"`
+	Log             LogConfig             `xml:"log"`
+	Blocklist       *BlocklistConfig      `xml:"blocklists"`
+	ThreatFeeds     *ThreatFeedConfig     `xml:"threatFeeds"`
+	Reputation      *ReputationConfig     `xml:"reputation"`
+	Robots          *RobotsConfig         `xml:"robots"`
+	Share           *ShareConfig          `xml:"shareLinks"`
+	Admin           *AdminConfig          `xml:"admin"`
+	Debug           *DebugConfig          `xml:"debug"`
+	ShortLinks      *ShortLinkConfig      `xml:"shortLinks"`
+	Static          []StaticDir           `xml:"static"`
+	GraphQL         []GraphQLEndpoint     `xml:"graphql>endpoint"`
+	Security        *SecurityConfig       `xml:"security"`
+	Redis           *RedisConfig          `xml:"redis"`
+	Cluster         *ClusterConfig        `xml:"cluster"`
+	Timeouts        TimeoutConfig         `xml:"timeouts"`
+	Listener        *ListenerConfig       `xml:"listener"`
+	RateLimit       *RateLimitConfig      `xml:"rateLimit"`
+	BodyLimits      *BodyLimits           `xml:"bodyLimits"`
+	Retry           *RetryConfig          `xml:"retry"`
+	CircuitBreaker  *CircuitBreakerConfig `xml:"circuitBreaker"`
+	Concurrency     *ConcurrencyConfig    `xml:"concurrency"`
+	HealthCheck     *HealthCheckConfig    `xml:"healthCheck"`
+	ProxyPools      []ProxyPool           `xml:"proxyPools>pool"`
+	ForwardHeaders  *ForwardedConfig      `xml:"forwardHeaders"`
+	Cache           *CacheConfig          `xml:"cache"`
+	Capture         *CaptureConfig        `xml:"capture"`
+	PAC             *PACConfig            `xml:"pac"`
+	DNS             *DNSConfig            `xml:"dns"`
+	Tracing         *TracingConfig        `xml:"tracing"`
+	// 额外信任的根证书(PEM)，如公司的中间人代理 CA、内部 PKI，与系统证书一起使用
+	CABundles []string `xml:"caBundles>file"`
+
+	directNets      []netip.Prefix
+	allowClients    []netip.Prefix
+	denyClients     []netip.Prefix
+	directTransport *http.Transport
+	rootCAs         *x509.CertPool
 }
 
 type CustomHeader struct {
 	Domain      string `xml:"domain,attr"`
 	PathPrefix  string `xml:"pathPrefix,attr"`
-	HeadersPath string `xml:"headersPath,attr"`
+	HeadersPath string `xml:"headersPath,attr,omitempty"`
+	// 直接在配置中修改请求头，在请求头文件之后按 remove、set、add 的顺序执行
+	SetHeaders    []HeaderValue `xml:"setHeader"`
+	AddHeaders    []HeaderValue `xml:"addHeader"`
+	RemoveHeaders []HeaderValue `xml:"removeHeader"`
+}
+
+// ResponseHeader 按域名和路径前缀修改目标站点返回的响应头，如去掉 X-Frame-Options、添加 Cache-Control
+type ResponseHeader struct {
+	Domain        string        `xml:"domain,attr"`
+	PathPrefix    string        `xml:"pathPrefix,attr"`
+	SetHeaders    []HeaderValue `xml:"setHeader"`
+	AddHeaders    []HeaderValue `xml:"addHeader"`
+	RemoveHeaders []HeaderValue `xml:"removeHeader"`
+}
+
+// HeaderValue 单个请求头或响应头，removeHeader 只使用 name
+type HeaderValue struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr,omitempty"`
 }
 
 // ProxyRule 单个代理规则
@@ -38,81 +114,437 @@ type ProxyRule struct {
 	ProxyURL string `xml:"proxyUrl,attr"`
 	Username string `xml:"username,attr,omitempty"`
 	Password string `xml:"password,attr,omitempty"`
+	// https:// 代理的 CA 证书(PEM)和 TLS 握手使用的服务器名
+	ProxyCA  string `xml:"proxyCa,attr,omitempty"`
+	ProxySNI string `xml:"proxySni,attr,omitempty"`
+	// 使用 proxyPools 中的代理池代替 proxyUrl
+	Pool string `xml:"pool,attr,omitempty"`
+	// proxyUrl 连接失败或返回 502/504 时依次改用的备用代理，失败的代理在 failoverCooldown(默认 30s)内不再使用
+	Fallbacks        []ProxyUpstream `xml:"fallback"`
+	FailoverCooldown string          `xml:"failoverCooldown,attr,omitempty"`
+	// 跳过目标站点的证书校验，只用于自签名等确实无法校验的站点
+	InsecureSkipVerify bool `xml:"insecureSkipVerify,attr,omitempty"`
+	// 校验目标站点证书时额外信任的 CA(PEM)，在全局 caBundles 的基础上追加
+	CAFile string `xml:"caFile,attr,omitempty"`
+	// 用正则匹配主机名或完整 URL，如 ^(.+)\.internal\.corp$
+	Regex string `xml:"regex,attr,omitempty"`
+	// 多条规则都匹配时优先使用数值大的，相同时按匹配级别和配置顺序
+	Priority int `xml:"priority,attr,omitempty"`
+	// 只匹配该路径前缀，如 /api/，同一域名可以按路径使用不同的上游
+	PathPrefix string `xml:"pathPrefix,attr,omitempty"`
+	// 限制发往该规则匹配的每个目标主机的请求速率(每秒请求数)，如 API 配额，超过时返回 429
+	RateLimit float64 `xml:"rateLimit,attr,omitempty"`
+	RateBurst int     `xml:"rateBurst,attr,omitempty"`
+	// 同时转发给该规则上游的请求数上限，超过时最多 maxQueue 个请求排队，其余返回 503
+	MaxConcurrent int `xml:"maxConcurrent,attr,omitempty"`
+	MaxQueue      int `xml:"maxQueue,attr,omitempty"`
+	// 连接上游失败时 GET/HEAD 请求的重试次数，覆盖全局 retry
+	Retries int `xml:"retries,attr,omitempty"`
+	// 请求体和响应体的大小限制，如 10MB，覆盖全局 bodyLimits
+	MaxRequestBody  string `xml:"maxRequestBody,attr,omitempty"`
+	MaxResponseBody string `xml:"maxResponseBody,attr,omitempty"`
+	// 上游是明文 HTTP/2(h2c)服务，如未启用 TLS 的 gRPC 服务，只能直连
+	H2C bool `xml:"h2c,attr,omitempty"`
+	// 把响应写给客户端的间隔，如 100ms；-1 表示每次写入后立即发送。留空时 text/event-stream 和未知长度的响应立即发送，其他响应缓冲
+	FlushInterval string `xml:"flushInterval,attr,omitempty"`
+	// 暂时停用该规则，可以在管理页面上切换
+	Disabled bool `xml:"disabled,attr,omitempty"`
+	// 日志采样率，每N个成功请求记录1个，错误请求总是记录
+	LogSample int `xml:"logSample,attr,omitempty"`
+	// 日志模式: off 不记录、meta 只记录元信息(默认)、verbose 额外记录请求和响应头
+	Log string `xml:"log,attr,omitempty"`
+	// 按 Content-Type 拦截或去掉响应体
+	ContentFilters []ContentFilter `xml:"contentFilter"`
+	// 将 GBK/GB2312/Big5 编码的文本响应转为 UTF-8
+	Transcode bool `xml:"transcode,attr,omitempty"`
+	// 文本响应体正则替换
+	Replaces []BodyReplace `xml:"replace"`
+	// JSON 响应字段删除、改名和脱敏
+	JSONTransforms []JSONTransform `xml:"jsonTransform"`
+	// 图片缩放和重新压缩
+	Image *ImageOptimize `xml:"image"`
+	// 压缩 HTML/CSS/JS 响应，如 "true" 或 "html,css"
+	Minify string `xml:"minify,attr,omitempty"`
+	// 向 HTML 注入脚本，在浏览器端改写 fetch/XHR 等请求的地址
+	InjectScript bool `xml:"injectScript,attr,omitempty"`
+	// 注入或修改 <base> 标签，使相对链接在代理路径下正确解析
+	BaseHref bool `xml:"baseHref,attr,omitempty"`
+	// 在服务端流式改写 HTML 中的链接、表单和脚本地址，使其经过代理
+	RewriteLinks bool `xml:"rewriteLinks,attr,omitempty"`
+	// 客户端用 HTTP 访问代理时去掉目标站点 Cookie 的 Secure 和 SameSite=None，否则浏览器不保存
+	InsecureCookies bool `xml:"insecureCookies,attr,omitempty"`
+	// 改写后的文本响应按客户端的 Accept-Encoding 重新压缩，gzip 或 deflate
+	Compress string `xml:"compress,attr,omitempty"`
+	// 记录发往上游的完整请求和响应，可以通过管理接口导出为 HAR 文件
+	Capture bool `xml:"capture,attr,omitempty"`
+	// 缓存 GET 响应，上游没有给出 Cache-Control/Expires 时的有效期，如 10m；存储大小在全局 cache 中设置
+	CacheTTL string `xml:"cacheTtl,attr,omitempty"`
+	// 按 OpenAPI 文档校验请求和响应
+	OpenAPI *OpenAPIValidation `xml:"openapi"`
+	// 使用 AWS SigV4 为上游请求签名
+	AWSSign *AWSSign `xml:"awsSign"`
+	// 通过 OAuth2 client credentials 获取令牌并附加到上游请求
+	OAuth2 *OAuth2Client `xml:"oauth2"`
+	// 为响应添加跨域响应头
+	CORS *CORSConfig `xml:"cors"`
+
+	regex         *regexp.Regexp
+	transport     *http.Transport // 加载配置时按 proxyUrl 创建，所有请求共用以复用连接
+	flushInterval time.Duration
+	failover      *failoverTransport
+	bodyLimits    *BodyLimits
+	cacheTTL      time.Duration
+}
+
+func (r *ProxyRule) init() error {
+	if r.Regex != "" {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return fmt.Errorf("规则 %s: regex 格式错误: %v", ruleName(r), err)
+		}
+		r.regex = re
+	}
+	for i := range r.ContentFilters {
+		if err := r.ContentFilters[i].init(); err != nil {
+			return fmt.Errorf("规则 %s: %v", ruleName(r), err)
+		}
+	}
+	for i := range r.Replaces {
+		if err := r.Replaces[i].init(); err != nil {
+			return fmt.Errorf("规则 %s: %v", ruleName(r), err)
+		}
+	}
+	for i := range r.JSONTransforms {
+		if err := r.JSONTransforms[i].init(); err != nil {
+			return fmt.Errorf("规则 %s: %v", ruleName(r), err)
+		}
+	}
+	if r.OpenAPI != nil {
+		if err := r.OpenAPI.init(); err != nil {
+			return fmt.Errorf("规则 %s: %v", ruleName(r), err)
+		}
+	}
+	if r.AWSSign != nil {
+		if err := r.AWSSign.init(); err != nil {
+			return fmt.Errorf("规则 %s: %v", ruleName(r), err)
+		}
+	}
+	if r.OAuth2 != nil {
+		if err := r.OAuth2.init(); err != nil {
+			return fmt.Errorf("规则 %s: %v", ruleName(r), err)
+		}
+	}
+	if r.CORS != nil {
+		if err := r.CORS.init(); err != nil {
+			return fmt.Errorf("规则 %s: %v", ruleName(r), err)
+		}
+	}
+	r.cacheTTL = 0
+	if r.CacheTTL != "" {
+		d, err := time.ParseDuration(r.CacheTTL)
+		if err != nil {
+			return fmt.Errorf("规则 %s: cacheTtl 格式错误: %v", ruleName(r), err)
+		}
+		r.cacheTTL = d
+	}
+	if err := checkCompress(r.Compress); err != nil {
+		return fmt.Errorf("规则 %s: %v", ruleName(r), err)
+	}
+	r.flushInterval = 0
+	if r.FlushInterval != "" {
+		d, err := time.ParseDuration(r.FlushInterval)
+		if r.FlushInterval == "-1" {
+			d, err = -1, nil
+		}
+		if err != nil {
+			return fmt.Errorf("规则 %s: flushInterval 格式错误: %v", ruleName(r), err)
+		}
+		r.flushInterval = d
+	}
+	r.bodyLimits = nil
+	if r.MaxRequestBody != "" || r.MaxResponseBody != "" {
+		r.bodyLimits = &BodyLimits{MaxRequestBody: r.MaxRequestBody, MaxResponseBody: r.MaxResponseBody}
+		if err := r.bodyLimits.init(); err != nil {
+			return fmt.Errorf("规则 %s: %v", ruleName(r), err)
+		}
+	}
+	return nil
+}
+
+// currentConfig 当前生效的配置，重新加载时整体替换，正在处理的请求不受影响
+var currentConfig atomic.Pointer[ProxyConfig]
+
+func config() *ProxyConfig {
+	if c := currentConfig.Load(); c != nil {
+		return c
+	}
+	return &ProxyConfig{}
+}
+
+var configFile = defaultConfigFile()
+
+// defaultConfigFile 默认使用 proxy_config.xml，不存在时尝试 yaml/yml/json
+func defaultConfigFile() string {
+	for _, name := range []string{"proxy_config.xml", "proxy_config.yaml", "proxy_config.yml", "proxy_config.json"} {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return "proxy_config.xml"
 }
 
-var config ProxyConfig
 var serverHost string
 var serverPort int
 var uuid int64
 
-func loadConfig(filename string) error {
+// parseConfigFile 读取、解析并初始化配置文件
+func parseConfigFile(filename string) (*ProxyConfig, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		return fmt.Errorf("读取配置文件失败: %v", err)
+		return nil, fmt.Errorf("读取配置文件失败: %v", err)
 	}
 
-	err = xml.Unmarshal(data, &config)
+	c := &ProxyConfig{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml", ".json":
+		node, err := parseConfigNode(filename, data)
+		if err != nil {
+			return nil, fmt.Errorf("解析配置失败: %v", err)
+		}
+		var d configDecoder
+		if err := d.decode(node, reflect.ValueOf(c).Elem(), ""); err != nil {
+			return nil, fmt.Errorf("解析配置失败: %v", err)
+		}
+	default:
+		if err := xml.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("解析XML配置失败: %v", err)
+		}
+	}
+	// 拼写错误等问题只输出警告，不影响启动
+	if node, err := parseConfigNode(filename, data); err == nil {
+		for _, p := range checkConfig(node) {
+			log.Printf("[WARN] 配置检查: %s", p)
+		}
+	}
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// init 解析后初始化各部分的内部状态，管理接口修改配置后同样调用
+func (c *ProxyConfig) init() error {
+	if err := c.Log.init(); err != nil {
+		return err
+	}
+	if err := c.Timeouts.init(); err != nil {
+		return err
+	}
+	if err := c.BodyLimits.init(); err != nil {
+		return err
+	}
+	if err := c.Retry.init(); err != nil {
+		return err
+	}
+	if err := c.CircuitBreaker.init(); err != nil {
+		return err
+	}
+	if err := c.Concurrency.init(); err != nil {
+		return err
+	}
+	if err := c.HealthCheck.init(); err != nil {
+		return err
+	}
+	if err := c.initPools(); err != nil {
+		return err
+	}
+	if err := c.ForwardHeaders.init(); err != nil {
+		return err
+	}
+	if err := c.Cache.init(); err != nil {
+		return err
+	}
+	if err := c.DNS.init(); err != nil {
+		return err
+	}
+	if err := c.Security.init(); err != nil {
+		return err
+	}
+	if err := c.Tracing.init(); err != nil {
+		return err
+	}
+	if err := c.Debug.init(); err != nil {
+		return err
+	}
+	if err := c.Capture.init(); err != nil {
+		return err
+	}
+	if err := c.PAC.init(); err != nil {
+		return err
+	}
+	if err := c.initDirectNetworks(); err != nil {
+		return err
+	}
+	if err := c.initClientNetworks(); err != nil {
+		return err
+	}
+	if err := c.ClientAuth.init(); err != nil {
+		return err
+	}
+	if err := c.Listener.init(); err != nil {
+		return err
+	}
+	if err := c.initAPIKeys(); err != nil {
+		return err
+	}
+	if err := c.DefaultProxy.init(); err != nil {
+		return err
+	}
+	for i := range c.ProxyRules {
+		if err := c.ProxyRules[i].init(); err != nil {
+			return err
+		}
+	}
+	if err := c.initTransports(); err != nil {
+		return err
+	}
+	sort.SliceStable(c.ProxyRules, func(i, j int) bool { return c.ProxyRules[i].Priority > c.ProxyRules[j].Priority })
+	return nil
+}
+
+func loadConfig(filename string) error {
+	c, err := parseConfigFile(filename)
 	if err != nil {
-		return fmt.Errorf("解析XML配置失败: %v", err)
+		return err
 	}
+	currentConfig.Store(c)
 
-	log.Printf("成功加载配置，共 %d 条代理规则", len(config.ProxyRules))
-	log.Printf("直连域名数量: %d", len(config.DirectDomains))
-	if config.DefaultProxy.ProxyURL != "" {
-		log.Printf("默认代理: %s", config.DefaultProxy.ProxyURL)
+	log.Printf("成功加载配置，共 %d 条代理规则", len(c.ProxyRules))
+	log.Printf("直连域名数量: %d", len(c.DirectDomains))
+	if c.DefaultProxy.usesProxy() {
+		log.Printf("默认代理: %s", c.DefaultProxy.upstreamName())
 	} else {
 		log.Printf("默认代理: 无")
 	}
 	return nil
 }
 
+// restartSections 只在启动时生效的配置，修改后仍需重启进程
+func restartSections(c *ProxyConfig) map[string]any {
+	return map[string]any{
+		"log": c.Log, "admin": c.Admin, "static": c.Static, "redis": c.Redis, "cluster": c.Cluster,
+		"blocklists": c.Blocklist, "threatFeeds": c.ThreatFeeds, "reputation": c.Reputation, "shortLinks": c.ShortLinks,
+		"serverTimeouts": []string{c.Timeouts.Read, c.Timeouts.Write}, "listener": c.Listener,
+	}
+}
+
+// reloadConfig 重新加载配置文件并原子替换，失败时继续使用旧配置
+func reloadConfig() {
+	c, err := parseConfigFile(configFile)
+	if err != nil {
+		log.Printf("[WARN] 重新加载配置失败，继续使用旧配置: %v", err)
+		recordReload(err)
+		return
+	}
+	// 只比较导出字段，初始化时生成的内部状态不参与比较
+	oldSections, _ := json.Marshal(restartSections(config()))
+	newSections, _ := json.Marshal(restartSections(c))
+	if !bytes.Equal(oldSections, newSections) {
+		log.Printf("日志、管理接口等启动配置已修改，重启进程")
+		systemEvent(eventInfo, "日志、管理接口等启动配置已修改，重启进程")
+		restart()
+		return
+	}
+	old := config()
+	currentConfig.Store(c)
+	old.closeIdleConnections()
+	recordReload(nil)
+	log.Printf("配置已重新加载，共 %d 条代理规则", len(c.ProxyRules))
+	systemEvent(eventInfo, "配置已重新加载，共 %d 条代理规则", len(c.ProxyRules))
+}
+
 func isDirect(domain string) bool {
-	for _, d := range config.DirectDomains {
-		if strings.Contains(domain, d) {
+	for _, d := range config().DirectDomains {
+		if ruleMatch(d, domain) != matchNone {
 			return true
 		}
 	}
-	return false
+	return inDirectNetwork(domain)
 }
 
-func findProxyRule(domain string) *ProxyRule {
+func findProxyRule(target *url.URL) *ProxyRule {
 	// 检查是否在直连列表中
-	if isDirect(domain) {
+	if isDirect(target.Host) {
 		return nil // 直连
 	}
 
-	// 查找特定域名代理规则
-	for _, rule := range config.ProxyRules {
-		if strings.Contains(domain, rule.Domain) {
-			return &rule
+	// 查找特定域名代理规则，规则已按优先级排序，优先级相同时比较匹配级别和路径前缀长度，再按配置顺序
+	c := config()
+	var best *ProxyRule
+	bestLevel := matchNone
+	for i := range c.ProxyRules {
+		rule := &c.ProxyRules[i]
+		if best != nil && rule.Priority < best.Priority {
+			break
+		}
+		level := rule.match(target)
+		if level > bestLevel || level == bestLevel && level != matchNone && len(rule.PathPrefix) > len(best.PathPrefix) {
+			best, bestLevel = rule, level
 		}
 	}
+	if best != nil {
+		return best
+	}
+
+	// 使用 PAC 脚本的结果，脚本出错时继续使用默认代理
+	if rule, ok := c.PAC.find(c, target); ok {
+		return rule
+	}
 
 	// 如果没有匹配规则且有默认代理，返回默认代理
-	if config.DefaultProxy.ProxyURL != "" {
-		return &config.DefaultProxy
+	if c.DefaultProxy.usesProxy() {
+		return &c.DefaultProxy
 	}
 
 	return nil // 没有代理规则，直连
 }
 
-// 处理重定向URL，将其转换为通过代理服务器的URL
-func handleRedirectURL(redirectURL string) string {
+// 处理重定向URL，将其转换为通过代理服务器的URL；origin 是客户端访问代理时使用的地址
+func handleRedirectURL(origin string, target *url.URL, redirectURL string) string {
 	if redirectURL == "" {
 		return ""
 	}
 
-	// 如果已经是相对路径，不需要处理
-	if !strings.HasPrefix(redirectURL, "http://") && !strings.HasPrefix(redirectURL, "https://") {
+	// 相对路径按目标地址解析，/login 这类路径在代理上会指向代理根路径
+	u, err := target.Parse(redirectURL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
 		return redirectURL
 	}
 
 	// 构建新的重定向URL，指向我们的代理服务器
-	return fmt.Sprintf("http://%s:%d/%s", serverHost, serverPort, redirectURL)
+	return proxiedURL(origin, u)
+}
+
+var refreshURLRe = regexp.MustCompile(`(?i)^(\s*\d*\s*[;,]\s*url\s*=\s*)['"]?([^'"]*)['"]?\s*$`)
+
+// rewriteRedirects 改写 Location、Content-Location 和 Refresh 响应头，使重定向后仍然经过代理
+func rewriteRedirects(origin string, target *url.URL, resp *http.Response) {
+	for _, k := range []string{"Location", "Content-Location"} {
+		if v := resp.Header.Get(k); v != "" {
+			resp.Header.Set(k, handleRedirectURL(origin, target, v))
+		}
+	}
+	if m := refreshURLRe.FindStringSubmatch(resp.Header.Get("Refresh")); m != nil {
+		resp.Header.Set("Refresh", m[1]+handleRedirectURL(origin, target, m[2]))
+	}
 }
 
 // 修正URL格式问题
 func fixTargetURL(path string) string {
+	// ws:// 和 wss:// 按 http:// 和 https:// 处理，WebSocket 升级请求本身就是 HTTP 请求
+	if strings.HasPrefix(path, "ws:/") || strings.HasPrefix(path, "wss:/") {
+		path = "http" + strings.TrimPrefix(path, "ws")
+	}
 	// 修复URL中的双斜杠问题 (https:/www.example.com -> https://www.example.com)
 	re := regexp.MustCompile(`^(https?:/)([^/])`)
 	if re.MatchString(path) {
@@ -135,13 +567,26 @@ func fixTargetURL(path string) string {
 
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	// 解析目标URL
-	targetPath := r.URL.Path[1:] // 移除开头的'/'
+	targetPath := strings.TrimPrefix(r.URL.Path, "/") // 移除开头的'/'
 
 	// 处理请求参数
 	if r.URL.RawQuery != "" {
 		targetPath = targetPath + "?" + r.URL.RawQuery
 	}
 
+	// 页面中的站点根路径请求(/favicon.ico 等)转发到 Referer 或会话 Cookie 对应的目标站点
+	if t := rootRelativeTarget(r); t != "" {
+		targetPath = t
+	}
+	// gRPC 请求的目标服务在 :authority 中
+	if t := grpcTarget(r); t != "" {
+		targetPath = t
+	}
+	// 作为 HTTP 代理收到的绝对地址
+	if r.URL.IsAbs() {
+		targetPath = r.URL.String()
+	}
+
 	// 修正URL格式问题
 	targetPath = fixTargetURL(targetPath)
 
@@ -151,58 +596,248 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 查找域名对应的代理规则
-	proxyRule := findProxyRule(targetURL.Host)
-
-	var transport *http.Transport
 	id := atomic.AddInt64(&uuid, 1)
+	inflightRequests.Add(1)
+	defer inflightRequests.Add(-1)
+	if checkClientRate(w, id, r) || checkClientCert(w, id, r, targetURL) || checkOrigin(w, id, r) || checkAPIKey(w, id, r, targetURL) || checkAllowlist(w, id, r, targetURL) || checkBlocklist(w, id, targetURL) || checkReputation(w, id, targetURL) {
+		return
+	}
+
+	// 查找域名对应的代理规则，短链接可以固定使用某个上游代理
+	proxyRule := pinnedRule(r)
+	if proxyRule == nil {
+		proxyRule = findProxyRule(targetURL)
+	}
+	if proxyRule != nil && proxyRule.H2C {
+		targetURL.Scheme = "http"
+	}
+
+	var transport http.RoundTripper
+	reqLog := newRequestLog(id, r, targetURL, proxyRule)
+	if isGraphQLEndpoint(targetURL) {
+		reqLog.setGraphQL(graphqlInfo(r))
+	}
+	if answerPreflight(w, proxyRule, r) {
+		reqLog.printf("id:%d 本地响应预检请求 %s", id, targetURL.String())
+		reqLog.done(http.StatusNoContent, 0, phaseTimes{})
+		return
+	}
+	if checkTargetRate(w, id, proxyRule, targetURL) {
+		reqLog.done(http.StatusTooManyRequests, 0, phaseTimes{})
+		return
+	}
+	if limitRequestBody(w, id, proxyRule, r) {
+		reqLog.done(http.StatusRequestEntityTooLarge, 0, phaseTimes{})
+		return
+	}
+	if checkOpenAPIRequest(w, id, proxyRule, r, targetURL) {
+		reqLog.done(http.StatusBadRequest, 0, phaseTimes{})
+		return
+	}
+	rejected, direct := checkCircuit(w, id, proxyRule)
+	if rejected {
+		reqLog.done(http.StatusServiceUnavailable, 0, phaseTimes{})
+		return
+	}
+	release, ok := acquireUpstream(w, id, r, proxyRule)
+	if !ok {
+		reqLog.done(http.StatusServiceUnavailable, 0, phaseTimes{})
+		return
+	}
+	defer release()
 	// 如果找到代理规则并且设置了代理URL
-	if proxyRule != nil && proxyRule.ProxyURL != "" {
-		proxyURL, err := url.Parse(proxyRule.ProxyURL)
+	if proxyRule != nil && proxyRule.usesProxy() && !direct {
+		var err error
+		transport, err = proxyRule.roundTripper()
 		if err != nil {
 			http.Error(w, fmt.Sprintf("代理URL配置错误: %v", err), http.StatusInternalServerError)
 			return
 		}
-
-		// 设置代理认证
-		if proxyRule.Username != "" && proxyRule.Password != "" {
-			proxyURL.User = url.UserPassword(proxyRule.Username, proxyRule.Password)
+		reqLog.printf("id:%d use+proxy %s access %s", id, proxyRule.upstreamName(), targetURL.String())
+	} else {
+		reqLog.printf("id:%d no-proxy %s", id, targetURL.String())
+		var denied int
+		if r, denied = pinTarget(w, id, r, targetURL); denied != 0 {
+			reqLog.done(denied, 0, phaseTimes{})
+			return
 		}
-
-		transport = &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+		transport = config().directTransport
+		if proxyRule != nil && !proxyRule.usesProxy() && proxyRule.transport != nil {
+			transport = proxyRule.transport
 		}
-		log.Printf("id:%d use+proxy %s access %s", id, proxyRule.ProxyURL, targetURL.String())
-	} else {
-		log.Printf("id:%d no-proxy %s", id, targetURL.String())
 	}
+	if isUpgrade(r) {
+		// 切换协议后连接长期保持，不受服务器读写超时限制
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+		transport = newTunnelTransport(transport)
+	}
+	if reqLog.base.GraphQLOp != "" || reqLog.base.GraphQLType != "" {
+		reqLog.printf("id:%d graphql %s %s", id, reqLog.base.GraphQLType, reqLog.base.GraphQLOp)
+	}
+
+	// 记录DNS、建连、TLS握手、首字节和传输各阶段耗时
+	trace := newRequestTrace()
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace.clientTrace()))
 
+	status := http.StatusBadGateway // 未收到上游响应时 ReverseProxy 返回 502
+	origin := proxyOrigin(r)
+	in := r
 	proxyUtil := &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
-			for _, i := range config.CustomHeaders {
+			for _, i := range config().CustomHeaders {
 				if i.Domain == targetURL.Host && strings.HasPrefix(targetURL.Path, i.PathPrefix) {
-					addHeadersFromTxt(i.HeadersPath, r)
+					i.apply(r)
 					break
 				}
 			}
 			r.URL = targetURL
 			r.Host = targetURL.Host
+			rewriteWebDAVRequest(in, r)
+			stripSessionCookie(r)
+			applyForwarded(in, r)
+			reqLog.span.inject(r)
+			linkAcceptEncoding(proxyRule, r)
+			// 需要改写响应体时要求上游返回可以解压的内容
+			if rewritesBody(proxyRule) {
+				bodyAcceptEncoding(r)
+			}
+			applyOAuth2(id, proxyRule, r)
+			// 签名覆盖最终的请求头，必须最后执行
+			applyAWSSign(id, proxyRule, r)
+			reqLog.headers(">", r.Header)
+		},
+		Transport:     withCache(withRetries(withCapture(transport, proxyRule), id, proxyRule, reqLog), id, proxyRule, reqLog),
+		FlushInterval: flushInterval(proxyRule),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			status = proxyErrorStatus(err)
+			reqLog.printf("id:%d proxy error: %v", id, err)
+			corsErrorHeaders(w, proxyRule, in)
+			w.WriteHeader(status)
 		},
-		Transport: transport,
 		ModifyResponse: func(r *http.Response) error {
-			log.Printf("id:%d response code %d", id, r.StatusCode)
-			return nil
+			status = r.StatusCode
+			reqLog.setStatus(r.StatusCode)
+			reqLog.printf("id:%d response code %d", id, r.StatusCode)
+			reqLog.headers("<", r.Header)
+			// 切换协议后 Body 是双向连接，不能改写
+			if r.StatusCode == http.StatusSwitchingProtocols {
+				return nil
+			}
+			if err := limitResponseBody(proxyRule, r); err != nil {
+				return err
+			}
+			applyNoIndex(r)
+			// 作为 HTTP 代理使用时客户端直接访问目标地址，不需要改写
+			if !in.URL.IsAbs() {
+				rewriteRedirects(origin, targetURL, r)
+				rewriteSetCookies(in, targetURL, proxyRule, r)
+				bindSession(in, targetURL, r)
+			}
+			applyCORS(proxyRule, in, r)
+			applyResponseHeaders(targetURL, r)
+			if r.StatusCode == http.StatusUnauthorized && proxyRule != nil && proxyRule.OAuth2 != nil {
+				proxyRule.OAuth2.invalidate()
+			}
+			// 事件流持续推送，不能读完整个响应体再改写
+			if isEventStream(r) {
+				return nil
+			}
+			if rewritesBody(proxyRule) {
+				if err := decodeBody(r); err != nil {
+					return err
+				}
+			}
+			if err := checkOpenAPIResponse(id, proxyRule, in.Method, targetURL, r); err != nil {
+				return err
+			}
+			if applyContentFilters(id, proxyRule, r) {
+				return nil
+			}
+			if err := applyImageOptimize(id, proxyRule, r); err != nil {
+				return err
+			}
+			if err := applyTranscode(id, proxyRule, r); err != nil {
+				return err
+			}
+			if err := applyBodyReplaces(id, proxyRule, r); err != nil {
+				return err
+			}
+			if err := applyJSONTransforms(id, proxyRule, r); err != nil {
+				return err
+			}
+			if err := rewriteMultistatus(origin, targetURL, r); err != nil {
+				return err
+			}
+			if err := applyBaseHref(origin, targetURL, proxyRule, r); err != nil {
+				return err
+			}
+			if err := applyScriptInject(proxyRule, r); err != nil {
+				return err
+			}
+			if err := applyMinify(id, proxyRule, r); err != nil {
+				return err
+			}
+			if err := applyLinkRewrite(targetURL, proxyRule, r); err != nil {
+				return err
+			}
+			return applyCompress(in, proxyRule, r)
 		},
 	}
 
-	proxyUtil.ServeHTTP(w, r)
+	body := &countingBody{ReadCloser: r.Body}
+	r.Body = body
+	rec := &responseRecorder{ResponseWriter: w}
+	proxyUtil.ServeHTTP(rec, r)
+	if rec.status != 0 {
+		status = rec.status
+	}
+
+	phases := trace.phases()
+	latencyStats.record(phases)
+	recordMetrics(targetURL.Host, ruleName(proxyRule), status, body.n, rec.bytes, phases.Total-phases.Transfer)
+	reqLog.done(status, rec.bytes, phases)
+	debugf("id:%d latency %s", id, phases)
+	logSlowRequest(id, targetURL.String(), proxyRule, status, phases)
+}
+
+// apply 添加请求头文件中的请求头，再执行配置中的 removeHeader、setHeader、addHeader
+func (h CustomHeader) apply(req *http.Request) {
+	if h.HeadersPath != "" {
+		addHeadersFromTxt(h.HeadersPath, req)
+	}
+	editHeaders(req.Header, h.RemoveHeaders, h.SetHeaders, h.AddHeaders)
+}
+
+// applyResponseHeaders 使用第一条匹配目标地址的 responseHeaders 规则
+func applyResponseHeaders(target *url.URL, resp *http.Response) {
+	for _, h := range config().ResponseHeaders {
+		if h.Domain == target.Host && strings.HasPrefix(target.Path, h.PathPrefix) {
+			editHeaders(resp.Header, h.RemoveHeaders, h.SetHeaders, h.AddHeaders)
+			return
+		}
+	}
+}
+
+func editHeaders(header http.Header, remove, set, add []HeaderValue) {
+	for _, v := range remove {
+		header.Del(v.Name)
+	}
+	for _, v := range set {
+		header.Set(v.Name, v.Value)
+	}
+	for _, v := range add {
+		header.Add(v.Name, v.Value)
+	}
+}
+
+func (h CustomHeader) empty() bool {
+	return h.HeadersPath == "" && len(h.SetHeaders) == 0 && len(h.AddHeaders) == 0 && len(h.RemoveHeaders) == 0
 }
 
 func addHeadersFromTxt(path string, req *http.Request) {
-	b, err := os.ReadFile(path)
+	b, err := readHeaderFile(path)
 	if err != nil {
 		log.Println(err)
 		return
@@ -221,28 +856,14 @@ func addHeadersFromTxt(path string, req *http.Request) {
 	}
 }
 
-func watchConfigChange() {
-	s, err := os.Stat("proxy_config.xml")
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	t := s.ModTime()
-	for {
-		time.Sleep(time.Second * 2)
-		s, err := os.Stat("proxy_config.xml")
-		if err != nil {
-			continue
-		}
-		t1 := s.ModTime()
-		if t != t1 {
-			t = t1
-			restart()
-		}
-	}
-}
+// restarting 等待新进程就绪期间不再重复重启
+var restarting atomic.Bool
 
 func restart() {
+	if !restarting.CompareAndSwap(false, true) {
+		return
+	}
+	defer restarting.Store(false)
 	fmt.Println("准备重启...")
 
 	// 获取当前程序的可执行文件路径
@@ -259,37 +880,140 @@ func restart() {
 	cmd := exec.Command(executable, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	// 把监听 socket 交给新进程，新进程就绪后旧进程停止接受连接并处理完进行中的请求，重启期间连接不会被拒绝
+	ready, err := passListeners(cmd)
+	if err != nil {
+		fmt.Println("无法传递监听 socket，重启期间会短暂无法连接:", err)
+	}
 
 	err = cmd.Start()
 	if err != nil {
+		for _, f := range cmd.ExtraFiles {
+			f.Close()
+		}
 		fmt.Println("启动新进程失败:", err)
+		systemEvent(eventError, "重启失败: %v", err)
 		return
 	}
+	if ready != nil {
+		if err := ready(); err != nil {
+			fmt.Println("重启失败，继续使用当前进程:", err)
+			systemEvent(eventError, "重启失败，继续使用当前进程: %v", err)
+			return
+		}
+		shutdownServers()
+	}
 	fmt.Println("重启成功！")
+	flushAccessLog()
 
 	// 关闭当前进程
 	os.Exit(0)
 }
 
+// handleStopSignals 收到中断信号或 SIGTERM 时停止接受新连接，处理完进行中的请求、写出缓冲的访问日志后退出。
+// Windows 下关闭控制台、注销和关机会以 SIGTERM 送达；等待期间再次收到信号会直接退出
+func handleStopSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		signal.Stop(c)
+		log.Printf("代理服务器正在停止")
+		shutdownServers()
+		flushAccessLog()
+		closeEventLog()
+		os.Exit(0)
+	}()
+}
+
+// listenHost 监听地址，为空表示所有网卡
+var listenHost string
+
+// envOr 读取环境变量，未设置时返回默认值
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// parseFlags 解析 -listen/-port/-config，未指定时依次使用环境变量 R_PROXY_LISTEN/R_PROXY_PORT/R_PROXY_CONFIG 和默认值
+func parseFlags() {
+	port, err := strconv.Atoi(envOr("R_PROXY_PORT", "3000"))
+	if err != nil {
+		log.Fatalf("R_PROXY_PORT 格式错误: %v", err)
+	}
+	flag.StringVar(&listenHost, "listen", envOr("R_PROXY_LISTEN", ""), "监听地址，如 127.0.0.1，默认所有网卡")
+	flag.IntVar(&serverPort, "port", port, "监听端口")
+	flag.StringVar(&configFile, "config", envOr("R_PROXY_CONFIG", configFile), "配置文件(.xml/.yaml/.json)")
+	flag.Parse()
+
+	// 生成链接和日志中显示的地址
+	serverHost = listenHost
+	if ip := net.ParseIP(listenHost); listenHost == "" || ip != nil && ip.IsUnspecified() {
+		serverHost = "localhost"
+	}
+}
+
 func main() {
-	go watchConfigChange()
-	// 设置服务器信息
-	serverHost = "localhost"
-	serverPort = 3000
+	parseFlags()
 
+	switch flag.Arg(0) {
+	case "sign":
+		runSignCommand(flag.Args()[1:])
+		return
+	case "check":
+		runCheckCommand(flag.Args()[1:])
+		return
+	case "import":
+		runImportCommand(flag.Args()[1:])
+		return
+	}
 	// 加载配置文件
-	if err := loadConfig("proxy_config.xml"); err != nil {
+	if err := loadConfig(configFile); err != nil {
 		log.Fatalf("加载配置失败: %v", err)
 	}
-
-	// 注册处理函数
-	http.HandleFunc("/", proxyHandler)
+	go watchConfigChange()
+	initEventLog()
+	initAccessLog()
+	handleStopSignals()
+	initBlocklist()
+	initReputation()
+	initSharedState()
+	loadShortLinks()
+	startAdmin()
+	startDebug()
+	startCluster()
+	startHealthChecks()
+
+	// 注册处理函数；不使用 http.DefaultServeMux，pprof 和 expvar 注册的调试接口不会出现在代理端口上
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", proxyHandler)
+	mux.HandleFunc(statsPath, statsHandler)
+	mux.HandleFunc(metricsPath, metricsHandler)
+	mux.HandleFunc(healthzPath, healthzHandler)
+	mux.HandleFunc(readyzPath, readyzHandler)
+	mux.HandleFunc("/robots.txt", robotsHandler)
+	mux.HandleFunc(sharePrefix, shareHandler)
+	mux.HandleFunc(shortLinkPrefix, shortLinkHandler)
+	registerStatic(mux)
 
 	// 启动服务器
-	log.Printf("代理服务器启动在 http://%s:%d", serverHost, serverPort)
-	log.Printf("使用示例: http://%s:%d/https://www.baidu.com", serverHost, serverPort)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", serverPort), nil)
-	if err != nil {
+	log.Printf("代理服务器启动在 %s", serverBase())
+	systemEvent(eventInfo, "代理服务器启动在 %s", serverBase())
+	log.Printf("使用示例: %s/https://www.baidu.com", serverBase())
+	server := &http.Server{
+		Addr:         net.JoinHostPort(listenHost, strconv.Itoa(serverPort)),
+		Handler:      clientFilter(clientAuth(forwardProxyHandler(schemePathHandler(mux)))),
+		ReadTimeout:  config().Timeouts.read,
+		WriteTimeout: config().Timeouts.write,
+		ConnState:    trackConnState,
+		Protocols:    serverProtocols(),
+	}
+	err := serve(server)
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("服务器启动失败: %v", err)
 	}
+	// 重启时服务器已交给新进程，等待进行中的请求处理完后由 restart 退出
+	select {}
 }
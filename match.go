@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 域名匹配级别，数值越大越优先: 精确匹配 > 通配符 > 正则 > 包含(~ 开头的规则)
+const (
+	matchNone = iota
+	matchContains
+	matchRegex
+	matchWildcard
+	matchExact
+)
+
+// ruleMatch 按规则匹配目标主机，host 可以带端口。
+// "example.com" 只精确匹配；"*.example.com" 匹配所有子域名；
+// "~example" 匹配包含该字符串的主机名，即旧版本的匹配方式，需要显式写出
+func ruleMatch(pattern, host string) int {
+	if pattern == "" {
+		return matchNone
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	pattern = strings.ToLower(pattern)
+	hostname = strings.ToLower(hostname)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		if strings.HasSuffix(hostname, "."+suffix) {
+			return matchWildcard
+		}
+		return matchNone
+	}
+	if sub, ok := strings.CutPrefix(pattern, "~"); ok {
+		if sub != "" && strings.Contains(hostname, sub) {
+			return matchContains
+		}
+		return matchNone
+	}
+	if pattern == hostname || pattern == strings.ToLower(host) {
+		return matchExact
+	}
+	return matchNone
+}
+
+// match 规则对目标地址的匹配级别，regex 同时尝试匹配主机名和完整 URL
+func (r *ProxyRule) match(u *url.URL) int {
+	if r.Disabled || r.PathPrefix != "" && !strings.HasPrefix(u.Path, r.PathPrefix) {
+		return matchNone
+	}
+	level := ruleMatch(r.Domain, u.Host)
+	if level < matchRegex && r.regex != nil && (r.regex.MatchString(u.Hostname()) || r.regex.MatchString(u.String())) {
+		level = matchRegex
+	}
+	return level
+}
+
+func (c *ProxyConfig) initDirectNetworks() error {
+	var err error
+	c.directNets, err = parseNetworks("directNetworks", c.DirectNetworks)
+	return err
+}
+
+// parseNetworks 解析网段列表，name 用于错误信息
+func parseNetworks(name string, list []string) ([]netip.Prefix, error) {
+	var nets []netip.Prefix
+	for _, n := range list {
+		n = strings.TrimSpace(n)
+		p, err := netip.ParsePrefix(n)
+		if err != nil {
+			// 单个 IP 视为 /32 或 /128
+			ip, ipErr := netip.ParseAddr(n)
+			if ipErr != nil {
+				return nil, fmt.Errorf("%s 中的 %q 格式错误: %v", name, n, err)
+			}
+			p = netip.PrefixFrom(ip, ip.BitLen())
+		}
+		nets = append(nets, p.Masked())
+	}
+	return nets, nil
+}
+
+func inNetworks(ip netip.Addr, nets []netip.Prefix) bool {
+	for _, p := range nets {
+		if p.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// inDirectNetwork 目标主机(IP 或解析后的任一 IP)是否属于直连网段
+func inDirectNetwork(host string) bool {
+	nets := config().directNets
+	if len(nets) == 0 {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var addrs []netip.Addr
+	if ip, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		addrs = []netip.Addr{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		addrs, _ = lookupHost(ctx, host)
+	}
+	for _, ip := range addrs {
+		if inNetworks(ip, nets) {
+			return true
+		}
+	}
+	return false
+}
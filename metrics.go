@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsPath Prometheus 指标接口，管理接口上同时提供 /metrics
+const metricsPath = "/_proxy/metrics"
+
+// 上游响应时间直方图的分桶(秒)，与 Prometheus 客户端默认值一致
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricKey struct {
+	domain, rule string
+}
+
+type metricValues struct {
+	requests  [6]int64 // 按状态码类别 1xx-5xx，0 表示未收到响应
+	bytesIn   int64
+	bytesOut  int64
+	buckets   []int64
+	latCount  int64
+	latSumSec float64
+}
+
+var metrics = struct {
+	sync.Mutex
+	m map[metricKey]*metricValues
+}{m: map[metricKey]*metricValues{}}
+
+var (
+	activeConns      atomic.Int64
+	inflightRequests atomic.Int64
+)
+
+// recordMetrics 每个代理请求结束时调用，latency 为收到上游响应头之前的时间
+func recordMetrics(domain, rule string, status int, bytesIn, bytesOut int64, latency time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	k := metricKey{domain, rule}
+	v := metrics.m[k]
+	if v == nil {
+		v = &metricValues{buckets: make([]int64, len(latencyBuckets))}
+		metrics.m[k] = v
+	}
+	class := status / 100
+	if class < 1 || class > 5 {
+		class = 0
+	}
+	v.requests[class]++
+	v.bytesIn += bytesIn
+	v.bytesOut += bytesOut
+	sec := latency.Seconds()
+	for i, b := range latencyBuckets {
+		if sec <= b {
+			v.buckets[i]++
+		}
+	}
+	v.latCount++
+	v.latSumSec += sec
+}
+
+// clientConns 当前打开的客户端连接，值为 connInfo，供调试接口列出
+var clientConns sync.Map
+
+type connInfo struct {
+	state   http.ConnState
+	opened  time.Time
+	changed time.Time
+}
+
+// trackConnState 统计当前打开的客户端连接数，设置到 http.Server.ConnState
+func trackConnState(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		activeConns.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		activeConns.Add(-1)
+		clientConns.Delete(c)
+		return
+	}
+	info := connInfo{state: state, opened: time.Now(), changed: time.Now()}
+	if v, ok := clientConns.Load(c); ok {
+		info.opened = v.(connInfo).opened
+	}
+	clientConns.Store(c, info)
+}
+
+// countingBody 统计读取的请求体字节数
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.Lock()
+	keys := make([]metricKey, 0, len(metrics.m))
+	for k := range metrics.m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].domain != keys[j].domain {
+			return keys[i].domain < keys[j].domain
+		}
+		return keys[i].rule < keys[j].rule
+	})
+	var b strings.Builder
+	labels := func(k metricKey) string {
+		return fmt.Sprintf(`domain="%s",rule="%s"`, escapeLabel(k.domain), escapeLabel(k.rule))
+	}
+
+	b.WriteString("# HELP r_proxy_requests_total 代理请求数，按状态码类别\n# TYPE r_proxy_requests_total counter\n")
+	for _, k := range keys {
+		for class, n := range metrics.m[k].requests {
+			if n == 0 {
+				continue
+			}
+			code := "none"
+			if class > 0 {
+				code = strconv.Itoa(class) + "xx"
+			}
+			fmt.Fprintf(&b, "r_proxy_requests_total{%s,code=\"%s\"} %d\n", labels(k), code, n)
+		}
+	}
+	b.WriteString("# HELP r_proxy_request_bytes_total 客户端请求体字节数\n# TYPE r_proxy_request_bytes_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "r_proxy_request_bytes_total{%s} %d\n", labels(k), metrics.m[k].bytesIn)
+	}
+	b.WriteString("# HELP r_proxy_response_bytes_total 返回给客户端的响应体字节数\n# TYPE r_proxy_response_bytes_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "r_proxy_response_bytes_total{%s} %d\n", labels(k), metrics.m[k].bytesOut)
+	}
+	b.WriteString("# HELP r_proxy_upstream_latency_seconds 收到上游响应头的时间\n# TYPE r_proxy_upstream_latency_seconds histogram\n")
+	for _, k := range keys {
+		v := metrics.m[k]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(&b, "r_proxy_upstream_latency_seconds_bucket{%s,le=\"%g\"} %d\n", labels(k), le, v.buckets[i])
+		}
+		fmt.Fprintf(&b, "r_proxy_upstream_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(k), v.latCount)
+		fmt.Fprintf(&b, "r_proxy_upstream_latency_seconds_sum{%s} %g\n", labels(k), v.latSumSec)
+		fmt.Fprintf(&b, "r_proxy_upstream_latency_seconds_count{%s} %d\n", labels(k), v.latCount)
+	}
+	metrics.Unlock()
+
+	b.WriteString("# HELP r_proxy_active_connections 当前打开的客户端连接数\n# TYPE r_proxy_active_connections gauge\n")
+	fmt.Fprintf(&b, "r_proxy_active_connections %d\n", activeConns.Load())
+	b.WriteString("# HELP r_proxy_inflight_requests 正在处理的代理请求数\n# TYPE r_proxy_inflight_requests gauge\n")
+	fmt.Fprintf(&b, "r_proxy_inflight_requests %d\n", inflightRequests.Load())
+	b.WriteString("# HELP r_proxy_log_dropped_total 缓冲区满时丢弃的访问日志行数\n# TYPE r_proxy_log_dropped_total counter\n")
+	fmt.Fprintf(&b, "r_proxy_log_dropped_total %d\n", droppedLogs())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func init() {
+	adminMux.HandleFunc("/metrics", metricsHandler)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// minifyKinds 解析规则的 minify 属性，true/all 表示全部
+func minifyKinds(s string) map[string]bool {
+	kinds := map[string]bool{}
+	for _, k := range strings.Split(strings.ToLower(s), ",") {
+		switch k = strings.TrimSpace(k); k {
+		case "true", "all":
+			kinds["html"], kinds["css"], kinds["js"] = true, true, true
+		case "html", "css", "js":
+			kinds[k] = true
+		}
+	}
+	return kinds
+}
+
+func minifyKind(contentType string) string {
+	ct := strings.ToLower(contentType)
+	switch {
+	case strings.HasPrefix(ct, "text/html"):
+		return "html"
+	case strings.HasPrefix(ct, "text/css"):
+		return "css"
+	case strings.HasPrefix(ct, "application/javascript"), strings.HasPrefix(ct, "text/javascript"),
+		strings.HasPrefix(ct, "application/x-javascript"):
+		return "js"
+	}
+	return ""
+}
+
+// minifyCSS 去掉注释和多余空白，不改变字符串内容
+func minifyCSS(src []byte) []byte {
+	var out bytes.Buffer
+	space := false
+	// decl 当前语句是块内的声明(属性: 值)，只有这时冒号两边的空白可以去掉，
+	// 选择器中 "div :first-child" 和 "div:first-child" 含义不同
+	depth, decl := 0, false
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '"' || c == '\'':
+			j := skipString(src, i)
+			if space && cssNeedSpace(out.Bytes(), c, decl) {
+				out.WriteByte(' ')
+			}
+			space = false
+			out.Write(src[i:j])
+			i = j - 1
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += end + 3
+			}
+			space = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			space = true
+		default:
+			if space && cssNeedSpace(out.Bytes(), c, decl) {
+				out.WriteByte(' ')
+			}
+			space = false
+			// 右括号前的最后一个分号可以省略
+			if c == '}' && out.Len() > 0 && out.Bytes()[out.Len()-1] == ';' {
+				out.Truncate(out.Len() - 1)
+			}
+			out.WriteByte(c)
+			switch c {
+			case '{':
+				depth++
+			case '}':
+				depth = max(depth-1, 0)
+			}
+			if c == '{' || c == '}' || c == ';' {
+				decl = depth > 0 && cssIsDeclaration(src[i+1:])
+			}
+		}
+	}
+	return out.Bytes()
+}
+
+// cssIsDeclaration 块内的语句在 { 之前遇到 ; 或 } 时是声明，否则是嵌套规则(如 @media 中的选择器)
+func cssIsDeclaration(rest []byte) bool {
+	i := bytes.IndexAny(rest, "{;}")
+	return i < 0 || rest[i] != '{'
+}
+
+// cssNeedSpace 分隔符两边的空白可以去掉，其他位置保留一个空格；冒号只在声明中是分隔符
+func cssNeedSpace(out []byte, next byte, decl bool) bool {
+	separators := "{};,>"
+	if decl {
+		separators += ":"
+	}
+	return len(out) > 0 && strings.IndexByte(separators, out[len(out)-1]) < 0 && strings.IndexByte(separators, next) < 0
+}
+
+// skipString 返回从 i 开始的字符串字面量结束后的位置
+func skipString(src []byte, i int) int {
+	quote := src[i]
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case quote:
+			return j + 1
+		case '\n':
+			if quote != '`' {
+				return j
+			}
+		}
+	}
+	return len(src)
+}
+
+// regexAllowedAfter 这些字符之后的 / 是正则表达式的开始而不是除号，换行之后也按正则处理，
+// 误判为正则时只是原样输出，误判为除号时正则中的 // 会被当作注释删掉
+const regexAllowedAfter = "\n(,=:[!&|?{};+-*%<>~^"
+
+// regexAllowedKeywords 这些关键字之后的 / 是正则表达式，其他标识符和数字之后是除号
+var regexAllowedKeywords = map[string]bool{
+	"return": true, "typeof": true, "case": true, "in": true, "of": true,
+	"void": true, "delete": true, "throw": true, "new": true, "instanceof": true,
+	"do": true, "else": true, "yield": true, "await": true,
+}
+
+func isJSIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// regexAllowed 根据已输出内容判断接下来的 / 是否是正则表达式的开始
+func regexAllowed(out []byte, lastSignificant byte) bool {
+	if strings.IndexByte(regexAllowedAfter, lastSignificant) >= 0 {
+		return true
+	}
+	if !isJSIdentByte(lastSignificant) {
+		return false
+	}
+	end := len(bytes.TrimRight(out, " "))
+	start := end
+	for start > 0 && isJSIdentByte(out[start-1]) {
+		start--
+	}
+	// obj.return 之类的属性名不是关键字
+	if start > 0 && out[start-1] == '.' {
+		return false
+	}
+	return regexAllowedKeywords[string(out[start:end])]
+}
+
+// minifyJS 保守的 JS 压缩: 去掉注释、行首行尾空白和空行，保留换行以免影响自动分号插入
+func minifyJS(src []byte) []byte {
+	var out bytes.Buffer
+	lineStart := true
+	lastSignificant := byte('\n')
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			j := skipString(src, i)
+			out.Write(src[i:j])
+			i = j - 1
+			lastSignificant = c
+			lineStart = false
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			i--
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(src)
+			} else {
+				comment := src[i : i+end+4]
+				// 保留 /*! 开头的版权注释
+				if bytes.HasPrefix(comment, []byte("/*!")) {
+					out.Write(comment)
+				}
+				i += end + 3
+			}
+		case c == '/' && regexAllowed(out.Bytes(), lastSignificant):
+			// 正则表达式字面量，原样输出
+			j := i + 1
+			inClass := false
+			for ; j < len(src) && src[j] != '\n'; j++ {
+				if src[j] == '\\' {
+					j++
+				} else if src[j] == '[' {
+					inClass = true
+				} else if src[j] == ']' {
+					inClass = false
+				} else if src[j] == '/' && !inClass {
+					break
+				}
+			}
+			if j < len(src) {
+				j++
+			}
+			out.Write(src[i:j])
+			i = j - 1
+			lastSignificant = '/'
+			lineStart = false
+		case c == '\n' || c == '\r':
+			if !lineStart {
+				// 去掉行尾空白
+				b := out.Bytes()
+				n := len(b)
+				for n > 0 && (b[n-1] == ' ' || b[n-1] == '\t') {
+					n--
+				}
+				out.Truncate(n)
+				out.WriteByte('\n')
+			}
+			lineStart = true
+			lastSignificant = '\n'
+		case (c == ' ' || c == '\t') && (lineStart || (out.Len() > 0 && (out.Bytes()[out.Len()-1] == ' '))):
+			// 行首空白和连续空白
+		default:
+			if c == '\t' {
+				c = ' '
+			}
+			out.WriteByte(c)
+			if c != ' ' {
+				lastSignificant = c
+			}
+			lineStart = false
+		}
+	}
+	return bytes.TrimSpace(out.Bytes())
+}
+
+var (
+	htmlCommentRe = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlSpaceRe   = regexp.MustCompile(`[ \t\r\n]+`)
+	htmlBetweenRe = regexp.MustCompile(`>\s+<`)
+	// 每种标签单独匹配到同名的结束标签，<pre> 中的 </script> 不会提前结束
+	htmlRawBlockRe = regexp.MustCompile(`(?is)<(pre)\b[^>]*>.*?</pre\s*>|<(textarea)\b[^>]*>.*?</textarea\s*>|` +
+		`<(script)\b[^>]*>.*?</script\s*>|<(style)\b[^>]*>.*?</style\s*>`)
+)
+
+// minifyHTML 去掉注释(保留 IE 条件注释)并合并空白，pre/textarea 原样保留，
+// 内联的 script/style 分别按 JS/CSS 压缩
+func minifyHTML(src []byte) []byte {
+	var out bytes.Buffer
+	collapse := func(b []byte) {
+		b = htmlCommentRe.ReplaceAllFunc(b, func(m []byte) []byte {
+			if bytes.HasPrefix(m, []byte("<!--[if")) {
+				return m
+			}
+			return nil
+		})
+		b = htmlBetweenRe.ReplaceAll(b, []byte("> <"))
+		b = htmlSpaceRe.ReplaceAll(b, []byte(" "))
+		out.Write(b)
+	}
+	last := 0
+	for _, loc := range htmlRawBlockRe.FindAllSubmatchIndex(src, -1) {
+		collapse(src[last:loc[0]])
+		block := src[loc[0]:loc[1]]
+		var tag string
+		for g := 2; g+1 < len(loc); g += 2 {
+			if loc[g] >= 0 {
+				tag = strings.ToLower(string(src[loc[g]:loc[g+1]]))
+			}
+		}
+		if tag == "script" || tag == "style" {
+			open := bytes.IndexByte(block, '>') + 1
+			close := bytes.LastIndex(block, []byte("</"))
+			if open > 0 && close >= open {
+				inner := block[open:close]
+				// 非 JS 类型的 script(如模板、JSON)不处理
+				if tag == "style" {
+					inner = minifyCSS(inner)
+				} else if typ := bytes.ToLower(block[:open]); !bytes.Contains(typ, []byte("type=")) ||
+					bytes.Contains(typ, []byte("javascript")) || bytes.Contains(typ, []byte("module")) {
+					inner = minifyJS(inner)
+				}
+				out.Write(block[:open])
+				out.Write(inner)
+				out.Write(block[close:])
+			} else {
+				out.Write(block)
+			}
+		} else {
+			out.Write(block)
+		}
+		last = loc[1]
+	}
+	collapse(src[last:])
+	return bytes.TrimSpace(out.Bytes())
+}
+
+// applyMinify 按规则压缩 HTML/CSS/JS 响应
+func applyMinify(id int64, rule *ProxyRule, resp *http.Response) error {
+	if rule == nil || rule.Minify == "" || !isIdentityEncoding(resp) {
+		return nil
+	}
+	kind := minifyKind(resp.Header.Get("Content-Type"))
+	if kind == "" || !minifyKinds(rule.Minify)[kind] {
+		return nil
+	}
+	body, ok, err := readBodyLimited(resp, defaultRewriteMaxSize)
+	if err != nil || !ok {
+		return err
+	}
+	var out []byte
+	switch kind {
+	case "html":
+		out = minifyHTML(body)
+	case "css":
+		out = minifyCSS(body)
+	case "js":
+		out = minifyJS(body)
+	}
+	debugf("id:%d minify %s %d -> %d 字节", id, kind, len(body), len(out))
+	setBody(resp, out)
+	return nil
+}
+
+// rewritesBody 规则是否会处理响应体，处理响应体时需要上游返回未压缩的内容
+func rewritesBody(rule *ProxyRule) bool {
+	return rule != nil && (rule.Transcode || rule.Minify != "" || rule.InjectScript || rule.BaseHref ||
+		len(rule.Replaces) > 0 || len(rule.JSONTransforms) > 0 || (rule.OpenAPI != nil && rule.OpenAPI.Responses))
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestMinifyJSRegex(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"return /^https?:\\/\\//i.test(u) // comment", "return /^https?:\\/\\//i.test(u)"},
+		{"if (typeof /a\\/\\//.source) x()", "if (typeof /a\\/\\//.source) x()"},
+		{"switch (c) { case /x\\/\\//: y() }", "switch (c) { case /x\\/\\//: y() }"},
+		{"throw /a\\/\\/b/", "throw /a\\/\\/b/"},
+		{"a = b\n/https:\\/\\//.test(s)", "a = b\n/https:\\/\\//.test(s)"},
+		{"x = a / b // half", "x = a / b"},
+		{"x = obj.return / 2 // half", "x = obj.return / 2"},
+		{"y = 10 / 2 /* c */ + 1", "y = 10 / 2 + 1"},
+	}
+	for _, tt := range tests {
+		if got := string(minifyJS([]byte(tt.src))); got != tt.want {
+			t.Errorf("minifyJS(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestMinifyCSSSelectorColon(t *testing.T) {
+	got := string(minifyCSS([]byte("div :first-child { color : red ; }\n@media (x) { a :hover { b : c } }")))
+	want := "div :first-child{color:red}@media (x){a :hover{b:c}}"
+	if got != want {
+		t.Errorf("minifyCSS = %q, want %q", got, want)
+	}
+}
+
+func TestMinifyHTMLRawBlocks(t *testing.T) {
+	src := "<pre>  a </script>  b </pre>\n<p>  x  </p>\n<script>\n  var a = 1 // c\n</script>"
+	want := "<pre>  a </script>  b </pre> <p> x </p> <script>var a = 1</script>"
+	if got := string(minifyHTML([]byte(src))); got != want {
+		t.Errorf("minifyHTML = %q, want %q", got, want)
+	}
+}
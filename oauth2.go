@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2Client 通过 client credentials 方式获取访问令牌，并以 Bearer 形式附加到上游请求
+type OAuth2Client struct {
+	TokenURL     string `xml:"tokenUrl,attr"`
+	ClientID     string `xml:"clientId,attr"`
+	ClientSecret string `xml:"clientSecret,attr"`
+	Scopes       string `xml:"scopes,attr,omitempty"`    // 空格或逗号分隔
+	Audience     string `xml:"audience,attr,omitempty"`  // 部分服务(如 Auth0)需要
+	AuthStyle    string `xml:"authStyle,attr,omitempty"` // header(默认，Basic 认证) 或 body(表单参数)
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+var oauth2HTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+func (o *OAuth2Client) init() error {
+	if o.TokenURL == "" || o.ClientID == "" {
+		return fmt.Errorf("oauth2 需要配置 tokenUrl 和 clientId")
+	}
+	return nil
+}
+
+// accessToken 返回缓存的令牌，过期前 1 分钟(或有效期的 1/10)重新获取
+func (o *OAuth2Client) accessToken() (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.token != "" && time.Now().Before(o.expires) {
+		return o.token, nil
+	}
+	token, ttl, err := o.fetch()
+	if err != nil {
+		return "", err
+	}
+	o.token = token
+	o.expires = time.Now().Add(ttl - min(time.Minute, ttl/10))
+	return token, nil
+}
+
+// invalidate 上游返回 401 时丢弃缓存的令牌，下次请求重新获取
+func (o *OAuth2Client) invalidate() {
+	o.mu.Lock()
+	o.token = ""
+	o.mu.Unlock()
+}
+
+func (o *OAuth2Client) fetch() (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if o.Scopes != "" {
+		form.Set("scope", strings.Join(strings.FieldsFunc(o.Scopes, func(r rune) bool { return r == ' ' || r == ',' }), " "))
+	}
+	if o.Audience != "" {
+		form.Set("audience", o.Audience)
+	}
+	if strings.EqualFold(o.AuthStyle, "body") {
+		form.Set("client_id", o.ClientID)
+		form.Set("client_secret", o.ClientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !strings.EqualFold(o.AuthStyle, "body") {
+		req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	}
+	resp, err := oauth2HTTPClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("请求令牌失败: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var result struct {
+		AccessToken string          `json:"access_token"`
+		TokenType   string          `json:"token_type"`
+		ExpiresIn   json.Number     `json:"expires_in"`
+		Error       string          `json:"error"`
+		Description json.RawMessage `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", 0, fmt.Errorf("解析令牌响应失败(%s): %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", 0, fmt.Errorf("获取令牌失败: %s %s %s", resp.Status, result.Error, result.Description)
+	}
+	ttl := time.Hour
+	if n, err := result.ExpiresIn.Int64(); err == nil && n > 0 {
+		ttl = time.Duration(n) * time.Second
+	}
+	return result.AccessToken, ttl, nil
+}
+
+// applyOAuth2 在 Director 中设置 Authorization 请求头
+func applyOAuth2(id int64, rule *ProxyRule, r *http.Request) {
+	if rule == nil || rule.OAuth2 == nil {
+		return
+	}
+	token, err := rule.OAuth2.accessToken()
+	if err != nil {
+		warnf("id:%d OAuth2 令牌获取失败: %v", id, err)
+		return
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OpenAPI 校验时最多读取的请求体/响应体大小
+const openAPIBodyLimit = 1 << 20
+
+// OpenAPIValidation 规则上挂载的 OpenAPI 文档(JSON 格式)，校验请求和响应是否符合接口定义
+type OpenAPIValidation struct {
+	Spec      string `xml:"spec,attr"`
+	Mode      string `xml:"mode,attr,omitempty"`      // log(默认，只记录) 或 enforce(拒绝不符合的请求)
+	Responses bool   `xml:"responses,attr,omitempty"` // 同时校验响应
+
+	doc *openAPIDoc
+}
+
+func (v *OpenAPIValidation) enforce() bool {
+	return strings.EqualFold(v.Mode, "enforce")
+}
+
+func (v *OpenAPIValidation) init() error {
+	doc, err := loadOpenAPI(v.Spec)
+	if err != nil {
+		return fmt.Errorf("加载 OpenAPI 文档 %s 失败: %v", v.Spec, err)
+	}
+	v.doc = doc
+	return nil
+}
+
+type openAPIDoc struct {
+	raw      map[string]any
+	basePath string
+	routes   []*openAPIRoute
+}
+
+type openAPIRoute struct {
+	template string
+	re       *regexp.Regexp
+	names    []string
+	ops      map[string]map[string]any // method -> operation
+	params   []any                     // path 级别的参数
+}
+
+var pathParamRe = regexp.MustCompile(`\{([^}/]+)\}`)
+
+func loadOpenAPI(path string) (*openAPIDoc, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	doc := &openAPIDoc{raw: raw}
+	if servers, ok := raw["servers"].([]any); ok && len(servers) > 0 {
+		if s, ok := servers[0].(map[string]any); ok {
+			if u, err := url.Parse(fmt.Sprint(s["url"])); err == nil {
+				doc.basePath = strings.TrimSuffix(u.Path, "/")
+			}
+		}
+	}
+	paths, _ := raw["paths"].(map[string]any)
+	for tpl, item := range paths {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		route := &openAPIRoute{template: tpl, ops: map[string]map[string]any{}}
+		// 将 /users/{id} 转换为 ^/users/([^/]+)$
+		var expr strings.Builder
+		expr.WriteString("^")
+		last := 0
+		for _, loc := range pathParamRe.FindAllStringSubmatchIndex(tpl, -1) {
+			expr.WriteString(regexp.QuoteMeta(tpl[last:loc[0]]))
+			expr.WriteString("([^/]+)")
+			route.names = append(route.names, tpl[loc[2]:loc[3]])
+			last = loc[1]
+		}
+		expr.WriteString(regexp.QuoteMeta(tpl[last:]) + "$")
+		re, err := regexp.Compile(expr.String())
+		if err != nil {
+			continue
+		}
+		route.re = re
+		for k, v := range m {
+			if k == "parameters" {
+				route.params, _ = v.([]any)
+				continue
+			}
+			if op, ok := v.(map[string]any); ok {
+				route.ops[strings.ToUpper(k)] = op
+			}
+		}
+		doc.routes = append(doc.routes, route)
+	}
+	// 没有参数的固定路径优先匹配
+	sort.Slice(doc.routes, func(i, j int) bool {
+		return len(doc.routes[i].names) < len(doc.routes[j].names)
+	})
+	return doc, nil
+}
+
+// resolve 解析 #/components/... 形式的 $ref
+func (d *openAPIDoc) resolve(v any) any {
+	for i := 0; i < 16; i++ {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return v
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok || !strings.HasPrefix(ref, "#/") {
+			return v
+		}
+		var cur any = d.raw
+		for _, p := range strings.Split(ref[2:], "/") {
+			p = strings.ReplaceAll(strings.ReplaceAll(p, "~1", "/"), "~0", "~")
+			cm, ok := cur.(map[string]any)
+			if !ok {
+				return nil
+			}
+			cur = cm[p]
+		}
+		v = cur
+	}
+	return v
+}
+
+func (d *openAPIDoc) match(p string) (*openAPIRoute, map[string]string) {
+	if d.basePath != "" {
+		if !strings.HasPrefix(p, d.basePath) {
+			return nil, nil
+		}
+		p = strings.TrimPrefix(p, d.basePath)
+		if p == "" {
+			p = "/"
+		}
+	}
+	for _, r := range d.routes {
+		if m := r.re.FindStringSubmatch(p); m != nil {
+			vals := map[string]string{}
+			for i, n := range r.names {
+				vals[n], _ = url.PathUnescape(m[i+1])
+			}
+			return r, vals
+		}
+	}
+	return nil, nil
+}
+
+// validateSchema 校验 JSON Schema 的常用子集，返回第一个错误
+func (d *openAPIDoc) validateSchema(schema any, v any, at string) error {
+	s, ok := d.resolve(schema).(map[string]any)
+	if !ok || len(s) == 0 {
+		return nil
+	}
+	if v == nil {
+		if s["nullable"] == true || s["type"] == "null" {
+			return nil
+		}
+		if _, typed := s["type"]; typed {
+			return fmt.Errorf("%s 不能为 null", at)
+		}
+	}
+	if all, ok := s["allOf"].([]any); ok {
+		for _, sub := range all {
+			if err := d.validateSchema(sub, v, at); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		if list, ok := s[key].([]any); ok {
+			matched := 0
+			for _, sub := range list {
+				if d.validateSchema(sub, v, at) == nil {
+					matched++
+				}
+			}
+			if matched == 0 || (key == "oneOf" && matched > 1) {
+				return fmt.Errorf("%s 不符合 %s", at, key)
+			}
+		}
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s 的值不在 enum 中", at)
+		}
+	}
+	switch t, _ := s["type"].(string); t {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s 应为 object", at)
+		}
+		if req, ok := s["required"].([]any); ok {
+			for _, r := range req {
+				if _, ok := obj[fmt.Sprint(r)]; !ok {
+					return fmt.Errorf("%s 缺少必填字段 %v", at, r)
+				}
+			}
+		}
+		props, _ := s["properties"].(map[string]any)
+		for k, val := range obj {
+			if ps, ok := props[k]; ok {
+				if err := d.validateSchema(ps, val, at+"."+k); err != nil {
+					return err
+				}
+			} else if s["additionalProperties"] == false {
+				return fmt.Errorf("%s 不允许字段 %s", at, k)
+			} else if ap, ok := s["additionalProperties"].(map[string]any); ok {
+				if err := d.validateSchema(ap, val, at+"."+k); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s 应为 array", at)
+		}
+		if n, ok := s["minItems"].(float64); ok && float64(len(arr)) < n {
+			return fmt.Errorf("%s 元素个数少于 %v", at, n)
+		}
+		if n, ok := s["maxItems"].(float64); ok && float64(len(arr)) > n {
+			return fmt.Errorf("%s 元素个数多于 %v", at, n)
+		}
+		if items, ok := s["items"]; ok {
+			for i, item := range arr {
+				if err := d.validateSchema(items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s 应为 string", at)
+		}
+		if n, ok := s["minLength"].(float64); ok && float64(len([]rune(str))) < n {
+			return fmt.Errorf("%s 长度小于 %v", at, n)
+		}
+		if n, ok := s["maxLength"].(float64); ok && float64(len([]rune(str))) > n {
+			return fmt.Errorf("%s 长度大于 %v", at, n)
+		}
+		if p, ok := s["pattern"].(string); ok {
+			if re, err := regexp.Compile(p); err == nil && !re.MatchString(str) {
+				return fmt.Errorf("%s 不匹配 pattern %s", at, p)
+			}
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok {
+			return fmt.Errorf("%s 应为 %s", at, t)
+		}
+		if t == "integer" && n != math.Trunc(n) {
+			return fmt.Errorf("%s 应为 integer", at)
+		}
+		if m, ok := s["minimum"].(float64); ok && n < m {
+			return fmt.Errorf("%s 小于 %v", at, m)
+		}
+		if m, ok := s["maximum"].(float64); ok && n > m {
+			return fmt.Errorf("%s 大于 %v", at, m)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s 应为 boolean", at)
+		}
+	}
+	return nil
+}
+
+// paramValue 将路径/查询/请求头中的字符串参数按 schema 类型转换后再校验
+func paramValue(schema map[string]any, raw string) any {
+	switch schema["type"] {
+	case "integer", "number":
+		if n, err := strconv.ParseFloat(raw, 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(raw); err == nil {
+			return b
+		}
+	}
+	return raw
+}
+
+func jsonMediaSchema(d *openAPIDoc, content any) (any, bool) {
+	c, ok := d.resolve(content).(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	for mt, v := range c {
+		if strings.Contains(mt, "json") {
+			m, _ := d.resolve(v).(map[string]any)
+			return m["schema"], true
+		}
+	}
+	return nil, false
+}
+
+// validateRequest 校验路径、方法、参数和 JSON 请求体
+func (d *openAPIDoc) validateRequest(r *http.Request, target *url.URL) error {
+	route, pathVals := d.match(target.Path)
+	if route == nil {
+		return fmt.Errorf("路径 %s 未在接口定义中", target.Path)
+	}
+	op, ok := route.ops[r.Method]
+	if !ok {
+		return fmt.Errorf("%s %s 不允许该方法", r.Method, route.template)
+	}
+	params := append([]any{}, route.params...)
+	if p, ok := op["parameters"].([]any); ok {
+		params = append(params, p...)
+	}
+	query := target.Query()
+	for _, p := range params {
+		pm, ok := d.resolve(p).(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _ := pm["name"].(string)
+		var raw string
+		var present bool
+		switch pm["in"] {
+		case "path":
+			raw, present = pathVals[name]
+		case "query":
+			present = query.Has(name)
+			raw = query.Get(name)
+		case "header":
+			raw = r.Header.Get(name)
+			present = raw != ""
+		default:
+			continue
+		}
+		if !present {
+			if pm["required"] == true {
+				return fmt.Errorf("缺少必填参数 %s(%v)", name, pm["in"])
+			}
+			continue
+		}
+		schema, _ := d.resolve(pm["schema"]).(map[string]any)
+		if err := d.validateSchema(schema, paramValue(schema, raw), name); err != nil {
+			return err
+		}
+	}
+	rb, ok := d.resolve(op["requestBody"]).(map[string]any)
+	if !ok {
+		return nil
+	}
+	body, complete, err := peekBody(r)
+	if err != nil || !complete {
+		// 超过 openAPIBodyLimit 的请求体不校验，与响应体的处理一致
+		return nil
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if rb["required"] == true {
+			return fmt.Errorf("缺少请求体")
+		}
+		return nil
+	}
+	if !strings.Contains(r.Header.Get("Content-Type"), "json") {
+		return nil
+	}
+	schema, ok := jsonMediaSchema(d, rb["content"])
+	if !ok {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("请求体不是合法 JSON: %v", err)
+	}
+	return d.validateSchema(schema, v, "body")
+}
+
+// validateResponse 校验状态码是否在定义中以及 JSON 响应体
+func (d *openAPIDoc) validateResponse(method string, target *url.URL, resp *http.Response) error {
+	route, _ := d.match(target.Path)
+	if route == nil {
+		return nil
+	}
+	op, ok := route.ops[method]
+	if !ok {
+		return nil
+	}
+	responses, _ := op["responses"].(map[string]any)
+	code := strconv.Itoa(resp.StatusCode)
+	def, ok := responses[code]
+	if !ok {
+		def, ok = responses[code[:1]+"XX"]
+	}
+	if !ok {
+		def, ok = responses["default"]
+	}
+	if !ok {
+		return fmt.Errorf("响应状态码 %d 未在接口定义中", resp.StatusCode)
+	}
+	rd, _ := d.resolve(def).(map[string]any)
+	schema, ok := jsonMediaSchema(d, rd["content"])
+	if !ok || !isJSONType(resp.Header.Get("Content-Type")) || !isIdentityEncoding(resp) {
+		return nil
+	}
+	body, ok, err := readBodyLimited(resp, openAPIBodyLimit)
+	if err != nil || !ok {
+		return err
+	}
+	setBody(resp, body)
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("响应体不是合法 JSON: %v", err)
+	}
+	return d.validateSchema(schema, v, "response")
+}
+
+// peekBody 读取请求体(最多 openAPIBodyLimit)，并放回以便继续转发；complete 为 false 表示请求体超过上限
+func peekBody(r *http.Request) (body []byte, complete bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > openAPIBodyLimit {
+		return nil, false, nil
+	}
+	body, err = io.ReadAll(io.LimitReader(r.Body, openAPIBodyLimit+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	return body, int64(len(body)) <= openAPIBodyLimit, err
+}
+
+// checkOpenAPIRequest 在转发前校验请求，enforce 模式下不符合时返回 400
+func checkOpenAPIRequest(w http.ResponseWriter, id int64, rule *ProxyRule, r *http.Request, target *url.URL) bool {
+	if rule == nil || rule.OpenAPI == nil || rule.OpenAPI.doc == nil {
+		return false
+	}
+	err := rule.OpenAPI.doc.validateRequest(r, target)
+	if err == nil {
+		return false
+	}
+	warnf("id:%d 请求不符合 OpenAPI 定义: %v", id, err)
+	if !rule.OpenAPI.enforce() {
+		return false
+	}
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": "请求不符合接口定义", "detail": err.Error()})
+	return true
+}
+
+// checkOpenAPIResponse 校验响应，enforce 模式下不符合时返回 502
+func checkOpenAPIResponse(id int64, rule *ProxyRule, method string, target *url.URL, resp *http.Response) error {
+	if rule == nil || rule.OpenAPI == nil || rule.OpenAPI.doc == nil || !rule.OpenAPI.Responses {
+		return nil
+	}
+	err := rule.OpenAPI.doc.validateResponse(method, target, resp)
+	if err == nil {
+		return nil
+	}
+	warnf("id:%d 响应不符合 OpenAPI 定义: %v", id, err)
+	if !rule.OpenAPI.enforce() {
+		return nil
+	}
+	return fmt.Errorf("响应不符合接口定义: %v", err)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TracingConfig OpenTelemetry 链路追踪: 每个代理请求生成一个 span，通过 OTLP/HTTP(JSON) 批量发送到 endpoint，
+// 并在转发的请求中写入 traceparent，上游服务的 span 会挂在代理的 span 下面
+type TracingConfig struct {
+	Endpoint    string        `xml:"endpoint,attr"`              // 如 http://localhost:4318/v1/traces
+	ServiceName string        `xml:"serviceName,attr,omitempty"` // 默认 r-proxy
+	Sample      string        `xml:"sample,attr,omitempty"`      // 没有上游 traceparent 时的采样率 0-1，默认 1
+	Headers     []HeaderValue `xml:"header"`                     // 发送到 collector 时附加的请求头，如认证信息
+
+	sample float64
+}
+
+func (c *TracingConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("tracing endpoint 格式错误: %q", c.Endpoint)
+	}
+	c.sample = 1
+	if c.Sample != "" {
+		f, err := strconv.ParseFloat(c.Sample, 64)
+		if err != nil || f < 0 || f > 1 {
+			return fmt.Errorf("tracing sample 应为 0 到 1 之间的数: %q", c.Sample)
+		}
+		c.sample = f
+	}
+	startSpanExporter()
+	return nil
+}
+
+// span 一个代理请求的追踪信息
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]any
+	status   int
+}
+
+// startSpan 沿用客户端 traceparent 中的 trace id 和采样标记，没有时按 sample 采样；未开启追踪时返回 nil
+func startSpan(r *http.Request, target *url.URL, rule *ProxyRule) *span {
+	c := config().Tracing
+	if c == nil {
+		return nil
+	}
+	s := &span{name: r.Method + " " + target.Host, start: time.Now()}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = c.sample >= 1 || mrand.Float64() < c.sample
+	}
+	rand.Read(s.spanID[:])
+	s.attrs = map[string]any{
+		"http.request.method": r.Method,
+		"url.full":            target.String(),
+		"server.address":      target.Hostname(),
+		"client.address":      clientIP(r),
+		"r_proxy.rule":        ruleName(rule),
+	}
+	if rule != nil && rule.usesProxy() {
+		s.attrs["r_proxy.upstream"] = rule.upstreamName()
+	}
+	return s
+}
+
+// parseTraceparent 解析 W3C traceparent: 00-<trace id>-<parent id>-<flags>
+func parseTraceparent(v string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if traceID == ([16]byte{}) || parentID == ([8]byte{}) {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// inject 把代理的 span 作为上游请求的父 span，tracestate 原样转发
+func (s *span) inject(r *http.Request) {
+	if s == nil {
+		return
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	r.Header.Set("traceparent", "00-"+hex.EncodeToString(s.traceID[:])+"-"+hex.EncodeToString(s.spanID[:])+"-"+flags)
+}
+
+// finish 记录状态码并放入发送队列，队列满时丢弃
+func (s *span) finish(status int, bytes int64) {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.end = time.Now()
+	s.status = status
+	s.attrs["http.response.status_code"] = status
+	s.attrs["http.response.body.size"] = bytes
+	select {
+	case spanQueue <- s:
+	default:
+	}
+}
+
+var (
+	spanQueue    = make(chan *span, 4096)
+	exporterOnce sync.Once
+)
+
+const (
+	spanBatchSize     = 512
+	spanFlushInterval = 5 * time.Second
+)
+
+// startSpanExporter 启动后台发送，配置重新加载后继续使用同一个队列，每次发送时读取当前的 tracing 配置
+func startSpanExporter() {
+	exporterOnce.Do(func() {
+		go func() {
+			client := &http.Client{Timeout: 10 * time.Second}
+			tick := time.NewTicker(spanFlushInterval)
+			var batch []*span
+			for {
+				select {
+				case s := <-spanQueue:
+					if batch = append(batch, s); len(batch) < spanBatchSize {
+						continue
+					}
+				case <-tick.C:
+					if len(batch) == 0 {
+						continue
+					}
+				}
+				if err := exportSpans(client, batch); err != nil {
+					log.Printf("发送 %d 个 span 失败: %v", len(batch), err)
+				}
+				batch = nil
+			}
+		}()
+	})
+}
+
+func exportSpans(client *http.Client, batch []*span) error {
+	c := config().Tracing
+	if c == nil {
+		return nil
+	}
+	body, err := json.Marshal(otlpRequest(c, batch))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range c.Headers {
+		req.Header.Set(h.Name, h.Value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector 返回 %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpRequest 按 OTLP/HTTP 的 JSON 编码组装请求，trace id 和 span id 使用十六进制，64 位整数使用字符串
+func otlpRequest(c *TracingConfig, batch []*span) map[string]any {
+	service := c.ServiceName
+	if service == "" {
+		service = "r-proxy"
+	}
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		out := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              2, // SPAN_KIND_SERVER
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != ([8]byte{}) {
+			out["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		// 服务端 span 只有 5xx 视为错误
+		if s.status >= 500 {
+			out["status"] = map[string]any{"code": 2}
+		}
+		spans = append(spans, out)
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttributes(map[string]any{"service.name": service})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "r-proxy"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]any) []any {
+	out := make([]any, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]any
+		switch v := v.(type) {
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]any{"key": k, "value": value})
+	}
+	return out
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PACConfig 用 PAC 脚本选择上游代理: 没有匹配的 proxy 规则时对目标调用 FindProxyForURL，
+// 按返回的 "PROXY host:port; SOCKS5 host:port; DIRECT" 依次使用代理，第一个代理失败时改用后面的；
+// 返回 DIRECT 时直连，脚本出错时使用 defaultProxy。path 和 url 二选一
+type PACConfig struct {
+	Path     string `xml:"path,attr,omitempty"`
+	URL      string `xml:"url,attr,omitempty"`
+	Refresh  string `xml:"refresh,attr,omitempty"`  // 重新读取脚本的间隔，默认 1h
+	CacheTTL string `xml:"cacheTtl,attr,omitempty"` // 同一主机的结果缓存时间，默认 1m，0 表示不缓存
+
+	refresh  time.Duration
+	cacheTTL time.Duration
+	script   atomic.Pointer[pacScript]
+	rulesMu  sync.Mutex
+	rules    map[string]*ProxyRule // 按 FindProxyForURL 的返回值缓存规则，同一组代理共用 Transport
+}
+
+func (c *PACConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	if (c.Path == "") == (c.URL == "") {
+		return fmt.Errorf("pac 需要配置 path 或 url 其中一个")
+	}
+	c.refresh = time.Hour
+	if c.Refresh != "" {
+		d, err := time.ParseDuration(c.Refresh)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("pac refresh 格式错误: %q", c.Refresh)
+		}
+		c.refresh = d
+	}
+	c.cacheTTL = time.Minute
+	if c.CacheTTL != "" {
+		d, err := time.ParseDuration(c.CacheTTL)
+		if err != nil || d < 0 {
+			return fmt.Errorf("pac cacheTtl 格式错误: %q", c.CacheTTL)
+		}
+		c.cacheTTL = d
+	}
+	s, err := loadPACScript(c.source())
+	if err != nil {
+		return fmt.Errorf("pac %s: %v", c.source(), err)
+	}
+	c.script.Store(s)
+	c.rules = map[string]*ProxyRule{}
+	startPACRefresh()
+	return nil
+}
+
+func (c *PACConfig) source() string {
+	if c.URL != "" {
+		return c.URL
+	}
+	return c.Path
+}
+
+// pacScript 解析后的脚本，每次求值使用新的全局作用域重新执行顶层代码，请求之间互不影响
+type pacScript struct {
+	prog []jsStmt
+
+	mu    sync.Mutex
+	cache map[string]pacResult
+}
+
+type pacResult struct {
+	value   string
+	expires time.Time
+}
+
+// pacCacheSize 结果缓存的主机数上限，超过时清空
+const pacCacheSize = 10000
+
+func loadPACScript(source string) (*pacScript, error) {
+	src, err := readPACSource(source)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := jsParse(src)
+	if err != nil {
+		return nil, err
+	}
+	s := &pacScript{prog: prog, cache: map[string]pacResult{}}
+	// 加载时先执行一次顶层代码，检查是否定义了 FindProxyForURL
+	in := newPACInterp()
+	if err := in.run(prog); err != nil {
+		return nil, err
+	}
+	if _, ok := in.global.vars["FindProxyForURL"].(*jsFunction); !ok {
+		return nil, fmt.Errorf("脚本中没有定义 FindProxyForURL 函数")
+	}
+	return s, nil
+}
+
+func readPACSource(source string) (string, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		b, err := os.ReadFile(source)
+		return string(b), err
+	}
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Get(source)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("下载失败: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	return string(b), err
+}
+
+var pacRefreshOnce sync.Once
+
+// startPACRefresh 后台定期重新读取当前配置的 PAC 脚本，读取或解析失败时继续使用旧脚本
+func startPACRefresh() {
+	pacRefreshOnce.Do(func() {
+		go func() {
+			for {
+				c := config().PAC
+				interval := time.Hour
+				if c != nil {
+					interval = c.refresh
+				}
+				time.Sleep(interval)
+				if c = config().PAC; c == nil {
+					continue
+				}
+				s, err := loadPACScript(c.source())
+				if err != nil {
+					warnf("重新读取 pac %s 失败，继续使用旧脚本: %v", c.source(), err)
+					continue
+				}
+				c.script.Store(s)
+				log.Printf("已重新读取 pac %s", c.source())
+			}
+		}()
+	})
+}
+
+// eval 对目标调用 FindProxyForURL；url 参数只包含协议和主机，与浏览器处理 https 的方式相同，结果可以按主机缓存
+func (c *PACConfig) eval(target *url.URL) (string, error) {
+	s := c.script.Load()
+	scheme := target.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	key := scheme + "://" + target.Host
+	now := time.Now()
+	s.mu.Lock()
+	if e, ok := s.cache[key]; ok && now.Before(e.expires) {
+		s.mu.Unlock()
+		return e.value, nil
+	}
+	s.mu.Unlock()
+
+	in := newPACInterp()
+	if err := in.run(s.prog); err != nil {
+		return "", err
+	}
+	v, err := in.callGlobal("FindProxyForURL", key+"/", strings.ToLower(target.Hostname()))
+	if err != nil {
+		return "", err
+	}
+	value := jsToString(v)
+	if v == jsUndefined || v == jsNull {
+		value = ""
+	}
+	if c.cacheTTL > 0 {
+		s.mu.Lock()
+		if len(s.cache) >= pacCacheSize {
+			clear(s.cache)
+		}
+		s.cache[key] = pacResult{value: value, expires: now.Add(c.cacheTTL)}
+		s.mu.Unlock()
+	}
+	return value, nil
+}
+
+// find 返回 PAC 脚本为目标选择的规则，直连时返回 nil；ok 为 false 表示没有配置 PAC 或脚本出错
+func (c *PACConfig) find(cfg *ProxyConfig, target *url.URL) (rule *ProxyRule, ok bool) {
+	if c == nil {
+		return nil, false
+	}
+	value, err := c.eval(target)
+	if err != nil {
+		warnf("pac FindProxyForURL(%s) 执行失败: %v", target.Host, err)
+		return nil, false
+	}
+	c.rulesMu.Lock()
+	defer c.rulesMu.Unlock()
+	if r, ok := c.rules[value]; ok {
+		return r, true
+	}
+	r, err := cfg.pacRule(value)
+	if err != nil {
+		warnf("pac FindProxyForURL(%s) 的返回值 %q 无法使用: %v", target.Host, value, err)
+		return nil, false
+	}
+	if len(c.rules) >= pacCacheSize {
+		return r, true
+	}
+	c.rules[value] = r
+	return r, true
+}
+
+// pacRule 按返回值创建规则，第一个代理为 proxyUrl，其余为 fallback；DIRECT 之后的代理不会使用
+func (c *ProxyConfig) pacRule(value string) (*ProxyRule, error) {
+	urls, err := parsePACResult(value)
+	if err != nil || len(urls) == 0 {
+		return nil, err
+	}
+	r := &ProxyRule{Domain: "pac"}
+	setPACUpstreams(r, urls)
+	t, err := proxyTransport(r, c.rootCAs)
+	if err != nil {
+		return nil, err
+	}
+	c.Timeouts.apply(t)
+	r.transport = t
+	if err := c.initFailover(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// setPACUpstreams 第一个代理为 proxyUrl，其余为 fallback
+func setPACUpstreams(r *ProxyRule, urls []string) {
+	if len(urls) == 0 {
+		return
+	}
+	r.ProxyURL = urls[0]
+	for _, u := range urls[1:] {
+		r.Fallbacks = append(r.Fallbacks, ProxyUpstream{ProxyURL: u})
+	}
+}
+
+// parsePACResult 把 "PROXY a:8080; HTTPS b:443; SOCKS5 c:1080; DIRECT" 转为代理地址，
+// 遇到 DIRECT 时停止；第一个就是 DIRECT 或返回值为空时表示直连
+func parsePACResult(value string) ([]string, error) {
+	var urls []string
+	for _, item := range strings.Split(value, ";") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" {
+			break
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("无法识别 %q", strings.TrimSpace(item))
+		}
+		scheme := ""
+		switch kind {
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS4", "SOCKS5":
+			// 不支持 SOCKS4，按 SOCKS5 连接并由代理解析域名
+			scheme = "socks5h"
+		default:
+			return nil, fmt.Errorf("不支持的代理类型 %s", fields[0])
+		}
+		if _, _, err := net.SplitHostPort(fields[1]); err != nil {
+			return nil, fmt.Errorf("代理地址格式错误 %q", fields[1])
+		}
+		urls = append(urls, scheme+"://"+fields[1])
+	}
+	return urls, nil
+}
+
+// closeIdleConnections 关闭 PAC 生成的规则的空闲连接
+func (c *PACConfig) closeIdleConnections() {
+	if c == nil {
+		return
+	}
+	c.rulesMu.Lock()
+	defer c.rulesMu.Unlock()
+	for _, r := range c.rules {
+		if r == nil {
+			continue
+		}
+		for _, u := range r.upstreams() {
+			u.transport.CloseIdleConnections()
+		}
+	}
+}
+
+// ---------- PAC 内置函数 ----------
+
+// pacDNSTimeout dnsResolve 等函数解析域名的超时时间
+const pacDNSTimeout = 2 * time.Second
+
+func newPACInterp() *jsInterp {
+	vars := map[string]any{}
+	jsBuiltins(vars)
+	str := func(args []any, i int) string { return jsToString(jsArg(args, i)) }
+	vars["isPlainHostName"] = jsNative(func(args []any) any {
+		return !strings.Contains(str(args, 0), ".")
+	})
+	vars["dnsDomainIs"] = jsNative(func(args []any) any {
+		return strings.HasSuffix(strings.ToLower(str(args, 0)), strings.ToLower(str(args, 1)))
+	})
+	vars["localHostOrDomainIs"] = jsNative(func(args []any) any {
+		host, hostdom := strings.ToLower(str(args, 0)), strings.ToLower(str(args, 1))
+		return host == hostdom || !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")
+	})
+	vars["dnsDomainLevels"] = jsNative(func(args []any) any {
+		return float64(strings.Count(str(args, 0), "."))
+	})
+	vars["isResolvable"] = jsNative(func(args []any) any {
+		_, ok := pacResolve(str(args, 0))
+		return ok
+	})
+	vars["dnsResolve"] = jsNative(func(args []any) any {
+		if ip, ok := pacResolve(str(args, 0)); ok {
+			return ip.String()
+		}
+		return jsNull
+	})
+	vars["isInNet"] = jsNative(func(args []any) any {
+		ip, ok := pacResolve(str(args, 0))
+		pattern, err1 := netip.ParseAddr(str(args, 1))
+		mask, err2 := netip.ParseAddr(str(args, 2))
+		if !ok || err1 != nil || err2 != nil || !ip.Is4() || !pattern.Is4() || !mask.Is4() {
+			return false
+		}
+		m := pacAddrValue(mask)
+		return pacAddrValue(ip)&m == pacAddrValue(pattern)&m
+	})
+	vars["convert_addr"] = jsNative(func(args []any) any {
+		ip, err := netip.ParseAddr(str(args, 0))
+		if err != nil || !ip.Is4() {
+			return float64(0)
+		}
+		return float64(pacAddrValue(ip))
+	})
+	vars["myIpAddress"] = jsNative(func([]any) any { return myIP() })
+	vars["shExpMatch"] = jsNative(func(args []any) any {
+		return shExpRegexp(str(args, 1)).MatchString(str(args, 0))
+	})
+	vars["weekdayRange"] = jsNative(pacWeekdayRange)
+	vars["dateRange"] = jsNative(pacDateRange)
+	vars["timeRange"] = jsNative(pacTimeRange)
+	vars["alert"] = jsNative(func(args []any) any {
+		log.Printf("pac: %s", str(args, 0))
+		return jsUndefined
+	})
+	return &jsInterp{global: &jsScope{vars: vars}}
+}
+
+// pacResolve 解析主机名，优先返回 IPv4 地址
+func pacResolve(host string) (netip.Addr, bool) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap(), true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pacDNSTimeout)
+	defer cancel()
+	addrs, err := lookupHost(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return netip.Addr{}, false
+	}
+	for _, a := range addrs {
+		if a.Unmap().Is4() {
+			return a.Unmap(), true
+		}
+	}
+	return addrs[0], true
+}
+
+func pacAddrValue(ip netip.Addr) uint32 {
+	b := ip.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// myIP 本机地址，只在第一次调用 myIpAddress 时确定
+var myIP = sync.OnceValue(func() string {
+	// UDP 的 Dial 不发送数据，只用来确定访问外网时使用的本机地址
+	conn, err := net.Dial("udp", "192.0.2.1:80")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+})
+
+// shExpCache shExpMatch 的通配符转换后的正则
+var shExpCache sync.Map
+
+// shExpRegexp 把 shell 通配符转为正则: * 匹配任意字符，? 匹配一个字符
+func shExpRegexp(pattern string) *regexp.Regexp {
+	if re, ok := shExpCache.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	var b strings.Builder
+	b.WriteString("^(?s)")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	re := regexp.MustCompile(b.String())
+	shExpCache.Store(pattern, re)
+	return re
+}
+
+var (
+	pacWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+	pacMonths   = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+)
+
+// pacNow 当前时间，最后一个参数为 "GMT" 时使用 UTC，并去掉该参数
+func pacNow(args []any) (time.Time, []any) {
+	if n := len(args); n > 0 && strings.EqualFold(jsToString(args[n-1]), "GMT") {
+		return time.Now().UTC(), args[:n-1]
+	}
+	return time.Now(), args
+}
+
+func pacIndex(list []string, s string) int {
+	for i, v := range list {
+		if strings.EqualFold(v, s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pacInRange 判断 v 是否在 [lo, hi] 内，lo 大于 hi 时表示跨越周期，如 FRI 到 MON
+func pacInRange(v, lo, hi int) bool {
+	if lo <= hi {
+		return v >= lo && v <= hi
+	}
+	return v >= lo || v <= hi
+}
+
+// pacWeekdayRange weekdayRange(wd1[, wd2][, "GMT"])
+func pacWeekdayRange(args []any) any {
+	now, args := pacNow(args)
+	if len(args) == 0 {
+		return false
+	}
+	lo := pacIndex(pacWeekdays, jsToString(args[0]))
+	hi := lo
+	if len(args) > 1 {
+		hi = pacIndex(pacWeekdays, jsToString(args[1]))
+	}
+	if lo < 0 || hi < 0 {
+		return false
+	}
+	return pacInRange(int(now.Weekday()), lo, hi)
+}
+
+// pacTimeRange timeRange(h)、(h1, h2)、(h1, m1, h2, m2) 或 (h1, m1, s1, h2, m2, s2)，可以加 "GMT"
+func pacTimeRange(args []any) any {
+	now, args := pacNow(args)
+	n := make([]int, len(args))
+	for i, a := range args {
+		n[i] = int(jsToNumber(a))
+	}
+	cur := now.Hour()*3600 + now.Minute()*60 + now.Second()
+	switch len(n) {
+	case 1:
+		return now.Hour() == n[0]
+	case 2:
+		// 结束的小时不包含在内，timeRange(9, 17) 表示 9:00 到 16:59
+		return pacInRange(cur, n[0]*3600, n[1]*3600-1)
+	case 4:
+		return pacInRange(cur, n[0]*3600+n[1]*60, n[2]*3600+n[3]*60+59)
+	case 6:
+		return pacInRange(cur, n[0]*3600+n[1]*60+n[2], n[3]*3600+n[4]*60+n[5])
+	}
+	return false
+}
+
+// pacDate dateRange 的一个日期，未指定的字段为 -1
+type pacDate struct {
+	year, month, day int
+}
+
+// pacDateRange dateRange 的参数可以是日(1-31)、月("JAN")、年(四位数)的组合，一个日期表示相等，两个日期表示范围，可以加 "GMT"
+func pacDateRange(args []any) any {
+	now, args := pacNow(args)
+	var dates []pacDate
+	d := pacDate{-1, -1, -1}
+	for _, a := range args {
+		if m := pacIndex(pacMonths, jsToString(a)); m >= 0 {
+			if d.month >= 0 {
+				dates, d = append(dates, d), pacDate{-1, -1, -1}
+			}
+			d.month = m
+			continue
+		}
+		v := int(jsToNumber(a))
+		if v > 31 {
+			if d.year >= 0 {
+				dates, d = append(dates, d), pacDate{-1, -1, -1}
+			}
+			d.year = v
+			continue
+		}
+		if d.day >= 0 || d.month >= 0 || d.year >= 0 {
+			dates, d = append(dates, d), pacDate{-1, -1, -1}
+		}
+		d.day = v
+	}
+	dates = append(dates, d)
+	// 只用两个日期都有的字段比较，字段按 年、月、日 组合成一个数
+	cur := pacDate{now.Year(), int(now.Month()) - 1, now.Day()}
+	key := func(d, mask pacDate) int {
+		v := 0
+		if mask.year >= 0 {
+			v = v*10000 + d.year
+		}
+		if mask.month >= 0 {
+			v = v*100 + d.month
+		}
+		if mask.day >= 0 {
+			v = v*100 + d.day
+		}
+		return v
+	}
+	switch len(dates) {
+	case 1:
+		return key(cur, dates[0]) == key(dates[0], dates[0])
+	case 2:
+		lo, hi := dates[0], dates[1]
+		if (lo.year >= 0) != (hi.year >= 0) || (lo.month >= 0) != (hi.month >= 0) || (lo.day >= 0) != (hi.day >= 0) {
+			return false
+		}
+		if lo.year >= 0 {
+			v := key(cur, lo)
+			return v >= key(lo, lo) && v <= key(hi, lo)
+		}
+		return pacInRange(key(cur, lo), key(lo, lo), key(hi, lo))
+	}
+	return false
+}
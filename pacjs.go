@@ -0,0 +1,2204 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 执行 PAC 脚本的 JavaScript 子集解释器: 支持 PAC 文件常用的 var/let/const、函数、if/for/while/switch、
+// 数组和对象字面量、正则表达式以及字符串和数组的常用方法；不支持 try/catch、class、this 和原型
+
+// jsError 脚本语法或运行错误
+type jsError struct {
+	msg string
+}
+
+func (e *jsError) Error() string {
+	return e.msg
+}
+
+func jsThrow(format string, v ...any) {
+	panic(&jsError{fmt.Sprintf(format, v...)})
+}
+
+// ---------- 词法分析 ----------
+
+type jsToken struct {
+	kind  byte // 'n' 数字、's' 字符串、'i' 标识符或关键字、'p' 符号、'r' 正则、0 结束
+	text  string
+	num   float64
+	flags string // 正则的标志
+	nl    bool   // 前面有换行，用于自动插入分号
+	line  int
+}
+
+var jsPuncts = []string{
+	">>>=", "===", "!==", ">>>", "<<=", ">>=",
+	"==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=", "*=", "/=", "%=", "<<", ">>", "&=", "|=", "^=",
+	"{", "}", "(", ")", "[", "]", ";", ",", ".", "?", ":", "=", "<", ">", "+", "-", "*", "/", "%", "!", "~", "&", "|", "^",
+}
+
+func jsLex(src string) []jsToken {
+	var toks []jsToken
+	line, nl := 1, false
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			nl = true
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+			continue
+		case strings.HasPrefix(src[i:], "\u00a0"), strings.HasPrefix(src[i:], "\ufeff"):
+			_, n := utf8.DecodeRuneInString(src[i:])
+			i += n
+			continue
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				jsThrow("第 %d 行: 注释没有结束", line)
+			}
+			comment := src[i : i+2+end+2]
+			if n := strings.Count(comment, "\n"); n > 0 {
+				line += n
+				nl = true
+			}
+			i += len(comment)
+			continue
+		}
+		tok := jsToken{nl: nl, line: line}
+		nl = false
+		switch {
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i
+			if c == '0' && i+1 < len(src) && (src[i+1] == 'x' || src[i+1] == 'X') {
+				j += 2
+				for j < len(src) && strings.IndexByte("0123456789abcdefABCDEF", src[j]) >= 0 {
+					j++
+				}
+				n, err := strconv.ParseUint(src[i+2:j], 16, 64)
+				if err != nil {
+					jsThrow("第 %d 行: 数字格式错误 %s", line, src[i:j])
+				}
+				tok.num = float64(n)
+			} else {
+				for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+					j++
+				}
+				if j < len(src) && (src[j] == 'e' || src[j] == 'E') {
+					j++
+					if j < len(src) && (src[j] == '+' || src[j] == '-') {
+						j++
+					}
+					for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+						j++
+					}
+				}
+				n, err := strconv.ParseFloat(src[i:j], 64)
+				if err != nil {
+					jsThrow("第 %d 行: 数字格式错误 %s", line, src[i:j])
+				}
+				tok.num = n
+			}
+			tok.kind, tok.text = 'n', src[i:j]
+			i = j
+		case c == '"' || c == '\'':
+			s, n := jsLexString(src[i:], line)
+			tok.kind, tok.text = 's', s
+			i += n
+		case c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '$' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tok.kind, tok.text = 'i', src[i:j]
+			i = j
+		case c == '/' && jsRegexAllowed(toks):
+			j := i + 1
+			inClass := false
+			for ; j < len(src) && (src[j] != '/' || inClass); j++ {
+				switch src[j] {
+				case '\\':
+					j++
+				case '[':
+					inClass = true
+				case ']':
+					inClass = false
+				case '\n':
+					jsThrow("第 %d 行: 正则表达式没有结束", line)
+				}
+			}
+			if j >= len(src) {
+				jsThrow("第 %d 行: 正则表达式没有结束", line)
+			}
+			tok.kind, tok.text = 'r', src[i+1:j]
+			j++
+			k := j
+			for k < len(src) && src[k] >= 'a' && src[k] <= 'z' {
+				k++
+			}
+			tok.flags = src[j:k]
+			i = k
+		default:
+			for _, p := range jsPuncts {
+				if strings.HasPrefix(src[i:], p) {
+					tok.kind, tok.text = 'p', p
+					break
+				}
+			}
+			if tok.kind == 0 {
+				jsThrow("第 %d 行: 无法识别的字符 %q", line, c)
+			}
+			i += len(tok.text)
+		}
+		toks = append(toks, tok)
+	}
+	return append(toks, jsToken{nl: true, line: line})
+}
+
+// jsRegexAllowed 前一个记号之后不可能是除号时把 / 当作正则表达式开始
+func jsRegexAllowed(toks []jsToken) bool {
+	if len(toks) == 0 {
+		return true
+	}
+	t := toks[len(toks)-1]
+	switch t.kind {
+	case 'n', 's', 'r':
+		return false
+	case 'i':
+		return t.text == "return" || t.text == "typeof" || t.text == "case" || t.text == "in" || t.text == "of"
+	}
+	return t.text != ")" && t.text != "]" && t.text != "}"
+}
+
+func jsLexString(s string, line int) (string, int) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1
+		case c == '\n':
+			jsThrow("第 %d 行: 字符串没有结束", line)
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch e := s[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'v':
+				b.WriteByte('\v')
+			case '0':
+				b.WriteByte(0)
+			case 'x', 'u':
+				n := 2
+				if e == 'u' {
+					n = 4
+				}
+				if i+n >= len(s) {
+					jsThrow("第 %d 行: 转义字符格式错误", line)
+				}
+				v, err := strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+				if err != nil {
+					jsThrow("第 %d 行: 转义字符格式错误", line)
+				}
+				b.WriteRune(rune(v))
+				i += n
+			case '\n':
+				// 行尾的反斜杠表示字符串续行
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	jsThrow("第 %d 行: 字符串没有结束", line)
+	return "", 0
+}
+
+// ---------- 语法分析 ----------
+
+type jsParser struct {
+	toks []jsToken
+	i    int
+}
+
+func (p *jsParser) peek() jsToken {
+	return p.toks[p.i]
+}
+
+func (p *jsParser) next() jsToken {
+	t := p.toks[p.i]
+	if t.kind != 0 {
+		p.i++
+	}
+	return t
+}
+
+// is 当前记号是否为指定的符号或关键字
+func (p *jsParser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == 'p' || t.kind == 'i') && t.text == text
+}
+
+func (p *jsParser) accept(text string) bool {
+	if p.is(text) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *jsParser) expect(text string) {
+	if !p.accept(text) {
+		p.fail("应为 %q", text)
+	}
+}
+
+func (p *jsParser) fail(format string, v ...any) {
+	t := p.peek()
+	got := t.text
+	if t.kind == 0 {
+		got = "文件结束"
+	}
+	jsThrow("第 %d 行 %s 处: %s", t.line, got, fmt.Sprintf(format, v...))
+}
+
+func (p *jsParser) ident() string {
+	t := p.peek()
+	if t.kind != 'i' || jsKeywords[t.text] {
+		p.fail("应为名称")
+	}
+	p.i++
+	return t.text
+}
+
+// semicolon 语句结尾的分号，换行、} 和文件结束时可以省略
+func (p *jsParser) semicolon() {
+	if p.accept(";") {
+		return
+	}
+	if t := p.peek(); t.kind == 0 || t.nl || p.is("}") {
+		return
+	}
+	p.fail("应为 \";\"")
+}
+
+var jsKeywords = map[string]bool{
+	"var": true, "let": true, "const": true, "function": true, "return": true, "if": true, "else": true,
+	"for": true, "while": true, "do": true, "break": true, "continue": true, "switch": true, "case": true,
+	"default": true, "new": true, "typeof": true, "in": true, "true": true, "false": true, "null": true,
+}
+
+func jsParse(src string) (prog []jsStmt, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			je, ok := e.(*jsError)
+			if !ok {
+				panic(e)
+			}
+			err = je
+		}
+	}()
+	p := &jsParser{toks: jsLex(src)}
+	for p.peek().kind != 0 {
+		prog = append(prog, p.statement())
+	}
+	return prog, nil
+}
+
+func (p *jsParser) statement() jsStmt {
+	switch {
+	case p.accept(";"):
+		return &jsBlock{}
+	case p.is("{"):
+		return p.block()
+	case p.is("var") || p.is("let") || p.is("const"):
+		p.next()
+		s := p.varDecl()
+		p.semicolon()
+		return s
+	case p.is("function"):
+		p.next()
+		return &jsFuncDecl{fn: p.function(p.ident())}
+	case p.accept("if"):
+		p.expect("(")
+		s := &jsIf{cond: p.expression()}
+		p.expect(")")
+		s.then = p.statement()
+		if p.accept("else") {
+			s.els = p.statement()
+		}
+		return s
+	case p.accept("for"):
+		return p.forStatement()
+	case p.accept("while"):
+		p.expect("(")
+		s := &jsWhile{cond: p.expression()}
+		p.expect(")")
+		s.body = p.statement()
+		return s
+	case p.accept("do"):
+		s := &jsWhile{do: true, body: p.statement()}
+		p.expect("while")
+		p.expect("(")
+		s.cond = p.expression()
+		p.expect(")")
+		p.accept(";")
+		return s
+	case p.is("return"):
+		t := p.next()
+		s := &jsReturn{}
+		if n := p.peek(); !p.is(";") && !p.is("}") && n.kind != 0 && !(n.nl && n.line > t.line) {
+			s.x = p.expression()
+		}
+		p.semicolon()
+		return s
+	case p.accept("break"):
+		p.semicolon()
+		return jsBreak{}
+	case p.accept("continue"):
+		p.semicolon()
+		return jsContinue{}
+	case p.accept("switch"):
+		return p.switchStatement()
+	}
+	s := &jsExprStmt{x: p.expression()}
+	p.semicolon()
+	return s
+}
+
+func (p *jsParser) block() *jsBlock {
+	p.expect("{")
+	b := &jsBlock{}
+	for !p.accept("}") {
+		if p.peek().kind == 0 {
+			p.fail("应为 \"}\"")
+		}
+		b.list = append(b.list, p.statement())
+	}
+	return b
+}
+
+func (p *jsParser) varDecl() *jsVarDecl {
+	s := &jsVarDecl{}
+	for {
+		s.names = append(s.names, p.ident())
+		var init jsExpr
+		if p.accept("=") {
+			init = p.assignment()
+		}
+		s.inits = append(s.inits, init)
+		if !p.accept(",") {
+			return s
+		}
+	}
+}
+
+func (p *jsParser) forStatement() jsStmt {
+	p.expect("(")
+	// for (var x in obj) 和 for (var x of list)
+	save := p.i
+	p.accept("var")
+	p.accept("let")
+	p.accept("const")
+	if t := p.peek(); t.kind == 'i' && !jsKeywords[t.text] {
+		name := p.ident()
+		if p.is("in") || p.is("of") {
+			of := p.next().text == "of"
+			s := &jsForIn{name: name, of: of, obj: p.expression()}
+			p.expect(")")
+			s.body = p.statement()
+			return s
+		}
+	}
+	p.i = save
+	s := &jsFor{}
+	if !p.accept(";") {
+		if p.is("var") || p.is("let") || p.is("const") {
+			p.next()
+			s.init = p.varDecl()
+		} else {
+			s.init = &jsExprStmt{x: p.expression()}
+		}
+		p.expect(";")
+	}
+	if !p.accept(";") {
+		s.cond = p.expression()
+		p.expect(";")
+	}
+	if !p.is(")") {
+		s.update = p.expression()
+	}
+	p.expect(")")
+	s.body = p.statement()
+	return s
+}
+
+func (p *jsParser) switchStatement() jsStmt {
+	p.expect("(")
+	s := &jsSwitch{disc: p.expression()}
+	p.expect(")")
+	p.expect("{")
+	for !p.accept("}") {
+		var c jsCase
+		if p.accept("default") {
+			c.isDefault = true
+		} else {
+			p.expect("case")
+			c.test = p.expression()
+		}
+		p.expect(":")
+		for !p.is("case") && !p.is("default") && !p.is("}") {
+			if p.peek().kind == 0 {
+				p.fail("应为 \"}\"")
+			}
+			c.body = append(c.body, p.statement())
+		}
+		s.cases = append(s.cases, c)
+	}
+	return s
+}
+
+func (p *jsParser) function(name string) *jsFuncLit {
+	f := &jsFuncLit{name: name}
+	p.expect("(")
+	for !p.accept(")") {
+		f.params = append(f.params, p.ident())
+		if !p.is(")") {
+			p.expect(",")
+		}
+	}
+	f.body = p.block().list
+	return f
+}
+
+func (p *jsParser) expression() jsExpr {
+	x := p.assignment()
+	if !p.is(",") {
+		return x
+	}
+	seq := &jsSeq{list: []jsExpr{x}}
+	for p.accept(",") {
+		seq.list = append(seq.list, p.assignment())
+	}
+	return seq
+}
+
+var jsAssignOps = map[string]bool{"=": true, "+=": true, "-=": true, "*=": true, "/=": true, "%=": true,
+	"<<=": true, ">>=": true, ">>>=": true, "&=": true, "|=": true, "^=": true}
+
+func (p *jsParser) assignment() jsExpr {
+	x := p.conditional()
+	if t := p.peek(); t.kind == 'p' && jsAssignOps[t.text] {
+		switch x.(type) {
+		case *jsIdent, *jsMember:
+		default:
+			p.fail("赋值的目标无效")
+		}
+		p.next()
+		return &jsAssign{op: strings.TrimSuffix(t.text, "="), target: x, value: p.assignment()}
+	}
+	return x
+}
+
+func (p *jsParser) conditional() jsExpr {
+	x := p.binary(0)
+	if !p.accept("?") {
+		return x
+	}
+	c := &jsCond{cond: x, a: p.assignment()}
+	p.expect(":")
+	c.b = p.assignment()
+	return c
+}
+
+// 二元运算符按优先级从低到高
+var jsBinaryLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!=", "===", "!=="},
+	{"<", ">", "<=", ">=", "in"},
+	{"<<", ">>", ">>>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *jsParser) binary(level int) jsExpr {
+	if level == len(jsBinaryLevels) {
+		return p.unary()
+	}
+	x := p.binary(level + 1)
+	for {
+		t := p.peek()
+		op := ""
+		for _, o := range jsBinaryLevels[level] {
+			if (t.kind == 'p' || t.kind == 'i' && o == "in") && t.text == o {
+				op = o
+			}
+		}
+		if op == "" {
+			return x
+		}
+		p.next()
+		y := p.binary(level + 1)
+		if op == "||" || op == "&&" {
+			x = &jsLogical{op: op, l: x, r: y}
+		} else {
+			x = &jsBinary{op: op, l: x, r: y}
+		}
+	}
+}
+
+func (p *jsParser) unary() jsExpr {
+	t := p.peek()
+	if t.kind == 'p' && (t.text == "!" || t.text == "-" || t.text == "+" || t.text == "~") || p.is("typeof") {
+		p.next()
+		return &jsUnary{op: t.text, x: p.unary()}
+	}
+	if t.kind == 'p' && (t.text == "++" || t.text == "--") {
+		p.next()
+		return &jsUpdate{op: t.text, prefix: true, target: p.unary()}
+	}
+	x := p.postfix()
+	if t := p.peek(); t.kind == 'p' && (t.text == "++" || t.text == "--") && !t.nl {
+		p.next()
+		return &jsUpdate{op: t.text, target: x}
+	}
+	return x
+}
+
+func (p *jsParser) postfix() jsExpr {
+	var x jsExpr
+	if p.accept("new") {
+		n := &jsCall{fn: p.primary(), isNew: true}
+		for p.accept(".") {
+			n.fn = &jsMember{obj: n.fn, name: p.propertyName()}
+		}
+		if p.is("(") {
+			n.args = p.arguments()
+		}
+		x = n
+	} else {
+		x = p.primary()
+	}
+	for {
+		switch {
+		case p.accept("."):
+			x = &jsMember{obj: x, name: p.propertyName()}
+		case p.accept("["):
+			x = &jsMember{obj: x, index: p.expression()}
+			p.expect("]")
+		case p.is("("):
+			x = &jsCall{fn: x, args: p.arguments()}
+		default:
+			return x
+		}
+	}
+}
+
+// propertyName 点号后面的属性名可以是关键字，如 list.default
+func (p *jsParser) propertyName() string {
+	t := p.next()
+	if t.kind != 'i' {
+		p.i--
+		p.fail("应为属性名")
+	}
+	return t.text
+}
+
+func (p *jsParser) arguments() []jsExpr {
+	p.expect("(")
+	args := []jsExpr{}
+	for !p.accept(")") {
+		args = append(args, p.assignment())
+		if !p.is(")") {
+			p.expect(",")
+		}
+	}
+	return args
+}
+
+func (p *jsParser) primary() jsExpr {
+	t := p.peek()
+	switch t.kind {
+	case 'n':
+		p.next()
+		return &jsLit{v: t.num}
+	case 's':
+		p.next()
+		return &jsLit{v: t.text}
+	case 'r':
+		p.next()
+		re, err := jsCompileRegexp(t.text, t.flags)
+		if err != nil {
+			p.i--
+			p.fail("%v", err)
+		}
+		return &jsLit{v: re}
+	case 'i':
+		switch t.text {
+		case "true", "false":
+			p.next()
+			return &jsLit{v: t.text == "true"}
+		case "null":
+			p.next()
+			return &jsLit{v: jsNull}
+		case "function":
+			p.next()
+			name := ""
+			if !p.is("(") {
+				name = p.ident()
+			}
+			return p.function(name)
+		}
+		return &jsIdent{name: p.ident()}
+	}
+	switch {
+	case p.accept("("):
+		x := p.expression()
+		p.expect(")")
+		return x
+	case p.accept("["):
+		a := &jsArrayLit{}
+		for !p.accept("]") {
+			a.elems = append(a.elems, p.assignment())
+			if !p.is("]") {
+				p.expect(",")
+			}
+		}
+		return a
+	case p.accept("{"):
+		o := &jsObjectLit{}
+		for !p.accept("}") {
+			k := p.next()
+			if k.kind != 'i' && k.kind != 's' && k.kind != 'n' {
+				p.i--
+				p.fail("应为属性名")
+			}
+			key := k.text
+			if k.kind == 'n' {
+				key = jsNumberString(k.num)
+			}
+			p.expect(":")
+			o.keys = append(o.keys, key)
+			o.vals = append(o.vals, p.assignment())
+			if !p.is("}") {
+				p.expect(",")
+			}
+		}
+		return o
+	}
+	p.fail("无法解析的表达式")
+	return nil
+}
+
+// ---------- 值 ----------
+
+type jsUndefinedType struct{}
+type jsNullType struct{}
+
+var (
+	jsUndefined = jsUndefinedType{}
+	jsNull      = jsNullType{}
+)
+
+type jsArray struct {
+	elems []any
+}
+
+type jsObject struct {
+	keys  []string
+	props map[string]any
+}
+
+func newJSObject() *jsObject {
+	return &jsObject{props: map[string]any{}}
+}
+
+func (o *jsObject) set(k string, v any) {
+	if _, ok := o.props[k]; !ok {
+		if len(o.keys) >= jsMaxArray {
+			jsThrow("对象属性数量超过限制")
+		}
+		o.keys = append(o.keys, k)
+	}
+	o.props[k] = v
+}
+
+type jsRegExp struct {
+	re     *regexp.Regexp
+	source string
+	global bool
+}
+
+// jsNative 内置函数
+type jsNative func(args []any) any
+
+type jsFunction struct {
+	lit *jsFuncLit
+	env *jsScope
+}
+
+// jsCompileRegexp 转换为 Go 的正则，语法基本相同，不支持前瞻和反向引用
+func jsCompileRegexp(source, flags string) (*jsRegExp, error) {
+	prefix := ""
+	if strings.Contains(flags, "i") {
+		prefix += "(?i)"
+	}
+	if strings.Contains(flags, "m") {
+		prefix += "(?m)"
+	}
+	if strings.Contains(flags, "s") {
+		prefix += "(?s)"
+	}
+	re, err := regexp.Compile(prefix + source)
+	if err != nil {
+		return nil, fmt.Errorf("正则表达式 /%s/ 不支持: %v", source, err)
+	}
+	return &jsRegExp{re: re, source: source, global: strings.Contains(flags, "g")}, nil
+}
+
+func jsNumberString(n float64) string {
+	switch {
+	case math.IsNaN(n):
+		return "NaN"
+	case math.IsInf(n, 1):
+		return "Infinity"
+	case math.IsInf(n, -1):
+		return "-Infinity"
+	case n == math.Trunc(n) && math.Abs(n) < 1e21:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+func jsToString(v any) string {
+	switch v := v.(type) {
+	case jsUndefinedType:
+		return "undefined"
+	case jsNullType:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return jsNumberString(v)
+	case string:
+		return v
+	case *jsArray:
+		return jsJoin(v, ",", 0)
+	case *jsRegExp:
+		return "/" + v.source + "/"
+	case *jsFunction, jsNative:
+		return "function"
+	}
+	return "[object Object]"
+}
+
+// jsJoin 连接数组元素，拼接过程中检查长度，嵌套过深(如数组包含自身)时中止
+func jsJoin(a *jsArray, sep string, depth int) string {
+	if depth > jsMaxDepth {
+		jsThrow("数组嵌套层数超过限制")
+	}
+	var b strings.Builder
+	for i, e := range a.elems {
+		if i > 0 {
+			b.WriteString(sep)
+		}
+		switch e := e.(type) {
+		case jsUndefinedType, jsNullType:
+		case *jsArray:
+			b.WriteString(jsJoin(e, ",", depth+1))
+		default:
+			b.WriteString(jsToString(e))
+		}
+		jsCheckLength(b.Len())
+	}
+	return b.String()
+}
+
+func jsToNumber(v any) float64 {
+	switch v := v.(type) {
+	case jsNullType:
+		return 0
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case float64:
+		return v
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return 0
+		}
+		if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+			if n, err := strconv.ParseUint(s[2:], 16, 64); err == nil {
+				return float64(n)
+			}
+			return math.NaN()
+		}
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n
+		}
+		return math.NaN()
+	case *jsArray:
+		return jsToNumber(jsToString(v))
+	}
+	return math.NaN()
+}
+
+func jsTruthy(v any) bool {
+	switch v := v.(type) {
+	case jsUndefinedType, jsNullType:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+func jsTypeOf(v any) string {
+	switch v.(type) {
+	case jsUndefinedType:
+		return "undefined"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *jsFunction, jsNative:
+		return "function"
+	}
+	return "object"
+}
+
+func jsIsPrimitive(v any) bool {
+	switch v.(type) {
+	case jsUndefinedType, jsNullType, bool, float64, string:
+		return true
+	}
+	return false
+}
+
+func jsStrictEquals(a, b any) bool {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		return ok && a == b
+	case jsNative:
+		return false
+	}
+	if _, ok := b.(jsNative); ok {
+		return false
+	}
+	return a == b
+}
+
+func jsLooseEquals(a, b any) bool {
+	if jsTypeOf(a) == jsTypeOf(b) && (a == jsNull) == (b == jsNull) {
+		return jsStrictEquals(a, b)
+	}
+	aNil := a == jsNull || a == jsUndefined
+	bNil := b == jsNull || b == jsUndefined
+	if aNil || bNil {
+		return aNil && bNil
+	}
+	if !jsIsPrimitive(a) {
+		a = jsToString(a)
+	}
+	if !jsIsPrimitive(b) {
+		b = jsToString(b)
+	}
+	if as, ok := a.(string); ok {
+		if bs, ok := b.(string); ok {
+			return as == bs
+		}
+	}
+	return jsToNumber(a) == jsToNumber(b)
+}
+
+func jsToInt32(v any) int32 {
+	n := jsToNumber(v)
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0
+	}
+	return int32(uint32(int64(math.Trunc(n))))
+}
+
+// ---------- 执行 ----------
+
+// 脚本执行的步数、调用深度和内存限制，避免死循环阻塞请求或者耗尽内存。
+// PAC 文件可以从远程地址下载，不能信任脚本的内容
+const (
+	jsMaxSteps  = 2000000
+	jsMaxDepth  = 200
+	jsMaxString = 1 << 20  // 单个字符串的最大长度
+	jsMaxArray  = 1 << 16  // 数组长度和对象属性数量的上限
+	jsMaxAlloc  = 32 << 20 // 一次执行中新建字符串和数组的总字节数
+)
+
+// jsCheckLength 在拼接过程中检查长度，不会先分配很大的字符串再报错
+func jsCheckLength(n int) {
+	if n > jsMaxString {
+		jsThrow("字符串长度超过限制")
+	}
+}
+
+func jsCheckArray(n int) {
+	if n > jsMaxArray {
+		jsThrow("数组长度超过限制")
+	}
+}
+
+type jsScope struct {
+	vars   map[string]any
+	parent *jsScope
+}
+
+func (s *jsScope) lookup(name string) (*jsScope, bool) {
+	for ; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+type jsInterp struct {
+	global *jsScope
+	steps  int
+	depth  int
+	alloc  int
+}
+
+func (in *jsInterp) tick() {
+	if in.steps++; in.steps > jsMaxSteps {
+		jsThrow("脚本执行步数超过限制")
+	}
+}
+
+// charge 统计新建的字符串和数组占用的内存，每个元素按 16 字节计算
+func (in *jsInterp) charge(v any) any {
+	switch v := v.(type) {
+	case string:
+		jsCheckLength(len(v))
+		in.allocate(len(v))
+	case *jsArray:
+		jsCheckArray(len(v.elems))
+		in.allocate(len(v.elems) * 16)
+	}
+	return v
+}
+
+func (in *jsInterp) allocate(n int) {
+	if in.alloc += n; in.alloc > jsMaxAlloc {
+		jsThrow("脚本使用的内存超过限制")
+	}
+}
+
+// run 执行程序顶层代码，函数声明先于其他语句生效
+func (in *jsInterp) run(prog []jsStmt) (err error) {
+	defer in.recover(&err)
+	in.hoist(prog, in.global)
+	for _, s := range prog {
+		if f, _ := s.exec(in, in.global); f != flowNormal {
+			break
+		}
+	}
+	return nil
+}
+
+func (in *jsInterp) recover(err *error) {
+	if e := recover(); e != nil {
+		je, ok := e.(*jsError)
+		if !ok {
+			panic(e)
+		}
+		*err = je
+	}
+}
+
+// callGlobal 调用全局函数，如 FindProxyForURL
+func (in *jsInterp) callGlobal(name string, args ...any) (v any, err error) {
+	defer in.recover(&err)
+	fn, ok := in.global.vars[name]
+	if !ok {
+		return nil, fmt.Errorf("脚本中没有定义 %s", name)
+	}
+	return in.call(fn, args), nil
+}
+
+func (in *jsInterp) hoist(list []jsStmt, scope *jsScope) {
+	for _, s := range list {
+		if f, ok := s.(*jsFuncDecl); ok {
+			scope.vars[f.fn.name] = &jsFunction{lit: f.fn, env: scope}
+		}
+	}
+}
+
+func (in *jsInterp) call(fn any, args []any) any {
+	in.tick()
+	switch f := fn.(type) {
+	case jsNative:
+		return in.charge(f(args))
+	case *jsFunction:
+		if in.depth++; in.depth > jsMaxDepth {
+			jsThrow("函数调用层数超过限制")
+		}
+		defer func() { in.depth-- }()
+		scope := &jsScope{vars: map[string]any{}, parent: f.env}
+		for i, name := range f.lit.params {
+			scope.vars[name] = jsArg(args, i)
+		}
+		if f.lit.name != "" {
+			if _, ok := scope.vars[f.lit.name]; !ok && f.env != in.global {
+				scope.vars[f.lit.name] = f
+			}
+		}
+		in.hoist(f.lit.body, scope)
+		for _, s := range f.lit.body {
+			if flow, v := s.exec(in, scope); flow == flowReturn {
+				return v
+			} else if flow != flowNormal {
+				break
+			}
+		}
+		return jsUndefined
+	}
+	jsThrow("%s 不是函数", jsToString(fn))
+	return nil
+}
+
+func jsArg(args []any, i int) any {
+	if i < len(args) {
+		return args[i]
+	}
+	return jsUndefined
+}
+
+type jsFlow int
+
+const (
+	flowNormal jsFlow = iota
+	flowReturn
+	flowBreak
+	flowContinue
+)
+
+type jsStmt interface {
+	exec(in *jsInterp, s *jsScope) (jsFlow, any)
+}
+
+type jsExpr interface {
+	eval(in *jsInterp, s *jsScope) any
+}
+
+type jsBlock struct{ list []jsStmt }
+
+func (b *jsBlock) exec(in *jsInterp, s *jsScope) (jsFlow, any) {
+	in.hoist(b.list, s)
+	for _, st := range b.list {
+		if f, v := st.exec(in, s); f != flowNormal {
+			return f, v
+		}
+	}
+	return flowNormal, nil
+}
+
+type jsVarDecl struct {
+	names []string
+	inits []jsExpr
+}
+
+// exec var/let/const 都声明在当前函数的作用域中
+func (d *jsVarDecl) exec(in *jsInterp, s *jsScope) (jsFlow, any) {
+	for i, name := range d.names {
+		if d.inits[i] != nil {
+			s.vars[name] = d.inits[i].eval(in, s)
+		} else if _, ok := s.vars[name]; !ok {
+			s.vars[name] = jsUndefined
+		}
+	}
+	return flowNormal, nil
+}
+
+type jsFuncDecl struct{ fn *jsFuncLit }
+
+func (d *jsFuncDecl) exec(*jsInterp, *jsScope) (jsFlow, any) {
+	return flowNormal, nil
+}
+
+type jsExprStmt struct{ x jsExpr }
+
+func (e *jsExprStmt) exec(in *jsInterp, s *jsScope) (jsFlow, any) {
+	in.tick()
+	e.x.eval(in, s)
+	return flowNormal, nil
+}
+
+type jsIf struct {
+	cond      jsExpr
+	then, els jsStmt
+}
+
+func (st *jsIf) exec(in *jsInterp, s *jsScope) (jsFlow, any) {
+	in.tick()
+	if jsTruthy(st.cond.eval(in, s)) {
+		return st.then.exec(in, s)
+	}
+	if st.els != nil {
+		return st.els.exec(in, s)
+	}
+	return flowNormal, nil
+}
+
+type jsFor struct {
+	init         jsStmt
+	cond, update jsExpr
+	body         jsStmt
+}
+
+func (st *jsFor) exec(in *jsInterp, s *jsScope) (jsFlow, any) {
+	if st.init != nil {
+		st.init.exec(in, s)
+	}
+	for {
+		in.tick()
+		if st.cond != nil && !jsTruthy(st.cond.eval(in, s)) {
+			return flowNormal, nil
+		}
+		f, v := st.body.exec(in, s)
+		if f == flowReturn {
+			return f, v
+		}
+		if f == flowBreak {
+			return flowNormal, nil
+		}
+		if st.update != nil {
+			st.update.eval(in, s)
+		}
+	}
+}
+
+type jsForIn struct {
+	name string
+	of   bool
+	obj  jsExpr
+	body jsStmt
+}
+
+func (st *jsForIn) exec(in *jsInterp, s *jsScope) (jsFlow, any) {
+	var items []any
+	switch o := st.obj.eval(in, s).(type) {
+	case *jsArray:
+		for i, e := range o.elems {
+			if st.of {
+				items = append(items, e)
+			} else {
+				items = append(items, strconv.Itoa(i))
+			}
+		}
+	case *jsObject:
+		for _, k := range o.keys {
+			if st.of {
+				items = append(items, o.props[k])
+			} else {
+				items = append(items, k)
+			}
+		}
+	case string:
+		for i := 0; i < len(o); i++ {
+			if st.of {
+				items = append(items, o[i:i+1])
+			} else {
+				items = append(items, strconv.Itoa(i))
+			}
+		}
+	}
+	for _, item := range items {
+		in.tick()
+		jsAssignName(in, s, st.name, item)
+		f, v := st.body.exec(in, s)
+		if f == flowReturn {
+			return f, v
+		}
+		if f == flowBreak {
+			break
+		}
+	}
+	return flowNormal, nil
+}
+
+type jsWhile struct {
+	cond jsExpr
+	body jsStmt
+	do   bool
+}
+
+func (st *jsWhile) exec(in *jsInterp, s *jsScope) (jsFlow, any) {
+	for first := true; ; first = false {
+		in.tick()
+		if !(st.do && first) && !jsTruthy(st.cond.eval(in, s)) {
+			return flowNormal, nil
+		}
+		f, v := st.body.exec(in, s)
+		if f == flowReturn {
+			return f, v
+		}
+		if f == flowBreak {
+			return flowNormal, nil
+		}
+	}
+}
+
+type jsReturn struct{ x jsExpr }
+
+func (r *jsReturn) exec(in *jsInterp, s *jsScope) (jsFlow, any) {
+	if r.x == nil {
+		return flowReturn, jsUndefined
+	}
+	return flowReturn, r.x.eval(in, s)
+}
+
+type jsBreak struct{}
+
+func (jsBreak) exec(*jsInterp, *jsScope) (jsFlow, any) { return flowBreak, nil }
+
+type jsContinue struct{}
+
+func (jsContinue) exec(*jsInterp, *jsScope) (jsFlow, any) { return flowContinue, nil }
+
+type jsCase struct {
+	test      jsExpr
+	isDefault bool
+	body      []jsStmt
+}
+
+type jsSwitch struct {
+	disc  jsExpr
+	cases []jsCase
+}
+
+func (st *jsSwitch) exec(in *jsInterp, s *jsScope) (jsFlow, any) {
+	v := st.disc.eval(in, s)
+	start := -1
+	for i, c := range st.cases {
+		if !c.isDefault && jsStrictEquals(v, c.test.eval(in, s)) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		for i, c := range st.cases {
+			if c.isDefault {
+				start = i
+			}
+		}
+	}
+	if start < 0 {
+		return flowNormal, nil
+	}
+	for _, c := range st.cases[start:] {
+		for _, body := range c.body {
+			f, val := body.exec(in, s)
+			if f == flowBreak {
+				return flowNormal, nil
+			}
+			if f != flowNormal {
+				return f, val
+			}
+		}
+	}
+	return flowNormal, nil
+}
+
+type jsLit struct{ v any }
+
+func (l *jsLit) eval(*jsInterp, *jsScope) any {
+	return l.v
+}
+
+type jsIdent struct{ name string }
+
+func (id *jsIdent) eval(in *jsInterp, s *jsScope) any {
+	if sc, ok := s.lookup(id.name); ok {
+		return sc.vars[id.name]
+	}
+	jsThrow("%s 没有定义", id.name)
+	return nil
+}
+
+// jsAssignName 给变量赋值，未声明的变量成为全局变量
+func jsAssignName(in *jsInterp, s *jsScope, name string, v any) {
+	if sc, ok := s.lookup(name); ok {
+		sc.vars[name] = v
+		return
+	}
+	in.global.vars[name] = v
+}
+
+type jsArrayLit struct{ elems []jsExpr }
+
+func (a *jsArrayLit) eval(in *jsInterp, s *jsScope) any {
+	arr := &jsArray{elems: make([]any, len(a.elems))}
+	in.charge(arr)
+	for i, e := range a.elems {
+		arr.elems[i] = e.eval(in, s)
+	}
+	return arr
+}
+
+type jsObjectLit struct {
+	keys []string
+	vals []jsExpr
+}
+
+func (o *jsObjectLit) eval(in *jsInterp, s *jsScope) any {
+	obj := newJSObject()
+	for i, k := range o.keys {
+		obj.set(k, o.vals[i].eval(in, s))
+	}
+	return obj
+}
+
+type jsFuncLit struct {
+	name   string
+	params []string
+	body   []jsStmt
+}
+
+func (f *jsFuncLit) eval(in *jsInterp, s *jsScope) any {
+	return &jsFunction{lit: f, env: s}
+}
+
+type jsMember struct {
+	obj   jsExpr
+	name  string
+	index jsExpr // obj[index]，为 nil 时使用 name
+}
+
+func (m *jsMember) key(in *jsInterp, s *jsScope) string {
+	if m.index == nil {
+		return m.name
+	}
+	return jsToString(m.index.eval(in, s))
+}
+
+func (m *jsMember) eval(in *jsInterp, s *jsScope) any {
+	obj := m.obj.eval(in, s)
+	return jsGetMember(in, obj, m.key(in, s))
+}
+
+type jsCall struct {
+	fn    jsExpr
+	args  []jsExpr
+	isNew bool
+}
+
+func (c *jsCall) eval(in *jsInterp, s *jsScope) any {
+	fn := c.fn.eval(in, s)
+	args := make([]any, len(c.args))
+	for i, a := range c.args {
+		args[i] = a.eval(in, s)
+	}
+	if _, ok := fn.(*jsFunction); !ok {
+		if _, ok := fn.(jsNative); !ok {
+			name := "表达式"
+			switch f := c.fn.(type) {
+			case *jsIdent:
+				name = f.name
+			case *jsMember:
+				name = f.name
+			}
+			jsThrow("%s 不是函数", name)
+		}
+	}
+	return in.call(fn, args)
+}
+
+type jsUnary struct {
+	op string
+	x  jsExpr
+}
+
+func (u *jsUnary) eval(in *jsInterp, s *jsScope) any {
+	if u.op == "typeof" {
+		// 对未定义的变量使用 typeof 不报错
+		if id, ok := u.x.(*jsIdent); ok {
+			if _, ok := s.lookup(id.name); !ok {
+				return "undefined"
+			}
+		}
+		return jsTypeOf(u.x.eval(in, s))
+	}
+	v := u.x.eval(in, s)
+	switch u.op {
+	case "!":
+		return !jsTruthy(v)
+	case "-":
+		return -jsToNumber(v)
+	case "~":
+		return float64(^jsToInt32(v))
+	}
+	return jsToNumber(v)
+}
+
+type jsUpdate struct {
+	op     string
+	prefix bool
+	target jsExpr
+}
+
+func (u *jsUpdate) eval(in *jsInterp, s *jsScope) any {
+	old := jsToNumber(u.target.eval(in, s))
+	n := old + 1
+	if u.op == "--" {
+		n = old - 1
+	}
+	jsStore(in, s, u.target, n)
+	if u.prefix {
+		return n
+	}
+	return old
+}
+
+type jsBinary struct {
+	op   string
+	l, r jsExpr
+}
+
+func (b *jsBinary) eval(in *jsInterp, s *jsScope) any {
+	v := jsBinaryOp(b.op, b.l.eval(in, s), b.r.eval(in, s))
+	if b.op == "+" {
+		in.charge(v)
+	}
+	return v
+}
+
+func jsBinaryOp(op string, a, b any) any {
+	switch op {
+	case "+":
+		if !jsIsPrimitive(a) {
+			a = jsToString(a)
+		}
+		if !jsIsPrimitive(b) {
+			b = jsToString(b)
+		}
+		_, as := a.(string)
+		_, bs := b.(string)
+		if as || bs {
+			return jsToString(a) + jsToString(b)
+		}
+		return jsToNumber(a) + jsToNumber(b)
+	case "-":
+		return jsToNumber(a) - jsToNumber(b)
+	case "*":
+		return jsToNumber(a) * jsToNumber(b)
+	case "/":
+		return jsToNumber(a) / jsToNumber(b)
+	case "%":
+		return math.Mod(jsToNumber(a), jsToNumber(b))
+	case "==":
+		return jsLooseEquals(a, b)
+	case "!=":
+		return !jsLooseEquals(a, b)
+	case "===":
+		return jsStrictEquals(a, b)
+	case "!==":
+		return !jsStrictEquals(a, b)
+	case "<", ">", "<=", ">=":
+		as, aok := a.(string)
+		bs, bok := b.(string)
+		if aok && bok {
+			switch op {
+			case "<":
+				return as < bs
+			case ">":
+				return as > bs
+			case "<=":
+				return as <= bs
+			}
+			return as >= bs
+		}
+		x, y := jsToNumber(a), jsToNumber(b)
+		switch op {
+		case "<":
+			return x < y
+		case ">":
+			return x > y
+		case "<=":
+			return x <= y
+		}
+		return x >= y
+	case "&":
+		return float64(jsToInt32(a) & jsToInt32(b))
+	case "|":
+		return float64(jsToInt32(a) | jsToInt32(b))
+	case "^":
+		return float64(jsToInt32(a) ^ jsToInt32(b))
+	case "<<":
+		return float64(jsToInt32(a) << (uint32(jsToInt32(b)) & 31))
+	case ">>":
+		return float64(jsToInt32(a) >> (uint32(jsToInt32(b)) & 31))
+	case ">>>":
+		return float64(uint32(jsToInt32(a)) >> (uint32(jsToInt32(b)) & 31))
+	case "in":
+		key := jsToString(a)
+		switch o := b.(type) {
+		case *jsObject:
+			_, ok := o.props[key]
+			return ok
+		case *jsArray:
+			i, err := strconv.Atoi(key)
+			return err == nil && i >= 0 && i < len(o.elems)
+		}
+		jsThrow("in 的右侧必须是对象")
+	}
+	jsThrow("不支持的运算符 %s", op)
+	return nil
+}
+
+type jsLogical struct {
+	op   string
+	l, r jsExpr
+}
+
+func (l *jsLogical) eval(in *jsInterp, s *jsScope) any {
+	v := l.l.eval(in, s)
+	if jsTruthy(v) == (l.op == "||") {
+		return v
+	}
+	return l.r.eval(in, s)
+}
+
+type jsCond struct{ cond, a, b jsExpr }
+
+func (c *jsCond) eval(in *jsInterp, s *jsScope) any {
+	if jsTruthy(c.cond.eval(in, s)) {
+		return c.a.eval(in, s)
+	}
+	return c.b.eval(in, s)
+}
+
+type jsAssign struct {
+	op     string // 空表示 =，否则为复合赋值的运算符
+	target jsExpr
+	value  jsExpr
+}
+
+func (a *jsAssign) eval(in *jsInterp, s *jsScope) any {
+	var v any
+	if a.op == "" {
+		v = a.value.eval(in, s)
+	} else {
+		v = jsBinaryOp(a.op, a.target.eval(in, s), a.value.eval(in, s))
+	}
+	jsStore(in, s, a.target, v)
+	return v
+}
+
+func jsStore(in *jsInterp, s *jsScope, target jsExpr, v any) {
+	switch t := target.(type) {
+	case *jsIdent:
+		jsAssignName(in, s, t.name, v)
+	case *jsMember:
+		obj := t.obj.eval(in, s)
+		key := t.key(in, s)
+		switch o := obj.(type) {
+		case *jsObject:
+			o.set(key, v)
+		case *jsArray:
+			if key == "length" {
+				n := int(jsToNumber(v))
+				if n < 0 {
+					jsThrow("数组长度无效")
+				}
+				jsCheckArray(n)
+				in.allocate(max(n-len(o.elems), 0) * 16)
+				for len(o.elems) < n {
+					o.elems = append(o.elems, jsUndefined)
+				}
+				o.elems = o.elems[:n]
+				return
+			}
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 {
+				jsThrow("不支持给数组设置属性 %s", key)
+			}
+			jsCheckArray(i + 1)
+			in.allocate(max(i+1-len(o.elems), 0) * 16)
+			for len(o.elems) <= i {
+				o.elems = append(o.elems, jsUndefined)
+			}
+			o.elems[i] = v
+		default:
+			jsThrow("不能给 %s 设置属性 %s", jsTypeOf(obj), key)
+		}
+	default:
+		jsThrow("赋值的目标无效")
+	}
+}
+
+type jsSeq struct{ list []jsExpr }
+
+func (q *jsSeq) eval(in *jsInterp, s *jsScope) any {
+	var v any = jsUndefined
+	for _, x := range q.list {
+		v = x.eval(in, s)
+	}
+	return v
+}
+
+// ---------- 内置对象和方法 ----------
+
+func jsGetMember(in *jsInterp, obj any, key string) any {
+	switch o := obj.(type) {
+	case jsUndefinedType, jsNullType:
+		jsThrow("不能读取 %s 的属性 %s", jsToString(obj), key)
+	case string:
+		return jsStringMember(in, o, key)
+	case *jsArray:
+		return jsArrayMember(in, o, key)
+	case *jsRegExp:
+		return jsRegExpMember(o, key)
+	case *jsObject:
+		if v, ok := o.props[key]; ok {
+			return v
+		}
+		if key == "hasOwnProperty" {
+			return jsNative(func(args []any) any {
+				_, ok := o.props[jsToString(jsArg(args, 0))]
+				return ok
+			})
+		}
+	}
+	return jsUndefined
+}
+
+func jsIndexArg(args []any, i int, def float64) int {
+	v := jsArg(args, i)
+	if v == jsUndefined {
+		return int(def)
+	}
+	n := jsToNumber(v)
+	if math.IsNaN(n) {
+		return 0
+	}
+	if math.IsInf(n, 0) || math.Abs(n) > 1<<31 {
+		return int(math.Copysign(1<<31, n))
+	}
+	return int(n)
+}
+
+// jsClamp 把 slice/substring 的参数限制在 [0, n] 内，负数按从末尾计算
+func jsClamp(i, n int, fromEnd bool) int {
+	if i < 0 && fromEnd {
+		i += n
+	}
+	return max(0, min(i, n))
+}
+
+func jsStringMember(in *jsInterp, s, key string) any {
+	if key == "length" {
+		return float64(len(s))
+	}
+	if i, err := strconv.Atoi(key); err == nil {
+		if i >= 0 && i < len(s) {
+			return s[i : i+1]
+		}
+		return jsUndefined
+	}
+	method := func(f func(args []any) any) any { return jsNative(f) }
+	switch key {
+	case "toLowerCase", "toLocaleLowerCase":
+		return method(func([]any) any { return strings.ToLower(s) })
+	case "toUpperCase", "toLocaleUpperCase":
+		return method(func([]any) any { return strings.ToUpper(s) })
+	case "trim":
+		return method(func([]any) any { return strings.TrimSpace(s) })
+	case "indexOf":
+		return method(func(args []any) any {
+			from := jsClamp(jsIndexArg(args, 1, 0), len(s), false)
+			i := strings.Index(s[from:], jsToString(jsArg(args, 0)))
+			if i < 0 {
+				return float64(-1)
+			}
+			return float64(i + from)
+		})
+	case "lastIndexOf":
+		return method(func(args []any) any {
+			return float64(strings.LastIndex(s, jsToString(jsArg(args, 0))))
+		})
+	case "includes":
+		return method(func(args []any) any { return strings.Contains(s, jsToString(jsArg(args, 0))) })
+	case "startsWith":
+		return method(func(args []any) any { return strings.HasPrefix(s, jsToString(jsArg(args, 0))) })
+	case "endsWith":
+		return method(func(args []any) any { return strings.HasSuffix(s, jsToString(jsArg(args, 0))) })
+	case "charAt":
+		return method(func(args []any) any {
+			i := jsIndexArg(args, 0, 0)
+			if i < 0 || i >= len(s) {
+				return ""
+			}
+			return s[i : i+1]
+		})
+	case "charCodeAt":
+		return method(func(args []any) any {
+			i := jsIndexArg(args, 0, 0)
+			if i < 0 || i >= len(s) {
+				return math.NaN()
+			}
+			return float64(s[i])
+		})
+	case "substring":
+		return method(func(args []any) any {
+			a := jsClamp(jsIndexArg(args, 0, 0), len(s), false)
+			b := jsClamp(jsIndexArg(args, 1, float64(len(s))), len(s), false)
+			if a > b {
+				a, b = b, a
+			}
+			return s[a:b]
+		})
+	case "substr":
+		return method(func(args []any) any {
+			a := jsClamp(jsIndexArg(args, 0, 0), len(s), true)
+			n := jsIndexArg(args, 1, float64(len(s)))
+			return s[a:jsClamp(a+max(n, 0), len(s), false)]
+		})
+	case "slice":
+		return method(func(args []any) any {
+			a := jsClamp(jsIndexArg(args, 0, 0), len(s), true)
+			b := jsClamp(jsIndexArg(args, 1, float64(len(s))), len(s), true)
+			if a > b {
+				return ""
+			}
+			return s[a:b]
+		})
+	case "concat":
+		return method(func(args []any) any {
+			var b strings.Builder
+			b.WriteString(s)
+			for _, a := range args {
+				b.WriteString(jsToString(a))
+				jsCheckLength(b.Len())
+			}
+			return b.String()
+		})
+	case "split":
+		return method(func(args []any) any {
+			var parts []string
+			switch sep := jsArg(args, 0).(type) {
+			case jsUndefinedType:
+				parts = []string{s}
+			case *jsRegExp:
+				parts = sep.re.Split(s, -1)
+			default:
+				parts = strings.Split(s, jsToString(sep))
+			}
+			if limit := jsArg(args, 1); limit != jsUndefined {
+				parts = parts[:jsClamp(int(jsToNumber(limit)), len(parts), false)]
+			}
+			arr := &jsArray{}
+			for _, p := range parts {
+				arr.elems = append(arr.elems, p)
+			}
+			return arr
+		})
+	case "replace":
+		return method(func(args []any) any { return jsReplace(in, s, jsArg(args, 0), jsArg(args, 1)) })
+	case "match":
+		return method(func(args []any) any {
+			re := jsToRegExp(jsArg(args, 0))
+			if !re.global {
+				return jsExec(re, s)
+			}
+			all := re.re.FindAllString(s, -1)
+			if all == nil {
+				return jsNull
+			}
+			arr := &jsArray{}
+			for _, m := range all {
+				arr.elems = append(arr.elems, m)
+			}
+			return arr
+		})
+	case "search":
+		return method(func(args []any) any {
+			if loc := jsToRegExp(jsArg(args, 0)).re.FindStringIndex(s); loc != nil {
+				return float64(loc[0])
+			}
+			return float64(-1)
+		})
+	}
+	return jsUndefined
+}
+
+func jsToRegExp(v any) *jsRegExp {
+	if re, ok := v.(*jsRegExp); ok {
+		return re
+	}
+	re, err := jsCompileRegexp(jsToString(v), "")
+	if err != nil {
+		jsThrow("%v", err)
+	}
+	return re
+}
+
+// jsExec 返回匹配的字符串和各分组，没有匹配时返回 null
+func jsExec(re *jsRegExp, s string) any {
+	m := re.re.FindStringSubmatchIndex(s)
+	if m == nil {
+		return jsNull
+	}
+	arr := &jsArray{}
+	for i := 0; i < len(m); i += 2 {
+		if m[i] < 0 {
+			arr.elems = append(arr.elems, jsUndefined)
+		} else {
+			arr.elems = append(arr.elems, s[m[i]:m[i+1]])
+		}
+	}
+	return arr
+}
+
+// jsReplace 字符串和非全局正则只替换第一个匹配，替换内容支持 $1、$& 和函数
+func jsReplace(in *jsInterp, s string, pattern, repl any) string {
+	var locs [][]int
+	if re, ok := pattern.(*jsRegExp); ok {
+		if re.global {
+			locs = re.re.FindAllStringSubmatchIndex(s, -1)
+		} else if m := re.re.FindStringSubmatchIndex(s); m != nil {
+			locs = [][]int{m}
+		}
+	} else if i := strings.Index(s, jsToString(pattern)); i >= 0 {
+		locs = [][]int{{i, i + len(jsToString(pattern))}}
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range locs {
+		b.WriteString(s[last:m[0]])
+		groups := make([]any, 0, len(m)/2)
+		for i := 0; i < len(m); i += 2 {
+			if m[i] < 0 {
+				groups = append(groups, jsUndefined)
+			} else {
+				groups = append(groups, s[m[i]:m[i+1]])
+			}
+		}
+		if _, ok := repl.(*jsFunction); ok {
+			b.WriteString(jsToString(in.call(repl, groups)))
+		} else if _, ok := repl.(jsNative); ok {
+			b.WriteString(jsToString(in.call(repl, groups)))
+		} else {
+			b.WriteString(jsExpandReplacement(jsToString(repl), groups))
+		}
+		jsCheckLength(b.Len())
+		last = m[1]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+func jsExpandReplacement(repl string, groups []any) string {
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		if repl[i] != '$' || i+1 >= len(repl) {
+			b.WriteByte(repl[i])
+			continue
+		}
+		switch c := repl[i+1]; {
+		case c == '$':
+			b.WriteByte('$')
+			i++
+		case c == '&':
+			b.WriteString(jsToString(groups[0]))
+			jsCheckLength(b.Len())
+			i++
+		case c >= '0' && c <= '9':
+			n := int(c - '0')
+			if n == 0 || n >= len(groups) {
+				b.WriteByte('$')
+				continue
+			}
+			if g := groups[n]; g != jsUndefined {
+				b.WriteString(jsToString(g))
+				jsCheckLength(b.Len())
+			}
+			i++
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String()
+}
+
+func jsArrayMember(in *jsInterp, a *jsArray, key string) any {
+	if key == "length" {
+		return float64(len(a.elems))
+	}
+	if i, err := strconv.Atoi(key); err == nil {
+		if i >= 0 && i < len(a.elems) {
+			return a.elems[i]
+		}
+		return jsUndefined
+	}
+	method := func(f func(args []any) any) any { return jsNative(f) }
+	switch key {
+	case "push":
+		return method(func(args []any) any {
+			jsCheckArray(len(a.elems) + len(args))
+			a.elems = append(a.elems, args...)
+			return float64(len(a.elems))
+		})
+	case "pop":
+		return method(func([]any) any {
+			if len(a.elems) == 0 {
+				return jsUndefined
+			}
+			v := a.elems[len(a.elems)-1]
+			a.elems = a.elems[:len(a.elems)-1]
+			return v
+		})
+	case "shift":
+		return method(func([]any) any {
+			if len(a.elems) == 0 {
+				return jsUndefined
+			}
+			v := a.elems[0]
+			a.elems = a.elems[1:]
+			return v
+		})
+	case "indexOf", "includes":
+		return method(func(args []any) any {
+			for i, e := range a.elems {
+				if jsStrictEquals(e, jsArg(args, 0)) {
+					if key == "includes" {
+						return true
+					}
+					return float64(i)
+				}
+			}
+			if key == "includes" {
+				return false
+			}
+			return float64(-1)
+		})
+	case "join":
+		return method(func(args []any) any {
+			sep := ","
+			if v := jsArg(args, 0); v != jsUndefined {
+				sep = jsToString(v)
+			}
+			return jsJoin(a, sep, 0)
+		})
+	case "slice":
+		return method(func(args []any) any {
+			i := jsClamp(jsIndexArg(args, 0, 0), len(a.elems), true)
+			j := jsClamp(jsIndexArg(args, 1, float64(len(a.elems))), len(a.elems), true)
+			if i > j {
+				return &jsArray{}
+			}
+			return &jsArray{elems: append([]any(nil), a.elems[i:j]...)}
+		})
+	case "concat":
+		return method(func(args []any) any {
+			out := &jsArray{elems: append([]any(nil), a.elems...)}
+			for _, v := range args {
+				if other, ok := v.(*jsArray); ok {
+					jsCheckArray(len(out.elems) + len(other.elems))
+					out.elems = append(out.elems, other.elems...)
+				} else {
+					out.elems = append(out.elems, v)
+				}
+			}
+			return out
+		})
+	case "reverse":
+		return method(func([]any) any {
+			for i, j := 0, len(a.elems)-1; i < j; i, j = i+1, j-1 {
+				a.elems[i], a.elems[j] = a.elems[j], a.elems[i]
+			}
+			return a
+		})
+	case "sort":
+		return method(func(args []any) any {
+			cmp := jsArg(args, 0)
+			sort.SliceStable(a.elems, func(i, j int) bool {
+				if cmp != jsUndefined {
+					return jsToNumber(in.call(cmp, []any{a.elems[i], a.elems[j]})) < 0
+				}
+				return jsToString(a.elems[i]) < jsToString(a.elems[j])
+			})
+			return a
+		})
+	case "forEach":
+		return method(func(args []any) any {
+			for i, e := range a.elems {
+				in.call(jsArg(args, 0), []any{e, float64(i), a})
+			}
+			return jsUndefined
+		})
+	}
+	return jsUndefined
+}
+
+func jsRegExpMember(re *jsRegExp, key string) any {
+	switch key {
+	case "test":
+		return jsNative(func(args []any) any { return re.re.MatchString(jsToString(jsArg(args, 0))) })
+	case "exec":
+		return jsNative(func(args []any) any { return jsExec(re, jsToString(jsArg(args, 0))) })
+	case "source":
+		return re.source
+	case "global":
+		return re.global
+	}
+	return jsUndefined
+}
+
+// jsBuiltins 标准库中 PAC 脚本常用的全局函数和对象
+func jsBuiltins(vars map[string]any) {
+	vars["undefined"] = jsUndefined
+	vars["NaN"] = math.NaN()
+	vars["Infinity"] = math.Inf(1)
+	vars["parseInt"] = jsNative(func(args []any) any {
+		s := strings.TrimSpace(jsToString(jsArg(args, 0)))
+		radix := 10
+		if r := jsArg(args, 1); r != jsUndefined {
+			radix = int(jsToNumber(r))
+		}
+		neg := strings.HasPrefix(s, "-")
+		s = strings.TrimLeft(s, "+-")
+		if (radix == 16 || radix == 10 && jsArg(args, 1) == jsUndefined) && (strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X")) {
+			s, radix = s[2:], 16
+		}
+		if radix < 2 || radix > 36 {
+			return math.NaN()
+		}
+		end := 0
+		for end < len(s) {
+			d := strings.IndexByte("0123456789abcdefghijklmnopqrstuvwxyz", s[end]|0x20)
+			if d < 0 || d >= radix {
+				break
+			}
+			end++
+		}
+		n, err := strconv.ParseInt(s[:end], radix, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		if neg {
+			n = -n
+		}
+		return float64(n)
+	})
+	vars["parseFloat"] = jsNative(func(args []any) any {
+		s := strings.TrimSpace(jsToString(jsArg(args, 0)))
+		for end := len(s); end > 0; end-- {
+			if n, err := strconv.ParseFloat(s[:end], 64); err == nil {
+				return n
+			}
+		}
+		return math.NaN()
+	})
+	vars["isNaN"] = jsNative(func(args []any) any { return math.IsNaN(jsToNumber(jsArg(args, 0))) })
+	vars["String"] = jsNative(func(args []any) any {
+		if len(args) == 0 {
+			return ""
+		}
+		return jsToString(args[0])
+	})
+	vars["Number"] = jsNative(func(args []any) any {
+		if len(args) == 0 {
+			return float64(0)
+		}
+		return jsToNumber(args[0])
+	})
+	vars["Boolean"] = jsNative(func(args []any) any { return jsTruthy(jsArg(args, 0)) })
+	vars["Array"] = jsNative(func(args []any) any {
+		if len(args) == 1 {
+			if n, ok := args[0].(float64); ok {
+				jsCheckArray(int(min(n, jsMaxArray+1)))
+				arr := &jsArray{elems: make([]any, int(max(0, n)))}
+				for i := range arr.elems {
+					arr.elems[i] = jsUndefined
+				}
+				return arr
+			}
+		}
+		return &jsArray{elems: append([]any(nil), args...)}
+	})
+	vars["Object"] = jsNative(func([]any) any { return newJSObject() })
+	vars["RegExp"] = jsNative(func(args []any) any {
+		if re, ok := jsArg(args, 0).(*jsRegExp); ok {
+			return re
+		}
+		flags := ""
+		if f := jsArg(args, 1); f != jsUndefined {
+			flags = jsToString(f)
+		}
+		re, err := jsCompileRegexp(jsToString(jsArg(args, 0)), flags)
+		if err != nil {
+			jsThrow("%v", err)
+		}
+		return re
+	})
+	m := newJSObject()
+	math1 := func(f func(float64) float64) jsNative {
+		return func(args []any) any { return f(jsToNumber(jsArg(args, 0))) }
+	}
+	m.set("floor", math1(math.Floor))
+	m.set("ceil", math1(math.Ceil))
+	m.set("abs", math1(math.Abs))
+	m.set("round", math1(func(x float64) float64 { return math.Floor(x + 0.5) }))
+	m.set("pow", jsNative(func(args []any) any { return math.Pow(jsToNumber(jsArg(args, 0)), jsToNumber(jsArg(args, 1))) }))
+	m.set("max", jsNative(func(args []any) any {
+		r := math.Inf(-1)
+		for _, a := range args {
+			r = math.Max(r, jsToNumber(a))
+		}
+		return r
+	}))
+	m.set("min", jsNative(func(args []any) any {
+		r := math.Inf(1)
+		for _, a := range args {
+			r = math.Min(r, jsToNumber(a))
+		}
+		return r
+	}))
+	vars["Math"] = m
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func runPACSource(t *testing.T, src string) error {
+	t.Helper()
+	prog, err := jsParse(src)
+	if err != nil {
+		t.Fatalf("parse %q: %v", src, err)
+	}
+	return newPACInterp().run(prog)
+}
+
+func TestPACMemoryLimits(t *testing.T) {
+	tests := []string{
+		"var s = 'a'; while (true) s = s + s + 'x';",
+		"var s = 'abcdefgh'; for (var i = 0; i < 20; i++) s = s.concat(s, s);",
+		"var a = []; var s = 'x'; for (var i = 0; i < 20; i++) s += s; while (true) a.push(s); a.join('');",
+		"var a = []; for (var i = 0; i < 20; i++) a = a.concat(a, [i]);",
+		"var a = []; a[100000000] = 1;",
+		"var a = []; a.length = 100000000;",
+		"var a = Array(100000000);",
+		"var a = []; a.push(a); var s = a + '';",
+		"var s = 'x'; for (var i = 0; i < 20; i++) s += s; var r = s.replace(/x/g, '$&$&');",
+		"var parts = []; for (var i = 0; ; i++) parts.push('part' + i + 'xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx');",
+	}
+	for _, src := range tests {
+		err := runPACSource(t, src)
+		if err == nil || !strings.Contains(err.Error(), "限制") {
+			t.Errorf("%q: err = %v, want limit error", src, err)
+		}
+	}
+}
+
+func TestPACNormalScript(t *testing.T) {
+	src := `var hosts = ["a.com", "b.com"];
+	function FindProxyForURL(url, host) {
+		var s = "";
+		for (var i = 0; i < 1000; i++) s += host.charAt(i % host.length);
+		if (hosts.join(",").indexOf(host) >= 0 && s.length == 1000) return "PROXY p:8080";
+		return "DIRECT";
+	}`
+	prog, err := jsParse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newPACInterp()
+	if err := in.run(prog); err != nil {
+		t.Fatal(err)
+	}
+	v, err := in.callGlobal("FindProxyForURL", "http://a.com/", "a.com")
+	if err != nil || v != "PROXY p:8080" {
+		t.Fatalf("FindProxyForURL = %v, %v", v, err)
+	}
+}
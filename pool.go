@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyPool 一组上游代理，规则通过 pool 属性引用；strategy 决定每个请求先使用哪个代理，失败时按顺序改用池中其他代理
+type ProxyPool struct {
+	Name     string          `xml:"name,attr"`
+	Strategy string          `xml:"strategy,attr,omitempty"` // roundRobin(默认)、leastConn 或 latency
+	Proxies  []ProxyUpstream `xml:"proxy"`
+}
+
+func (c *ProxyConfig) initPools() error {
+	seen := map[string]bool{}
+	for _, p := range c.ProxyPools {
+		if p.Name == "" || seen[p.Name] {
+			return fmt.Errorf("proxyPool 名称为空或重复: %q", p.Name)
+		}
+		seen[p.Name] = true
+		switch p.Strategy {
+		case "", "roundRobin", "leastConn", "latency":
+		default:
+			return fmt.Errorf("proxyPool %s: strategy 只能是 roundRobin、leastConn 或 latency: %s", p.Name, p.Strategy)
+		}
+		if len(p.Proxies) == 0 {
+			return fmt.Errorf("proxyPool %s 中没有代理", p.Name)
+		}
+	}
+	return nil
+}
+
+func (c *ProxyConfig) pool(name string) *ProxyPool {
+	for i := range c.ProxyPools {
+		if c.ProxyPools[i].Name == name {
+			return &c.ProxyPools[i]
+		}
+	}
+	return nil
+}
+
+// upstreamStats 经过某个代理的进行中请求数和响应时间，按 proxyUrl 区分，多条规则共用
+type upstreamStats struct {
+	active  atomic.Int64
+	mu      sync.Mutex
+	latency time.Duration // 收到响应头时间的指数移动平均，0 表示还没有数据
+}
+
+var (
+	poolStats    sync.Map // proxyUrl -> *upstreamStats
+	poolCounters sync.Map // 代理池名称 -> *atomic.Uint64，用于轮询
+)
+
+func statsFor(proxyURL string) *upstreamStats {
+	v, _ := poolStats.LoadOrStore(proxyURL, &upstreamStats{})
+	return v.(*upstreamStats)
+}
+
+func (s *upstreamStats) avgLatency() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latency
+}
+
+func (s *upstreamStats) observe(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latency == 0 {
+		s.latency = d
+	} else {
+		s.latency = (s.latency*4 + d) / 5
+	}
+}
+
+// order 按代理池的 strategy 排列池中的候选代理，备用代理保持在后面
+func (f *failoverTransport) order(candidates []failoverUpstream) []failoverUpstream {
+	var pooled, rest []failoverUpstream
+	for _, u := range candidates {
+		if u.pooled {
+			pooled = append(pooled, u)
+		} else {
+			rest = append(rest, u)
+		}
+	}
+	if len(pooled) < 2 {
+		return candidates
+	}
+	switch f.strategy {
+	case "leastConn":
+		sort.SliceStable(pooled, func(i, j int) bool {
+			return statsFor(pooled[i].proxyURL).active.Load() < statsFor(pooled[j].proxyURL).active.Load()
+		})
+	case "latency":
+		pooled = byLatency(pooled)
+	default:
+		v, _ := poolCounters.LoadOrStore(f.pool, &atomic.Uint64{})
+		n := int((v.(*atomic.Uint64).Add(1) - 1) % uint64(len(pooled)))
+		pooled = append(append([]failoverUpstream{}, pooled[n:]...), pooled[:n]...)
+	}
+	return append(pooled, rest...)
+}
+
+// byLatency 按响应时间的倒数加权随机选出第一个代理，还没有数据的代理优先，使每个代理都能被测量；其余按响应时间排序
+func byLatency(pooled []failoverUpstream) []failoverUpstream {
+	lat := make([]time.Duration, len(pooled))
+	var total float64
+	weights := make([]float64, len(pooled))
+	for i, u := range pooled {
+		lat[i] = statsFor(u.proxyURL).avgLatency()
+		if lat[i] == 0 {
+			return append(append([]failoverUpstream{u}, pooled[:i]...), pooled[i+1:]...)
+		}
+		weights[i] = 1 / lat[i].Seconds()
+		total += weights[i]
+	}
+	pick := len(pooled) - 1
+	x := rand.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			pick = i
+			break
+		}
+		x -= w
+	}
+	first := pooled[pick]
+	rest := append(append([]failoverUpstream{}, pooled[:pick]...), pooled[pick+1:]...)
+	sort.SliceStable(rest, func(i, j int) bool {
+		return statsFor(rest[i].proxyURL).avgLatency() < statsFor(rest[j].proxyURL).avgLatency()
+	})
+	return append([]failoverUpstream{first}, rest...)
+}
+
+// roundTrip 经过 u 发送请求，统计进行中的请求数(到响应体关闭为止)和收到响应头的时间
+func (f *failoverTransport) roundTrip(u failoverUpstream, r *http.Request) (*http.Response, error) {
+	s := statsFor(u.proxyURL)
+	s.active.Add(1)
+	start := time.Now()
+	resp, err := u.transport.RoundTrip(r)
+	if err != nil {
+		s.active.Add(-1)
+		return resp, err
+	}
+	s.observe(time.Since(start))
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { s.active.Add(-1) }}
+	return resp, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 终端颜色
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorCyan   = "\033[36m"
+	colorGray   = "\033[90m"
+)
+
+// pretty 模式下 URL 的最大显示长度
+const prettyURLWidth = 80
+
+func isTerminal(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	s, err := f.Stat()
+	return err == nil && s.Mode()&os.ModeCharDevice != 0
+}
+
+func statusColor(status int) string {
+	switch {
+	case status >= 500:
+		return colorRed
+	case status >= 400:
+		return colorYellow
+	case status >= 300:
+		return colorCyan
+	}
+	return colorGreen
+}
+
+// truncate 截断过长的字符串，中间用 ... 代替，保留开头的域名和结尾的路径
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	head := (width - 3) * 2 / 3
+	tail := width - 3 - head
+	return string(r[:head]) + "..." + string(r[len(r)-tail:])
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return fmt.Sprintf("%.2fs", d.Seconds())
+	case d >= time.Millisecond:
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%dµs", d.Microseconds())
+}
+
+// prettyLine 格式: 时间 id 状态码 方法 耗时 规则 URL
+func prettyLine(e *accessEntry, color bool) string {
+	status := fmt.Sprintf("%3d", e.Status)
+	rule := fmt.Sprintf("%-16s", truncate(e.Rule, 16))
+	ts := time.Now().Format("15:04:05")
+	if color {
+		status = statusColor(e.Status) + status + colorReset
+		rule = colorGray + rule + colorReset
+		ts = colorGray + ts + colorReset
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s #%-5d %s %-7s %8s %s %s",
+		ts, e.ID, status, e.Method, formatDuration(e.Duration), rule, truncate(e.URL, prettyURLWidth))
+	if e.GraphQLOp != "" {
+		fmt.Fprintf(&b, " [%s %s]", e.GraphQLType, e.GraphQLOp)
+	}
+	return b.String()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig 按客户端 IP 限速，rate 为每秒请求数，burst 为允许的突发请求数(默认等于 rate)
+type RateLimitConfig struct {
+	Rate  float64 `xml:"rate,attr"`
+	Burst int     `xml:"burst,attr,omitempty"`
+}
+
+// tokenBucket 令牌桶，每秒补充 rate 个令牌，最多 burst 个
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  int
+}
+
+// bucketSet 按 key 分开的令牌桶，长时间未使用的桶会被清理
+type bucketSet struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// take 取一个令牌，没有令牌时返回需要等待的时间
+func (s *bucketSet) take(key string, rate float64, burst int) (bool, time.Duration) {
+	if burst <= 0 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets == nil {
+		s.buckets = map[string]*tokenBucket{}
+	}
+	// 桶补满后与新建的桶相同，可以删除
+	if now.Sub(s.swept) > time.Minute {
+		for k, b := range s.buckets {
+			if now.Sub(b.last).Seconds()*b.rate >= float64(b.burst) {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept = now
+	}
+	b := s.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last, b.rate, b.burst = now, rate, burst
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// takeToken 从共享状态的令牌桶取一个令牌，配置了 Redis 时所有实例共用同一个桶
+func takeToken(key string, rate float64, burst int) (bool, time.Duration) {
+	if burst <= 0 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	// Redis 失败时 fallbackStore 会退回本地令牌桶，不会返回错误
+	ok, wait, _ := sharedState.take(key, rate, burst)
+	return ok, wait
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// rejectRateLimited 返回 429，并通过 Retry-After 告诉客户端多久之后重试
+func rejectRateLimited(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// checkClientRate 单个客户端 IP 超过 rateLimit 时返回 429
+func checkClientRate(w http.ResponseWriter, id int64, r *http.Request) bool {
+	c := config().RateLimit
+	if c == nil || c.Rate <= 0 {
+		return false
+	}
+	ip := clientIP(r)
+	ok, wait := takeToken("rate:client:"+ip, c.Rate, c.Burst)
+	if ok {
+		return false
+	}
+	warnf("id:%d 客户端 %s 请求过于频繁", id, ip)
+	rejectRateLimited(w, wait, "请求过于频繁，请稍后重试")
+	return true
+}
+
+// checkTargetRate 按规则的 rateLimit 限制发往每个目标主机的请求速率
+func checkTargetRate(w http.ResponseWriter, id int64, rule *ProxyRule, target *url.URL) bool {
+	if rule == nil || rule.RateLimit <= 0 {
+		return false
+	}
+	ok, wait := takeToken("rate:target:"+ruleName(rule)+"|"+target.Host, rule.RateLimit, rule.RateBurst)
+	if ok {
+		return false
+	}
+	warnf("id:%d 发往 %s 的请求超过规则 %s 的速率限制", id, target.Host, ruleName(rule))
+	rejectRateLimited(w, wait, "目标站点请求过于频繁，请稍后重试")
+	return true
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const safeBrowsingAPI = "https://safebrowsing.googleapis.com/v4/threatMatches:find"
+
+// ReputationConfig 目标URL信誉检查，可使用本地哈希库或 Google Safe Browsing API
+type ReputationConfig struct {
+	HashFile   string `xml:"hashFile,attr,omitempty"`   // 每行一个 SHA-256(十六进制)，对应 host/path 形式的URL表达式
+	APIKey     string `xml:"apiKey,attr,omitempty"`     // Google Safe Browsing API key
+	CacheTTL   string `xml:"cacheTTL,attr,omitempty"`   // 检查结果缓存时间，默认 30m
+	FailClosed bool   `xml:"failClosed,attr,omitempty"` // API 调用失败时拦截请求，默认放行
+}
+
+type reputationVerdict struct {
+	bad     bool
+	threat  string
+	expires time.Time
+}
+
+type reputationChecker struct {
+	conf   *ReputationConfig
+	hashes map[[sha256.Size]byte]struct{}
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]reputationVerdict
+}
+
+var reputation *reputationChecker
+
+func initReputation() {
+	c := config().Reputation
+	if c == nil || (c.HashFile == "" && c.APIKey == "") {
+		return
+	}
+	rc := &reputationChecker{
+		conf:   c,
+		hashes: map[[sha256.Size]byte]struct{}{},
+		ttl:    30 * time.Minute,
+		client: &http.Client{Timeout: 5 * time.Second},
+		cache:  map[string]reputationVerdict{},
+	}
+	if c.CacheTTL != "" {
+		if d, err := time.ParseDuration(c.CacheTTL); err == nil {
+			rc.ttl = d
+		}
+	}
+	if c.HashFile != "" {
+		if err := rc.loadHashes(c.HashFile); err != nil {
+			log.Printf("加载URL信誉哈希库失败: %v", err)
+		} else {
+			log.Printf("加载URL信誉哈希库，共 %d 条", len(rc.hashes))
+		}
+	}
+	reputation = rc
+}
+
+func (c *reputationChecker) loadHashes(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != sha256.Size {
+			continue
+		}
+		c.hashes[[sha256.Size]byte(b)] = struct{}{}
+	}
+	return sc.Err()
+}
+
+// urlExpressions 按 Safe Browsing 的方式生成 host 后缀 + path 前缀组合，
+// 如 a.b.example.com/1/2.html 对应 a.b.example.com/1/2.html、b.example.com/1/、example.com/ 等
+func urlExpressions(u *url.URL) []string {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	hosts := []string{host}
+	labels := strings.Split(host, ".")
+	for i := len(labels) - 5; i < len(labels)-1; i++ {
+		if i > 0 {
+			hosts = append(hosts, strings.Join(labels[i:], "."))
+		}
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	paths := []string{path}
+	if u.RawQuery != "" {
+		paths = append(paths, path+"?"+u.RawQuery)
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	prefix := "/"
+	paths = append(paths, prefix)
+	for i := 0; i < len(parts)-1 && i < 3; i++ {
+		prefix += parts[i] + "/"
+		paths = append(paths, prefix)
+	}
+	var exprs []string
+	for _, h := range hosts {
+		for _, p := range paths {
+			exprs = append(exprs, h+p)
+		}
+	}
+	return exprs
+}
+
+func (c *reputationChecker) matchLocal(u *url.URL) bool {
+	if len(c.hashes) == 0 {
+		return false
+	}
+	for _, expr := range urlExpressions(u) {
+		if _, ok := c.hashes[sha256.Sum256([]byte(expr))]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupAPI 调用 Safe Browsing Lookup API，返回命中的威胁类型
+func (c *reputationChecker) lookupAPI(target string) (string, error) {
+	body, _ := json.Marshal(map[string]any{
+		"client": map[string]string{"clientId": "r-proxy", "clientVersion": "1.0"},
+		"threatInfo": map[string]any{
+			"threatTypes":      []string{"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE", "POTENTIALLY_HARMFUL_APPLICATION"},
+			"platformTypes":    []string{"ANY_PLATFORM"},
+			"threatEntryTypes": []string{"URL"},
+			"threatEntries":    []map[string]string{{"url": target}},
+		},
+	})
+	resp, err := c.client.Post(safeBrowsingAPI+"?key="+url.QueryEscape(c.conf.APIKey), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("safe browsing 返回 %s", resp.Status)
+	}
+	var result struct {
+		Matches []struct {
+			ThreatType string `json:"threatType"`
+		} `json:"matches"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if len(result.Matches) > 0 {
+		return result.Matches[0].ThreatType, nil
+	}
+	return "", nil
+}
+
+// verdict 返回目标是否为恶意地址，结果按 cacheTTL 缓存
+func (c *reputationChecker) verdict(u *url.URL) (bool, string) {
+	key := u.String()
+	now := time.Now()
+	c.mu.Lock()
+	if v, ok := c.cache[key]; ok && now.Before(v.expires) {
+		c.mu.Unlock()
+		return v.bad, v.threat
+	}
+	c.mu.Unlock()
+
+	v := reputationVerdict{expires: now.Add(c.ttl)}
+	if c.matchLocal(u) {
+		v.bad, v.threat = true, "LOCAL_HASH"
+	} else if c.conf.APIKey != "" {
+		threat, err := c.lookupAPI(key)
+		if err != nil {
+			log.Printf("URL信誉检查失败: %v", err)
+			// 失败结果不缓存，下次请求重新检查
+			return c.conf.FailClosed, "CHECK_FAILED"
+		}
+		v.bad, v.threat = threat != "", threat
+	}
+
+	c.mu.Lock()
+	if len(c.cache) > 10000 {
+		c.cache = map[string]reputationVerdict{}
+	}
+	c.cache[key] = v
+	c.mu.Unlock()
+	return v.bad, v.threat
+}
+
+// checkReputation 目标为已知钓鱼/恶意地址时返回 403
+func checkReputation(w http.ResponseWriter, id int64, target *url.URL) bool {
+	if reputation == nil {
+		return false
+	}
+	bad, threat := reputation.verdict(target)
+	if !bad {
+		return false
+	}
+	warnf("id:%d 目标URL信誉检查未通过(%s)，已拦截 %s", id, threat, target.String())
+	logAccess(&accessEntry{ID: id, Host: target.Host, Status: http.StatusForbidden, Line: fmt.Sprintf("id:%d blocked(reputation) %s", id, target.Host)})
+	w.Header().Set("X-Proxy-Blocked", "reputation")
+	http.Error(w, "目标地址被识别为恶意网站，已拦截", http.StatusForbidden)
+	return true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryConfig 连接上游失败(拒绝连接、建连超时)时重试 GET/HEAD 请求，规则上的 retries 属性覆盖次数
+type RetryConfig struct {
+	Attempts int    `xml:"attempts,attr"`          // 最多重试次数
+	Backoff  string `xml:"backoff,attr,omitempty"` // 第一次重试前的等待时间，之后每次翻倍，默认 100ms
+
+	backoff time.Duration
+}
+
+func (c *RetryConfig) init() error {
+	if c == nil {
+		return nil
+	}
+	c.backoff = 100 * time.Millisecond
+	if c.Backoff != "" {
+		d, err := time.ParseDuration(c.Backoff)
+		if err != nil {
+			return fmt.Errorf("retry backoff 格式错误: %v", err)
+		}
+		c.backoff = d
+	}
+	return nil
+}
+
+// retryTransport 只重试还没有发出请求的连接错误，请求不会被上游重复处理
+type retryTransport struct {
+	base     http.RoundTripper
+	attempts int
+	backoff  time.Duration
+	id       int64
+	log      *requestLog
+}
+
+// withRetries 按配置包装 Transport，不需要重试时原样返回
+func withRetries(base http.RoundTripper, id int64, rule *ProxyRule, reqLog *requestLog) http.RoundTripper {
+	c := config().Retry
+	attempts, backoff := 0, 100*time.Millisecond
+	if c != nil {
+		attempts, backoff = c.Attempts, c.backoff
+	}
+	if rule != nil && rule.Retries > 0 {
+		attempts = rule.Retries
+	}
+	if attempts <= 0 {
+		return base
+	}
+	return &retryTransport{base: base, attempts: attempts, backoff: backoff, id: id, log: reqLog}
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(r)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || r.Body != nil && r.Body != http.NoBody {
+		return resp, err
+	}
+	wait := t.backoff
+	for i := 0; i < t.attempts && err != nil && isConnectError(err); i++ {
+		t.log.printf("id:%d 连接上游失败，%s 后第 %d 次重试: %v", t.id, wait, i+1, err)
+		select {
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return nil, err
+		}
+		wait *= 2
+		resp, err = t.base.RoundTrip(r)
+	}
+	return resp, err
+}
+
+// isConnectError 建立到上游代理或目标站点的连接时失败
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 响应体改写默认的最大处理大小，超过时原样转发
+const defaultRewriteMaxSize = 10 << 20
+
+// 默认只改写这些文本类型
+var defaultRewriteTypes = []string{"text/*", "application/json", "application/javascript", "application/xml", "application/xhtml+xml"}
+
+// BodyReplace 响应体正则替换规则
+type BodyReplace struct {
+	Pattern string `xml:"pattern,attr"`
+	With    string `xml:"with,attr"`              // 支持 $1 等分组引用
+	Types   string `xml:"types,attr,omitempty"`   // 逗号分隔的 Content-Type，默认常见文本类型
+	MaxSize string `xml:"maxSize,attr,omitempty"` // 超过该大小的响应不处理，默认 10MB
+
+	re      *regexp.Regexp
+	types   []ContentFilter
+	maxSize int64
+}
+
+func (r *BodyReplace) init() error {
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return fmt.Errorf("替换规则 %q 格式错误: %v", r.Pattern, err)
+	}
+	r.re = re
+	r.types = parseTypeList(r.Types)
+	r.maxSize = defaultRewriteMaxSize
+	if r.MaxSize != "" {
+		if r.maxSize, err = parseSize(r.MaxSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTypeList 解析逗号分隔的 Content-Type 列表，为空时使用默认文本类型
+func parseTypeList(s string) []ContentFilter {
+	list := defaultRewriteTypes
+	if strings.TrimSpace(s) != "" {
+		list = strings.Split(s, ",")
+	}
+	var types []ContentFilter
+	for _, t := range list {
+		types = append(types, ContentFilter{Type: strings.TrimSpace(t)})
+	}
+	return types
+}
+
+func matchTypes(types []ContentFilter, contentType string) bool {
+	for i := range types {
+		if types[i].matchType(contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIdentityEncoding 压缩过的响应体无法直接做文本替换
+func isIdentityEncoding(resp *http.Response) bool {
+	ce := strings.TrimSpace(resp.Header.Get("Content-Encoding"))
+	return ce == "" || strings.EqualFold(ce, "identity")
+}
+
+// readBodyLimited 读取整个响应体，超过 max 时返回 false 并恢复原始响应体以便原样转发
+func readBodyLimited(resp *http.Response, max int64) ([]byte, bool, error) {
+	if resp.ContentLength > max {
+		return nil, false, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(b)) > max {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+		return nil, false, nil
+	}
+	resp.Body.Close()
+	return b, true, nil
+}
+
+// setBody 替换响应体并修正 Content-Length，内容变化后原有的 ETag 不再有效
+func setBody(resp *http.Response, b []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	resp.Header.Del("Content-MD5")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	resp.TransferEncoding = nil
+}
+
+// applyBodyReplaces 按规则对文本响应体做正则替换
+func applyBodyReplaces(id int64, rule *ProxyRule, resp *http.Response) error {
+	if rule == nil || len(rule.Replaces) == 0 || !isIdentityEncoding(resp) || resp.Body == http.NoBody {
+		return nil
+	}
+	ct := resp.Header.Get("Content-Type")
+	var active []*BodyReplace
+	max := int64(0)
+	for i := range rule.Replaces {
+		r := &rule.Replaces[i]
+		if matchTypes(r.types, ct) {
+			active = append(active, r)
+			if r.maxSize > max {
+				max = r.maxSize
+			}
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	body, ok, err := readBodyLimited(resp, max)
+	if err != nil || !ok {
+		return err
+	}
+	size := int64(len(body))
+	for _, r := range active {
+		if size <= r.maxSize {
+			body = r.re.ReplaceAll(body, []byte(r.With))
+		}
+	}
+	setBody(resp, body)
+	log.Printf("id:%d 响应体替换完成 %d -> %d 字节", id, size, len(body))
+	return nil
+}
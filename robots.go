@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const defaultRobots = "User-agent: *\nDisallow: /\n"
+
+// RobotsConfig 代理自身的 robots.txt，以及是否给代理的响应加 X-Robots-Tag: noindex
+type RobotsConfig struct {
+	Content string `xml:",chardata"` // 为空时禁止所有爬虫
+	NoIndex bool   `xml:"noindex,attr,omitempty"`
+}
+
+// robotsHandler 爬虫直接访问 /robots.txt 时返回代理自身的配置；
+// 代理页面中的 /robots.txt 请求(带 Referer)仍按站点根路径转发
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	if config().Robots == nil || rootRelativeTarget(r) != "" {
+		proxyHandler(w, r)
+		return
+	}
+	content := strings.TrimSpace(config().Robots.Content)
+	if content == "" {
+		content = defaultRobots
+	} else {
+		// 去掉 XML 中每行的缩进
+		lines := strings.Split(content, "\n")
+		for i := range lines {
+			lines[i] = strings.TrimSpace(lines[i])
+		}
+		content = strings.Join(lines, "\n") + "\n"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(content))
+}
+
+func applyNoIndex(resp *http.Response) {
+	if config().Robots != nil && config().Robots.NoIndex {
+		resp.Header.Set("X-Robots-Tag", "noindex, nofollow")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SecurityConfig 对外开放时的访问控制
+type SecurityConfig struct {
+	// 严格模式: 只允许访问代理规则、直连列表和 allow 中配置的域名
+	Strict bool     `xml:"strict,attr,omitempty"`
+	Allow  []string `xml:"allow"`
+	// 直连时先解析域名并校验 IP，拒绝内网地址，然后固定连接到校验过的 IP，防止 DNS 重绑定；
+	// 默认开启，blockPrivate="false" 关闭
+	BlockPrivate *bool `xml:"blockPrivate,attr,omitempty"`
+	// blockPrivate 时仍允许访问的网段，如 10.1.0.0/16
+	AllowNets []string `xml:"allowNet"`
+	// 浏览器请求的 Origin/Referer 白名单，如 https://app.example.com 或 *.example.com；代理自身的地址总是允许
+	Origins []string `xml:"origin"`
+	// 严格模式拒绝未配置的域名时返回的内容
+	Message string `xml:"message,attr,omitempty"`
+
+	allowNets []netip.Prefix
+}
+
+func (s *SecurityConfig) init() error {
+	if s == nil {
+		return nil
+	}
+	s.allowNets = nil
+	for _, n := range s.AllowNets {
+		p, err := netip.ParsePrefix(strings.TrimSpace(n))
+		if err != nil {
+			return fmt.Errorf("allowNet %q 格式错误: %v", n, err)
+		}
+		s.allowNets = append(s.allowNets, p)
+	}
+	return nil
+}
+
+// allowedOrigin 来源地址是否在白名单中，origin 形如 scheme://host[:port]
+func (s *SecurityConfig) allowedOrigin(origin, self string) bool {
+	if strings.EqualFold(origin, self) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, o := range s.Origins {
+		if suffix, ok := strings.CutPrefix(o, "*."); ok {
+			h := u.Hostname()
+			if h == suffix || strings.HasSuffix(h, "."+suffix) {
+				return true
+			}
+		} else if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin 拒绝 Origin/Referer 不在白名单中的浏览器请求，两者都没有时视为非浏览器请求放行
+func checkOrigin(w http.ResponseWriter, id int64, r *http.Request) bool {
+	if config().Security == nil || len(config().Security.Origins) == 0 || isSharedRequest(r) {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		if ref, err := url.Parse(r.Referer()); err == nil && ref.Host != "" {
+			origin = ref.Scheme + "://" + ref.Host
+		}
+	}
+	if origin == "" || config().Security.allowedOrigin(origin, proxyOrigin(r)) {
+		return false
+	}
+	warnf("id:%d 拒绝来源 %s 的请求", id, origin)
+	http.Error(w, "请求来源不在允许列表中", http.StatusForbidden)
+	return true
+}
+
+// cgnatPrefix 运营商级 NAT 地址段，同样视为内网
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+func isPrivateAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() || cgnatPrefix.Contains(ip)
+}
+
+// blockPrivate 是否拒绝直连内网地址，没有 security 配置时同样拒绝
+func (s *SecurityConfig) blockPrivate() bool {
+	return s == nil || s.BlockPrivate == nil || *s.BlockPrivate
+}
+
+// allowedAddr 地址是否符合安全策略，allowNet 和 directNetworks 中的网段视为明确允许
+func (s *SecurityConfig) allowedAddr(ip netip.Addr) bool {
+	if !isPrivateAddr(ip) {
+		return true
+	}
+	if s != nil && inNetworks(ip, s.allowNets) {
+		return true
+	}
+	return inNetworks(ip, config().directNets)
+}
+
+// explicitTarget 目标域名精确或按通配符写在 directDomains 或 security allow 中，
+// 如默认配置的 localhost；不使用包含匹配，避免 localhost.example.com 之类的域名绕过
+func explicitTarget(target *url.URL) bool {
+	list := config().DirectDomains
+	if config().Security != nil {
+		list = append(list[:len(list):len(list)], config().Security.Allow...)
+	}
+	for _, d := range list {
+		if ruleMatch(d, target.Host) >= matchWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+type pinnedAddrsKey struct{}
+
+// pinTarget 解析目标域名并校验所有 IP，校验通过后将 IP 放入请求上下文，供 pinnedDial 使用；
+// 被拒绝时返回已写出的状态码
+func pinTarget(w http.ResponseWriter, id int64, r *http.Request, target *url.URL) (*http.Request, int) {
+	if !config().Security.blockPrivate() || explicitTarget(target) {
+		return r, 0
+	}
+	host := target.Hostname()
+	var addrs []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		addrs, err = lookupHost(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			warnf("id:%d 解析 %s 失败: %v", id, host, err)
+			http.Error(w, "目标域名解析失败", http.StatusBadGateway)
+			return nil, http.StatusBadGateway
+		}
+	}
+	// 任一地址不符合就拒绝，避免轮询解析结果时连到内网
+	for _, ip := range addrs {
+		if !config().Security.allowedAddr(ip) {
+			warnf("id:%d 拒绝访问内网地址 %s (%s)", id, ip, host)
+			http.Error(w, "不允许访问内网地址", http.StatusForbidden)
+			return nil, http.StatusForbidden
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), pinnedAddrsKey{}, addrs)), 0
+}
+
+// pinnedDial 只连接 pinTarget 校验过的 IP，不再重新解析域名；没有校验过的 IP 时按 dns 配置解析
+func pinnedDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	addrs, _ := ctx.Value(pinnedAddrsKey{}).([]netip.Addr)
+	if len(addrs) == 0 {
+		return dialResolved(ctx, network, addr)
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range addrs {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// allowedHost 域名是否在规则、直连列表或额外白名单中；只接受精确、通配符和正则匹配，
+// ~ 包含匹配会放行 internal.corp.evil.com 之类的域名
+func allowedHost(target *url.URL) bool {
+	host := target.Host
+	matches := func(d string) bool { return ruleMatch(d, host) >= matchWildcard }
+	for _, d := range config().DirectDomains {
+		if matches(d) {
+			return true
+		}
+	}
+	for i := range config().ProxyRules {
+		if config().ProxyRules[i].match(target) >= matchRegex {
+			return true
+		}
+	}
+	for _, d := range config().Security.Allow {
+		if matches(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAllowlist 严格模式下拒绝未配置的域名，签名分享链接和短链接已经过授权所以放行
+func checkAllowlist(w http.ResponseWriter, id int64, r *http.Request, target *url.URL) bool {
+	if config().Security == nil || !config().Security.Strict || isSharedRequest(r) {
+		return false
+	}
+	if allowedHost(target) {
+		return false
+	}
+	warnf("id:%d 严格模式，拒绝未配置的域名 %s", id, target.Host)
+	http.Error(w, messageOr(config().Security.Message, "目标域名不在允许列表中"), http.StatusForbidden)
+	return true
+}
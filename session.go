@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// 浏览器在代理页面中自动请求的站点根路径文件
+var rootRelativeFiles = map[string]bool{
+	"favicon.ico":          true,
+	"robots.txt":           true,
+	"sitemap.xml":          true,
+	"manifest.json":        true,
+	"site.webmanifest":     true,
+	"browserconfig.xml":    true,
+	"apple-touch-icon.png": true,
+	".well-known":          true,
+}
+
+// 常见的静态文件扩展名，带这些扩展名的首段路径不会是域名
+var assetExts = map[string]bool{
+	".ico": true, ".txt": true, ".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true,
+	".webp": true, ".js": true, ".mjs": true, ".css": true, ".json": true, ".xml": true, ".map": true,
+	".html": true, ".htm": true, ".woff": true, ".woff2": true, ".ttf": true, ".webmanifest": true,
+}
+
+// hasScheme 路径是否以 http:/ 或 https:/ 开头
+func hasScheme(p string) bool {
+	return strings.HasPrefix(p, "http:/") || strings.HasPrefix(p, "https:/")
+}
+
+// targetFromProxyURL 从形如 http://localhost:3000/https:/example.com/a 的代理地址中取出目标地址
+func targetFromProxyURL(r *http.Request, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host != r.Host {
+		return nil
+	}
+	p := strings.TrimPrefix(u.Path, "/")
+	if !hasScheme(p) {
+		return nil
+	}
+	t, err := url.Parse(fixTargetURL(p))
+	if err != nil || t.Host == "" {
+		return nil
+	}
+	return t
+}
+
+// looksRootRelative 判断未带协议的路径是否是页面中的站点根路径请求(如 /favicon.ico、/assets/app.js)，
+// 而不是省略了协议的目标地址(如 /www.example.com/a)
+func looksRootRelative(p string) bool {
+	first, _, _ := strings.Cut(p, "/")
+	if first == "" {
+		return true
+	}
+	if rootRelativeFiles[strings.ToLower(first)] || strings.HasPrefix(strings.ToLower(first), "apple-touch-icon") {
+		return true
+	}
+	if !strings.Contains(first, ".") {
+		// 不含点的首段不是域名(localhost 和 IPv6 地址除外)
+		host := first
+		if h, _, err := net.SplitHostPort(first); err == nil {
+			host = h
+		}
+		return host != "localhost" && !strings.HasPrefix(first, "[")
+	}
+	return assetExts[strings.ToLower(path.Ext(first))]
+}
+
+// rootRelativeTarget 对站点根路径请求，根据 Referer 找到所属的目标站点并返回完整的目标地址；
+// 没有 Referer 时(如 Referrer-Policy: no-referrer)使用最近打开的页面所在的站点
+func rootRelativeTarget(r *http.Request) string {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if hasScheme(p) || !looksRootRelative(p) {
+		return ""
+	}
+	ref := targetFromProxyURL(r, r.Referer())
+	if ref == nil {
+		ref = sessionTarget(r)
+	}
+	if ref == nil {
+		return ""
+	}
+	target := ref.Scheme + "://" + ref.Host + r.URL.Path
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	return target
+}
+
+// sessionCookie 记录客户端最近通过代理打开的页面所在的站点，如 https://example.com
+const sessionCookie = "r_proxy_target"
+
+func sessionTarget(r *http.Request) *url.URL {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	t, err := url.Parse(c.Value)
+	if err != nil || t.Host == "" || t.Scheme != "http" && t.Scheme != "https" {
+		return nil
+	}
+	return t
+}
+
+// bindSession 通过 /https://host/... 打开 HTML 页面时记录目标站点，页面中的脚本、样式等请求即使没有 Referer 也能找到目标
+func bindSession(in *http.Request, target *url.URL, resp *http.Response) {
+	if !hasScheme(strings.TrimPrefix(in.URL.Path, "/")) || !isHTML(resp) {
+		return
+	}
+	v := target.Scheme + "://" + target.Host
+	if c, err := in.Cookie(sessionCookie); err == nil && c.Value == v {
+		return
+	}
+	c := &http.Cookie{Name: sessionCookie, Value: v, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	resp.Header.Add("Set-Cookie", c.String())
+}
+
+// stripSessionCookie 不把代理自己的 Cookie 发给目标站点
+func stripSessionCookie(r *http.Request) {
+	if _, err := r.Cookie(sessionCookie); err != nil {
+		return
+	}
+	var kept []string
+	for _, c := range r.Cookies() {
+		if c.Name != sessionCookie {
+			kept = append(kept, c.Name+"="+c.Value)
+		}
+	}
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// sharePrefix 签名分享地址的前缀: /s/<token>/https://example.com/file
+const sharePrefix = "/s/"
+
+// ShareConfig 签名分享链接配置
+type ShareConfig struct {
+	Secret string `xml:"secret,attr"`
+}
+
+type sharedKey struct{}
+
+// isSharedRequest 请求是否来自有效的签名分享链接
+func isSharedRequest(r *http.Request) bool {
+	return r.Context().Value(sharedKey{}) != nil
+}
+
+// signShareURL 生成签名 token，payload 为 过期时间(8字节) + 次数限制(4字节) + 随机数(4字节)
+func signShareURL(secret, target string, expires time.Time, limit uint32) string {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload, uint64(expires.Unix()))
+	binary.BigEndian.PutUint32(payload[8:], limit)
+	rand.Read(payload[12:])
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + shareMAC(secret, payload, target)
+}
+
+func shareMAC(secret string, payload []byte, target string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	mac.Write([]byte(target))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+}
+
+// verifyShareToken 校验签名、过期时间和使用次数
+func verifyShareToken(secret, token, target string) error {
+	p, sig, ok := strings.Cut(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if !ok || err != nil || len(payload) != 16 {
+		return errors.New("分享链接格式错误")
+	}
+	if !hmac.Equal([]byte(sig), []byte(shareMAC(secret, payload, target))) {
+		return errors.New("分享链接签名无效")
+	}
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(payload)) {
+		return errors.New("分享链接已过期")
+	}
+	if limit := binary.BigEndian.Uint32(payload[8:]); limit > 0 {
+		// 使用次数保存在共享状态中，多实例部署时全局生效
+		ttl := time.Until(time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)) + time.Minute
+		n, err := sharedState.incr("share:"+token, ttl)
+		if err != nil {
+			return fmt.Errorf("记录分享链接使用次数失败: %v", err)
+		}
+		if n > int64(limit) {
+			return errors.New("分享链接已达到下载次数上限")
+		}
+	}
+	return nil
+}
+
+// shareHandler 处理 /s/<token>/<目标地址>，校验通过后按普通代理请求转发
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	if config().Share == nil || config().Share.Secret == "" {
+		proxyHandler(w, r)
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, sharePrefix)
+	token, target, ok := strings.Cut(rest, "/")
+	if !ok || target == "" {
+		http.Error(w, "分享链接格式错误", http.StatusBadRequest)
+		return
+	}
+	target = fixTargetURL(target)
+	signed := target
+	if r.URL.RawQuery != "" {
+		signed += "?" + r.URL.RawQuery
+	}
+	if err := verifyShareToken(config().Share.Secret, token, signed); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	r2 := r.Clone(context.WithValue(r.Context(), sharedKey{}, true))
+	r2.URL.Path = "/" + target
+	r2.URL.RawPath = ""
+	proxyHandler(w, r2)
+}
+
+// runSignCommand 命令行生成分享链接: r-proxy sign -ttl 24h -limit 3 https://example.com/file
+func runSignCommand(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	ttl := fs.Duration("ttl", 24*time.Hour, "有效期")
+	limit := fs.Uint("limit", 0, "最多下载次数，0 表示不限")
+	cfg := fs.String("config", configFile, "配置文件")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "用法: r-proxy sign [-ttl 24h] [-limit 3] <目标地址>")
+		os.Exit(2)
+	}
+	if err := loadConfig(*cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if config().Share == nil || config().Share.Secret == "" {
+		fmt.Fprintln(os.Stderr, "配置文件中没有设置 shareLinks secret")
+		os.Exit(1)
+	}
+	// 签名包含查询参数，分享后不能再改动
+	target := fixTargetURL(fs.Arg(0))
+	token := signShareURL(config().Share.Secret, target, time.Now().Add(*ttl), uint32(*limit))
+	fmt.Printf("%s%s%s/%s\n", serverBase(), sharePrefix, token, target)
+}
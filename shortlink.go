@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shortLinkPrefix 短链接访问前缀: /l/<token>
+const shortLinkPrefix = "/l/"
+
+// ShortLinkConfig 短链接持久化配置
+type ShortLinkConfig struct {
+	File string `xml:"file,attr,omitempty"` // 默认 shortlinks.json
+}
+
+// shortLink 管理接口创建的短链接，可以固定使用某个上游代理
+type shortLink struct {
+	Token    string    `json:"token"`
+	Target   string    `json:"target"`
+	ProxyURL string    `json:"proxyUrl,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Password string    `json:"password,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+var shortLinks = struct {
+	sync.RWMutex
+	m       map[string]*shortLink
+	version int64 // 最后修改时间(纳秒)，集群模式下用于判断哪个节点的数据最新
+}{m: map[string]*shortLink{}}
+
+// shortLinkSnapshot 集群节点之间同步的短链接数据
+type shortLinkSnapshot struct {
+	Version int64        `json:"version"`
+	Links   []*shortLink `json:"links"`
+}
+
+func shortLinkVersion() int64 {
+	shortLinks.RLock()
+	defer shortLinks.RUnlock()
+	return shortLinks.version
+}
+
+// sortedShortLinks 按创建时间排序的短链接列表；调用方需持有锁
+func sortedShortLinks() []*shortLink {
+	list := make([]*shortLink, 0, len(shortLinks.m))
+	for _, l := range shortLinks.m {
+		list = append(list, l)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+func currentShortLinks() shortLinkSnapshot {
+	shortLinks.RLock()
+	defer shortLinks.RUnlock()
+	return shortLinkSnapshot{Version: shortLinks.version, Links: sortedShortLinks()}
+}
+
+// replaceShortLinks 收到比本地更新的数据时整体替换并保存
+func replaceShortLinks(snap shortLinkSnapshot) {
+	shortLinks.Lock()
+	defer shortLinks.Unlock()
+	if snap.Version <= shortLinks.version {
+		return
+	}
+	shortLinks.m = map[string]*shortLink{}
+	for _, l := range snap.Links {
+		shortLinks.m[l.Token] = l
+	}
+	shortLinks.version = snap.Version
+	if err := saveShortLinks(); err != nil {
+		log.Printf("保存短链接失败: %v", err)
+	}
+	log.Printf("已同步短链接 %d 个", len(snap.Links))
+}
+
+func shortLinkFile() string {
+	if config().ShortLinks != nil && config().ShortLinks.File != "" {
+		return config().ShortLinks.File
+	}
+	return "shortlinks.json"
+}
+
+func loadShortLinks() {
+	b, err := os.ReadFile(shortLinkFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取短链接失败: %v", err)
+		}
+		return
+	}
+	var list []*shortLink
+	if err := json.Unmarshal(b, &list); err != nil {
+		log.Printf("解析短链接失败: %v", err)
+		return
+	}
+	shortLinks.Lock()
+	for _, l := range list {
+		shortLinks.m[l.Token] = l
+	}
+	if st, err := os.Stat(shortLinkFile()); err == nil {
+		shortLinks.version = st.ModTime().UnixNano()
+	}
+	shortLinks.Unlock()
+	log.Printf("加载短链接 %d 个", len(list))
+}
+
+// saveShortLinks 先写临时文件再改名，避免写到一半时进程退出损坏文件；调用方需持有锁
+func saveShortLinks() error {
+	b, err := json.MarshalIndent(sortedShortLinks(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := shortLinkFile() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, shortLinkFile())
+}
+
+func newShortToken() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type pinnedRuleKey struct{}
+
+// pinnedRule 短链接固定的上游代理，返回 nil 表示按正常规则匹配
+func pinnedRule(r *http.Request) *ProxyRule {
+	rule, _ := r.Context().Value(pinnedRuleKey{}).(*ProxyRule)
+	return rule
+}
+
+// shortLinkHandler 处理 /l/<token>，token 之后的路径会拼接到目标地址后面
+func shortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, shortLinkPrefix)
+	token, extra, _ := strings.Cut(rest, "/")
+	shortLinks.RLock()
+	l := shortLinks.m[token]
+	shortLinks.RUnlock()
+	if l == nil {
+		http.NotFound(w, r)
+		return
+	}
+	target := l.Target
+	if extra != "" {
+		target = strings.TrimSuffix(target, "/") + "/" + extra
+	}
+	ctx := context.WithValue(r.Context(), sharedKey{}, true)
+	if l.ProxyURL != "" {
+		ctx = context.WithValue(ctx, pinnedRuleKey{}, &ProxyRule{
+			Domain:   "shortlink:" + l.Token,
+			ProxyURL: l.ProxyURL,
+			Username: l.Username,
+			Password: l.Password,
+		})
+	}
+	r2 := r.Clone(ctx)
+	r2.URL.Path = "/" + target
+	r2.URL.RawPath = ""
+	proxyHandler(w, r2)
+}
+
+// adminShortLinks 管理接口: GET 列出，POST 创建 {"target": "...", "proxyUrl": "..."}，DELETE ?token= 撤销
+func adminShortLinks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		shortLinks.RLock()
+		list := sortedShortLinks()
+		shortLinks.RUnlock()
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		var l shortLink
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil || l.Target == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "需要 target 字段"})
+			return
+		}
+		l.Target = fixTargetURL(l.Target)
+		l.Created = time.Now()
+		shortLinks.Lock()
+		if l.Token == "" || shortLinks.m[l.Token] != nil {
+			l.Token = newShortToken()
+		}
+		shortLinks.m[l.Token] = &l
+		shortLinks.version = time.Now().UnixNano()
+		err := saveShortLinks()
+		shortLinks.Unlock()
+		if err != nil {
+			log.Printf("保存短链接失败: %v", err)
+		}
+		replicateShortLinks()
+		writeJSON(w, http.StatusCreated, map[string]string{
+			"token": l.Token,
+			"url":   serverBase() + shortLinkPrefix + l.Token,
+		})
+	case http.MethodDelete:
+		token := r.URL.Query().Get("token")
+		shortLinks.Lock()
+		_, ok := shortLinks.m[token]
+		delete(shortLinks.m, token)
+		shortLinks.version = time.Now().UnixNano()
+		err := saveShortLinks()
+		shortLinks.Unlock()
+		if err != nil {
+			log.Printf("保存短链接失败: %v", err)
+		}
+		replicateShortLinks()
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "短链接不存在"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func init() {
+	adminMux.HandleFunc("/api/shortlinks", adminShortLinks)
+}
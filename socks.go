@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// socks5Dialer 通过 SOCKS5 代理建立 TCP 连接(RFC 1928/1929)。
+// socks5:// 在本地解析域名，socks5h:// 把域名交给代理解析
+type socks5Dialer struct {
+	proxyAddr string
+	username  string
+	password  string
+	remoteDNS bool
+}
+
+func newSocks5Dialer(u *url.URL) *socks5Dialer {
+	d := &socks5Dialer{proxyAddr: u.Host, remoteDNS: u.Scheme == "socks5h"}
+	if u.Port() == "" {
+		d.proxyAddr = net.JoinHostPort(u.Hostname(), "1080")
+	}
+	if u.User != nil {
+		d.username = u.User.Username()
+		d.password, _ = u.User.Password()
+	}
+	return d
+}
+
+var socksReplies = map[byte]string{
+	1: "代理服务器错误",
+	2: "规则不允许连接",
+	3: "网络不可达",
+	4: "主机不可达",
+	5: "连接被拒绝",
+	6: "TTL 过期",
+	7: "不支持的命令",
+	8: "不支持的地址类型",
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	if !d.remoteDNS {
+		if _, err := netip.ParseAddr(host); err != nil {
+			ips, err := lookupHost(ctx, host)
+			if err != nil || len(ips) == 0 {
+				return nil, fmt.Errorf("解析 %s 失败: %v", host, err)
+			}
+			host = ips[0].Unmap().String()
+		}
+	}
+
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := d.handshake(conn, host, port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 %s: %v", d.proxyAddr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, host string, port int) error {
+	methods := []byte{0x00}
+	if d.username != "" {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return errors.New("不是 SOCKS5 代理")
+	}
+	switch resp[1] {
+	case 0x00:
+	case 0x02:
+		if len(d.username) > 255 || len(d.password) > 255 {
+			return errors.New("用户名或密码过长")
+		}
+		req := []byte{0x01, byte(len(d.username))}
+		req = append(req, d.username...)
+		req = append(req, byte(len(d.password)))
+		req = append(req, d.password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errors.New("用户名或密码错误")
+		}
+	default:
+		return errors.New("代理不支持的认证方式")
+	}
+
+	// CONNECT 请求
+	req := []byte{0x05, 0x01, 0x00}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() {
+			req = append(req, 0x01)
+		} else {
+			req = append(req, 0x04)
+		}
+		req = append(req, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return errors.New("域名过长")
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		if msg, ok := socksReplies[head[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("连接失败，错误码 %d", head[1])
+	}
+	// 跳过 BND.ADDR 和 BND.PORT
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = 4
+	case 0x04:
+		skip = 16
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return errors.New("无法解析的代理响应")
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
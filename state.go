@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateStore 需要在多个实例间共享的计数等状态，未配置 Redis 时保存在本进程内存中
+type stateStore interface {
+	// incr 计数加一并返回新值，ttl 从第一次计数开始计算
+	incr(key string, ttl time.Duration) (int64, error)
+	// take 从令牌桶取一个令牌，没有令牌时返回需要等待的时间
+	take(key string, rate float64, burst int) (bool, time.Duration, error)
+}
+
+var sharedState stateStore = newMemoryStore()
+
+// RedisConfig 多实例部署时使用 Redis 共享限流、密钥限速的令牌桶和分享链接的下载次数；响应缓存仍按实例保存
+type RedisConfig struct {
+	Address  string `xml:"address,attr"`
+	Password string `xml:"password,attr,omitempty"`
+	DB       int    `xml:"db,attr,omitempty"`
+	Prefix   string `xml:"prefix,attr,omitempty"` // 键前缀，默认 r-proxy:
+	PoolSize int    `xml:"poolSize,attr,omitempty"`
+}
+
+func initSharedState() {
+	if config().Redis == nil || config().Redis.Address == "" {
+		return
+	}
+	store := newRedisStore(config().Redis)
+	if _, err := store.do("PING"); err != nil {
+		log.Printf("[WARN] 连接 Redis %s 失败，暂时使用本地状态: %v", config().Redis.Address, err)
+	} else {
+		log.Printf("共享状态使用 Redis %s", config().Redis.Address)
+	}
+	sharedState = &fallbackStore{primary: store, local: newMemoryStore()}
+}
+
+type memoryItem struct {
+	count   int64
+	expires time.Time
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	items   map[string]*memoryItem
+	ops     int
+	buckets bucketSet
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{items: map[string]*memoryItem{}}
+}
+
+// item 返回未过期的条目，并定期清理过期条目
+func (s *memoryStore) item(key string, now time.Time) *memoryItem {
+	if s.ops++; s.ops%1024 == 0 {
+		for k, it := range s.items {
+			if !it.expires.IsZero() && now.After(it.expires) {
+				delete(s.items, k)
+			}
+		}
+	}
+	it := s.items[key]
+	if it != nil && !it.expires.IsZero() && now.After(it.expires) {
+		delete(s.items, key)
+		return nil
+	}
+	return it
+}
+
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+func (s *memoryStore) incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	it := s.item(key, now)
+	if it == nil {
+		it = &memoryItem{expires: expiry(now, ttl)}
+		s.items[key] = it
+	}
+	it.count++
+	return it.count, nil
+}
+
+func (s *memoryStore) take(key string, rate float64, burst int) (bool, time.Duration, error) {
+	ok, wait := s.buckets.take(key, rate, burst)
+	return ok, wait, nil
+}
+
+// fallbackStore Redis 不可用时退回本地状态，避免 Redis 故障导致代理不可用
+type fallbackStore struct {
+	primary *redisStore
+	local   *memoryStore
+	warned  sync.Once
+}
+
+func (s *fallbackStore) failed(err error) {
+	s.warned.Do(func() { warnf("Redis 请求失败，使用本地状态: %v", err) })
+}
+
+func (s *fallbackStore) incr(key string, ttl time.Duration) (int64, error) {
+	n, err := s.primary.incr(key, ttl)
+	if err != nil {
+		s.failed(err)
+		return s.local.incr(key, ttl)
+	}
+	return n, nil
+}
+
+func (s *fallbackStore) take(key string, rate float64, burst int) (bool, time.Duration, error) {
+	ok, wait, err := s.primary.take(key, rate, burst)
+	if err != nil {
+		s.failed(err)
+		return s.local.take(key, rate, burst)
+	}
+	return ok, wait, nil
+}
+
+// redisStore 基于 RESP 协议的最小 Redis 客户端
+type redisStore struct {
+	cfg    *RedisConfig
+	prefix string
+	pool   chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisStore(cfg *RedisConfig) *redisStore {
+	size := cfg.PoolSize
+	if size <= 0 {
+		size = 8
+	}
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = "r-proxy:"
+	}
+	return &redisStore{cfg: cfg, prefix: prefix, pool: make(chan *redisConn, size)}
+}
+
+func (s *redisStore) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", s.cfg.Address, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if s.cfg.Password != "" {
+		if _, err := c.do("AUTH", s.cfg.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.cfg.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(s.cfg.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do 从连接池取连接执行命令，网络错误时关闭连接
+func (s *redisStore) do(args ...string) (any, error) {
+	var c *redisConn
+	select {
+	case c = <-s.pool:
+	default:
+		var err error
+		if c, err = s.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.do(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		c.conn.Close()
+		return nil, err
+	}
+	select {
+	case s.pool <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (c *redisConn) do(args ...string) (any, error) {
+	c.conn.SetDeadline(time.Now().Add(3 * time.Second))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read 解析一条 RESP 回复: 简单字符串、错误、整数、批量字符串和数组
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: 空回复")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				var redisErr redisError
+				if !errors.As(err, &redisErr) {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: 无法解析的回复 %q", line)
+}
+
+// redisIncrScript 计数和第一次计数时设置过期时间在同一个脚本中执行，不会留下没有过期时间的计数
+const redisIncrScript = `local n = redis.call("INCR", KEYS[1])
+if n == 1 and tonumber(ARGV[1]) > 0 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end
+return n`
+
+func (s *redisStore) incr(key string, ttl time.Duration) (int64, error) {
+	reply, err := s.do("EVAL", redisIncrScript, "1", s.prefix+key, strconv.FormatInt(max(ttl.Milliseconds(), 0), 10))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	return n, nil
+}
+
+// redisTakeScript 令牌桶保存在哈希中，使用 Redis 的时间计算补充的令牌，不受各实例时钟差异影响；
+// 返回 {是否取到令牌, 需要等待的毫秒数}
+const redisTakeScript = `local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = t[1] * 1000 + t[2] / 1000
+local b = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens, last = tonumber(b[1]), tonumber(b[2])
+if tokens == nil then tokens, last = burst, now end
+tokens = math.min(burst, tokens + math.max(now - last, 0) / 1000 * rate)
+local ok, wait = 0, 0
+if tokens >= 1 then tokens, ok = tokens - 1, 1 else wait = math.ceil((1 - tokens) / rate * 1000) end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {ok, wait}`
+
+func (s *redisStore) take(key string, rate float64, burst int) (bool, time.Duration, error) {
+	reply, err := s.do("EVAL", redisTakeScript, "1", s.prefix+key,
+		strconv.FormatFloat(rate, 'f', -1, 64), strconv.Itoa(burst))
+	if err != nil {
+		return false, 0, err
+	}
+	items, _ := reply.([]any)
+	if len(items) != 2 {
+		return false, 0, fmt.Errorf("redis: 令牌桶脚本返回了 %v", reply)
+	}
+	ok, _ := items[0].(int64)
+	wait, _ := items[1].(int64)
+	return ok == 1, time.Duration(wait) * time.Millisecond, nil
+}
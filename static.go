@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// StaticDir 将本地目录挂载到指定路径前缀，如 PAC 文件、说明文档或简单的落地页
+type StaticDir struct {
+	Prefix string `xml:"prefix,attr"`          // 如 /docs/
+	Dir    string `xml:"dir,attr"`             // 本地目录
+	Index  string `xml:"index,attr,omitempty"` // 目录默认文件，默认 index.html
+}
+
+// staticHandler 返回目录下的文件，带 ETag 以支持 If-None-Match 条件请求
+func staticHandler(s StaticDir) http.Handler {
+	root := http.Dir(s.Dir)
+	index := s.Index
+	if index == "" {
+		index = "index.html"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, s.Prefix))
+		f, err := root.Open(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if fi.IsDir() {
+			// 目录地址补全结尾的 /，保证页面中的相对链接正确
+			if !strings.HasSuffix(r.URL.Path, "/") {
+				http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+				return
+			}
+			f.Close()
+			name = path.Join(name, index)
+			if f, err = root.Open(name); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			defer f.Close()
+			if fi, err = f.Stat(); err != nil || fi.IsDir() {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	})
+}
+
+// registerStatic 注册所有静态目录
+func registerStatic(mux *http.ServeMux) {
+	for _, s := range config().Static {
+		if s.Prefix == "" || s.Dir == "" {
+			continue
+		}
+		if !strings.HasSuffix(s.Prefix, "/") {
+			s.Prefix += "/"
+		}
+		if !strings.HasPrefix(s.Prefix, "/") {
+			s.Prefix = "/" + s.Prefix
+		}
+		mux.Handle(s.Prefix, staticHandler(s))
+		log.Printf("静态目录 %s -> %s", s.Prefix, s.Dir)
+	}
+}
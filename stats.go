@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// statsPath 代理自身的统计接口，不会被当作目标URL转发
+const statsPath = "/_proxy/stats"
+
+func statsSnapshot() map[string]any {
+	return map[string]any{
+		"requests":    atomic.LoadInt64(&uuid),
+		"latency":     latencyStats.snapshot(),
+		"log_dropped": droppedLogs(),
+	}
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statsSnapshot())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyslogConfig syslog 输出配置，address 为空时写本机 syslog
+type SyslogConfig struct {
+	Network  string `xml:"network,attr,omitempty"` // udp / tcp，为空表示本机 unix socket
+	Address  string `xml:"address,attr,omitempty"` // 远程地址，如 logs.example.com:514
+	Tag      string `xml:"tag,attr,omitempty"`     // APP-NAME，默认 r-proxy
+	Facility string `xml:"facility,attr,omitempty"`
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogWriter 按 RFC 5424 格式发送日志，每次 Write 对应一条消息
+type syslogWriter struct {
+	mu       sync.Mutex
+	network  string
+	address  string
+	tag      string
+	hostname string
+	facility int
+	severity int // 非0时固定使用该级别，否则按日志前缀判断
+	conn     net.Conn
+}
+
+func newSyslogWriter(c *SyslogConfig, severity int) (*syslogWriter, error) {
+	facility := syslogFacilities["user"]
+	if c.Facility != "" {
+		f, ok := syslogFacilities[strings.ToLower(c.Facility)]
+		if !ok {
+			return nil, fmt.Errorf("未知的 syslog facility: %s", c.Facility)
+		}
+		facility = f
+	}
+	tag := c.Tag
+	if tag == "" {
+		tag = "r-proxy"
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	w := &syslogWriter{
+		network:  strings.ToLower(c.Network),
+		address:  c.Address,
+		tag:      tag,
+		hostname: hostname,
+		facility: facility,
+		severity: severity,
+	}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) connect() error {
+	if w.address != "" {
+		network := w.network
+		if network == "" {
+			network = "udp"
+		}
+		conn, err := net.DialTimeout(network, w.address, 5*time.Second)
+		if err != nil {
+			return fmt.Errorf("连接 syslog 失败: %v", err)
+		}
+		w.conn = conn
+		return nil
+	}
+	for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := net.Dial(network, path); err == nil {
+				w.conn = conn
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("连接本机 syslog 失败")
+}
+
+// severityOf 根据日志前缀推断 syslog 级别
+func severityOf(msg []byte) int {
+	switch {
+	case bytes.Contains(msg, []byte("[DEBUG]")):
+		return 7
+	case bytes.Contains(msg, []byte("[WARN]")):
+		return 4
+	case bytes.Contains(msg, []byte("[ERROR]")), bytes.Contains(msg, []byte("失败")):
+		return 3
+	}
+	return 6
+}
+
+// stripLogTime 去掉 log 包添加的 "2006/01/02 15:04:05 " 时间前缀，syslog 头中已有时间
+func stripLogTime(p []byte) []byte {
+	if len(p) >= 20 && p[4] == '/' && p[7] == '/' && p[13] == ':' && p[19] == ' ' {
+		return p[20:]
+	}
+	return p
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := bytes.TrimRight(stripLogTime(p), "\n")
+	severity := w.severity
+	if severity == 0 {
+		severity = severityOf(msg)
+	}
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		w.facility*8+severity, time.Now().Format(time.RFC3339Nano), w.hostname, w.tag, os.Getpid(), msg)
+	// TCP 使用 RFC 6587 的长度前缀分帧
+	if w.network == "tcp" {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := w.conn.Write([]byte(line)); err != nil {
+		// 连接断开时重连一次
+		w.conn.Close()
+		w.conn = nil
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+		if _, err := w.conn.Write([]byte(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TimeoutConfig 上游连接和本地服务器的超时设置，格式如 10s、1m，0 表示不限制
+type TimeoutConfig struct {
+	Dial           string `xml:"dial,attr,omitempty"`           // 建立 TCP 连接(含到代理的握手)，默认 30s
+	TLSHandshake   string `xml:"tlsHandshake,attr,omitempty"`   // TLS 握手，默认 10s
+	ResponseHeader string `xml:"responseHeader,attr,omitempty"` // 请求发出后等待响应头，默认 2m
+	Idle           string `xml:"idle,attr,omitempty"`           // 空闲连接保留时间，默认 90s
+	Read           string `xml:"read,attr,omitempty"`           // 读取客户端请求(含请求体)，默认不限制
+	Write          string `xml:"write,attr,omitempty"`          // 写响应，默认不限制；大文件下载和流式响应会被截断
+
+	dial, tlsHandshake, responseHeader, idle, read, write time.Duration
+}
+
+func (c *TimeoutConfig) init() error {
+	fields := []struct {
+		name  string
+		value string
+		def   time.Duration
+		out   *time.Duration
+	}{
+		{"dial", c.Dial, 30 * time.Second, &c.dial},
+		{"tlsHandshake", c.TLSHandshake, 10 * time.Second, &c.tlsHandshake},
+		{"responseHeader", c.ResponseHeader, 2 * time.Minute, &c.responseHeader},
+		{"idle", c.Idle, 90 * time.Second, &c.idle},
+		{"read", c.Read, 0, &c.read},
+		{"write", c.Write, 0, &c.write},
+	}
+	for _, f := range fields {
+		*f.out = f.def
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil {
+			return fmt.Errorf("timeouts %s 格式错误: %v", f.name, err)
+		}
+		*f.out = d
+	}
+	return nil
+}
+
+// apply 把超时设置到 Transport 上，已有的 DialContext(SOCKS5、HTTPS 代理、IP 固定)通过 context 限制时间
+func (c *TimeoutConfig) apply(t *http.Transport) {
+	if t == nil {
+		return
+	}
+	t.TLSHandshakeTimeout = c.tlsHandshake
+	t.ResponseHeaderTimeout = c.responseHeader
+	t.IdleConnTimeout = c.idle
+	if c.dial <= 0 {
+		return
+	}
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{KeepAlive: 30 * time.Second}).DialContext
+	}
+	timeout := c.dial
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, network, addr)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// phaseTimes 单个请求各阶段耗时
+type phaseTimes struct {
+	DNS      time.Duration
+	Connect  time.Duration
+	TLS      time.Duration
+	TTFB     time.Duration
+	Transfer time.Duration
+	Total    time.Duration
+	Reused   bool
+}
+
+func (p phaseTimes) String() string {
+	return fmt.Sprintf("dns=%s connect=%s tls=%s ttfb=%s transfer=%s total=%s reused=%t",
+		p.DNS, p.Connect, p.TLS, p.TTFB, p.Transfer, p.Total, p.Reused)
+}
+
+// requestTrace 通过 httptrace 记录一次上游请求的各阶段时间点
+type requestTrace struct {
+	mu        sync.Mutex
+	start     time.Time
+	dnsStart  time.Time
+	dnsDone   time.Time
+	connStart time.Time
+	connDone  time.Time
+	tlsStart  time.Time
+	tlsDone   time.Time
+	wroteReq  time.Time
+	firstByte time.Time
+	reused    bool
+}
+
+func newRequestTrace() *requestTrace {
+	return &requestTrace{start: time.Now()}
+}
+
+func (t *requestTrace) set(p *time.Time) {
+	t.mu.Lock()
+	if p.IsZero() {
+		*p = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { t.set(&t.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.set(&t.dnsDone) },
+		ConnectStart:      func(string, string) { t.set(&t.connStart) },
+		ConnectDone:       func(string, string, error) { t.set(&t.connDone) },
+		TLSHandshakeStart: func() { t.set(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.set(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.set(&t.wroteReq) },
+		GotFirstResponseByte: func() { t.set(&t.firstByte) },
+	}
+}
+
+// phases 在响应体传输结束后调用，计算各阶段耗时
+func (t *requestTrace) phases() phaseTimes {
+	end := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	span := func(a, b time.Time) time.Duration {
+		if a.IsZero() || b.IsZero() || b.Before(a) {
+			return 0
+		}
+		return b.Sub(a)
+	}
+	p := phaseTimes{
+		DNS:     span(t.dnsStart, t.dnsDone),
+		Connect: span(t.connStart, t.connDone),
+		TLS:     span(t.tlsStart, t.tlsDone),
+		Total:   end.Sub(t.start),
+		Reused:  t.reused,
+	}
+	// 首字节时间从请求写完开始计算，表示上游（代理或源站）的处理时间
+	if !t.wroteReq.IsZero() {
+		p.TTFB = span(t.wroteReq, t.firstByte)
+	} else {
+		p.TTFB = span(t.start, t.firstByte)
+	}
+	p.Transfer = span(t.firstByte, end)
+	return p
+}
+
+// phaseStats 各阶段耗时的累计统计，供统计接口使用
+type phaseStats struct {
+	mu    sync.Mutex
+	Count int64
+	Sum   phaseTimes
+	Max   phaseTimes
+}
+
+var latencyStats phaseStats
+
+func (s *phaseStats) record(p phaseTimes) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Count++
+	add := func(sum, max *time.Duration, v time.Duration) {
+		*sum += v
+		if v > *max {
+			*max = v
+		}
+	}
+	add(&s.Sum.DNS, &s.Max.DNS, p.DNS)
+	add(&s.Sum.Connect, &s.Max.Connect, p.Connect)
+	add(&s.Sum.TLS, &s.Max.TLS, p.TLS)
+	add(&s.Sum.TTFB, &s.Max.TTFB, p.TTFB)
+	add(&s.Sum.Transfer, &s.Max.Transfer, p.Transfer)
+	add(&s.Sum.Total, &s.Max.Total, p.Total)
+}
+
+// snapshot 返回平均值和最大值（毫秒）
+func (s *phaseStats) snapshot() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	avg := func(d time.Duration) float64 {
+		if s.Count == 0 {
+			return 0
+		}
+		return ms(d) / float64(s.Count)
+	}
+	return map[string]any{
+		"count": s.Count,
+		"avg_ms": map[string]float64{
+			"dns": avg(s.Sum.DNS), "connect": avg(s.Sum.Connect), "tls": avg(s.Sum.TLS),
+			"ttfb": avg(s.Sum.TTFB), "transfer": avg(s.Sum.Transfer), "total": avg(s.Sum.Total),
+		},
+		"max_ms": map[string]float64{
+			"dns": ms(s.Max.DNS), "connect": ms(s.Max.Connect), "tls": ms(s.Max.TLS),
+			"ttfb": ms(s.Max.TTFB), "transfer": ms(s.Max.Transfer), "total": ms(s.Max.Total),
+		},
+	}
+}
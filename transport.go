@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// proxyTransport 按规则的 proxyUrl 创建 Transport: http:// 使用 HTTP 代理，https:// 与代理之间使用 TLS，
+// socks5(h):// 使用 SOCKS5
+func proxyTransport(rule *ProxyRule, roots *x509.CertPool) (*http.Transport, error) {
+	proxyURL, err := url.Parse(rule.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	// 设置代理认证
+	if rule.Username != "" && rule.Password != "" {
+		proxyURL.User = url.UserPassword(rule.Username, rule.Password)
+	}
+
+	tlsConfig, err := rule.tlsConfig(roots)
+	if err != nil {
+		return nil, err
+	}
+	t := &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		t.DialContext = newSocks5Dialer(proxyURL).DialContext
+	case "https":
+		// 自己完成到代理的 TLS 握手，这样代理的 CA 和 SNI 可以与目标站点分开配置；
+		// Transport 看到的是 http 代理，在这条 TLS 连接上发送 CONNECT 或普通代理请求
+		cfg, err := proxyTLSConfig(rule, proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		t.DialContext = tlsDialer(cfg)
+		plain := *proxyURL
+		plain.Scheme = "http"
+		if plain.Port() == "" {
+			plain.Host = net.JoinHostPort(plain.Hostname(), "443")
+		}
+		t.Proxy = http.ProxyURL(&plain)
+	default:
+		t.Proxy = http.ProxyURL(proxyURL)
+	}
+	return t, nil
+}
+
+// tlsConfig 连接目标站点时的 TLS 配置，默认校验证书；roots 为全局 CA，为 nil 时只使用系统证书
+func (r *ProxyRule) tlsConfig(roots *x509.CertPool) (*tls.Config, error) {
+	if r.CAFile != "" {
+		if roots == nil {
+			roots = systemRoots()
+		} else {
+			roots = roots.Clone()
+		}
+		if err := appendCAFile(roots, r.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	return &tls.Config{RootCAs: roots, InsecureSkipVerify: r.InsecureSkipVerify}, nil
+}
+
+// systemRoots 系统证书池，读取失败时(如部分 Windows 环境)使用空池
+func systemRoots() *x509.CertPool {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return x509.NewCertPool()
+	}
+	return pool
+}
+
+func appendCAFile(pool *x509.CertPool, file string) error {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%s 中没有有效的证书", file)
+	}
+	return nil
+}
+
+// proxyTLSConfig 连接 HTTPS 代理时使用的 TLS 配置，proxyCa 为 PEM 文件，proxySni 覆盖握手时的服务器名
+func proxyTLSConfig(rule *ProxyRule, proxyURL *url.URL) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: proxyURL.Hostname()}
+	if rule.ProxySNI != "" {
+		cfg.ServerName = rule.ProxySNI
+	}
+	if rule.ProxyCA != "" {
+		pool := x509.NewCertPool()
+		if err := appendCAFile(pool, rule.ProxyCA); err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func tlsDialer(cfg *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("与代理 %s 的 TLS 握手失败: %v", addr, err)
+		}
+		return tc, nil
+	}
+}
+
+// newDirectTransport 直连使用的 Transport，开启 blockPrivate 时只连接 pinTarget 校验过的 IP
+func newDirectTransport(tlsConfig *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = pinnedDial
+	t.TLSClientConfig = tlsConfig
+	return t
+}
+
+// initTransports 加载配置时创建直连和各规则的 Transport，并设置全局 CA 和超时
+func (c *ProxyConfig) initTransports() error {
+	c.rootCAs = nil
+	if len(c.CABundles) > 0 {
+		c.rootCAs = systemRoots()
+		for _, file := range c.CABundles {
+			if err := appendCAFile(c.rootCAs, file); err != nil {
+				return fmt.Errorf("caBundles: %v", err)
+			}
+		}
+	}
+	c.directTransport = newDirectTransport(&tls.Config{RootCAs: c.rootCAs})
+	c.Timeouts.apply(c.directTransport)
+
+	rules := []*ProxyRule{&c.DefaultProxy}
+	for i := range c.ProxyRules {
+		rules = append(rules, &c.ProxyRules[i])
+	}
+	for _, r := range rules {
+		r.transport = nil
+		if r.H2C && r.usesProxy() {
+			return fmt.Errorf("规则 %s: h2c 只能用于直连的规则", ruleName(r))
+		}
+		switch {
+		case r.H2C:
+			r.transport = newH2CTransport()
+		case r.ProxyURL != "":
+			t, err := proxyTransport(r, c.rootCAs)
+			if err != nil {
+				return fmt.Errorf("规则 %s: proxyUrl 配置错误: %v", ruleName(r), err)
+			}
+			r.transport = t
+		case r.InsecureSkipVerify || r.CAFile != "":
+			// 直连的规则有单独的 TLS 设置时使用自己的 Transport
+			tlsConfig, err := r.tlsConfig(c.rootCAs)
+			if err != nil {
+				return fmt.Errorf("规则 %s: caFile 配置错误: %v", ruleName(r), err)
+			}
+			r.transport = newDirectTransport(tlsConfig)
+		}
+		c.Timeouts.apply(r.transport)
+		if err := c.initFailover(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkTransports 短链接固定的上游代理不在配置中，按代理设置缓存 Transport
+var linkTransports sync.Map
+
+// roundTripper 返回规则共用的 Transport，短链接等临时规则按代理设置复用
+func (r *ProxyRule) roundTripper() (http.RoundTripper, error) {
+	if r.failover != nil {
+		return r.failover, nil
+	}
+	if r.transport != nil {
+		return r.transport, nil
+	}
+	key := r.ProxyURL + "\x00" + r.Username + "\x00" + r.Password
+	if t, ok := linkTransports.Load(key); ok {
+		return t.(*http.Transport), nil
+	}
+	c := config()
+	t, err := proxyTransport(r, c.rootCAs)
+	if err != nil {
+		return nil, err
+	}
+	c.Timeouts.apply(t)
+	actual, _ := linkTransports.LoadOrStore(key, t)
+	return actual.(*http.Transport), nil
+}
+
+// closeIdleConnections 配置被替换后关闭旧 Transport 的空闲连接，正在进行的请求不受影响
+func (c *ProxyConfig) closeIdleConnections() {
+	if c.directTransport != nil {
+		c.directTransport.CloseIdleConnections()
+	}
+	for _, r := range append(c.ProxyRules, c.DefaultProxy) {
+		if r.transport != nil {
+			r.transport.CloseIdleConnections()
+		}
+		if r.failover != nil {
+			for _, u := range r.failover.upstreams {
+				u.transport.CloseIdleConnections()
+			}
+		}
+	}
+	c.PAC.closeIdleConnections()
+}
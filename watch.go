@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dirNotifier 监听目录中的文件变化，监听目录而不是文件本身，编辑器先写临时文件再改名时也能收到通知
+type dirNotifier interface {
+	add(dir string) error
+	events() <-chan string // 发生变化的文件完整路径
+}
+
+// watchedFiles 需要监听的文件: 配置文件和自定义请求头文件，返回 绝对路径 -> 原始路径
+func watchedFiles() map[string]string {
+	files := map[string]string{}
+	add := func(p string) {
+		if p == "" {
+			return
+		}
+		if abs, err := filepath.Abs(p); err == nil {
+			files[abs] = p
+		}
+	}
+	add(configFile)
+	for _, h := range config().CustomHeaders {
+		add(h.HeadersPath)
+	}
+	return files
+}
+
+// fileChanged 处理文件变化: 配置文件重新加载，请求头文件清除缓存
+func fileChanged(abs string, files map[string]string) {
+	if configAbs, _ := filepath.Abs(configFile); abs == configAbs {
+		reloadConfig()
+		return
+	}
+	headerFiles.Delete(files[abs])
+	log.Printf("请求头文件 %s 已修改", files[abs])
+}
+
+// watchConfigChange 优先使用文件系统通知，不支持时退回定时检查
+func watchConfigChange() {
+	n, err := newDirNotifier()
+	if err != nil {
+		log.Printf("文件通知不可用，使用定时检查: %v", err)
+		pollFiles()
+		return
+	}
+	dirs := map[string]bool{}
+	files := watchedFiles()
+	addDirs := func() {
+		for abs := range files {
+			dir := filepath.Dir(abs)
+			if dirs[dir] {
+				continue
+			}
+			if err := n.add(dir); err != nil {
+				log.Printf("监听目录 %s 失败: %v", dir, err)
+				continue
+			}
+			dirs[dir] = true
+		}
+	}
+	addDirs()
+
+	// 编辑器保存时会产生多个事件，合并 300ms 内的变化
+	pending := map[string]bool{}
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		select {
+		case p := <-n.events():
+			if _, ok := files[p]; ok {
+				pending[p] = true
+				timer.Reset(300 * time.Millisecond)
+			}
+		case <-timer.C:
+			for p := range pending {
+				fileChanged(p, files)
+			}
+			pending = map[string]bool{}
+			// 重新加载后请求头文件可能有变化
+			files = watchedFiles()
+			addDirs()
+		}
+	}
+}
+
+type fileStamp struct {
+	mod  time.Time
+	size int64
+	ok   bool
+}
+
+func stampOf(p string) fileStamp {
+	s, err := os.Stat(p)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{mod: s.ModTime(), size: s.Size(), ok: true}
+}
+
+// pollFiles 每 2 秒检查一次文件的修改时间和大小
+func pollFiles() {
+	files := watchedFiles()
+	stamps := map[string]fileStamp{}
+	for abs := range files {
+		stamps[abs] = stampOf(abs)
+	}
+	for {
+		time.Sleep(2 * time.Second)
+		for abs := range files {
+			st := stampOf(abs)
+			if st != stamps[abs] {
+				stamps[abs] = st
+				if st.ok {
+					fileChanged(abs, files)
+				}
+			}
+		}
+		files = watchedFiles()
+		for abs := range files {
+			if _, ok := stamps[abs]; !ok {
+				stamps[abs] = stampOf(abs)
+			}
+		}
+	}
+}
+
+// headerFiles 自定义请求头文件内容的缓存，文件变化时清除
+var headerFiles sync.Map
+
+func readHeaderFile(path string) ([]byte, error) {
+	if b, ok := headerFiles.Load(path); ok {
+		return b.([]byte), nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	headerFiles.Store(path, b)
+	return b, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// inotifyNotifier 基于 inotify 的目录监听
+type inotifyNotifier struct {
+	fd int
+	mu sync.Mutex
+	wd map[int32]string
+	ch chan string
+}
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_ATTRIB
+
+func newDirNotifier() (dirNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	n := &inotifyNotifier{fd: fd, wd: map[int32]string{}, ch: make(chan string, 64)}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifyNotifier) add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(n.fd, dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.wd[int32(wd)] = dir
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *inotifyNotifier) events() <-chan string {
+	return n.ch
+}
+
+// read 解析 inotify_event: wd(4) mask(4) cookie(4) len(4) name(len)
+func (n *inotifyNotifier) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		size, err := syscall.Read(n.fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= size; {
+			wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			start := off + syscall.SizeofInotifyEvent
+			off = start + nameLen
+			if off > size {
+				break
+			}
+			name := strings.TrimRight(string(buf[start:off]), "\x00")
+			n.mu.Lock()
+			dir := n.wd[wd]
+			n.mu.Unlock()
+			if dir != "" && name != "" {
+				n.ch <- filepath.Join(dir, name)
+			}
+		}
+	}
+}
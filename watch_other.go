@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func newDirNotifier() (dirNotifier, error) {
+	return nil, errors.New("当前系统不支持文件通知")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// schemePathHandler 将 /https://host 形式的路径在内部转换为 /https:/host，
+// 避免 ServeMux 清理路径时返回 301，PROPFIND/MOVE 等非 GET 请求的客户端通常不会跟随这种跳转
+func schemePathHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		for _, s := range []string{"/http://", "/https://", "/ws://", "/wss://"} {
+			if !strings.HasPrefix(p, s) {
+				continue
+			}
+			r.URL.Path = s[:len(s)-1] + strings.TrimLeft(p[len(s):], "/")
+			r.URL.RawPath = ""
+			break
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unproxyURL 将客户端发来的代理地址(http://localhost:3000/https://host/a 或 /https:/host/a)还原为目标地址
+func unproxyURL(r *http.Request, raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw, false
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return raw, false
+	}
+	p := strings.TrimPrefix(u.EscapedPath(), "/")
+	if !hasScheme(p) {
+		return raw, false
+	}
+	target := fixTargetURL(p)
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	return target, true
+}
+
+var ifTaggedURLRe = regexp.MustCompile(`<([^>]+)>`)
+
+// rewriteWebDAVRequest 改写 WebDAV 请求头中引用的资源地址:
+// MOVE/COPY 的 Destination 和 If 头中的 tagged-list 地址
+func rewriteWebDAVRequest(in, out *http.Request) {
+	// Multi-Status 响应中的 href 需要改写，要求上游返回未压缩的内容
+	if out.Method == "PROPFIND" || out.Method == "REPORT" {
+		out.Header.Del("Accept-Encoding")
+	}
+	if dest := out.Header.Get("Destination"); dest != "" {
+		if t, ok := unproxyURL(in, dest); ok {
+			out.Header.Set("Destination", t)
+		}
+	}
+	if h := out.Header.Get("If"); h != "" && strings.Contains(h, "<") {
+		out.Header.Set("If", ifTaggedURLRe.ReplaceAllStringFunc(h, func(m string) string {
+			inner := m[1 : len(m)-1]
+			if strings.HasPrefix(inner, "urn:") || strings.HasPrefix(inner, "opaquelocktoken:") {
+				return m
+			}
+			if t, ok := unproxyURL(in, inner); ok {
+				return "<" + t + ">"
+			}
+			return m
+		}))
+	}
+}
+
+var davHrefRe = regexp.MustCompile(`(?i)(<(?:[a-z0-9]+:)?href>)\s*([^<]+?)\s*(</(?:[a-z0-9]+:)?href>)`)
+
+// rewriteMultistatus 改写 207 Multi-Status 响应中的 href，使 WebDAV 客户端继续通过代理访问资源
+func rewriteMultistatus(origin string, target *url.URL, resp *http.Response) error {
+	if resp.StatusCode != http.StatusMultiStatus || !isIdentityEncoding(resp) {
+		return nil
+	}
+	ct := strings.ToLower(resp.Header.Get("Content-Type"))
+	if !strings.Contains(ct, "xml") {
+		return nil
+	}
+	body, ok, err := readBodyLimited(resp, defaultRewriteMaxSize)
+	if err != nil || !ok {
+		return err
+	}
+	prefix := "/" + target.Scheme + "://" + target.Host
+	body = davHrefRe.ReplaceAllFunc(body, func(m []byte) []byte {
+		g := davHrefRe.FindSubmatch(m)
+		href := string(g[2])
+		switch {
+		case strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://"):
+			href = origin + "/" + href
+		case strings.HasPrefix(href, "/"):
+			href = prefix + href
+		default:
+			return m
+		}
+		return bytes.Join([][]byte{g[1], []byte(href), g[3]}, nil)
+	})
+	setBody(resp, body)
+	return nil
+}
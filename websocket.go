@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// isUpgrade 请求要求切换协议，如 WebSocket
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tunnelTransport 处理协议升级请求: 经过上游 HTTP 代理时先用 CONNECT 建立到目标的隧道，再在隧道上发送请求。
+// http.Transport 对 http:// 目标会发送普通代理请求，很多代理不支持在这种请求上切换协议
+type tunnelTransport struct {
+	transports []*http.Transport // 依次尝试，直连时为直连 Transport
+}
+
+// newTunnelTransport 使用与普通请求相同的上游代理和 TLS 设置
+func newTunnelTransport(base http.RoundTripper) *tunnelTransport {
+	switch t := base.(type) {
+	case *failoverTransport:
+		tt := &tunnelTransport{}
+		for _, u := range t.candidates() {
+			tt.transports = append(tt.transports, u.transport)
+		}
+		return tt
+	case *http.Transport:
+		return &tunnelTransport{transports: []*http.Transport{t}}
+	}
+	return &tunnelTransport{transports: []*http.Transport{config().directTransport}}
+}
+
+func (t *tunnelTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	addr := r.URL.Host
+	if r.URL.Port() == "" {
+		port := "80"
+		if r.URL.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(r.URL.Hostname(), port)
+	}
+	var conn net.Conn
+	var err error
+	var used *http.Transport
+	for _, tr := range t.transports {
+		if conn, err = dialTunnel(r.Context(), tr, r, addr); err == nil {
+			used = tr
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.URL.Scheme == "https" {
+		cfg := &tls.Config{}
+		if used.TLSClientConfig != nil {
+			cfg = used.TLSClientConfig.Clone()
+		}
+		cfg.ServerName = r.URL.Hostname()
+		// WebSocket 只能在 HTTP/1.1 上升级
+		cfg.NextProtos = []string{"http/1.1"}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(r.Context()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	if err := r.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// ReverseProxy 要求 101 响应的 Body 可写，用于双向转发
+		resp.Body = &bufferedConn{Conn: conn, r: br}
+	} else {
+		resp.Body = &closeConnBody{ReadCloser: resp.Body, conn: conn}
+	}
+	return resp, nil
+}
+
+// dialTunnel 通过 tr 的上游代理建立到 addr 的连接；SOCKS5 代理和直连在拨号时完成
+func dialTunnel(ctx context.Context, tr *http.Transport, r *http.Request, addr string) (net.Conn, error) {
+	dial := tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second}).DialContext
+	}
+	if tr.Proxy == nil {
+		return dial(ctx, "tcp", addr)
+	}
+	proxyURL, err := tr.Proxy(r)
+	if err != nil || proxyURL == nil {
+		return dial(ctx, "tcp", addr)
+	}
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	br := bufio.NewReader(conn)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	conn.SetDeadline(time.Time{})
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("上游代理拒绝 CONNECT %s: %s", addr, resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn 先读出 bufio.Reader 中已缓冲的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+type closeConnBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *closeConnBody) Close() error {
+	b.ReadCloser.Close()
+	return b.conn.Close()
+}
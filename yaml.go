@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 配置文件使用的 YAML 子集: 块状映射和列表、[a, b] 与 {k: v} 行内写法、
+// 单双引号字符串、| 和 > 多行文本以及 # 注释；不支持锚点、标签和多文档
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+	raw   []string
+}
+
+func parseYAML(data []byte) (*cfgNode, error) {
+	p := &yamlParser{raw: strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")}
+	for i, l := range p.raw {
+		text := stripYAMLComment(l)
+		if strings.TrimSpace(text) == "" || strings.TrimSpace(text) == "---" {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimLeft(text, " "), "\t") {
+			return nil, fmt.Errorf("第 %d 行: YAML 不能使用 Tab 缩进", i+1)
+		}
+		trimmed := strings.TrimLeft(text, " ")
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: strings.TrimRight(trimmed, " \t")})
+	}
+	if len(p.lines) == 0 {
+		return &cfgNode{kind: nodeMap, line: 1}, nil
+	}
+	n, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("第 %d 行: 缩进错误", p.lines[p.pos].num)
+	}
+	return n, nil
+}
+
+// stripYAMLComment 去掉引号之外、以空白开头的 # 注释
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" \t:[{,-", rune(s[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func (p *yamlParser) block(indent int) (*cfgNode, error) {
+	l := p.lines[p.pos]
+	if l.text == "-" || strings.HasPrefix(l.text, "- ") {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (*cfgNode, error) {
+	n := &cfgNode{kind: nodeList, line: p.lines[p.pos].num}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("第 %d 行: 缩进错误", l.num)
+		}
+		if l.text != "-" && !strings.HasPrefix(l.text, "- ") {
+			break
+		}
+		content := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if content == "" {
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				n.items = append(n.items, &cfgNode{kind: nodeScalar, line: l.num})
+				continue
+			}
+			item, err := p.block(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+			continue
+		}
+		// "- key: value" 开始一个映射，把这一行改写为映射的第一行
+		if _, _, ok := splitYAMLKey(content); ok && content[0] != '[' && content[0] != '{' {
+			p.lines[p.pos] = yamlLine{num: l.num, indent: l.indent + len(l.text) - len(content), text: content}
+			item, err := p.mapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+			continue
+		}
+		p.pos++
+		item, err := p.inlineValue(content, l, indent)
+		if err != nil {
+			return nil, err
+		}
+		n.items = append(n.items, item)
+	}
+	return n, nil
+}
+
+func (p *yamlParser) mapping(indent int) (*cfgNode, error) {
+	n := &cfgNode{kind: nodeMap, line: p.lines[p.pos].num}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("第 %d 行: 缩进错误", l.num)
+		}
+		key, rest, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("第 %d 行: 应为 key: value", l.num)
+		}
+		p.pos++
+		var val *cfgNode
+		if rest == "" {
+			// 值在下一行: 更深的缩进，或与 key 同级的列表
+			if p.pos < len(p.lines) && (p.lines[p.pos].indent > indent ||
+				p.lines[p.pos].indent == indent && (p.lines[p.pos].text == "-" || strings.HasPrefix(p.lines[p.pos].text, "- "))) {
+				var err error
+				if val, err = p.block(p.lines[p.pos].indent); err != nil {
+					return nil, err
+				}
+			} else {
+				val = &cfgNode{kind: nodeScalar, line: l.num}
+			}
+		} else {
+			var err error
+			if val, err = p.inlineValue(rest, l, indent); err != nil {
+				return nil, err
+			}
+		}
+		n.keys = append(n.keys, key)
+		n.vals = append(n.vals, val)
+	}
+	return n, nil
+}
+
+// inlineValue 解析 key: 之后或 - 之后的值，包括多行文本和行内集合
+func (p *yamlParser) inlineValue(s string, l yamlLine, indent int) (*cfgNode, error) {
+	if s[0] == '|' || s[0] == '>' {
+		return p.blockScalar(s, l, indent), nil
+	}
+	if s[0] == '[' || s[0] == '{' {
+		f := &flowParser{s: s, line: l.num}
+		n, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		if f.skipSpace(); f.i < len(f.s) {
+			return nil, fmt.Errorf("第 %d 行: 多余的内容 %q", l.num, f.s[f.i:])
+		}
+		return n, nil
+	}
+	v, err := yamlScalar(s, l.num)
+	if err != nil {
+		return nil, err
+	}
+	return &cfgNode{kind: nodeScalar, line: l.num, value: v}, nil
+}
+
+// blockScalar 读取 | 或 > 之后缩进更深的原始行
+func (p *yamlParser) blockScalar(header string, l yamlLine, indent int) *cfgNode {
+	folded := header[0] == '>'
+	keep := strings.Contains(header, "+")
+	strip := strings.Contains(header, "-")
+	start := l.num // 原始行号从 1 开始，start 即下一行的下标
+	end := len(p.raw)
+	if p.pos < len(p.lines) {
+		for p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+			p.pos++
+		}
+		if p.pos < len(p.lines) {
+			end = p.lines[p.pos].num - 1
+		}
+	}
+	var lines []string
+	minIndent := -1
+	for _, raw := range p.raw[start:end] {
+		if strings.TrimSpace(raw) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		ind := len(raw) - len(strings.TrimLeft(raw, " "))
+		if minIndent < 0 || ind < minIndent {
+			minIndent = ind
+		}
+		lines = append(lines, raw)
+	}
+	for i, s := range lines {
+		if len(s) >= minIndent && minIndent > 0 {
+			lines[i] = s[minIndent:]
+		}
+	}
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	var text string
+	if folded {
+		var b strings.Builder
+		for i, s := range lines {
+			if i > 0 {
+				if s == "" || lines[i-1] == "" {
+					b.WriteString("\n")
+				} else {
+					b.WriteString(" ")
+				}
+			}
+			b.WriteString(s)
+		}
+		text = b.String()
+	} else {
+		text = strings.Join(lines, "\n")
+	}
+	switch {
+	case keep:
+		text += strings.Repeat("\n", trailing+1)
+	case !strip && text != "":
+		text += "\n"
+	}
+	return &cfgNode{kind: nodeScalar, line: l.num, value: text}
+}
+
+// splitYAMLKey 在引号之外查找 ": " 或行尾的 ":"
+func splitYAMLKey(s string) (key, rest string, ok bool) {
+	if s[0] == '"' || s[0] == '\'' {
+		end := strings.IndexByte(s[1:], s[0])
+		if end < 0 {
+			return "", "", false
+		}
+		after := s[end+2:]
+		if after != ":" && !strings.HasPrefix(after, ": ") {
+			return "", "", false
+		}
+		k, err := yamlScalar(s[:end+2], 0)
+		return k, strings.TrimSpace(after[1:]), err == nil
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] == ':' && (i == len(s)-1 || s[i+1] == ' ') {
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), i > 0
+		}
+	}
+	return "", "", false
+}
+
+// yamlScalar 去掉引号并处理转义，null 和 ~ 视为空字符串
+func yamlScalar(s string, line int) (string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "~" || s == "null" || s == "Null" || s == "NULL":
+		return "", nil
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("第 %d 行: 字符串格式错误 %s", line, s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("第 %d 行: 字符串格式错误 %s", line, s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, nil
+}
+
+// flowParser 解析 [a, b] 和 {k: v} 形式的行内集合，可以嵌套
+type flowParser struct {
+	s    string
+	i    int
+	line int
+}
+
+func (f *flowParser) skipSpace() {
+	for f.i < len(f.s) && (f.s[f.i] == ' ' || f.s[f.i] == '\t') {
+		f.i++
+	}
+}
+
+func (f *flowParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("第 %d 行: "+format, append([]any{f.line}, args...)...)
+}
+
+func (f *flowParser) value() (*cfgNode, error) {
+	f.skipSpace()
+	if f.i >= len(f.s) {
+		return nil, f.errorf("行内集合不完整")
+	}
+	switch f.s[f.i] {
+	case '[':
+		f.i++
+		n := &cfgNode{kind: nodeList, line: f.line}
+		for {
+			f.skipSpace()
+			if f.i < len(f.s) && f.s[f.i] == ']' {
+				f.i++
+				return n, nil
+			}
+			item, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.i++
+		n := &cfgNode{kind: nodeMap, line: f.line}
+		for {
+			f.skipSpace()
+			if f.i < len(f.s) && f.s[f.i] == '}' {
+				f.i++
+				return n, nil
+			}
+			key, err := f.scalar(":")
+			if err != nil {
+				return nil, err
+			}
+			if f.i >= len(f.s) || f.s[f.i] != ':' {
+				return nil, f.errorf("行内映射缺少 ':'")
+			}
+			f.i++
+			val, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			n.keys = append(n.keys, key)
+			n.vals = append(n.vals, val)
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	}
+	v, err := f.scalar(",]}")
+	if err != nil {
+		return nil, err
+	}
+	return &cfgNode{kind: nodeScalar, line: f.line, value: v}, nil
+}
+
+// separator 读取 , 或结束符，结束符留给调用方处理
+func (f *flowParser) separator(end byte) error {
+	f.skipSpace()
+	if f.i >= len(f.s) {
+		return f.errorf("行内集合缺少 '%c'", end)
+	}
+	switch f.s[f.i] {
+	case ',':
+		f.i++
+		return nil
+	case end:
+		return nil
+	}
+	return f.errorf("行内集合中出现意外的字符 '%c'", f.s[f.i])
+}
+
+func (f *flowParser) scalar(stops string) (string, error) {
+	f.skipSpace()
+	start := f.i
+	if f.i < len(f.s) && (f.s[f.i] == '"' || f.s[f.i] == '\'') {
+		q := f.s[f.i]
+		for f.i++; f.i < len(f.s); f.i++ {
+			if f.s[f.i] == '\\' && q == '"' {
+				f.i++
+			} else if f.s[f.i] == q {
+				if q == '\'' && f.i+1 < len(f.s) && f.s[f.i+1] == '\'' {
+					f.i++
+					continue
+				}
+				f.i++
+				v, err := yamlScalar(f.s[start:f.i], f.line)
+				f.skipSpace()
+				return v, err
+			}
+		}
+		return "", f.errorf("字符串缺少结束引号")
+	}
+	for f.i < len(f.s) && !strings.ContainsRune(stops, rune(f.s[f.i])) {
+		f.i++
+	}
+	return yamlScalar(f.s[start:f.i], f.line)
+}